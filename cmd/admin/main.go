@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/as283-ua/yappa/api/gen/client"
+	"github.com/as283-ua/yappa/api/gen/server"
+	srv "github.com/as283-ua/yappa/internal/server"
+	"github.com/as283-ua/yappa/internal/server/auth"
+	"github.com/as283-ua/yappa/internal/server/keys"
+	"github.com/as283-ua/yappa/internal/server/report"
+	"github.com/as283-ua/yappa/internal/server/settings"
+	"github.com/as283-ua/yappa/pkg/common"
+	"golang.org/x/term"
+	"google.golang.org/protobuf/proto"
+)
+
+var (
+	cfgPath = flag.String("config", "cfg/yappad.toml", "Configuration file of the chat server")
+	status  = flag.String("status", report.STATUS_OPEN, "Status of the reports to list")
+	limit   = flag.Int("n", 20, "Number of reports to list")
+)
+
+const usage = `Usage: yappadm [options] <command>
+
+Reviews the reports users sent to the chat server and manages its master key.
+
+Commands:
+  list          list reports, oldest first
+  show <id>     show a report and check its attached messages again
+  dismiss <id>  close a report without acting on it
+  revoke <id>   ask the CA to revoke the reported user's certificate and close the report
+  rotate-key    wrap the server's data keys with a new master key and add a new data key. Data is
+                re-encrypted with it the next time yappad starts, with the new master key
+
+Options:
+`
+
+func readCfgFile(path string) (*settings.ChatCfg, error) {
+	cfgRaw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &settings.ChatCfg{}
+	_, err = toml.Decode(string(cfgRaw), &cfg)
+	if err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func reportId(args []string) int32 {
+	if len(args) != 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	id, err := strconv.ParseInt(args[1], 10, 32)
+	if err != nil {
+		log.Fatalf("Invalid report id %v", args[1])
+	}
+	return int32(id)
+}
+
+func printReport(r report.ReportRepo, id int32) {
+	rep, err := r.GetReport(id)
+	if err != nil {
+		log.Fatalf("Report %v: %v", id, err)
+	}
+	fmt.Printf("Report %v · %v\n", rep.ID, rep.Status)
+	fmt.Printf("%v reported %v for %v on %v\n", rep.Reporter, rep.Reported, server.ReportReason(rep.Reason), rep.CreatedAt.Time.Format(time.DateTime))
+	if rep.Comment != "" {
+		fmt.Printf("Comment: %v\n", rep.Comment)
+	}
+
+	evidence, err := r.GetEvidence(id)
+	if err != nil {
+		log.Fatalf("Evidence of report %v: %v", id, err)
+	}
+	if len(evidence) == 0 {
+		fmt.Println("No messages attached")
+		return
+	}
+	reported, err := auth.Repo.GetUserData(context.Background(), rep.Reported)
+	if err != nil {
+		log.Fatalf("User %v: %v", rep.Reported, err)
+	}
+	fmt.Printf("\n%v attached messages:\n", len(evidence))
+	for _, v := range evidence {
+		verified := "signature ok"
+		err = report.CheckEvidence(reported, rep.Reporter, &server.ReportEvidence{Event: v.Event, Signature: v.Signature})
+		if err != nil {
+			// the certificate may have been renewed since
+			verified = "NOT VERIFIED: " + err.Error()
+		}
+		event := &client.ClientEvent{}
+		if proto.Unmarshal(v.Event, event) != nil {
+			fmt.Printf("- unreadable message (%v)\n", verified)
+			continue
+		}
+		sent := time.Unix(int64(event.Timestamp), 0).UTC().Format(time.DateTime)
+		fmt.Printf("- %v (%v)\n  %v\n", sent, verified, event.GetMessage().GetMsg())
+	}
+}
+
+// Revocation is the CA's call. The report is only closed once it accepted it
+func revoke(cfg *settings.ChatCfg, username string) error {
+	err := common.InitHttp3Client(cfg.Ca.Cert)
+	if err != nil {
+		return err
+	}
+	err = common.AddTlsCert(cfg.Tls.Cert, cfg.Tls.Key)
+	if err != nil {
+		return err
+	}
+
+	resp, err := common.HttpClient.Post(fmt.Sprintf("https://%v/revoke/%v", cfg.Ca.Addr, username), "application/x-protobuf", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("CA answered %v: %s", resp.Status, body)
+	}
+	return nil
+}
+
+func resolve(r report.ReportRepo, id int32, status string) {
+	ok, err := r.ResolveReport(id, status)
+	if err != nil {
+		log.Fatalf("Report %v: %v", id, err)
+	}
+	if !ok {
+		log.Fatalf("Report %v isn't open", id)
+	}
+	fmt.Printf("Report %v %v\n", id, status)
+}
+
+// Asks for the new master key twice
+func readNewMasterKey() []byte {
+	read := func(prompt string) []byte {
+		fmt.Print(prompt)
+		key, err := term.ReadPassword(int(syscall.Stdin))
+		fmt.Println()
+		if err != nil {
+			log.Fatalf("Error reading from stdin: %v", err)
+		}
+		return key
+	}
+
+	key := read("New master key: ")
+	if len(key) == 0 {
+		log.Fatal("Empty master key")
+	}
+	if !bytes.Equal(key, read("Repeat the new master key: ")) {
+		log.Fatal("Master keys don't match")
+	}
+	return key
+}
+
+func rotateKey(r keys.KeyRepo, masterKey []byte) {
+	newKey := readNewMasterKey()
+	id, err := keys.Rotate(r, masterKey, newKey)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("Added data key %v. Restart yappad with the new master key to re-encrypt with it\n", id)
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	args := flag.Args()
+	if len(args) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	cfg, err := readCfgFile(*cfgPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	masterKey := srv.ReadMasterKey()
+	authRepo, _, reportRepo, keyRepo := srv.SetupPgxDb(context.Background(), masterKey)
+	auth.Repo = authRepo
+
+	switch args[0] {
+	case "list":
+		reports, err := reportRepo.ListReports(*status, int32(*limit))
+		if err != nil {
+			log.Fatal(err)
+		}
+		if len(reports) == 0 {
+			fmt.Printf("No %v reports\n", *status)
+		}
+		for _, v := range reports {
+			fmt.Printf("%v\t%v\t%v -> %v\t%v\n", v.ID, v.CreatedAt.Time.Format(time.DateTime), v.Reporter, v.Reported, server.ReportReason(v.Reason))
+		}
+	case "show":
+		printReport(reportRepo, reportId(args))
+	case "dismiss":
+		resolve(reportRepo, reportId(args), report.STATUS_DISMISSED)
+	case "revoke":
+		id := reportId(args)
+		rep, err := reportRepo.GetReport(id)
+		if err != nil {
+			log.Fatalf("Report %v: %v", id, err)
+		}
+		if rep.Status != report.STATUS_OPEN {
+			log.Fatalf("Report %v isn't open", id)
+		}
+		err = revoke(cfg, rep.Reported)
+		if err != nil {
+			log.Fatal(errors.Join(fmt.Errorf("couldn't revoke the certificate of %v, report left open", rep.Reported), err))
+		}
+		resolve(reportRepo, id, report.STATUS_ACTIONED)
+	case "rotate-key":
+		rotateKey(keyRepo, masterKey)
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+}
@@ -8,8 +8,6 @@ import (
 	"strings"
 	"time"
 
-	"github.com/as283-ua/yappa/api/gen/client"
-	"github.com/as283-ua/yappa/api/gen/server"
 	"github.com/as283-ua/yappa/internal/client/save"
 	"github.com/as283-ua/yappa/internal/client/service"
 	"github.com/as283-ua/yappa/internal/client/settings"
@@ -24,6 +22,9 @@ var (
 	caHost     *string
 	logsDir    *string
 	fetchOnly  *bool
+	presence   *bool
+	cover      *time.Duration
+	coverBatch *int
 )
 
 func main() {
@@ -35,6 +36,9 @@ func main() {
 	caHost = flag.String("ca", "yappa.io:4434", "Yappa CA server ip and port")
 	logsDir = flag.String("logs", "logs/cli/", "Error logs directory.\n\"/dev/null\" or \"null\" to suppress error logs.\n\"-\" to show errors on-screen (buggy)")
 	fetchOnly = flag.Bool("fetch", false, "Path to certs directory")
+	presence = flag.Bool("presence", false, "Show peers when you're online and typing, and see theirs")
+	cover = flag.Duration("cover", 0, "Send at a constant rate, one batch of frames every interval on average, with dummies\nwhen there's nothing to send. Hides when you write, at the cost of bandwidth and latency. 0 to disable")
+	coverBatch = flag.Int("cover-batch", 1, "Frames sent every cover interval")
 
 	flag.Parse()
 
@@ -47,6 +51,10 @@ func main() {
 		CaCert:     *caCert,
 		ServerHost: *serverHost,
 		CaHost:     *caHost,
+		Presence:   *presence,
+
+		CoverInterval: *cover,
+		CoverBatch:    *coverBatch,
 	}
 
 	var logFile *os.File = nil
@@ -77,6 +85,7 @@ func main() {
 	}
 	h3c, _ := service.GetHttp3Client()
 	chatClient := service.InitChatClient(h3c)
+	chatClient.StartCover(settings.CliSettings.CoverInterval, settings.CliSettings.CoverBatch)
 
 	_, err = os.Stat(settings.CliSettings.CertDir + "yappa.crt")
 	if err == nil {
@@ -94,13 +103,7 @@ func main() {
 			}
 
 			if !*fetchOnly {
-				go func() {
-					err = chatClient.Connect()
-					if err != nil {
-						log.Printf("Failed opening connection to the server: %v", err)
-						return
-					}
-				}()
+				go chatClient.KeepConnected()
 				defer service.GetChatClient().Close()
 			}
 		} else {
@@ -115,9 +118,6 @@ func main() {
 		log.Fatalf("Failed to load saved chats: %v", err)
 	}
 
-	if !*fetchOnly {
-		go service.StartListening(saveState)
-	}
 	defer func() {
 		err := save.SaveChats(saveState)
 		if err != nil {
@@ -128,59 +128,9 @@ func main() {
 	}()
 
 	if service.GetUsername() != "" {
-		newChats, err := service.GetChatClient().GetNewChats()
+		err := service.CatchUp(saveState)
 		if err != nil {
-			log.Printf("Errors while retrieving new chats: %v", err)
-		}
-		for _, chat := range newChats {
-			save.NewDirectChat(saveState, chat)
-		}
-
-		newEncMsgs, err := service.GetChatClient().GetNewMessages(saveState)
-		if err != nil {
-			log.Printf("Errors while retrieving new messages: %v", err)
-		}
-		for chat, listMsgs := range newEncMsgs {
-			for _, msg := range listMsgs {
-				event, _, err := service.DecryptPeerMessage(chat, &server.ServerMessage_Send{Send: &server.ReceiveMsg{
-					InboxId: chat.Peer.InboxId,
-					Serial:  msg.Serial,
-					EncData: msg.EncMsg,
-				}})
-				if err != nil {
-					log.Printf("Error decrypting message %v from chat %v", msg.Serial, chat.Peer.InboxId)
-					continue
-				}
-
-				var newSerial uint64 = chat.CurrentSerial
-				var newKey []byte = chat.Key
-				if chat.CurrentSerial == msg.Serial { // ratchet if order was kept, keep previous key and current serial otherwise
-					newSerial++
-					errored := false
-					switch msg := event.Payload.(type) {
-					case *client.ClientEvent_KeyRotation:
-						decapKey := service.GetMlkemDecap()
-						if decapKey == nil {
-							errored = true
-							log.Println("Received key rotation message but no MLKEM key is loaded")
-							break
-						}
-						newKey, err = decapKey.Decapsulate(msg.KeyRotation.KeyExchangeData)
-						if err != nil {
-							errored = true
-							log.Println("Error decapsulating key:", err)
-							break
-						}
-					default:
-						newKey = service.Ratchet(chat.Key)
-					}
-					if errored {
-						// todo send NACK to redo key exchange
-						break
-					}
-				}
-				save.NewEvent(chat, newSerial, newKey, event)
-			}
+			log.Printf("Errors while catching up: %v", err)
 		}
 	}
 
@@ -189,6 +139,9 @@ func main() {
 		return
 	}
 
+	// only once caught up, both advance the chats. Whatever is pushed meanwhile waits in the chat client's queue
+	go service.StartListening(saveState)
+
 	if service.GetUsername() == "" {
 		log.Println("Started client without session")
 	} else {
@@ -12,6 +12,8 @@ import (
 
 	"github.com/BurntSushi/toml"
 	"github.com/as283-ua/yappa/internal/server"
+	"github.com/as283-ua/yappa/internal/server/connection"
+	"github.com/as283-ua/yappa/internal/server/keys"
 	"github.com/as283-ua/yappa/internal/server/logging"
 	"github.com/as283-ua/yappa/internal/server/settings"
 )
@@ -104,8 +106,13 @@ func main() {
 		}
 	}
 
-	authRepo, chatRepo := server.SetupPgxDb(context.Background())
-	srv, err := server.SetupServer(cfg, authRepo, chatRepo)
+	masterKey := server.ReadMasterKey()
+	authRepo, chatRepo, reportRepo, keyRepo := server.SetupPgxDb(context.Background(), masterKey)
+	ring, err := keys.Load(keyRepo, masterKey)
+	if err != nil {
+		log.Fatal(err)
+	}
+	srv, err := server.SetupServer(cfg, ring, authRepo, chatRepo, reportRepo)
 
 	log := logging.GetLogger()
 
@@ -118,6 +125,7 @@ func main() {
 
 	go func() {
 		<-sigChan
+		connection.Sessions.CloseAll()
 		srv.Close()
 		log.Println("Closed server")
 		os.Exit(0)
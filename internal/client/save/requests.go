@@ -0,0 +1,160 @@
+package save
+
+import (
+	"bytes"
+	"log"
+	"slices"
+	"time"
+
+	"github.com/as283-ua/yappa/api/gen/client"
+)
+
+// Max live messages held for a single request, later ones are dropped. The sender can't fill the save file
+// before being accepted
+const MAX_HELD_MESSAGES = 100
+
+// Where an invitation ended up
+type Invitation int
+
+const (
+	// the sender already has a chat with this user, so it's added to the chats
+	INVITATION_ADDED Invitation = iota
+	// waiting in the message requests to be accepted
+	INVITATION_REQUEST
+	// the sender is blocked, the invitation is discarded
+	INVITATION_BLOCKED
+)
+
+// Files a verified invitation: straight into the chats if its sender is known, into the requests otherwise,
+// or nowhere if the sender is blocked
+func NewInvitation(save *client.SaveState, chat *client.Chat) Invitation {
+	sender := chat.Peer.Username
+	if IsBlocked(save, sender) {
+		log.Printf("Discarded invitation from blocked user %v\n", sender)
+		return INVITATION_BLOCKED
+	}
+	if DirectChatByUser(save, sender) != nil {
+		NewDirectChat(save, chat)
+		return INVITATION_ADDED
+	}
+
+	mx.Lock()
+	defer mx.Unlock()
+	for _, v := range save.Requests {
+		if bytes.Equal(v.Chat.Peer.InboxId, chat.Peer.InboxId) {
+			return INVITATION_REQUEST
+		}
+	}
+	save.Requests = append(save.Requests, &client.MessageRequest{
+		Chat:       chat,
+		ReceivedAt: uint64(time.Now().UTC().Unix()),
+	})
+	log.Printf("New message request from %v\n", sender)
+	return INVITATION_REQUEST
+}
+
+func Request(save *client.SaveState, inboxId []byte) (*client.MessageRequest, bool) {
+	mx.Lock()
+	defer mx.Unlock()
+	for _, v := range save.Requests {
+		if bytes.Equal(v.Chat.Peer.InboxId, inboxId) {
+			return v, true
+		}
+	}
+	return nil, false
+}
+
+// First pending request from the user
+func RequestByUser(save *client.SaveState, username string) (*client.MessageRequest, bool) {
+	mx.Lock()
+	defer mx.Unlock()
+	for _, v := range save.Requests {
+		if v.Chat.Peer.Username == username {
+			return v, true
+		}
+	}
+	return nil, false
+}
+
+// Copy of the pending requests, safe to range over while new ones arrive
+func Requests(save *client.SaveState) []*client.MessageRequest {
+	mx.Lock()
+	defer mx.Unlock()
+	return slices.Clone(save.Requests)
+}
+
+// Keeps a live message of the request until it's accepted. Returns false if it holds too many already
+func HoldMessage(req *client.MessageRequest, serial uint64, encData []byte) bool {
+	mx.Lock()
+	defer mx.Unlock()
+	if len(req.Held) >= MAX_HELD_MESSAGES {
+		return false
+	}
+	req.Held = append(req.Held, &client.HeldMessage{Serial: serial, EncData: encData})
+	return true
+}
+
+// Called with mx held
+func takeRequest(save *client.SaveState, inboxId []byte) (*client.MessageRequest, bool) {
+	for i, v := range save.Requests {
+		if bytes.Equal(v.Chat.Peer.InboxId, inboxId) {
+			save.Requests = slices.Delete(save.Requests, i, i+1)
+			return v, true
+		}
+	}
+	return nil, false
+}
+
+// Moves the request's chat into the chats. The held messages are left in the returned request for the caller
+// to decrypt
+func AcceptRequest(save *client.SaveState, inboxId []byte) (*client.MessageRequest, bool) {
+	mx.Lock()
+	req, ok := takeRequest(save, inboxId)
+	mx.Unlock()
+	if !ok {
+		return nil, false
+	}
+	NewDirectChat(save, req.Chat)
+	return req, true
+}
+
+// Forgets the request. Whatever its sender stored in the inbox is left for the server to expire
+func DeclineRequest(save *client.SaveState, inboxId []byte) bool {
+	mx.Lock()
+	defer mx.Unlock()
+	_, ok := takeRequest(save, inboxId)
+	return ok
+}
+
+func IsBlocked(save *client.SaveState, username string) bool {
+	mx.Lock()
+	defer mx.Unlock()
+	return slices.Contains(save.Blocked, username)
+}
+
+// Blocks the user and drops their pending requests. Chats already accepted are kept
+func Block(save *client.SaveState, username string) {
+	mx.Lock()
+	defer mx.Unlock()
+	if !slices.Contains(save.Blocked, username) {
+		save.Blocked = append(save.Blocked, username)
+	}
+	save.Requests = slices.DeleteFunc(save.Requests, func(req *client.MessageRequest) bool {
+		return req.Chat.Peer.Username == username
+	})
+}
+
+func Unblock(save *client.SaveState, username string) {
+	mx.Lock()
+	defer mx.Unlock()
+	save.Blocked = slices.DeleteFunc(save.Blocked, func(blocked string) bool {
+		return blocked == username
+	})
+}
+
+// Copy of the block list
+func Blocked(save *client.SaveState) []string {
+	mx.Lock()
+	defer mx.Unlock()
+	return slices.Clone(save.Blocked)
+}
@@ -5,6 +5,7 @@ import (
 	"compress/gzip"
 	"crypto/rand"
 	"encoding/base64"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
@@ -21,6 +22,17 @@ import (
 const WAL_PATH = "data.wal"
 const SERVICE_NAME = "YAPPA_PRIV_CHAT"
 
+// Max number of ratchet steps a single incoming message can force. Anything further ahead is rejected
+const MAX_RATCHET_CYCLE = 1000
+
+// Max number of skipped message keys kept per chat. Oldest keys are dropped first
+const MAX_SKIPPED_KEYS = 2000
+
+// Save files start with SAVE_MAGIC followed by the format version. Files without it are from before the file
+// key was derived from the keyring secret and are still read, then rewritten in the current format on save
+const SAVE_MAGIC = "YPSV"
+const SAVE_VERSION uint32 = 1
+
 var username string
 var mx = sync.Mutex{}
 
@@ -31,6 +43,44 @@ func savePath() string {
 	return fmt.Sprintf("chats_%v.data", username)
 }
 
+func saveAD() common.AssociatedData {
+	return common.AssociatedData{
+		Version: common.PROTOCOL_VERSION,
+		Label:   common.LabelSaveFile,
+		Context: []byte(username),
+	}
+}
+
+// The keyring holds a secret the file key is derived from, so the stored value is never used as a key directly
+func fileKey(secret []byte) ([]byte, error) {
+	return common.DeriveKey(secret, common.LabelSaveFile, []byte(username))
+}
+
+func decryptSave(secret, data []byte) ([]byte, error) {
+	if len(data) >= len(SAVE_MAGIC)+4 && string(data[:len(SAVE_MAGIC)]) == SAVE_MAGIC {
+		version := binary.BigEndian.Uint32(data[len(SAVE_MAGIC):])
+		if version != SAVE_VERSION {
+			return nil, fmt.Errorf("unsupported save file version %v", version)
+		}
+		key, err := fileKey(secret)
+		if err != nil {
+			return nil, err
+		}
+		return common.Open(key, data[len(SAVE_MAGIC)+4:], saveAD())
+	}
+
+	out, err := common.Open(secret, data, saveAD())
+	if err != nil {
+		// files written before the save was bound to its owner
+		var legacyErr error
+		out, legacyErr = common.Decrypt(data, secret)
+		if legacyErr != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
 func LoadChats() (*client.SaveState, error) {
 	mx.Lock()
 	defer mx.Unlock()
@@ -53,7 +103,7 @@ func LoadChats() (*client.SaveState, error) {
 		return nil, fmt.Errorf("base 64 decode error: %v", err)
 	}
 
-	saveGzipd, err := common.Decrypt(encSaveGzipd, key)
+	saveGzipd, err := decryptSave(key, encSaveGzipd)
 	if err != nil {
 		return nil, fmt.Errorf("decrypt error: %v", err)
 	}
@@ -77,6 +127,11 @@ func LoadChats() (*client.SaveState, error) {
 			return nil, fmt.Errorf("nil peer in a chat %v", v)
 		}
 	}
+	for _, v := range saveState.Requests {
+		if v.Chat == nil || v.Chat.Peer == nil {
+			return nil, fmt.Errorf("nil peer in a message request %v", v)
+		}
+	}
 
 	return saveState, nil
 }
@@ -112,12 +167,17 @@ func SaveChats(save *client.SaveState) error {
 
 	saveGzipd := buf.Bytes()
 
-	encSaveGzipd, err := common.Encrypt(saveGzipd, key)
+	fKey, err := fileKey(key)
+	if err != nil {
+		return err
+	}
+	encSaveGzipd, err := common.Seal(fKey, saveGzipd, saveAD())
 	if err != nil {
 		return err
 	}
 
-	return os.WriteFile(savePath(), encSaveGzipd, 0600)
+	out := binary.BigEndian.AppendUint32([]byte(SAVE_MAGIC), SAVE_VERSION)
+	return os.WriteFile(savePath(), append(out, encSaveGzipd...), 0600)
 }
 
 func NewDirectChat(save *client.SaveState, chat *client.Chat) {
@@ -132,11 +192,107 @@ func NewDirectChat(save *client.SaveState, chat *client.Chat) {
 func NewEvent(chat *client.Chat, nextSerial uint64, nextKey []byte, event *client.ClientEvent) {
 	mx.Lock()
 	defer mx.Unlock()
-	chat.Events = append(chat.Events, event)
+	if kept(event) {
+		chat.Events = append(chat.Events, event)
+	}
 	chat.CurrentSerial = nextSerial
 	chat.Key = nextKey
 }
 
+// Stores the keys of messages the ratchet skipped over so they can still be decrypted when they arrive
+func SkipKeys(chat *client.Chat, skipped []*client.SkippedKey) {
+	if len(skipped) == 0 {
+		return
+	}
+	mx.Lock()
+	defer mx.Unlock()
+	chat.SkippedKeys = append(chat.SkippedKeys, skipped...)
+	if len(chat.SkippedKeys) > MAX_SKIPPED_KEYS {
+		chat.SkippedKeys = chat.SkippedKeys[len(chat.SkippedKeys)-MAX_SKIPPED_KEYS:]
+	}
+}
+
+func SkippedKey(chat *client.Chat, serial uint64) ([]byte, bool) {
+	mx.Lock()
+	defer mx.Unlock()
+	for _, v := range chat.SkippedKeys {
+		if v.Serial == serial {
+			return v.Key, true
+		}
+	}
+	return nil, false
+}
+
+func RatchetState(chat *client.Chat) *client.RatchetState {
+	mx.Lock()
+	defer mx.Unlock()
+	return proto.Clone(chat.Ratchet).(*client.RatchetState)
+}
+
+func SetRatchet(chat *client.Chat, state *client.RatchetState) {
+	mx.Lock()
+	defer mx.Unlock()
+	chat.Ratchet = state
+}
+
+// First epoch whose derived inbox the next retrieval of a sealed chat goes through
+func InboxEpoch(chat *client.Chat) uint64 {
+	mx.Lock()
+	defer mx.Unlock()
+	return chat.InboxEpoch
+}
+
+func SetInboxEpoch(chat *client.Chat, epoch uint64) {
+	mx.Lock()
+	defer mx.Unlock()
+	chat.InboxEpoch = epoch
+}
+
+// Adds an event of a double ratchet chat along with the ratchet state left after decrypting it
+func NewRatchetEvent(chat *client.Chat, serial uint64, state *client.RatchetState, event *client.ClientEvent) {
+	mx.Lock()
+	defer mx.Unlock()
+	chat.Ratchet = state
+	if kept(event) {
+		insertEvent(chat, serial, event)
+	}
+	if serial >= chat.CurrentSerial {
+		chat.CurrentSerial = serial + 1
+	}
+}
+
+// Adds an event that arrived after newer ones. The event is placed by serial and its skipped key is discarded,
+// the current serial and key of the chat are left untouched
+func LateEvent(chat *client.Chat, serial uint64, event *client.ClientEvent) {
+	mx.Lock()
+	defer mx.Unlock()
+	for i, v := range chat.SkippedKeys {
+		if v.Serial == serial {
+			chat.SkippedKeys = append(chat.SkippedKeys[:i], chat.SkippedKeys[i+1:]...)
+			break
+		}
+	}
+	if kept(event) {
+		insertEvent(chat, serial, event)
+	}
+}
+
+// Receipts only raise the status of the messages they list, they take their serial but aren't kept in the history
+func kept(event *client.ClientEvent) bool {
+	_, receipt := event.Payload.(*client.ClientEvent_Receipt)
+	return !receipt
+}
+
+func insertEvent(chat *client.Chat, serial uint64, event *client.ClientEvent) {
+	idx := len(chat.Events)
+	for idx > 0 && chat.Events[idx-1].Serial > serial {
+		idx--
+	}
+	chat.Events = append(chat.Events, nil)
+	copy(chat.Events[idx+1:], chat.Events[idx:])
+	chat.Events[idx] = event
+}
+
 func DirectChat(save *client.SaveState, inboxId []byte) (*client.Chat, bool) {
 	for _, v := range save.Chats {
 		if bytes.Equal(v.Peer.InboxId, inboxId) {
@@ -154,3 +310,73 @@ func DirectChatByUser(save *client.SaveState, username string) *client.Chat {
 	}
 	return nil
 }
+
+// Raises the status of this client's messages. A status is never lowered, so an ack arriving after the peer's
+// read receipt doesn't undo it
+func SetStatus(chat *client.Chat, serials []uint64, status client.MessageStatus) {
+	mx.Lock()
+	defer mx.Unlock()
+	if chat.Statuses == nil {
+		chat.Statuses = make(map[uint64]client.MessageStatus)
+	}
+	for _, serial := range serials {
+		if chat.Statuses[serial] < status {
+			chat.Statuses[serial] = status
+		}
+	}
+}
+
+func Status(chat *client.Chat, serial uint64) client.MessageStatus {
+	mx.Lock()
+	defer mx.Unlock()
+	return chat.Statuses[serial]
+}
+
+// Serials of this client's messages waiting in the peer's inbox
+func StoredSerials(chat *client.Chat) []uint64 {
+	mx.Lock()
+	defer mx.Unlock()
+	stored := make([]uint64, 0)
+	for serial, status := range chat.Statuses {
+		if status == client.MessageStatus_STATUS_STORED {
+			stored = append(stored, serial)
+		}
+	}
+	return stored
+}
+
+// Send time of this client's events with the given serials
+func SentAt(chat *client.Chat, serials []uint64) map[uint64]uint64 {
+	mx.Lock()
+	defer mx.Unlock()
+	wanted := make(map[uint64]bool, len(serials))
+	for _, serial := range serials {
+		wanted[serial] = true
+	}
+	sent := make(map[uint64]uint64, len(serials))
+	for _, ev := range chat.Events {
+		if ev.Sender != chat.Peer.Username && wanted[ev.Serial] {
+			sent[ev.Serial] = ev.Timestamp
+		}
+	}
+	return sent
+}
+
+// Serials of peer messages not yet reported as read, marking them as reported
+func TakeUnread(chat *client.Chat) []uint64 {
+	mx.Lock()
+	defer mx.Unlock()
+	unread := make([]uint64, 0)
+	for _, ev := range chat.Events {
+		if _, ok := ev.Payload.(*client.ClientEvent_Message); !ok || ev.Sender != chat.Peer.Username {
+			continue
+		}
+		if ev.Serial >= chat.ReadSerial {
+			unread = append(unread, ev.Serial)
+		}
+	}
+	if len(unread) != 0 {
+		chat.ReadSerial = unread[len(unread)-1] + 1
+	}
+	return unread
+}
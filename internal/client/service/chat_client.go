@@ -2,33 +2,76 @@ package service
 
 import (
 	"context"
-	"encoding/binary"
-	"fmt"
+	"errors"
 	"log"
+	"math/rand/v2"
 	"net/http"
 	"net/url"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/as283-ua/yappa/api/gen/client"
 	"github.com/as283-ua/yappa/api/gen/server"
 	"github.com/as283-ua/yappa/internal/client/settings"
 	"github.com/as283-ua/yappa/pkg/common"
-	"github.com/quic-go/quic-go/http3"
-	"google.golang.org/protobuf/proto"
 )
 
+// Sent to chat subscribers when the status of messages sent by this client changes
+type StatusUpdate struct {
+	InboxId []byte
+	Serials []uint64
+	Status  client.MessageStatus
+}
+
+// Chat message sent to the server and not yet acknowledged
+type pendingSend struct {
+	inboxId []byte
+	serial  uint64
+}
+
+// Delays between reconnection attempts grow exponentially from RECONNECT_BASE_DELAY up to RECONNECT_MAX_DELAY
+const RECONNECT_BASE_DELAY = 500 * time.Millisecond
+const RECONNECT_MAX_DELAY = 30 * time.Second
+
 type ChatClient struct {
 	client *http.Client
+
+	// guards the current connection, replaced on every reconnect
+	connMx sync.RWMutex
 	str    *common.BiStream
+	reader *common.FrameReader
+	writer *common.FrameWriter
 
 	subsMu sync.RWMutex
-	subs   map[[32]byte][]chan *client.ClientEvent
+	// receive *client.ClientEvent and StatusUpdate
+	subs map[[32]byte][]chan any
 
 	MainSub chan *server.ServerMessage
+	// messages read but not yet taken from MainSub
+	queueMu sync.Mutex
+	queue   []*server.ServerMessage
+	queued  chan struct{}
+	// signaled after every connect, the first one included. Whoever listens catches up on what was missed while
+	// disconnected and sets up what the server only keeps for the connection, like presence
+	ConnectedSig chan struct{}
 
-	connected bool
-	// ConnectedC chan bool
+	nextMsgId atomic.Uint64
+	pendingMu sync.Mutex
+	pending   map[uint64]pendingSend
+
+	// real sends held for the next cover traffic slot, see StartCover
+	coverMu  sync.Mutex
+	covering bool
+	outbox   []*server.ClientMessage
+
+	nextRpcId atomic.Uint64
+	callsMu   sync.Mutex
+	calls     map[uint64]chan *server.RpcResponse
+
+	connected atomic.Bool
+	closeOnce sync.Once
+	closed    chan struct{}
 }
 
 var chatClient *ChatClient
@@ -36,12 +79,18 @@ var ConnectedC chan bool = make(chan bool, 50)
 
 func InitChatClient(h3c *http.Client) *ChatClient {
 	chatClient = &ChatClient{
-		client:  h3c,
-		str:     nil,
-		subsMu:  sync.RWMutex{},
-		subs:    make(map[[32]byte][]chan *client.ClientEvent),
-		MainSub: make(chan *server.ServerMessage, 50),
+		client:       h3c,
+		str:          nil,
+		subsMu:       sync.RWMutex{},
+		subs:         make(map[[32]byte][]chan any),
+		MainSub:      make(chan *server.ServerMessage, 50),
+		ConnectedSig: make(chan struct{}, 1),
+		pending:      make(map[uint64]pendingSend),
+		calls:        make(map[uint64]chan *server.RpcResponse),
+		queued:       make(chan struct{}, 1),
+		closed:       make(chan struct{}),
 	}
+	go chatClient.forwardLoop()
 	return chatClient
 }
 
@@ -50,83 +99,229 @@ func GetChatClient() *ChatClient {
 }
 
 func (c *ChatClient) GetConnected() bool {
-	return c.connected
+	return c.connected.Load()
 }
 
 func (c *ChatClient) setConnected(connected bool) {
-	c.connected = connected
-	ConnectedC <- c.connected
+	if c.connected.Swap(connected) == connected {
+		return
+	}
+	select {
+	case ConnectedC <- connected:
+	default:
+		log.Println("Connection state channel full, dropping state", connected)
+	}
 }
 
+// Closed once the client is closed for good
+func (c *ChatClient) Done() <-chan struct{} {
+	return c.closed
+}
+
+func (c *ChatClient) isClosed() bool {
+	select {
+	case <-c.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// Opens a single connection to the server and starts reading from it. Use KeepConnected to also reconnect
+// when it is lost
 func (c *ChatClient) Connect() error {
-	serverURL := "https://" + settings.CliSettings.ServerHost + "/connect"
-	u, err := url.Parse(serverURL)
+	str, err := c.dial()
 	if err != nil {
 		return err
 	}
+	go func() {
+		c.readloop(str)
+		c.disconnected(str)
+	}()
+	return nil
+}
+
+// Connects to the server and reconnects with jittered exponential backoff every time the connection is lost,
+// until Close is called. Blocks until then
+func (c *ChatClient) KeepConnected() {
+	attempt := 0
+	for !c.isClosed() {
+		str, err := c.dial()
+		if err != nil {
+			delay := ReconnectDelay(attempt)
+			attempt++
+			log.Printf("Failed opening connection to the server, retrying in %v: %v", delay, err)
+			select {
+			case <-time.After(delay):
+			case <-c.closed:
+			}
+			continue
+		}
+
+		attempt = 0
+		select {
+		case c.ConnectedSig <- struct{}{}:
+		default:
+		}
 
-	c.str, err = common.Http3Stream(context.Background(), u, c.client.Transport.(*http3.Transport), http.Header{})
+		c.readloop(str)
+		c.disconnected(str)
+		c.rebind()
+	}
+}
 
+// Moves the shared connection to a new local socket. Connections are often lost to a network change, which can
+// leave the socket bound to an address that no longer works
+func (c *ChatClient) rebind() {
+	t, ok := c.client.Transport.(*common.SharedTransport)
+	if !ok || c.isClosed() {
+		return
+	}
+	err := t.Rebind()
 	if err != nil {
-		return err
+		log.Println("Failed moving to a new socket:", err)
 	}
-	c.setConnected(true)
-	go c.readloop()
-	go c.heartbeatLoop()
-	return nil
 }
 
-func (c *ChatClient) Close() error {
-	if c != nil && c.GetConnected() {
-		c.setConnected(false)
-		return c.str.Close()
+// Random delay in [d/2, d], d being the exponential backoff for the attempt capped at RECONNECT_MAX_DELAY.
+// The jitter keeps clients that lost their connection at the same time from reconnecting all at once
+func ReconnectDelay(attempt int) time.Duration {
+	delay := RECONNECT_MAX_DELAY
+	if attempt < 16 {
+		delay = min(RECONNECT_BASE_DELAY<<attempt, RECONNECT_MAX_DELAY)
 	}
-	return nil
+	return delay/2 + rand.N(delay/2+1)
 }
 
-func (c *ChatClient) Send(msg *server.ClientMessage) error {
-	m, err := proto.Marshal(msg)
+func (c *ChatClient) dial() (*common.BiStream, error) {
+	serverURL := "https://" + settings.CliSettings.ServerHost + "/connect"
+	u, err := url.Parse(serverURL)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	t, ok := c.client.Transport.(*common.SharedTransport)
+	if !ok {
+		return nil, errors.New("http transport error")
+	}
+	str, err := t.OpenStream(context.Background(), u, http.Header{})
+	if err != nil {
+		return nil, err
+	}
+
+	c.connMx.Lock()
+	if c.isClosed() {
+		// Close ran while dialing and didn't see this stream
+		c.connMx.Unlock()
+		str.Close()
+		return nil, errors.New("client closed")
+	}
+	c.str = str
+	c.reader = common.NewFrameReader(str, 0)
+	c.writer = common.NewFrameWriter(str, 0)
+	c.setConnected(true)
+	c.connMx.Unlock()
+
+	go c.heartbeatLoop(str)
+	return str, nil
+}
+
+// Drops the connection if it is still the current one
+func (c *ChatClient) disconnected(str *common.BiStream) {
+	c.connMx.Lock()
+	if c.str == str {
+		c.str = nil
+		c.reader = nil
+		c.writer = nil
+		c.setConnected(false)
 	}
+	c.connMx.Unlock()
+	str.Close()
+}
 
-	// length of message at the start of the frame
-	messageLen := len(m)
-	lenBytes := make([]byte, 4)
-	binary.BigEndian.PutUint32(lenBytes, uint32(messageLen))
+// Closes the connection and stops reconnecting
+func (c *ChatClient) Close() error {
+	if c == nil {
+		return nil
+	}
+	c.closeOnce.Do(func() {
+		close(c.closed)
+	})
 
-	c.str.Write(append(lenBytes, m...))
+	c.connMx.RLock()
+	str := c.str
+	c.connMx.RUnlock()
+	if str != nil {
+		c.disconnected(str)
+	}
 	return nil
 }
 
-func (c *ChatClient) readOnce(msg *server.ServerMessage, msgRaw, lenBytes []byte) error {
-	_, err := c.str.Read(lenBytes)
-	if err != nil {
-		return err
+// Writes the message to the connection. With cover traffic on, chat messages are held for the next slot instead
+func (c *ChatClient) Send(msg *server.ClientMessage) error {
+	c.connMx.RLock()
+	writer := c.writer
+	c.connMx.RUnlock()
+	if writer == nil {
+		return errors.New("not connected")
 	}
-	msgLen := binary.BigEndian.Uint32(lenBytes[:])
-	if int(msgLen) >= cap(msgRaw) {
-		return fmt.Errorf("invalid incoming message size: %v. Max: %v", msgLen, cap(msgRaw))
+	if _, ok := msg.Payload.(*server.ClientMessage_Send); ok && c.hold(msg) {
+		return nil
 	}
-	_, err = c.str.Read(msgRaw[:msgLen])
+	return writer.WriteMsg(msg)
+}
+
+// Sends a chat message with a new message id, so the server's status for it can be matched with TakePending
+func (c *ChatClient) SendMsg(msg *server.SendMsg) error {
+	msg.MsgId = c.nextMsgId.Add(1)
+	c.pendingMu.Lock()
+	c.pending[msg.MsgId] = pendingSend{inboxId: msg.InboxId, serial: msg.Serial}
+	c.pendingMu.Unlock()
+
+	err := c.Send(&server.ClientMessage{
+		Payload: &server.ClientMessage_Send{
+			Send: msg,
+		},
+	})
 	if err != nil {
-		return err
+		c.pendingMu.Lock()
+		delete(c.pending, msg.MsgId)
+		c.pendingMu.Unlock()
 	}
-	err = proto.Unmarshal(msgRaw[:msgLen], msg)
-	if err != nil {
-		return err
+	return err
+}
+
+// Returns the inbox and serial of the message with the given id, forgetting about it
+func (c *ChatClient) TakePending(msgId uint64) ([]byte, uint64, bool) {
+	c.pendingMu.Lock()
+	defer c.pendingMu.Unlock()
+	p, ok := c.pending[msgId]
+	if !ok {
+		return nil, 0, false
 	}
-	return nil
+	delete(c.pending, msgId)
+	return p.inboxId, p.serial, true
 }
 
-func (c *ChatClient) readloop() {
-	var msgRaw, lenBytes []byte = make([]byte, 0, 4096), make([]byte, 4)
-	defer c.Close()
-	for c.connected {
+// Reads from the connection until it fails
+func (c *ChatClient) readloop(str *common.BiStream) {
+	c.connMx.RLock()
+	reader := c.reader
+	current := c.str == str
+	c.connMx.RUnlock()
+	if !current {
+		return
+	}
+	for {
 		msg := &server.ServerMessage{}
-		err := c.readOnce(msg, msgRaw, lenBytes)
-		if err != nil {
+		err := reader.ReadMsg(msg)
+		var decodeErr *common.FrameDecodeError
+		if errors.As(err, &decodeErr) {
 			log.Println("Readloop error, unmarshal:", err)
+			continue
+		}
+		if err != nil {
+			log.Println("Readloop error:", err)
 			break
 		}
 
@@ -134,11 +329,64 @@ func (c *ChatClient) readloop() {
 	}
 }
 
+// Never blocks: whoever reads MainSub may be waiting on an rpc, whose response has to be read first
 func (c *ChatClient) dispatch(msg *server.ServerMessage) {
-	c.MainSub <- msg
+	switch payload := msg.Payload.(type) {
+	case *server.ServerMessage_Rpc:
+		c.resolveCall(payload.Rpc)
+		return
+	case *server.ServerMessage_Hb:
+		// answer so the server doesn't take the session for dead
+		go func() {
+			err := c.Send(&server.ClientMessage{Payload: &server.ClientMessage_Hb{Hb: &server.HeartBeat{}}})
+			if err != nil {
+				log.Printf("HB error: %v", err)
+			}
+		}()
+		return
+	case *server.ServerMessage_Error:
+		log.Printf("Server refused a message: %v (%v), retry after %vms", payload.Error.Message, payload.Error.Code, payload.Error.RetryAfterMs)
+		return
+	}
+	c.queueMu.Lock()
+	c.queue = append(c.queue, msg)
+	c.queueMu.Unlock()
+	select {
+	case c.queued <- struct{}{}:
+	default:
+	}
 }
 
-func (c *ChatClient) Emit(inboxId []byte, msg *client.ClientEvent) {
+// Moves queued messages to MainSub in the order they were read
+func (c *ChatClient) forwardLoop() {
+	for {
+		select {
+		case <-c.queued:
+		case <-c.closed:
+			return
+		}
+		for {
+			c.queueMu.Lock()
+			if len(c.queue) == 0 {
+				c.queueMu.Unlock()
+				break
+			}
+			msg := c.queue[0]
+			c.queue[0] = nil
+			c.queue = c.queue[1:]
+			c.queueMu.Unlock()
+
+			select {
+			case c.MainSub <- msg:
+			case <-c.closed:
+				return
+			}
+		}
+	}
+}
+
+// Notifies the inbox's subscribers. msg is either a *client.ClientEvent or a StatusUpdate
+func (c *ChatClient) Emit(inboxId []byte, msg any) {
 	c.subsMu.RLock()
 	defer c.subsMu.RUnlock()
 
@@ -155,10 +403,22 @@ func (c *ChatClient) Emit(inboxId []byte, msg *client.ClientEvent) {
 	}
 }
 
-func (c *ChatClient) heartbeatLoop() {
+// Sends heartbeats for as long as str is the current connection
+func (c *ChatClient) heartbeatLoop(str *common.BiStream) {
 	ticker := time.NewTicker(20 * time.Second)
-	for c.connected {
-		<-ticker.C
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-c.closed:
+			return
+		}
+		c.connMx.RLock()
+		current := c.str == str
+		c.connMx.RUnlock()
+		if !current {
+			return
+		}
 		err := c.Send(&server.ClientMessage{Payload: &server.ClientMessage_Hb{}})
 		if err != nil {
 			log.Printf("HB error: %v", err)
@@ -167,15 +427,15 @@ func (c *ChatClient) heartbeatLoop() {
 	}
 }
 
-func (c *ChatClient) Subscribe(inboxId [32]byte) (int, chan *client.ClientEvent) {
+func (c *ChatClient) Subscribe(inboxId [32]byte) (int, chan any) {
 	c.subsMu.RLock()
 	defer c.subsMu.RUnlock()
 
 	inboxSubs, ok := c.subs[inboxId]
 	if !ok {
-		inboxSubs = make([]chan *client.ClientEvent, 0)
+		inboxSubs = make([]chan any, 0)
 	}
-	ch := make(chan *client.ClientEvent, 50)
+	ch := make(chan any, 50)
 	inboxSubs = append(inboxSubs, ch)
 	c.subs[inboxId] = inboxSubs
 	id := len(c.subs[inboxId])
@@ -1,18 +1,89 @@
 package service
 
 import (
+	"crypto/ecdsa"
 	"crypto/mlkem"
 	"crypto/sha256"
+	"fmt"
+	"log"
+	"sync"
 	"time"
 
 	cli_proto "github.com/as283-ua/yappa/api/gen/client"
 	"github.com/as283-ua/yappa/api/gen/server"
+	"github.com/as283-ua/yappa/internal/client/save"
 	"github.com/as283-ua/yappa/pkg/common"
 	"google.golang.org/protobuf/proto"
 )
 
 const MLKEM_RATCHET_INTERVAL int = 20
 
+// Chats created before the version field existed are read as 0 and use the hash chain as well.
+// Saved chats keep the version they were created with, it only changes how new chats are set up
+const (
+	CHAT_VERSION_HASH_CHAIN     uint32 = 1
+	CHAT_VERSION_DOUBLE_RATCHET uint32 = 2
+	// double ratchet whose invitation and initial keys are derived from the shared secret with common.DeriveKey
+	CHAT_VERSION_KEY_SEPARATION uint32 = 3
+	// as CHAT_VERSION_KEY_SEPARATION, but messages go sealed to inboxes derived from the chat's inbox secret
+	// instead of the one the server handed out. See DerivedInboxId
+	CHAT_VERSION_SEALED_INBOX uint32 = 4
+)
+
+func usesDoubleRatchet(chat *cli_proto.Chat) bool {
+	return chat.Version >= CHAT_VERSION_DOUBLE_RATCHET
+}
+
+var chatLocks sync.Map
+
+// Locks the chat while an event is encrypted, sent and committed or a peer event decrypted and accepted. Each
+// of them reads the serial and ratchet of the chat and writes back the next ones, two at once would reuse a step
+// or lose the other's. Returns the unlock function
+func lockChat(chat *cli_proto.Chat) func() {
+	v, _ := chatLocks.LoadOrStore(chat, &sync.Mutex{})
+	mx := v.(*sync.Mutex)
+	mx.Lock()
+	return mx.Unlock
+}
+
+// Binds each message to its chat and position in it
+func messageAD(chat *cli_proto.Chat, serial uint64) common.AssociatedData {
+	return common.AssociatedData{
+		Version: chat.Version,
+		Label:   common.LabelChatMessage,
+		InboxId: chat.Peer.InboxId,
+		Serial:  serial,
+	}
+}
+
+// Chats set up before versions existed, possibly with a peer that still runs that release and knows nothing
+// about associated data
+func isLegacyChat(chat *cli_proto.Chat) bool {
+	return chat.Version < CHAT_VERSION_HASH_CHAIN
+}
+
+// Encrypts a hash chain message. Legacy chats are sent without associated data, so the peer can still read them
+func sealMessage(chat *cli_proto.Chat, key, raw []byte, serial uint64) ([]byte, error) {
+	if isLegacyChat(chat) {
+		return common.Encrypt(raw, key)
+	}
+	return common.Seal(key, raw, messageAD(chat, serial))
+}
+
+func openMessage(chat *cli_proto.Chat, key, encRaw []byte, serial uint64) ([]byte, error) {
+	raw, err := common.Open(key, encRaw, messageAD(chat, serial))
+	if err != nil && isLegacyChat(chat) {
+		// sent by a peer without associated data, or stored in the inbox before it existed
+		var legacyErr error
+		raw, legacyErr = common.Decrypt(encRaw, key)
+		if legacyErr != nil {
+			return nil, err
+		}
+		return raw, nil
+	}
+	return raw, err
+}
+
 func Ratchet(v []byte) []byte {
 	h := sha256.New()
 	h.Write(v)
@@ -20,35 +91,153 @@ func Ratchet(v []byte) []byte {
 	// return v
 }
 
-func DecryptPeerMessage(chat *cli_proto.Chat, msg *server.ServerMessage_Send) (*cli_proto.ClientEvent, uint64, error) {
-	var key []byte = chat.Key
-	usedSerial := chat.CurrentSerial
-	if chat.CurrentSerial != msg.Send.Serial {
-		usedSerial = msg.Send.Serial
+// Result of decrypting a message from the peer, holding what's needed to advance the chat afterwards
+type PeerEvent struct {
+	Event  *cli_proto.ClientEvent
+	Serial uint64
+	// key the message was encrypted with
+	Key []byte
+	// keys for the serials between the current one and the message's, which haven't arrived yet
+	Skipped []*cli_proto.SkippedKey
+	// message older than the current serial, decrypted with a previously skipped key
+	Late bool
+	// state of the double ratchet after decrypting the message. nil for hash chain chats
+	Ratchet *cli_proto.RatchetState
+}
+
+func DecryptPeerMessage(chat *cli_proto.Chat, msg *server.ServerMessage_Send) (*PeerEvent, error) {
+	if usesDoubleRatchet(chat) {
+		return decryptRatchetMessage(chat, msg)
+	}
+
+	result := &PeerEvent{Serial: msg.Send.Serial}
+	key := chat.Key
+
+	switch {
+	case msg.Send.Serial < chat.CurrentSerial:
+		var ok bool
+		key, ok = save.SkippedKey(chat, msg.Send.Serial)
+		if !ok {
+			return nil, fmt.Errorf("no key for old serial %v (current %v), duplicate or expired message", msg.Send.Serial, chat.CurrentSerial)
+		}
+		result.Late = true
+	case msg.Send.Serial > chat.CurrentSerial:
 		// ratchet should not extend more than MAX_RATCHET_CYCLE. should have set the new key with mlkem
-		// if msg.Send.Serial == chat.CurrentSerial+save.MAX_RATCHET_CYCLE {
-		// 	return nil, fmt.Errorf("serial number for message (%v) exceeded MAX RATCHET CYCLE (%v)", msg.Send.Serial, save.MAX_RATCHET_CYCLE)
-		// }
+		if msg.Send.Serial-chat.CurrentSerial > save.MAX_RATCHET_CYCLE {
+			return nil, fmt.Errorf("serial number for message (%v) exceeded MAX RATCHET CYCLE (%v)", msg.Send.Serial, save.MAX_RATCHET_CYCLE)
+		}
 
-		// ratchet until we get key for serial of msg
+		// ratchet until we get key for serial of msg, keeping the keys for the ones in between
 		for i := chat.CurrentSerial; i < msg.Send.Serial; i++ {
+			result.Skipped = append(result.Skipped, &cli_proto.SkippedKey{Serial: i, Key: key})
 			key = Ratchet(key)
 		}
 	}
+	result.Key = key
 
 	encRaw := msg.Send.EncData
-	raw, err := common.Decrypt(encRaw, key)
+	raw, err := openMessage(chat, key, encRaw, msg.Send.Serial)
 	if err != nil {
-		return nil, 0, err
+		return nil, err
 	}
 
-	peerMsg := &cli_proto.ClientEvent{}
-	err = proto.Unmarshal(raw, peerMsg)
+	peerMsg, err := unmarshalPadded(raw)
+	if err != nil {
+		return nil, err
+	}
+	result.Event = peerMsg
+	return result, nil
+}
 
+func decryptRatchetMessage(chat *cli_proto.Chat, msg *server.ServerMessage_Send) (*PeerEvent, error) {
+	env := &cli_proto.Envelope{}
+	err := proto.Unmarshal(msg.Send.EncData, env)
 	if err != nil {
-		return nil, 0, err
+		return nil, err
 	}
-	return peerMsg, usedSerial, nil
+	if env.Version != CHAT_VERSION_DOUBLE_RATCHET {
+		return nil, fmt.Errorf("unsupported envelope version %v", env.Version)
+	}
+
+	peerEncap, err := getEncap(chat)
+	if err != nil {
+		return nil, err
+	}
+
+	state := save.RatchetState(chat)
+	raw, err := ratchetDecrypt(state, env, messageAD(chat, msg.Send.Serial), GetMlkemDecap(), peerEncap)
+	if err != nil {
+		return nil, err
+	}
+
+	peerMsg, err := unmarshalPadded(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	return &PeerEvent{
+		Event:   peerMsg,
+		Serial:  msg.Send.Serial,
+		Late:    msg.Send.Serial < chat.CurrentSerial,
+		Ratchet: state,
+	}, nil
+}
+
+// Encrypts the event, padded, with the next key of the chat. For double ratchet chats the sending chain is moved
+// forward right away, for hash chain chats the caller advances the chat with CommitSentEvent
+func encryptEvent(chat *cli_proto.Chat, event *cli_proto.ClientEvent) ([]byte, error) {
+	raw, err := marshalPadded(event)
+	if err != nil {
+		return nil, err
+	}
+
+	if !usesDoubleRatchet(chat) {
+		return sealMessage(chat, chat.Key, raw, event.Serial)
+	}
+
+	state := save.RatchetState(chat)
+	env, err := ratchetEncrypt(state, raw, messageAD(chat, event.Serial))
+	if err != nil {
+		return nil, err
+	}
+	encRaw, err := marshalEnvelope(env)
+	if err != nil {
+		return nil, err
+	}
+	save.SetRatchet(chat, state)
+	return encRaw, nil
+}
+
+// Saves an event sent by this client, moving the chat to the next serial
+func CommitSentEvent(chat *cli_proto.Chat, event *cli_proto.ClientEvent) {
+	if usesDoubleRatchet(chat) {
+		save.NewEvent(chat, chat.CurrentSerial+1, chat.Key, event)
+		return
+	}
+	save.NewEvent(chat, chat.CurrentSerial+1, Ratchet(chat.Key), event)
+}
+
+// Bytes covered by the sender's signature: the event without it or its padding, marshalled deterministically so the receiver
+// can reproduce them from the saved event
+func SignedEventBytes(event *cli_proto.ClientEvent) ([]byte, error) {
+	unsigned := proto.Clone(event).(*cli_proto.ClientEvent)
+	unsigned.Signature = nil
+	unsigned.Padding = nil
+	return proto.MarshalOptions{Deterministic: true}.Marshal(unsigned)
+}
+
+// Signs the event for the receiver with the key of the user's certificate. Left unsigned if there is none
+func signEvent(event *cli_proto.ClientEvent, receiver string) error {
+	privK, ok := GetCertificate().PrivateKey.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil
+	}
+	raw, err := SignedEventBytes(event)
+	if err != nil {
+		return err
+	}
+	event.Signature, err = common.SignEvent(privK, receiver, raw)
+	return err
 }
 
 func EncryptMessageForPeer(chat *cli_proto.Chat, txt string) (*server.SendMsg, *cli_proto.ClientEvent, error) {
@@ -62,24 +251,139 @@ func EncryptMessageForPeer(chat *cli_proto.Chat, txt string) (*server.SendMsg, *
 			},
 		},
 	}
-	raw, err := proto.Marshal(event)
+	err := signEvent(event, chat.Peer.Username)
+	if err != nil {
+		return nil, nil, err
+	}
+	encRaw, err := encryptEvent(chat, event)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	msg, err := addressSend(chat, &server.SendMsg{
+		Serial:  chat.CurrentSerial,
+		Message: encRaw,
+	}, event.Timestamp)
+	if err != nil {
+		return nil, nil, err
+	}
+	return msg, event, nil
+}
+
+func EncryptReceiptForPeer(chat *cli_proto.Chat, receiptType cli_proto.ReceiptType, serials []uint64) (*server.SendMsg, *cli_proto.ClientEvent, error) {
+	event := &cli_proto.ClientEvent{
+		Timestamp: uint64(time.Now().UTC().Unix()),
+		Serial:    chat.CurrentSerial,
+		Sender:    GetUsername(),
+		Payload: &cli_proto.ClientEvent_Receipt{
+			Receipt: &cli_proto.Receipt{
+				Type:    receiptType,
+				Serials: serials,
+			},
+		},
+	}
+	encRaw, err := encryptEvent(chat, event)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	encRaw, err := common.Encrypt(raw, chat.Key)
+	msg, err := addressSend(chat, &server.SendMsg{
+		Serial:  chat.CurrentSerial,
+		Message: encRaw,
+	}, event.Timestamp)
 	if err != nil {
 		return nil, nil, err
 	}
+	return msg, event, nil
+}
+
+// Tells the peer its messages arrived or were read. Receipts are end to end encrypted like any other event.
+// Hash chain chats share a single chain between both ends, a receipt crossing a message of the peer would take
+// its serial and make it unreadable, so they get none
+func SendReceipt(chat *cli_proto.Chat, receiptType cli_proto.ReceiptType, serials []uint64) error {
+	if len(serials) == 0 || !usesDoubleRatchet(chat) {
+		return nil
+	}
+	defer lockChat(chat)()
+	encMsg, event, err := EncryptReceiptForPeer(chat, receiptType, serials)
+	if err != nil {
+		return err
+	}
+	err = GetChatClient().SendMsg(encMsg)
+	if err != nil {
+		return err
+	}
+	CommitSentEvent(chat, event)
+	return nil
+}
+
+// Encrypts, sends and saves a message for the peer, followed by a key rotation when it's this client's turn.
+// Returns the events sent
+func SendMessage(chat *cli_proto.Chat, txt string) ([]*cli_proto.ClientEvent, error) {
+	defer lockChat(chat)()
+	encMsg, event, err := EncryptMessageForPeer(chat, txt)
+	if err != nil {
+		return nil, err
+	}
+	err = GetChatClient().SendMsg(encMsg)
+	if err != nil {
+		return nil, err
+	}
+	CommitSentEvent(chat, event)
+	sent := []*cli_proto.ClientEvent{event}
+
+	if !KeyExchNeeded(chat) {
+		return sent, nil
+	}
+	log.Printf("Sending key exchange on send. Current serial = %v, first message = %v. Frequency = %v", chat.CurrentSerial, chat.SerialStart, MLKEM_RATCHET_INTERVAL)
+	kevent, err := sendKeyExchange(chat)
+	if err != nil {
+		return sent, err
+	}
+	return append(sent, kevent), nil
+}
+
+// Sends a new ML-KEM key for a hash chain chat and moves the chat to it. The caller holds the chat's lock
+func sendKeyExchange(chat *cli_proto.Chat) (*cli_proto.ClientEvent, error) {
+	encapKey, err := getEncap(chat)
+	if err != nil {
+		return nil, err
+	}
+	encMsg, kevent, key, err := KeyExchangeEvent(chat, encapKey)
+	if err != nil {
+		return nil, err
+	}
+	err = GetChatClient().SendMsg(encMsg)
+	if err != nil {
+		return nil, err
+	}
+	save.NewEvent(chat, chat.CurrentSerial+1, key, kevent)
+	return kevent, nil
+}
 
-	return &server.SendMsg{
-		Serial:   chat.CurrentSerial,
-		Receiver: chat.Peer.Username,
-		InboxId:  chat.Peer.InboxId,
-		Message:  encRaw,
-	}, event, nil
+func receiptStatus(receiptType cli_proto.ReceiptType) cli_proto.MessageStatus {
+	switch receiptType {
+	case cli_proto.ReceiptType_RECEIPT_DELIVERED:
+		return cli_proto.MessageStatus_STATUS_DELIVERED
+	case cli_proto.ReceiptType_RECEIPT_READ:
+		return cli_proto.MessageStatus_STATUS_READ
+	}
+	return cli_proto.MessageStatus_STATUS_PENDING
+}
+
+func deliveryStatus(status server.DeliveryStatus) cli_proto.MessageStatus {
+	switch status {
+	case server.DeliveryStatus_DELIVERY_RELAYED:
+		return cli_proto.MessageStatus_STATUS_RELAYED
+	case server.DeliveryStatus_DELIVERY_STORED:
+		return cli_proto.MessageStatus_STATUS_STORED
+	case server.DeliveryStatus_DELIVERY_FAILED, server.DeliveryStatus_DELIVERY_RATE_LIMITED:
+		return cli_proto.MessageStatus_STATUS_FAILED
+	}
+	return cli_proto.MessageStatus_STATUS_PENDING
 }
 
+// ML-KEM key rotation for hash chain chats. Double ratchet chats rotate on every reply
 func KeyExchangeEvent(chat *cli_proto.Chat, encapKey *mlkem.EncapsulationKey1024) (*server.SendMsg, *cli_proto.ClientEvent, []byte, error) {
 	key, cipherText := encapKey.Encapsulate()
 	event := &cli_proto.ClientEvent{
@@ -93,18 +397,20 @@ func KeyExchangeEvent(chat *cli_proto.Chat, encapKey *mlkem.EncapsulationKey1024
 			},
 		},
 	}
-	raw, err := proto.Marshal(event)
+	raw, err := marshalPadded(event)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	encRaw, err := sealMessage(chat, chat.Key, raw, event.Serial)
 	if err != nil {
 		return nil, nil, nil, err
 	}
-	encRaw, err := common.Encrypt(raw, chat.Key)
+	msg, err := addressSend(chat, &server.SendMsg{
+		Serial:  chat.CurrentSerial,
+		Message: encRaw,
+	}, event.Timestamp)
 	if err != nil {
 		return nil, nil, nil, err
 	}
-	return &server.SendMsg{
-		Serial:   chat.CurrentSerial,
-		Receiver: chat.Peer.Username,
-		InboxId:  chat.Peer.InboxId,
-		Message:  encRaw,
-	}, event, key, nil
+	return msg, event, key, nil
 }
@@ -1,56 +1,25 @@
 package service
 
 import (
-	"bytes"
 	"crypto"
 	"crypto/ecdsa"
 	"crypto/mlkem"
 	"crypto/rand"
+	"encoding/base64"
 	"encoding/binary"
 	"errors"
 	"fmt"
-	"io"
 	"net/http"
-	"sort"
 
 	cli_proto "github.com/as283-ua/yappa/api/gen/client"
 	"github.com/as283-ua/yappa/api/gen/server"
-	"github.com/as283-ua/yappa/internal/client/settings"
+	"github.com/as283-ua/yappa/internal/client/save"
 	"github.com/as283-ua/yappa/pkg/common"
 	"github.com/quic-go/quic-go/http3"
 	"google.golang.org/protobuf/proto"
 )
 
-func (c *ChatClient) initChat() ([]byte, error) {
-	url := fmt.Sprintf("https://%v/chat/init", settings.CliSettings.ServerHost)
-
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return nil, err
-	}
-
-	resp, err := c.client.Do(req)
-	if err != nil {
-		return nil, handleHttpErrors(err)
-	}
-	defer resp.Body.Close()
-
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
-	}
-
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("%v", string(body))
-	}
-	chatInit := &server.ChatInit{}
-	err = proto.Unmarshal(body, chatInit)
-	if err != nil {
-		return nil, err
-	}
-
-	return chatInit.InboxId, nil
-}
+var errInboxNotFound = errors.New("inbox not found")
 
 func (c *ChatClient) notifyNewChat(notify *server.ChatInitNotify) error {
 	raw, err := proto.Marshal(notify)
@@ -58,40 +27,52 @@ func (c *ChatClient) notifyNewChat(notify *server.ChatInitNotify) error {
 		return err
 	}
 
-	url := fmt.Sprintf("https://%v/chat/notify", settings.CliSettings.ServerHost)
-
-	req, err := http.NewRequest("POST", url, bytes.NewReader(raw))
-	if err != nil {
-		return err
-	}
-
-	resp, err := c.client.Do(req)
-	if err != nil {
-		return handleHttpErrors(err)
-	}
-	defer resp.Body.Close()
-
-	return nil
+	_, err = request(c.client, apiCall{
+		rpc:    server.RpcMethod_RPC_CHAT_NOTIFY,
+		method: http.MethodPost,
+		path:   "/chat/notify",
+		body:   raw,
+	})
+	return err
 }
 
-func chatData(peer *server.UserData, inboxId []byte) (*cli_proto.Chat, []byte, error) {
+// Returns the new chat along with the shared secret and the ML-KEM ciphertext the peer needs to obtain it
+func ChatData(peer *server.UserData, inboxId []byte) (*cli_proto.Chat, []byte, []byte, error) {
 	encapKey, err := mlkem.NewEncapsulationKey1024(peer.PubKeyExchange)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, nil, err
 	}
 	key, keyExchData := encapKey.Encapsulate()
 
 	var serialBytes [8]byte
 	_, err = rand.Read(serialBytes[:])
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, nil, err
 	}
 	serial := binary.LittleEndian.Uint64(serialBytes[:])
+
+	ratchet, err := newInitiatorRatchet(key, inboxId)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	ephemeralKey, err := common.DeriveKey(key, common.LabelEphemeralEvent, inboxId)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	inboxSecret, err := common.DeriveKey(key, common.LabelInboxSecret, inboxId)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
 	chat := &cli_proto.Chat{
 		Events:        make([]*cli_proto.ClientEvent, 0),
 		SerialStart:   serial,
 		CurrentSerial: serial,
-		Key:           key,
+		Version:       CHAT_VERSION_SEALED_INBOX,
+		Ratchet:       ratchet,
+		EphemeralKey:  ephemeralKey,
+		InboxSecret:   inboxSecret,
+		InboxEpoch:    currentEpoch() - 1,
 		Peer: &cli_proto.PeerData{
 			Username:    peer.Username,
 			KeyExchange: peer.PubKeyExchange,
@@ -100,18 +81,55 @@ func chatData(peer *server.UserData, inboxId []byte) (*cli_proto.Chat, []byte, e
 		},
 		Initiator: GetUsername(),
 	}
-	return chat, keyExchData, nil
+	return chat, key, keyExchData, nil
+}
+
+// Each field of an invitation is encrypted with its own key derived from the shared secret and the key
+// exchange it came from, and is bound to its label, the receiver and the chat version, so fields can't be
+// swapped between each other or between invitations, nor the invitation passed off as an older version
+type invite struct {
+	secret      []byte
+	keyExchData []byte
+	receiver    string
+	version     uint32
+}
+
+func (i invite) ad(label string) common.AssociatedData {
+	return common.AssociatedData{
+		Version: i.version,
+		Label:   label,
+		Context: []byte(i.receiver),
+	}
+}
+
+func (i invite) seal(label string, data []byte) ([]byte, error) {
+	fieldKey, err := common.DeriveKey(i.secret, label, i.keyExchData)
+	if err != nil {
+		return nil, err
+	}
+	return common.Seal(fieldKey, data, i.ad(label))
+}
+
+func (i invite) open(label string, data []byte) ([]byte, error) {
+	fieldKey, err := common.DeriveKey(i.secret, label, i.keyExchData)
+	if err != nil {
+		return nil, err
+	}
+	return common.Open(fieldKey, data, i.ad(label))
 }
 
-func encryptChatData(peername string, sendername string, serial uint64, inboxId, key, keyExchData []byte, privSignKey *ecdsa.PrivateKey) (*server.ChatInitNotify, error) {
+// Builds the invitation of a new chat for peername, opened on their end with OpenInvitation
+func EncryptChatData(peername string, sendername string, serial uint64, inboxId, key, keyExchData, ratchetKey []byte, privSignKey *ecdsa.PrivateKey) (*server.ChatInitNotify, error) {
+	inv := invite{secret: key, keyExchData: keyExchData, receiver: peername, version: CHAT_VERSION_SEALED_INBOX}
+
 	serialB := make([]byte, 8)
 	binary.LittleEndian.PutUint64(serialB[:], serial)
-	encSerial, err := common.Encrypt(serialB, key)
+	encSerial, err := inv.seal(common.LabelInviteSerial, serialB)
 	if err != nil {
 		return nil, err
 	}
 
-	encSender, err := common.Encrypt([]byte(sendername), key)
+	encSender, err := inv.seal(common.LabelInviteSender, []byte(sendername))
 	if err != nil {
 		return nil, err
 	}
@@ -120,12 +138,17 @@ func encryptChatData(peername string, sendername string, serial uint64, inboxId,
 	if err != nil {
 		return nil, err
 	}
-	encSign, err := common.Encrypt(signature, key)
+	encSign, err := inv.seal(common.LabelInviteSignature, signature)
+	if err != nil {
+		return nil, err
+	}
+
+	encInboxId, err := inv.seal(common.LabelInviteInboxId, inboxId)
 	if err != nil {
 		return nil, err
 	}
 
-	encInboxId, err := common.Encrypt(inboxId, key)
+	encRatchetKey, err := inv.seal(common.LabelInviteRatchetKey, ratchetKey)
 	if err != nil {
 		return nil, err
 	}
@@ -137,22 +160,27 @@ func encryptChatData(peername string, sendername string, serial uint64, inboxId,
 		EncSignature:    encSign,
 		EncInboxId:      encInboxId,
 		KeyExchangeData: keyExchData,
+		EncRatchetKey:   encRatchetKey,
+		Version:         CHAT_VERSION_SEALED_INBOX,
 	}
 
 	return notify, nil
 }
 
+// Starts a chat with the peer. Its id is only ever sent inside the invitation, the server sees the inboxes
+// derived from it instead
 func (c *ChatClient) NewChat(peer *server.UserData) (*cli_proto.Chat, error) {
-	inboxId, err := c.initChat()
+	inboxId := make([]byte, 32)
+	_, err := rand.Read(inboxId)
 	if err != nil {
 		return nil, err
 	}
-	chat, keyExchData, err := chatData(peer, inboxId)
+	chat, key, keyExchData, err := ChatData(peer, inboxId)
 	if err != nil {
 		return nil, err
 	}
 
-	t, ok := c.client.Transport.(*http3.Transport)
+	t, ok := c.client.Transport.(*common.SharedTransport)
 	if !ok {
 		return nil, errors.New("http transport retrieve error")
 	}
@@ -169,7 +197,7 @@ func (c *ChatClient) NewChat(peer *server.UserData) (*cli_proto.Chat, error) {
 		return nil, errors.New("private key is not of expected type ECDSA")
 	}
 
-	chatNotify, err := encryptChatData(chat.Peer.Username, clientName, chat.CurrentSerial, inboxId, chat.Key, keyExchData, privK)
+	chatNotify, err := EncryptChatData(chat.Peer.Username, clientName, chat.CurrentSerial, inboxId, key, keyExchData, chat.Ratchet.DhPub, privK)
 	if err != nil {
 		return nil, fmt.Errorf("failed to encrypt data for chat notification: %w", err)
 	}
@@ -182,26 +210,13 @@ func (c *ChatClient) NewChat(peer *server.UserData) (*cli_proto.Chat, error) {
 }
 
 func (c *ChatClient) fetchNewChats() (*server.ListNewChats, error) {
-	url := fmt.Sprintf("https://%v/chat/new", settings.CliSettings.ServerHost)
-
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return nil, err
-	}
-
-	resp, err := c.client.Do(req)
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return nil, errors.New("failed to retrieve new chats: " + resp.Status)
-	}
-
-	data, err := io.ReadAll(resp.Body)
+	data, err := request(c.client, apiCall{
+		rpc:    server.RpcMethod_RPC_CHAT_NEW,
+		method: http.MethodGet,
+		path:   "/chat/new",
+	})
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("failed to retrieve new chats: %w", err)
 	}
 
 	chats := &server.ListNewChats{}
@@ -214,90 +229,201 @@ func (c *ChatClient) fetchNewChats() (*server.ListNewChats, error) {
 }
 
 func (c *ChatClient) fetchChatToken(inboxId []byte) (*server.InboxToken, error) {
-	url := fmt.Sprintf("https://%v/chat/token", settings.CliSettings.ServerHost)
+	data, err := request(c.client, apiCall{
+		rpc: server.RpcMethod_RPC_CHAT_TOKEN,
+		// read only, so it may go out as 0-RTT data when resuming a connection
+		method: http3.MethodGet0RTT,
+		path:   "/chat/token",
+		params: map[string]string{"inbox": base64.RawURLEncoding.EncodeToString(inboxId)},
+	})
+	if rpcCode(err) == server.RpcErrorCode_RPC_NOT_FOUND {
+		return nil, errInboxNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to retrieve chat token: %w", err)
+	}
 
-	req, err := http.NewRequest("POST", url, bytes.NewReader(inboxId))
+	token := &server.InboxToken{}
+	err = proto.Unmarshal(data, token)
 	if err != nil {
 		return nil, err
 	}
-	req.Header.Set("Content-Type", "application/octet-stream")
 
-	resp, err := c.client.Do(req)
+	return token, nil
+}
+
+// Messages asked for per page when retrieving an inbox
+const MESSAGES_PAGE_SIZE = 100
+
+// Most serials the server checks for expiry in a single request
+const MAX_EXPIRED_CHECK = 1000
+
+// Most derived inboxes of a sealed chat gone through in a single retrieval. Each takes at least a request, a
+// client back after a long while would run out of the server's rate limit otherwise
+const MAX_CATCH_UP_EPOCHS = 20
+
+func (c *ChatClient) fetchNewMessages(inboxId, token, page []byte) (*server.ListNewMessages, error) {
+	getMsgs := &server.GetNewMessages{
+		InboxId:  inboxId,
+		Token:    token,
+		Page:     page,
+		PageSize: MESSAGES_PAGE_SIZE,
+	}
+	payload, err := proto.Marshal(getMsgs)
 	if err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode == http.StatusNotFound {
-		return nil, errors.New("inbox not found")
-	} else if resp.StatusCode != http.StatusOK {
-		return nil, errors.New("failed to retrieve chat token: " + resp.Status)
+	data, err := request(c.client, apiCall{
+		rpc:    server.RpcMethod_RPC_CHAT_MESSAGES,
+		method: http.MethodPost,
+		path:   "/chat/messages",
+		body:   payload,
+	})
+	if err != nil {
+		switch rpcCode(err) {
+		case server.RpcErrorCode_RPC_NOT_FOUND:
+			return nil, errInboxNotFound
+		case server.RpcErrorCode_RPC_UNAUTHORIZED:
+			return nil, errors.New("bad token")
+		case server.RpcErrorCode_RPC_BAD_REQUEST:
+			return nil, errors.New("incorrect body format")
+		default:
+			return nil, fmt.Errorf("failed to retrieve new messages: %w", err)
+		}
 	}
 
-	data, err := io.ReadAll(resp.Body)
+	msgs := &server.ListNewMessages{}
+	err = proto.Unmarshal(data, msgs)
 	if err != nil {
 		return nil, err
 	}
 
-	token := &server.InboxToken{}
-	err = proto.Unmarshal(data, token)
+	return msgs, nil
+}
+
+func (c *ChatClient) ackMessages(inboxId, token []byte, cursor uint64) error {
+	payload, err := proto.Marshal(&server.AckMessages{
+		InboxId: inboxId,
+		Token:   token,
+		Cursor:  cursor,
+	})
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	return token, nil
+	_, err = request(c.client, apiCall{
+		rpc:    server.RpcMethod_RPC_CHAT_ACK,
+		method: http.MethodPost,
+		path:   "/chat/messages/ack",
+		body:   payload,
+	})
+	if err != nil {
+		switch rpcCode(err) {
+		case server.RpcErrorCode_RPC_NOT_FOUND:
+			return errInboxNotFound
+		case server.RpcErrorCode_RPC_UNAUTHORIZED:
+			return errors.New("bad token")
+		default:
+			return fmt.Errorf("failed to acknowledge messages: %w", err)
+		}
+	}
+	return nil
 }
 
-func (c *ChatClient) fetchNewMessages(inboxId, token []byte) (*server.ListNewMessages, error) {
-	url := fmt.Sprintf("https://%v/chat/messages", settings.CliSettings.ServerHost)
-
-	getMsgs := &server.GetNewMessages{
+// Which of the messages this client stored in the peer's inbox expired before the peer fetched them
+func (c *ChatClient) GetExpiredMessages(inboxId, token []byte, serials []uint64) ([]uint64, error) {
+	payload, err := proto.Marshal(&server.CheckExpired{
 		InboxId: inboxId,
+		Serials: serials,
 		Token:   token,
-	}
-	payload, err := proto.Marshal(getMsgs)
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	req, err := http.NewRequest("POST", url, bytes.NewReader(payload))
+	data, err := request(c.client, apiCall{
+		rpc:    server.RpcMethod_RPC_CHAT_EXPIRED,
+		method: http.MethodPost,
+		path:   "/chat/expired",
+		body:   payload,
+	})
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("failed to check expired messages: %w", err)
 	}
-	req.Header.Set("Content-Type", "application/octet-stream")
 
-	resp, err := c.client.Do(req)
+	expired := &server.ExpiredMessages{}
+	err = proto.Unmarshal(data, expired)
 	if err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
+	return expired.Serials, nil
+}
+
+// Fields of an invitation, once opened with the shared secret
+type Invitation struct {
+	InboxId []byte
+	Sender  string
+	Serial  uint64
+	// signature of the sender over the inbox id and key of its double ratchet. Missing in legacy invitations
+	Signature  []byte
+	RatchetKey []byte
+}
 
-	switch resp.StatusCode {
-	case http.StatusOK:
-	case http.StatusNotFound:
-		return nil, errors.New("inbox not found")
-	case http.StatusUnauthorized:
-		return nil, errors.New("bad token")
-	case http.StatusBadRequest:
-		return nil, errors.New("incorrect body format")
+// Opens an invitation addressed to receiver with the shared secret of its key exchange. Invitations carry a
+// version since CHAT_VERSION_KEY_SEPARATION, those without one come from clients that encrypted each field with
+// the shared secret itself, to start a hash chain chat
+func OpenInvitation(chat *server.NewChat, receiver string, key []byte) (*Invitation, error) {
+	var open func(label string, data []byte) ([]byte, error)
+	switch chat.Version {
+	case 0:
+		open = func(_ string, data []byte) ([]byte, error) {
+			return common.Decrypt(data, key)
+		}
+	case CHAT_VERSION_KEY_SEPARATION, CHAT_VERSION_SEALED_INBOX:
+		open = invite{secret: key, keyExchData: chat.KeyExchangeData, receiver: receiver, version: chat.Version}.open
 	default:
-		return nil, errors.New("failed to retrieve new messages: " + resp.Status)
+		// the server already deleted it, the sender has to invite again
+		return nil, fmt.Errorf("invitation of unsupported version %v lost, update the client", chat.Version)
 	}
 
-	data, err := io.ReadAll(resp.Body)
+	inboxId, err := open(common.LabelInviteInboxId, chat.EncInboxCode)
 	if err != nil {
 		return nil, err
 	}
-
-	msgs := &server.ListNewMessages{}
-	err = proto.Unmarshal(data, msgs)
+	sender, err := open(common.LabelInviteSender, chat.EncSender)
+	if err != nil {
+		return nil, err
+	}
+	serialB, err := open(common.LabelInviteSerial, chat.EncSerial)
 	if err != nil {
 		return nil, err
 	}
+	if len(serialB) != 8 {
+		return nil, errors.New("malformed invitation serial")
+	}
+	inv := &Invitation{
+		InboxId: inboxId,
+		Sender:  string(sender),
+		Serial:  binary.LittleEndian.Uint64(serialB),
+	}
+	if chat.Version == 0 {
+		return inv, nil
+	}
 
-	return msgs, nil
+	inv.Signature, err = open(common.LabelInviteSignature, chat.EncSign)
+	if err != nil {
+		return nil, err
+	}
+	inv.RatchetKey, err = open(common.LabelInviteRatchetKey, chat.EncRatchetKey)
+	if err != nil {
+		return nil, err
+	}
+	return inv, nil
 }
 
+// Opens the invitations waiting on the server. Invitations that can't be opened or whose signature doesn't
+// match their sender are left out and reported in the error. Legacy invitations aren't signed, only the name
+// they carry vouches for their sender
 func (c *ChatClient) GetNewChats() ([]*cli_proto.Chat, error) {
 	chats, err := c.fetchNewChats()
 	if err != nil {
@@ -311,44 +437,103 @@ func (c *ChatClient) GetNewChats() ([]*cli_proto.Chat, error) {
 			errs.Errors = append(errs.Errors, err)
 			continue
 		}
-		inboxId, err := common.Decrypt(chat.EncInboxCode, key)
+		inv, err := OpenInvitation(chat, GetUsername(), key)
 		if err != nil {
 			errs.Errors = append(errs.Errors, err)
 			continue
 		}
-		sender, err := common.Decrypt(chat.EncSender, key)
+		userData, err := UsersClient{Client: c.client}.GetUserData(inv.Sender)
 		if err != nil {
 			errs.Errors = append(errs.Errors, err)
 			continue
 		}
-		serialB, err := common.Decrypt(chat.EncSerial, key)
+		if chat.Version != 0 {
+			err = VerifyInviteSignature(rootCAs, inv.Sender, []byte(userData.Certificate), inv.InboxId, inv.Signature)
+			if err != nil {
+				errs.Errors = append(errs.Errors, err)
+				continue
+			}
+		}
+		newChat, err := InvitedChat(chat, inv, key, userData)
 		if err != nil {
 			errs.Errors = append(errs.Errors, err)
 			continue
 		}
+		newChats = append(newChats, newChat)
+	}
+
+	return newChats, errs.NilOrError()
+}
 
-		serial := binary.LittleEndian.Uint64(serialB[:])
-		userData, err := UsersClient{Client: c.client}.GetUserData(string(sender))
+// Chat of an opened invitation from sender, the responder's end of the chat ChatData started
+func InvitedChat(chat *server.NewChat, inv *Invitation, key []byte, sender *server.UserData) (*cli_proto.Chat, error) {
+	newChat := &cli_proto.Chat{
+		Events:        make([]*cli_proto.ClientEvent, 0),
+		SerialStart:   inv.Serial,
+		CurrentSerial: inv.Serial,
+		Version:       chat.Version,
+		Peer: &cli_proto.PeerData{
+			Username:    sender.Username,
+			KeyExchange: sender.PubKeyExchange,
+			Cert:        []byte(sender.Certificate),
+			InboxId:     inv.InboxId,
+		},
+		Initiator: sender.Username,
+	}
+	if chat.Version == 0 {
+		newChat.Key = key
+		return newChat, nil
+	}
+
+	peerEncap, err := mlkem.NewEncapsulationKey1024(sender.PubKeyExchange)
+	if err != nil {
+		return nil, err
+	}
+	newChat.Ratchet, err = newResponderRatchet(key, inv.InboxId, inv.RatchetKey, peerEncap)
+	if err != nil {
+		return nil, err
+	}
+	newChat.EphemeralKey, err = common.DeriveKey(key, common.LabelEphemeralEvent, inv.InboxId)
+	if err != nil {
+		return nil, err
+	}
+	if chat.Version == CHAT_VERSION_SEALED_INBOX {
+		newChat.InboxSecret, err = common.DeriveKey(key, common.LabelInboxSecret, inv.InboxId)
 		if err != nil {
-			errs.Errors = append(errs.Errors, err)
-			continue
+			return nil, err
 		}
-		newChats = append(newChats, &cli_proto.Chat{
-			Events:        make([]*cli_proto.ClientEvent, 0),
-			SerialStart:   serial,
-			CurrentSerial: serial,
-			Key:           key,
-			Peer: &cli_proto.PeerData{
-				Username:    userData.Username,
-				KeyExchange: userData.PubKeyExchange,
-				Cert:        []byte(userData.Certificate),
-				InboxId:     inboxId,
-			},
-			Initiator: userData.Username,
-		})
+		// the sender may have written before the server got the invitation
+		newChat.InboxEpoch = InboxEpoch(chat.CreatedAt) - 1
 	}
+	return newChat, nil
+}
 
-	return newChats, errs.NilOrError()
+func openInboxToken(tokenObj *server.InboxToken, inboxId []byte) ([]byte, error) {
+	secret, err := GetMlkemDecap().Decapsulate(tokenObj.KeyExchangeData)
+	if err != nil {
+		// probably the other user's still unretrieved messages
+		return nil, err
+	}
+	ad := common.AssociatedData{
+		Version: common.PROTOCOL_VERSION,
+		Label:   common.LabelInboxToken,
+		InboxId: inboxId,
+	}
+	key, err := common.DeriveKey(secret, common.LabelInboxToken, inboxId)
+	if err != nil {
+		return nil, err
+	}
+	token, err := common.Open(key, tokenObj.EncToken, ad)
+	if err != nil {
+		// tokens the server set before deriving its keys are sealed with the secret itself. they stay until
+		// the inbox is emptied, so keep accepting them
+		var legacyErr error
+		token, legacyErr = common.Open(secret, tokenObj.EncToken, ad)
+		if legacyErr != nil {
+			return nil, err
+		}
+	}
+	return token, nil
 }
 
 type EventWithMetadata struct {
@@ -356,42 +541,96 @@ type EventWithMetadata struct {
 	Serial uint64
 }
 
-func (c *ChatClient) GetNewMessages(saveState *cli_proto.SaveState) (map[*cli_proto.Chat][]*server.Message, error) {
+// Streams the messages stored in every chat's inbox to apply. See StreamChatMessages
+func (c *ChatClient) GetNewMessages(saveState *cli_proto.SaveState, apply func(chat *cli_proto.Chat, msgs []*server.Message)) error {
 	errs := common.MultiError{Errors: make([]error, 0)}
-	chats := make(map[*cli_proto.Chat][]*server.Message)
 	for _, chat := range saveState.Chats {
-		tokenObj, err := c.fetchChatToken(chat.Peer.InboxId)
+		err := c.StreamChatMessages(chat, func(msgs []*server.Message) {
+			apply(chat, msgs)
+		})
 		if err != nil {
 			errs.Errors = append(errs.Errors, err)
-			continue
 		}
-		if len(tokenObj.KeyExchangeData) == 0 {
-			// nothing new to retrieve
-			continue
+	}
+	return errs.NilOrError()
+}
+
+// Retrieves the messages stored in the chat's inbox a page at a time, in the order the server stored them, which
+// is not always serial order. Each page is handed to apply and then acknowledged, so the server deletes it. On
+// error, the pages already applied stay acknowledged.
+// Sealed chats go through the inbox of every epoch since the last retrieval
+func (c *ChatClient) StreamChatMessages(chat *cli_proto.Chat, apply func(msgs []*server.Message)) error {
+	if sealed(chat) {
+		return c.streamSealedInboxes(chat, apply)
+	}
+	tokenObj, err := c.fetchChatToken(chat.Peer.InboxId)
+	if errors.Is(err, errInboxNotFound) {
+		// emptied inboxes are deleted, the next message creates it again
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if len(tokenObj.KeyExchangeData) == 0 {
+		// nothing new to retrieve
+		return nil
+	}
+	token, err := openInboxToken(tokenObj, chat.Peer.InboxId)
+	if err != nil {
+		// corrupt token, or probably the other user's still unretrieved messages
+		return err
+	}
+	return c.streamInbox(chat.Peer.InboxId, token, apply)
+}
+
+// Derived inboxes only exist on the server while they hold messages. The epoch before the current one is
+// kept as the next starting point, the peer may still be writing to it. Chats further behind than
+// MAX_CATCH_UP_EPOCHS only go through that many, the rest is left for the next retrieval, see CatchUpBehind
+func (c *ChatClient) streamSealedInboxes(chat *cli_proto.Chat, apply func(msgs []*server.Message)) error {
+	current := currentEpoch()
+	from := save.InboxEpoch(chat)
+	last := min(current+1, from+MAX_CATCH_UP_EPOCHS-1)
+	for epoch := from; epoch <= last; epoch++ {
+		inboxId, err := DerivedInboxId(chat, GetUsername(), epoch)
+		if err != nil {
+			return err
 		}
-		tokenKey, err := GetMlkemDecap().Decapsulate(tokenObj.KeyExchangeData)
+		token, err := derivedInboxToken(chat, inboxId)
 		if err != nil {
-			// probably the other user's still unretrieved messages
-			errs.Errors = append(errs.Errors, err)
-			continue
+			return err
+		}
+		err = c.streamInbox(inboxId, token, apply)
+		if err != nil && !errors.Is(err, errInboxNotFound) {
+			return err
 		}
-		token, err := common.Decrypt(tokenObj.EncToken, tokenKey)
+	}
+	if last < current+1 {
+		save.SetInboxEpoch(chat, last+1)
+		return nil
+	}
+	save.SetInboxEpoch(chat, max(from, current-1))
+	return nil
+}
+
+func (c *ChatClient) streamInbox(inboxId, token []byte, apply func(msgs []*server.Message)) error {
+	var page []byte
+	for {
+		messages, err := c.fetchNewMessages(inboxId, token, page)
 		if err != nil {
-			// corrupt token
-			errs.Errors = append(errs.Errors, err)
-			continue
+			return err
+		}
+		if len(messages.Msgs) == 0 {
+			return nil
 		}
 
-		messages, err := c.fetchNewMessages(chat.Peer.InboxId, token)
+		apply(messages.Msgs)
+		err = c.ackMessages(inboxId, token, messages.Cursor)
 		if err != nil {
-			errs.Errors = append(errs.Errors, err)
-			continue
+			return err
 		}
 
-		sort.Slice(messages.Msgs, func(i, j int) bool {
-			return messages.Msgs[i].Serial < messages.Msgs[j].Serial
-		})
-		chats[chat] = messages.Msgs
+		if len(messages.NextPage) == 0 {
+			return nil
+		}
+		page = messages.NextPage
 	}
-	return chats, errs.NilOrError()
 }
@@ -0,0 +1,126 @@
+package service
+
+import (
+	"crypto/rand"
+	"log"
+	mrand "math/rand/v2"
+	"time"
+
+	"github.com/as283-ua/yappa/api/gen/server"
+	"github.com/as283-ua/yappa/pkg/common"
+)
+
+// Slots are spread uniformly in [interval*(1-COVER_JITTER), interval*(1+COVER_JITTER)], so the rate is constant
+// on average without being a clock anyone can line up with
+const COVER_JITTER = 0.5
+
+// Tag and value of the cover flag, only set in dummies. Taken off their message so they are as large as a real send
+const coverFlagSize = 2
+
+// Turns on cover traffic: every interval on average, batch chat messages are written to the connection. Messages
+// sent in between are held for the next slot and slots with nothing to send are filled with dummies, which the
+// server drops. Whoever watches the connection, the server included, only learns which slot a message went out in
+// and the server also which frames were dummies. Does nothing with a zero interval
+func (c *ChatClient) StartCover(interval time.Duration, batch int) {
+	if interval <= 0 {
+		return
+	}
+	batch = max(batch, 1)
+	c.coverMu.Lock()
+	if c.covering {
+		c.coverMu.Unlock()
+		return
+	}
+	c.covering = true
+	c.coverMu.Unlock()
+
+	go func() {
+		for {
+			delay := time.Duration(float64(interval) * (1 - COVER_JITTER + 2*COVER_JITTER*mrand.Float64()))
+			select {
+			case <-time.After(delay):
+			case <-c.closed:
+				return
+			}
+			for range batch {
+				c.sendSlot()
+			}
+		}
+	}()
+}
+
+// Queues the message for the next slot if cover traffic is on
+func (c *ChatClient) hold(msg *server.ClientMessage) bool {
+	c.coverMu.Lock()
+	defer c.coverMu.Unlock()
+	if !c.covering {
+		return false
+	}
+	c.outbox = append(c.outbox, msg)
+	return true
+}
+
+// Messages still held for a slot
+func (c *ChatClient) Held() int {
+	c.coverMu.Lock()
+	defer c.coverMu.Unlock()
+	return len(c.outbox)
+}
+
+// Writes the oldest held message, or a dummy if there is none. While disconnected nothing is written and held
+// messages wait for the connection to come back
+func (c *ChatClient) sendSlot() {
+	c.connMx.RLock()
+	writer := c.writer
+	c.connMx.RUnlock()
+	if writer == nil {
+		return
+	}
+
+	c.coverMu.Lock()
+	var msg *server.ClientMessage
+	if len(c.outbox) != 0 {
+		msg = c.outbox[0]
+		c.outbox = c.outbox[1:]
+	}
+	c.coverMu.Unlock()
+
+	if msg == nil {
+		err := writer.WriteMsg(c.CoverMsg())
+		if err != nil {
+			log.Println("Cover traffic error:", err)
+		}
+		return
+	}
+	err := writer.WriteMsg(msg)
+	if err != nil {
+		log.Println("Held message couldn't be sent, retrying in the next slot:", err)
+		c.coverMu.Lock()
+		c.outbox = append([]*server.ClientMessage{msg}, c.outbox...)
+		c.coverMu.Unlock()
+	}
+}
+
+// Dummy shaped like a sealed send of a short message in a double ratchet chat, padded envelope and sender auth
+// included. Serials are random like those chats start at
+func (c *ChatClient) CoverMsg() *server.ClientMessage {
+	random := func(n int) []byte {
+		b := make([]byte, n)
+		rand.Read(b)
+		return b
+	}
+	return &server.ClientMessage{
+		Payload: &server.ClientMessage_Send{
+			Send: &server.SendMsg{
+				Serial:        mrand.Uint64(),
+				InboxId:       random(common.KEY_SIZE),
+				Message:       random(ENVELOPE_MIN_SIZE - coverFlagSize),
+				MsgId:         c.nextMsgId.Add(1),
+				InboxAuth:     random(common.HASH_SIZE),
+				DeliveryToken: random(common.KEY_SIZE),
+				SenderAuth:    random(common.HASH_SIZE),
+				Cover:         true,
+			},
+		},
+	}
+}
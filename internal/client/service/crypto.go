@@ -8,6 +8,7 @@ import (
 	"crypto/x509/pkix"
 	"encoding/pem"
 	"errors"
+	"fmt"
 	"log"
 )
 
@@ -60,3 +61,36 @@ func GenerateCSR(privateKey *ecdsa.PrivateKey, username string) ([]byte, error)
 
 	return csrPem, nil
 }
+
+var ErrBadInviteSignature = errors.New("invitation isn't signed by its sender")
+
+// Checks that the sender of an invitation signed its inbox id with the key of a certificate the CA issued to
+// the sender
+func VerifyInviteSignature(roots *x509.CertPool, sender string, certPem, inboxId, signature []byte) error {
+	block, _ := pem.Decode(certPem)
+	if block == nil {
+		return errors.New("sender certificate isn't PEM encoded")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return err
+	}
+	if cert.Subject.CommonName != sender {
+		return fmt.Errorf("certificate of %v is issued to %v", sender, cert.Subject.CommonName)
+	}
+	_, err = cert.Verify(x509.VerifyOptions{
+		Roots:     roots,
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		return fmt.Errorf("certificate of %v: %w", sender, err)
+	}
+	pubKey, ok := cert.PublicKey.(*ecdsa.PublicKey)
+	if !ok {
+		return fmt.Errorf("certificate of %v has no ECDSA key", sender)
+	}
+	if !ecdsa.VerifyASN1(pubKey, inboxId, signature) {
+		return ErrBadInviteSignature
+	}
+	return nil
+}
@@ -0,0 +1,270 @@
+package service
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/mlkem"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+
+	cli_proto "github.com/as283-ua/yappa/api/gen/client"
+	"github.com/as283-ua/yappa/internal/client/save"
+	"github.com/as283-ua/yappa/pkg/common"
+	"google.golang.org/protobuf/proto"
+)
+
+// Double ratchet (https://signal.org/docs/specifications/doubleratchet/) where every DH ratchet step also
+// mixes in a fresh ML-KEM-1024 shared secret encapsulated to the peer's long term key.
+//
+// The chat initiator sends its first ratchet key in the chat invitation and uses a bootstrap chain derived
+// from the initial shared secret until the peer replies. The responder starts with a ratchet step against
+// that key, so either side can send first. The first root and chain keys are derived from the initial shared
+// secret and the chat's inbox id, never used directly.
+
+const rootKdfInfo = "yappa double ratchet root"
+
+func kdfRoot(rootKey, dhOut, kemOut []byte) ([]byte, []byte, error) {
+	ikm := make([]byte, 0, len(dhOut)+len(kemOut))
+	ikm = append(ikm, dhOut...)
+	ikm = append(ikm, kemOut...)
+	out, err := hkdf.Key(sha256.New, ikm, rootKey, rootKdfInfo, 64)
+	if err != nil {
+		return nil, nil, err
+	}
+	return out[:32], out[32:], nil
+}
+
+// returns next chain key and message key
+func kdfChain(chainKey []byte) ([]byte, []byte) {
+	mac := hmac.New(sha256.New, chainKey)
+	mac.Write([]byte{0x01})
+	msgKey := mac.Sum(nil)
+
+	mac = hmac.New(sha256.New, chainKey)
+	mac.Write([]byte{0x02})
+	return mac.Sum(nil), msgKey
+}
+
+// returns the first root key and the initiator's bootstrap chain
+func initialKeys(secret, inboxId []byte) ([]byte, []byte, error) {
+	root, err := common.DeriveKey(secret, common.LabelRatchetRoot, inboxId)
+	if err != nil {
+		return nil, nil, err
+	}
+	chain, err := common.DeriveKey(secret, common.LabelRatchetBootstrap, inboxId)
+	if err != nil {
+		return nil, nil, err
+	}
+	return root, chain, nil
+}
+
+func newInitiatorRatchet(secret, inboxId []byte) (*cli_proto.RatchetState, error) {
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	root, chain, err := initialKeys(secret, inboxId)
+	if err != nil {
+		return nil, err
+	}
+	return &cli_proto.RatchetState{
+		RootKey:   root,
+		DhPriv:    priv.Bytes(),
+		DhPub:     priv.PublicKey().Bytes(),
+		SendChain: chain,
+	}, nil
+}
+
+func newResponderRatchet(secret, inboxId, peerDhPub []byte, peerEncap *mlkem.EncapsulationKey1024) (*cli_proto.RatchetState, error) {
+	root, chain, err := initialKeys(secret, inboxId)
+	if err != nil {
+		return nil, err
+	}
+	state := &cli_proto.RatchetState{
+		RootKey:   root,
+		PeerDhPub: peerDhPub,
+		RecvChain: chain,
+	}
+	err = ratchetSendStep(state, peerEncap)
+	if err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+func dh(priv, pub []byte) ([]byte, error) {
+	privKey, err := ecdh.X25519().NewPrivateKey(priv)
+	if err != nil {
+		return nil, err
+	}
+	pubKey, err := ecdh.X25519().NewPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+	return privKey.ECDH(pubKey)
+}
+
+// Starts a new sending chain with a fresh ratchet key
+func ratchetSendStep(state *cli_proto.RatchetState, peerEncap *mlkem.EncapsulationKey1024) error {
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	dhOut, err := dh(priv.Bytes(), state.PeerDhPub)
+	if err != nil {
+		return err
+	}
+	kemOut, kemCipherText := peerEncap.Encapsulate()
+
+	state.RootKey, state.SendChain, err = kdfRoot(state.RootKey, dhOut, kemOut)
+	if err != nil {
+		return err
+	}
+	state.DhPriv = priv.Bytes()
+	state.DhPub = priv.PublicKey().Bytes()
+	state.SendKemCiphertext = kemCipherText
+	state.PrevSendN = state.SendN
+	state.SendN = 0
+	return nil
+}
+
+// Starts a new receiving chain for the peer's new ratchet key
+func ratchetRecvStep(state *cli_proto.RatchetState, header *cli_proto.RatchetHeader, decap *mlkem.DecapsulationKey1024) error {
+	if decap == nil {
+		return errors.New("no MLKEM key is loaded")
+	}
+	dhOut, err := dh(state.DhPriv, header.DhPub)
+	if err != nil {
+		return err
+	}
+	kemOut, err := decap.Decapsulate(header.KemCiphertext)
+	if err != nil {
+		return err
+	}
+
+	state.RootKey, state.RecvChain, err = kdfRoot(state.RootKey, dhOut, kemOut)
+	if err != nil {
+		return err
+	}
+	state.PeerDhPub = header.DhPub
+	state.RecvN = 0
+	return nil
+}
+
+// Moves the receiving chain up to n, keeping the keys of the messages in between
+func ratchetSkip(state *cli_proto.RatchetState, n uint64) error {
+	if state.RecvChain == nil || n <= state.RecvN {
+		return nil
+	}
+	if n-state.RecvN > save.MAX_RATCHET_CYCLE {
+		return fmt.Errorf("message number %v exceeded MAX RATCHET CYCLE (%v) from %v", n, save.MAX_RATCHET_CYCLE, state.RecvN)
+	}
+	for state.RecvN < n {
+		var msgKey []byte
+		state.RecvChain, msgKey = kdfChain(state.RecvChain)
+		state.SkippedKeys = append(state.SkippedKeys, &cli_proto.SkippedKey{
+			Serial: state.RecvN,
+			Key:    msgKey,
+			DhPub:  state.PeerDhPub,
+		})
+		state.RecvN++
+	}
+	if len(state.SkippedKeys) > save.MAX_SKIPPED_KEYS {
+		state.SkippedKeys = state.SkippedKeys[len(state.SkippedKeys)-save.MAX_SKIPPED_KEYS:]
+	}
+	return nil
+}
+
+func takeSkippedKey(state *cli_proto.RatchetState, header *cli_proto.RatchetHeader) ([]byte, bool) {
+	for i, v := range state.SkippedKeys {
+		if v.Serial == header.N && bytes.Equal(v.DhPub, header.DhPub) {
+			state.SkippedKeys = append(state.SkippedKeys[:i], state.SkippedKeys[i+1:]...)
+			return v.Key, true
+		}
+	}
+	return nil, false
+}
+
+// Header is authenticated together with the ciphertext
+func headerAD(header *cli_proto.RatchetHeader, ad common.AssociatedData) (common.AssociatedData, error) {
+	raw, err := proto.MarshalOptions{Deterministic: true}.Marshal(header)
+	if err != nil {
+		return ad, err
+	}
+	ad.Context = raw
+	return ad, nil
+}
+
+func ratchetEncrypt(state *cli_proto.RatchetState, plaintext []byte, ad common.AssociatedData) (*cli_proto.Envelope, error) {
+	var msgKey []byte
+	state.SendChain, msgKey = kdfChain(state.SendChain)
+	header := &cli_proto.RatchetHeader{
+		DhPub:         state.DhPub,
+		KemCiphertext: state.SendKemCiphertext,
+		N:             state.SendN,
+		Pn:            state.PrevSendN,
+	}
+	state.SendN++
+
+	ad, err := headerAD(header, ad)
+	if err != nil {
+		return nil, err
+	}
+	cipherText, err := common.Seal(msgKey, plaintext, ad)
+	if err != nil {
+		return nil, err
+	}
+	return &cli_proto.Envelope{
+		Version:    CHAT_VERSION_DOUBLE_RATCHET,
+		Header:     header,
+		Ciphertext: cipherText,
+	}, nil
+}
+
+// Decrypts the envelope, modifying the state. Callers should pass a copy and only keep it if no error is returned
+func ratchetDecrypt(state *cli_proto.RatchetState, env *cli_proto.Envelope, ad common.AssociatedData, decap *mlkem.DecapsulationKey1024, peerEncap *mlkem.EncapsulationKey1024) ([]byte, error) {
+	header := env.Header
+	if header == nil {
+		return nil, errors.New("missing ratchet header")
+	}
+	ad, err := headerAD(header, ad)
+	if err != nil {
+		return nil, err
+	}
+
+	if msgKey, ok := takeSkippedKey(state, header); ok {
+		return common.Open(msgKey, env.Ciphertext, ad)
+	}
+
+	if !bytes.Equal(header.DhPub, state.PeerDhPub) {
+		err := ratchetSkip(state, header.Pn)
+		if err != nil {
+			return nil, err
+		}
+		err = ratchetRecvStep(state, header, decap)
+		if err != nil {
+			return nil, err
+		}
+		err = ratchetSendStep(state, peerEncap)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if header.N < state.RecvN {
+		return nil, fmt.Errorf("no key for message number %v, duplicate or expired message", header.N)
+	}
+	err = ratchetSkip(state, header.N)
+	if err != nil {
+		return nil, err
+	}
+	var msgKey []byte
+	state.RecvChain, msgKey = kdfChain(state.RecvChain)
+	state.RecvN++
+
+	return common.Open(msgKey, env.Ciphertext, ad)
+}
@@ -0,0 +1,193 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	cli_proto "github.com/as283-ua/yappa/api/gen/client"
+	"github.com/as283-ua/yappa/api/gen/server"
+	"github.com/as283-ua/yappa/internal/client/settings"
+	"github.com/as283-ua/yappa/pkg/common"
+)
+
+// Ephemeral events older than this are dropped, so a relayed event can't be replayed later on
+const EPHEMERAL_MAX_AGE = 30 * time.Second
+
+// Sent to chat subscribers when the peer comes online or goes offline, as told by the server's presence
+type PresenceUpdate struct {
+	InboxId []byte
+	Online  bool
+}
+
+var ErrNoEphemeralKey = errors.New("chat has no ephemeral key")
+
+// Ephemeral events are sealed with the chat's ephemeral key instead of its ratchet, so they never move the chat
+// forward and losing them costs nothing. The sender is bound instead of the serial, as there is none
+func ephemeralAD(chat *cli_proto.Chat, sender string) common.AssociatedData {
+	return common.AssociatedData{
+		Version: chat.Version,
+		Label:   common.LabelEphemeralEvent,
+		InboxId: chat.Peer.InboxId,
+		Context: []byte(sender),
+	}
+}
+
+func isEphemeral(event *cli_proto.ClientEvent) bool {
+	switch event.Payload.(type) {
+	case *cli_proto.ClientEvent_Typing, *cli_proto.ClientEvent_Online:
+		return true
+	}
+	return false
+}
+
+func EncryptEphemeralForPeer(chat *cli_proto.Chat, event *cli_proto.ClientEvent) (*server.SendMsg, error) {
+	if len(chat.EphemeralKey) == 0 {
+		return nil, ErrNoEphemeralKey
+	}
+	if !isEphemeral(event) {
+		return nil, fmt.Errorf("event %T isn't ephemeral", event.Payload)
+	}
+	raw, err := marshalPadded(event)
+	if err != nil {
+		return nil, err
+	}
+	encRaw, err := common.Seal(chat.EphemeralKey, raw, ephemeralAD(chat, event.Sender))
+	if err != nil {
+		return nil, err
+	}
+	return addressSend(chat, &server.SendMsg{
+		Message:   encRaw,
+		Ephemeral: true,
+	}, event.Timestamp)
+}
+
+func DecryptEphemeral(chat *cli_proto.Chat, msg *server.ReceiveMsg) (*cli_proto.ClientEvent, error) {
+	if len(chat.EphemeralKey) == 0 {
+		return nil, ErrNoEphemeralKey
+	}
+	raw, err := common.Open(chat.EphemeralKey, msg.EncData, ephemeralAD(chat, chat.Peer.Username))
+	if err != nil {
+		return nil, err
+	}
+	event, err := unmarshalPadded(raw)
+	if err != nil {
+		return nil, err
+	}
+	if !isEphemeral(event) {
+		return nil, fmt.Errorf("event %T isn't ephemeral", event.Payload)
+	}
+	sent := time.Unix(int64(event.Timestamp), 0)
+	if time.Since(sent) > EPHEMERAL_MAX_AGE {
+		return nil, fmt.Errorf("ephemeral event from %v is too old", sent)
+	}
+	return event, nil
+}
+
+func sendEphemeral(chat *cli_proto.Chat, payload any) error {
+	if !settings.CliSettings.Presence || len(chat.EphemeralKey) == 0 || !GetChatClient().GetConnected() {
+		return nil
+	}
+	event := &cli_proto.ClientEvent{
+		Timestamp: uint64(time.Now().UTC().Unix()),
+		Sender:    GetUsername(),
+	}
+	switch p := payload.(type) {
+	case *cli_proto.Typing:
+		event.Payload = &cli_proto.ClientEvent_Typing{Typing: p}
+	case *cli_proto.Online:
+		event.Payload = &cli_proto.ClientEvent_Online{Online: p}
+	}
+	encMsg, err := EncryptEphemeralForPeer(chat, event)
+	if err != nil {
+		return err
+	}
+	return GetChatClient().Send(&server.ClientMessage{
+		Payload: &server.ClientMessage_Send{Send: encMsg},
+	})
+}
+
+// Tells the peer this user started or stopped typing. Does nothing unless presence is enabled
+func SendTyping(chat *cli_proto.Chat, typing bool) error {
+	return sendEphemeral(chat, &cli_proto.Typing{Typing: typing})
+}
+
+// Tells the peer this user opened or left the chat. Does nothing unless presence is enabled
+func SendOnline(chat *cli_proto.Chat, online bool) error {
+	return sendEphemeral(chat, &cli_proto.Online{Online: online})
+}
+
+// Token both members of the chat announce to the server to see each other online. It reveals nothing about
+// the chat or its members to the server. nil for chats without an ephemeral key
+func PresenceToken(chat *cli_proto.Chat) []byte {
+	if len(chat.EphemeralKey) == 0 {
+		return nil
+	}
+	token, err := common.DeriveKey(chat.EphemeralKey, common.LabelPresenceToken, chat.Peer.InboxId)
+	if err != nil {
+		return nil
+	}
+	return token
+}
+
+var presenceMx sync.Mutex
+var peersOnline = make(map[[32]byte]bool)
+
+// Whether the peer of the chat was last seen online. Always false with presence disabled
+func PeerOnline(inboxId []byte) bool {
+	presenceMx.Lock()
+	defer presenceMx.Unlock()
+	return peersOnline[[32]byte(inboxId)]
+}
+
+// Announces the presence token of every chat, or withdraws them all if presence is disabled. Needed on every
+// connect, since the server forgets them with the connection
+func AnnouncePresence(saveState *cli_proto.SaveState) error {
+	tokens := make([][]byte, 0)
+	if settings.CliSettings.Presence {
+		for _, chat := range saveState.Chats {
+			if token := PresenceToken(chat); token != nil {
+				tokens = append(tokens, token)
+			}
+		}
+	}
+	return GetChatClient().Send(&server.ClientMessage{
+		Payload: &server.ClientMessage_Presence{
+			Presence: &server.PresenceAnnounce{Tokens: tokens},
+		},
+	})
+}
+
+// Records the peers that came online or went offline and notifies the subscribers of their chats
+func applyPresence(saveState *cli_proto.SaveState, update *server.PresenceUpdate) {
+	changed := make(map[string]bool)
+	for _, token := range update.Offline {
+		changed[string(token)] = false
+	}
+	for _, token := range update.Online {
+		changed[string(token)] = true
+	}
+
+	for _, chat := range saveState.Chats {
+		token := PresenceToken(chat)
+		if token == nil {
+			continue
+		}
+		online, ok := changed[string(token)]
+		if !ok {
+			continue
+		}
+		presenceMx.Lock()
+		peersOnline[[32]byte(chat.Peer.InboxId)] = online
+		presenceMx.Unlock()
+		GetChatClient().Emit(chat.Peer.InboxId, PresenceUpdate{InboxId: chat.Peer.InboxId, Online: online})
+	}
+}
+
+// Forgets who was online, e.g. after losing the connection
+func clearPresence() {
+	presenceMx.Lock()
+	defer presenceMx.Unlock()
+	clear(peersOnline)
+}
@@ -10,13 +10,15 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"time"
 
 	"github.com/as283-ua/yappa/internal/client/save"
+	"github.com/as283-ua/yappa/pkg/common"
 	"github.com/quic-go/quic-go"
-	"github.com/quic-go/quic-go/http3"
 )
 
 var httpClient *http.Client
+var rootCAs *x509.CertPool
 var certificate tls.Certificate
 var mlkemDecap *mlkem.DecapsulationKey1024
 var username string
@@ -46,7 +48,7 @@ func InitHttp3Client(caCertPath string) error {
 		return errors.New("no http client set up")
 	}
 
-	rootCAs := x509.NewCertPool()
+	rootCAs = x509.NewCertPool()
 
 	caCert, err := os.ReadFile(caCertPath)
 	if err != nil {
@@ -60,10 +62,11 @@ func InitHttp3Client(caCertPath string) error {
 		NextProtos: []string{"h3"},
 	}
 
-	transport := &http3.Transport{
-		TLSClientConfig: tlsConfig,
-		QUICConfig:      &quic.Config{},
-	}
+	// one connection for REST calls and the chat stream, kept alive between requests so it can migrate when
+	// the network changes instead of being redialed
+	transport := common.NewSharedTransport(tlsConfig, &quic.Config{
+		KeepAlivePeriod: 15 * time.Second,
+	})
 
 	httpClient = &http.Client{
 		Transport: transport,
@@ -82,13 +85,15 @@ func UseCertificate(cert, key string) error {
 		return err
 	}
 
-	t, ok := httpClient.Transport.(*http3.Transport)
+	t, ok := httpClient.Transport.(*common.SharedTransport)
 
 	if !ok {
 		return errors.New("http transport error")
 	}
 
 	t.TLSClientConfig.Certificates = append(t.TLSClientConfig.Certificates, x509cert)
+	// connections made before this are anonymous
+	t.Reset()
 	certificate = x509cert
 
 	parsedCert, err := x509.ParseCertificate(certificate.Certificate[0])
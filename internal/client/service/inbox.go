@@ -0,0 +1,183 @@
+package service
+
+import (
+	"encoding/binary"
+	"sync"
+	"time"
+
+	cli_proto "github.com/as283-ua/yappa/api/gen/client"
+	"github.com/as283-ua/yappa/api/gen/server"
+	"github.com/as283-ua/yappa/internal/client/save"
+	"github.com/as283-ua/yappa/pkg/common"
+)
+
+// How long a derived inbox id is used before both ends of the chat move to the next one
+const INBOX_EPOCH = 24 * time.Hour
+
+// Epoch of the inbox messages sent at the given unix time go to
+func InboxEpoch(unix uint64) uint64 {
+	return unix / uint64(INBOX_EPOCH/time.Second)
+}
+
+func currentEpoch() uint64 {
+	return InboxEpoch(uint64(time.Now().UTC().Unix()))
+}
+
+func sealed(chat *cli_proto.Chat) bool {
+	return len(chat.InboxSecret) != 0
+}
+
+// Binds a derived value to the user whose inbox it is and the epoch, so neither direction nor epoch share one
+func inboxContext(receiver string, epoch uint64) []byte {
+	return binary.BigEndian.AppendUint64([]byte(receiver), epoch)
+}
+
+// Id of the receiver's inbox in the chat for the epoch. Nobody without the chat's secret can tell two of them
+// belong to the same chat
+func DerivedInboxId(chat *cli_proto.Chat, receiver string, epoch uint64) ([]byte, error) {
+	return common.DeriveKey(chat.InboxSecret, common.LabelInboxId, inboxContext(receiver, epoch))
+}
+
+// Token the receiver fetches the derived inbox with. The sender hands the server its hash with every message
+func derivedInboxToken(chat *cli_proto.Chat, inboxId []byte) ([]byte, error) {
+	return common.DeriveKey(chat.InboxSecret, common.LabelInboxToken, inboxId)
+}
+
+// Token the receiver registers so sealed sends to it are relayed while it is connected
+func DeliveryToken(chat *cli_proto.Chat, receiver string, epoch uint64) ([]byte, error) {
+	return common.DeriveKey(chat.InboxSecret, common.LabelDeliveryToken, inboxContext(receiver, epoch))
+}
+
+// Token this client checks the messages it stored in an inbox for expiry with. Derived from its own ML-KEM key,
+// which nobody else holds. Nil if no key is loaded, the messages can't be checked then
+func expiryToken(inboxId []byte) ([]byte, error) {
+	decap := GetMlkemDecap()
+	if decap == nil {
+		return nil, nil
+	}
+	return common.DeriveKey(decap.Bytes(), common.LabelExpiryToken, inboxId)
+}
+
+// Addresses the message to the peer's inbox for the epoch of the given send time. Sealed chats leave the
+// receiver out, only the derived inbox and the tokens to reach it are sent
+func addressSend(chat *cli_proto.Chat, msg *server.SendMsg, sentAt uint64) (*server.SendMsg, error) {
+	if !sealed(chat) {
+		msg.Receiver = chat.Peer.Username
+		msg.InboxId = chat.Peer.InboxId
+		return withSenderAuth(msg)
+	}
+	epoch := InboxEpoch(sentAt)
+	inboxId, err := DerivedInboxId(chat, chat.Peer.Username, epoch)
+	if err != nil {
+		return nil, err
+	}
+	token, err := derivedInboxToken(chat, inboxId)
+	if err != nil {
+		return nil, err
+	}
+	deliveryToken, err := DeliveryToken(chat, chat.Peer.Username, epoch)
+	if err != nil {
+		return nil, err
+	}
+	msg.InboxId = inboxId
+	msg.InboxAuth = common.Hash(token)
+	msg.DeliveryToken = deliveryToken
+	return withSenderAuth(msg)
+}
+
+func withSenderAuth(msg *server.SendMsg) (*server.SendMsg, error) {
+	token, err := expiryToken(msg.InboxId)
+	if err != nil || token == nil {
+		return msg, err
+	}
+	msg.SenderAuth = common.Hash(token)
+	return msg, nil
+}
+
+var inboxMx sync.Mutex
+
+// Derived inbox ids of the current epochs, in both directions, to the chat's own id
+var inboxIndex = make(map[[32]byte][]byte)
+
+// Epochs around the current one are all in use at once, clocks at both ends don't need to agree
+func nearEpochs() []uint64 {
+	current := currentEpoch()
+	return []uint64{current - 1, current, current + 1}
+}
+
+func indexChat(chat *cli_proto.Chat) {
+	if !sealed(chat) {
+		return
+	}
+	for _, epoch := range nearEpochs() {
+		for _, receiver := range []string{GetUsername(), chat.Peer.Username} {
+			inboxId, err := DerivedInboxId(chat, receiver, epoch)
+			if err != nil {
+				continue
+			}
+			inboxIndex[[32]byte(inboxId)] = chat.Peer.InboxId
+		}
+	}
+}
+
+// Id of the chat or request the inbox id the server used belongs to. Derived ids are mapped back to the chat's
+// own, any other id is returned as is
+func chatInboxId(saveState *cli_proto.SaveState, inboxId []byte) []byte {
+	if len(inboxId) != 32 {
+		return inboxId
+	}
+	inboxMx.Lock()
+	defer inboxMx.Unlock()
+	if id, ok := inboxIndex[[32]byte(inboxId)]; ok {
+		return id
+	}
+	if _, ok := save.DirectChat(saveState, inboxId); ok {
+		return inboxId
+	}
+	if _, ok := save.Request(saveState, inboxId); ok {
+		return inboxId
+	}
+
+	// new chats, or the epoch moved on
+	clear(inboxIndex)
+	for _, chat := range saveState.Chats {
+		indexChat(chat)
+	}
+	for _, req := range save.Requests(saveState) {
+		indexChat(req.Chat)
+	}
+	if id, ok := inboxIndex[[32]byte(inboxId)]; ok {
+		return id
+	}
+	return inboxId
+}
+
+// Registers the delivery tokens of every sealed chat's inbox for this user, so the peer's messages are relayed
+// instead of stored. Needed on every connect and once a new epoch starts. Requests aren't registered, their
+// messages are only fetched once accepted
+func RegisterDelivery(saveState *cli_proto.SaveState) error {
+	tokens := make([][]byte, 0)
+	for _, chat := range saveState.Chats {
+		if !sealed(chat) {
+			continue
+		}
+		for _, epoch := range nearEpochs() {
+			token, err := DeliveryToken(chat, GetUsername(), epoch)
+			if err != nil {
+				return err
+			}
+			tokens = append(tokens, token)
+		}
+	}
+	return GetChatClient().Send(&server.ClientMessage{
+		Payload: &server.ClientMessage_Delivery{
+			Delivery: &server.DeliveryRegister{Tokens: tokens},
+		},
+	})
+}
+
+// Time left until the next epoch starts
+func untilNextEpoch() time.Duration {
+	next := time.Unix(int64((currentEpoch()+1)*uint64(INBOX_EPOCH/time.Second)), 0)
+	return time.Until(next)
+}
@@ -1,10 +1,12 @@
 package service
 
 import (
-	"bytes"
 	"crypto/mlkem"
+	"errors"
 	"fmt"
 	"log"
+	"sync"
+	"time"
 
 	"github.com/as283-ua/yappa/api/gen/client"
 	"github.com/as283-ua/yappa/api/gen/server"
@@ -12,10 +14,15 @@ import (
 	"github.com/as283-ua/yappa/pkg/common"
 )
 
+var cacheMx sync.Mutex
 var chatCache = make(map[[32]byte]*client.Chat)
 var encapCache = make(map[string]*mlkem.EncapsulationKey1024)
 
+// Chat the inbox id the server used belongs to, derived or not
 func getChat(saveState *client.SaveState, inboxId []byte) (*client.Chat, error) {
+	inboxId = chatInboxId(saveState, inboxId)
+	cacheMx.Lock()
+	defer cacheMx.Unlock()
 	chat, ok := chatCache[[32]byte(inboxId)]
 	if !ok {
 		chat, ok = save.DirectChat(saveState, inboxId)
@@ -23,18 +30,6 @@ func getChat(saveState *client.SaveState, inboxId []byte) (*client.Chat, error)
 			chatCache[[32]byte(inboxId)] = chat
 		}
 	}
-	if chat == nil {
-		newChats, err := GetChatClient().GetNewChats()
-		if err != nil {
-			return nil, fmt.Errorf("errors while retrieving new chats: %v", err)
-		}
-		for _, nc := range newChats {
-			save.NewDirectChat(saveState, nc)
-			if bytes.Equal(nc.Peer.InboxId, inboxId) {
-				chat = nc
-			}
-		}
-	}
 	if chat == nil {
 		return nil, fmt.Errorf("received message from unknown inbox: %v", inboxId)
 	}
@@ -42,6 +37,8 @@ func getChat(saveState *client.SaveState, inboxId []byte) (*client.Chat, error)
 }
 
 func getEncap(chat *client.Chat) (*mlkem.EncapsulationKey1024, error) {
+	cacheMx.Lock()
+	defer cacheMx.Unlock()
 	var err error
 	encapKey, ok := encapCache[chat.Peer.Username]
 	if !ok {
@@ -56,6 +53,9 @@ func getEncap(chat *client.Chat) (*mlkem.EncapsulationKey1024, error) {
 }
 
 func KeyExchNeeded(chat *client.Chat) bool {
+	if usesDoubleRatchet(chat) {
+		return false
+	}
 	eventIdx := chat.CurrentSerial - chat.SerialStart
 	var keyRotUserOffset int = 0
 	if chat.Peer.Username == chat.Initiator {
@@ -82,80 +82,427 @@ func KeyExchNeeded(chat *client.Chat) bool {
 	return isMyTurn || (lastSeen > MLKEM_RATCHET_INTERVAL/2)
 }
 
+// Saves a decrypted peer event into the chat, advancing the ratchet. Late events are only added to the history
+func AcceptPeerEvent(chat *client.Chat, peerEvent *PeerEvent) error {
+	if receipt, ok := peerEvent.Event.Payload.(*client.ClientEvent_Receipt); ok {
+		save.SetStatus(chat, receipt.Receipt.Serials, receiptStatus(receipt.Receipt.Type))
+	}
+
+	if peerEvent.Ratchet != nil {
+		save.NewRatchetEvent(chat, peerEvent.Serial, peerEvent.Ratchet, peerEvent.Event)
+		return nil
+	}
+
+	if peerEvent.Late {
+		if _, ok := peerEvent.Event.Payload.(*client.ClientEvent_KeyRotation); ok {
+			// the chain was already ratcheted past this rotation, messages encrypted with its key can't be recovered
+			log.Printf("Received key rotation with serial %v after newer messages (current %v)", peerEvent.Serial, chat.CurrentSerial)
+		}
+		save.LateEvent(chat, peerEvent.Serial, peerEvent.Event)
+		return nil
+	}
+
+	var newKey []byte
+	switch msg := peerEvent.Event.Payload.(type) {
+	case *client.ClientEvent_KeyRotation:
+		decapKey := GetMlkemDecap()
+		if decapKey == nil {
+			return errors.New("received key rotation message but no MLKEM key is loaded")
+		}
+		var err error
+		newKey, err = decapKey.Decapsulate(msg.KeyRotation.KeyExchangeData)
+		if err != nil {
+			return fmt.Errorf("error decapsulating key: %w", err)
+		}
+	default:
+		newKey = Ratchet(peerEvent.Key)
+	}
+
+	save.SkipKeys(chat, peerEvent.Skipped)
+	save.NewEvent(chat, peerEvent.Serial+1, newKey, peerEvent.Event)
+	return nil
+}
+
+// Decrypts a message of the peer and saves it into the chat, under the chat's lock
+func receivePeerMessage(chat *client.Chat, msg *server.ServerMessage_Send) (*PeerEvent, error) {
+	defer lockChat(chat)()
+	peerEvent, err := DecryptPeerMessage(chat, msg)
+	if err != nil {
+		return nil, fmt.Errorf("decrypting: %w", err)
+	}
+	err = AcceptPeerEvent(chat, peerEvent)
+	if err != nil {
+		// todo send NACK to redo key exchange
+		return nil, fmt.Errorf("accepting: %w", err)
+	}
+	return peerEvent, nil
+}
+
+// Sends a new ML-KEM key if it's this client's turn to rotate it after receiving. Returns nil if it isn't
+func rotateOnReceive(chat *client.Chat) (*client.ClientEvent, error) {
+	defer lockChat(chat)()
+	if !KeyExchNeeded(chat) {
+		return nil, nil
+	}
+	log.Printf("Sending key exchange on receive. Current serial = %v, first message = %v. Frequency = %v", chat.CurrentSerial, chat.SerialStart, MLKEM_RATCHET_INTERVAL)
+	return sendKeyExchange(chat)
+}
+
+// Files the chat invitations waiting on the server. Those from users without a chat yet become message
+// requests, those from blocked users are discarded
+func FetchNewChats(saveState *client.SaveState) error {
+	newChats, err := GetChatClient().GetNewChats()
+	for _, chat := range newChats {
+		save.NewInvitation(saveState, chat)
+	}
+	return err
+}
+
+// Moves the request into the chats, then retrieves what its sender stored in the inbox and decrypts the
+// messages held while it was pending
+func AcceptRequest(saveState *client.SaveState, inboxId []byte) (*client.Chat, error) {
+	req, ok := save.AcceptRequest(saveState, inboxId)
+	if !ok {
+		return nil, fmt.Errorf("no message request for inbox %v", inboxId)
+	}
+	chat := req.Chat
+	errs := common.MultiError{Errors: make([]error, 0)}
+
+	delivered := make([]uint64, 0)
+	err := GetChatClient().StreamChatMessages(chat, func(msgs []*server.Message) {
+		delivered = append(delivered, applyStoredMessages(chat, msgs)...)
+	})
+	if err != nil {
+		errs.Errors = append(errs.Errors, err)
+	}
+	held := make([]*server.Message, 0, len(req.Held))
+	for _, msg := range req.Held {
+		held = append(held, &server.Message{Serial: msg.Serial, EncMsg: msg.EncData})
+	}
+	delivered = append(delivered, applyStoredMessages(chat, held)...)
+	sendDelivered(chat, delivered)
+
+	err = AnnouncePresence(saveState)
+	if err != nil {
+		errs.Errors = append(errs.Errors, err)
+	}
+	err = RegisterDelivery(saveState)
+	if err != nil {
+		errs.Errors = append(errs.Errors, err)
+	}
+	return chat, errs.NilOrError()
+}
+
+// Decrypts and saves messages stored in the chat's inbox. Returns the serials of the chat messages, for the
+// delivery receipt. Messages that fail are dropped, the server deletes them along with the rest of the page
+func applyStoredMessages(chat *client.Chat, msgs []*server.Message) []uint64 {
+	delivered := make([]uint64, 0)
+	for _, msg := range msgs {
+		peerEvent, err := receivePeerMessage(chat, &server.ServerMessage_Send{Send: &server.ReceiveMsg{
+			InboxId: chat.Peer.InboxId,
+			Serial:  msg.Serial,
+			EncData: msg.EncMsg,
+		}})
+		if err != nil {
+			log.Printf("Error reading message %v from chat %v: %v", msg.Serial, chat.Peer.InboxId, err)
+			continue
+		}
+		GetChatClient().Emit(chat.Peer.InboxId, peerEvent.Event)
+		if _, ok := peerEvent.Event.Payload.(*client.ClientEvent_Message); ok {
+			delivered = append(delivered, peerEvent.Serial)
+		}
+	}
+	return delivered
+}
+
+// Tells the peer which of the stored messages arrived, once the whole inbox is retrieved
+func sendDelivered(chat *client.Chat, delivered []uint64) {
+	if !GetChatClient().GetConnected() {
+		return
+	}
+	err := SendReceipt(chat, client.ReceiptType_RECEIPT_DELIVERED, delivered)
+	if err != nil {
+		log.Printf("Error sending delivery receipt to chat %v: %v", chat.Peer.InboxId, err)
+	}
+}
+
+// Retrieves and applies the messages stored in a single inbox
+func FetchChatMessages(chat *client.Chat) error {
+	delivered := make([]uint64, 0)
+	err := GetChatClient().StreamChatMessages(chat, func(msgs []*server.Message) {
+		delivered = append(delivered, applyStoredMessages(chat, msgs)...)
+	})
+	sendDelivered(chat, delivered)
+	return err
+}
+
+// Retrieves everything stored on the server while this client wasn't listening: new chat invitations and the
+// messages in every known inbox
+func CatchUp(saveState *client.SaveState) error {
+	errs := common.MultiError{Errors: make([]error, 0)}
+	err := FetchNewChats(saveState)
+	if err != nil {
+		errs.Errors = append(errs.Errors, fmt.Errorf("retrieving new chats: %w", err))
+	}
+
+	delivered := make(map[*client.Chat][]uint64)
+	err = GetChatClient().GetNewMessages(saveState, func(chat *client.Chat, msgs []*server.Message) {
+		delivered[chat] = append(delivered[chat], applyStoredMessages(chat, msgs)...)
+	})
+	if err != nil {
+		errs.Errors = append(errs.Errors, fmt.Errorf("retrieving new messages: %w", err))
+	}
+	for chat, serials := range delivered {
+		sendDelivered(chat, serials)
+	}
+	return errs.NilOrError()
+}
+
+// How often sealed chats left behind by MAX_CATCH_UP_EPOCHS go on retrieving their inboxes, once the rate limit
+// refilled
+const CATCH_UP_RESUME_INTERVAL = 10 * time.Second
+
+// Goes on retrieving the sealed chats whose last retrieval stopped short of the current epochs
+func CatchUpBehind(saveState *client.SaveState) error {
+	errs := common.MultiError{Errors: make([]error, 0)}
+	for _, chat := range saveState.Chats {
+		if !sealed(chat) || save.InboxEpoch(chat)+1 >= currentEpoch() {
+			continue
+		}
+		err := FetchChatMessages(chat)
+		if err != nil {
+			errs.Errors = append(errs.Errors, err)
+		}
+	}
+	return errs.NilOrError()
+}
+
+// Inboxes of the peer this client's stored messages went to, with their serials. Sealed chats used the inbox of
+// the epoch each message was sent in
+func storedByInbox(chat *client.Chat) (map[[32]byte][]uint64, error) {
+	stored := save.StoredSerials(chat)
+	byInbox := make(map[[32]byte][]uint64)
+	if !sealed(chat) {
+		if len(stored) != 0 {
+			byInbox[[32]byte(chat.Peer.InboxId)] = stored
+		}
+		return byInbox, nil
+	}
+	for serial, sentAt := range save.SentAt(chat, stored) {
+		inboxId, err := DerivedInboxId(chat, chat.Peer.Username, InboxEpoch(sentAt))
+		if err != nil {
+			return nil, err
+		}
+		byInbox[[32]byte(inboxId)] = append(byInbox[[32]byte(inboxId)], serial)
+	}
+	return byInbox, nil
+}
+
+// Marks the messages still waiting in a peer's inbox that the server deleted before the peer fetched them
+func CheckExpired(saveState *client.SaveState) error {
+	errs := common.MultiError{Errors: make([]error, 0)}
+	for _, chat := range saveState.Chats {
+		byInbox, err := storedByInbox(chat)
+		if err != nil {
+			errs.Errors = append(errs.Errors, err)
+			continue
+		}
+		for inboxId, stored := range byInbox {
+			token, err := expiryToken(inboxId[:])
+			if err != nil {
+				errs.Errors = append(errs.Errors, err)
+				continue
+			}
+			if token == nil {
+				// stored without a sender auth
+				continue
+			}
+			for len(stored) != 0 {
+				batch := stored[:min(len(stored), MAX_EXPIRED_CHECK)]
+				stored = stored[len(batch):]
+
+				expired, err := GetChatClient().GetExpiredMessages(inboxId[:], token, batch)
+				if err != nil {
+					errs.Errors = append(errs.Errors, err)
+					break
+				}
+				if len(expired) == 0 {
+					continue
+				}
+				save.SetStatus(chat, expired, client.MessageStatus_STATUS_EXPIRED)
+				GetChatClient().Emit(chat.Peer.InboxId, StatusUpdate{
+					InboxId: chat.Peer.InboxId,
+					Serials: expired,
+					Status:  client.MessageStatus_STATUS_EXPIRED,
+				})
+			}
+		}
+	}
+	return errs.NilOrError()
+}
+
+// Handles everything the server pushes until the chat client is closed. Survives reconnects, catching up on
+// whatever was stored while the connection was down each time the client reconnects
 func StartListening(saveState *client.SaveState) {
 	chatCli := GetChatClient()
-	<-ConnectedC
-	for chatCli.GetConnected() {
-		msg := <-chatCli.MainSub
+	// the first connection is caught up on at startup
+	reconnect := false
+	// delivery tokens are registered for the epochs around the current one, moved along as it changes
+	nextEpoch := time.NewTimer(untilNextEpoch())
+	defer nextEpoch.Stop()
+	resume := time.NewTicker(CATCH_UP_RESUME_INTERVAL)
+	defer resume.Stop()
+	for {
+		var msg *server.ServerMessage
+		select {
+		case msg = <-chatCli.MainSub:
+		case <-resume.C:
+			if !chatCli.GetConnected() {
+				continue
+			}
+			err := CatchUpBehind(saveState)
+			if err != nil {
+				log.Println("Errors while catching up on sealed chats:", err)
+			}
+			continue
+		case <-nextEpoch.C:
+			nextEpoch.Reset(untilNextEpoch())
+			if !chatCli.GetConnected() {
+				// registered on connect
+				continue
+			}
+			err := RegisterDelivery(saveState)
+			if err != nil {
+				log.Println("Error registering delivery tokens:", err)
+			}
+			continue
+		case <-chatCli.ConnectedSig:
+			if reconnect {
+				err := CatchUp(saveState)
+				if err != nil {
+					log.Println("Errors while catching up after reconnecting:", err)
+				}
+			}
+			reconnect = true
+			err := CheckExpired(saveState)
+			if err != nil {
+				log.Println("Errors while checking for expired messages:", err)
+			}
+			clearPresence()
+			err = AnnouncePresence(saveState)
+			if err != nil {
+				log.Println("Error announcing presence:", err)
+			}
+			err = RegisterDelivery(saveState)
+			if err != nil {
+				log.Println("Error registering delivery tokens:", err)
+			}
+			continue
+		case <-chatCli.Done():
+			return
+		}
 		switch payload := msg.Payload.(type) {
 		case *server.ServerMessage_Send:
-			chat, err := getChat(saveState, msg.GetSend().InboxId)
-			if err != nil {
-				log.Printf("Error reading new incoming message: %v", err)
+			if req, ok := save.Request(saveState, chatInboxId(saveState, payload.Send.InboxId)); ok {
+				// can't be decrypted in order until the request is accepted. Ephemeral events are of no use later
+				if !payload.Send.Ephemeral && !save.HoldMessage(req, payload.Send.Serial, payload.Send.EncData) {
+					log.Printf("Dropped message for request from %v, too many held", req.Chat.Peer.Username)
+				}
 				break
 			}
-
-			event, usedSerial, err := DecryptPeerMessage(chat, payload)
+			chat, err := getChat(saveState, payload.Send.InboxId)
 			if err != nil {
-				log.Println("Error decrypting peer msg:", err, usedSerial, payload.Send.Serial, common.Hash(payload.Send.EncData))
+				log.Printf("Error reading new incoming message: %v", err)
 				break
 			}
-			var newSerial uint64 = chat.CurrentSerial
-			var newKey []byte = chat.Key
 
-			errored := false
-			switch msg := event.Payload.(type) {
-			case *client.ClientEvent_KeyRotation:
-				decapKey := GetMlkemDecap()
-				if decapKey == nil {
-					errored = true
-					log.Println("Received key rotation message but no MLKEM key is loaded")
-					break
-				}
-				newKey, err = decapKey.Decapsulate(msg.KeyRotation.KeyExchangeData)
+			if payload.Send.Ephemeral {
+				event, err := DecryptEphemeral(chat, payload.Send)
 				if err != nil {
-					errored = true
-					log.Println("Error decapsulating key:", err)
+					log.Println("Dropped ephemeral event:", err)
 					break
 				}
-				newSerial = usedSerial + 1
-			default:
-				if chat.CurrentSerial == usedSerial { // ratchet if order was kept, keep previous key and current serial otherwise
-					newSerial++
-					newKey = Ratchet(chat.Key)
-				}
-			}
-			if errored {
-				// todo send NACK to redo key exchange
+				// shown and forgotten, never saved
+				chatCli.Emit(chat.Peer.InboxId, event)
 				break
 			}
-			save.NewEvent(chat, newSerial, newKey, event)
-			chatCli.Emit(chat.Peer.InboxId, event)
 
-			if KeyExchNeeded(chat) {
-				log.Printf("Sending key exchange on receive. Current serial = %v, first message = %v. Frequency = %v", chat.CurrentSerial, chat.SerialStart, MLKEM_RATCHET_INTERVAL)
-				encapKey, err := getEncap(chat)
-				if err != nil {
-					log.Println("Error getting peer's public key:", err)
-					continue
-				}
-				encMsg, kevent, key, err := KeyExchangeEvent(chat, encapKey)
+			peerEvent, err := receivePeerMessage(chat, payload)
+			if err != nil {
+				log.Println("Error reading peer msg:", err, payload.Send.Serial, common.Hash(payload.Send.EncData))
+				break
+			}
+			chatCli.Emit(chat.Peer.InboxId, peerEvent.Event)
+			if receipt, ok := peerEvent.Event.Payload.(*client.ClientEvent_Receipt); ok {
+				chatCli.Emit(chat.Peer.InboxId, StatusUpdate{
+					InboxId: chat.Peer.InboxId,
+					Serials: receipt.Receipt.Serials,
+					Status:  receiptStatus(receipt.Receipt.Type),
+				})
+			}
+			if _, ok := peerEvent.Event.Payload.(*client.ClientEvent_Message); ok {
+				err = SendReceipt(chat, client.ReceiptType_RECEIPT_DELIVERED, []uint64{peerEvent.Serial})
 				if err != nil {
-					log.Println("Error in key exchange message creation:", err)
-					continue
+					log.Println("Error sending delivery receipt:", err)
 				}
-				err = GetChatClient().Send(&server.ClientMessage{
-					Payload: &server.ClientMessage_Send{
-						Send: encMsg,
-					},
-				})
+			}
+
+			if !peerEvent.Late {
+				kevent, err := rotateOnReceive(chat)
 				if err != nil {
 					log.Println("Error sending key exchange:", err)
-					continue
+					break
+				}
+				if kevent != nil {
+					chatCli.Emit(chat.Peer.InboxId, kevent)
 				}
-				save.NewEvent(chat, chat.CurrentSerial+1, key, kevent)
-				chatCli.Emit(chat.Peer.InboxId, kevent)
 			}
+		case *server.ServerMessage_NewChats:
+			err := FetchNewChats(saveState)
+			if err != nil {
+				log.Println("Errors while retrieving new chats:", err)
+			}
+			// the new chats' tokens
+			err = AnnouncePresence(saveState)
+			if err != nil {
+				log.Println("Error announcing presence:", err)
+			}
+			err = RegisterDelivery(saveState)
+			if err != nil {
+				log.Println("Error registering delivery tokens:", err)
+			}
+		case *server.ServerMessage_Presence:
+			applyPresence(saveState, payload.Presence)
+		case *server.ServerMessage_Inbox:
+			chat, err := getChat(saveState, payload.Inbox.InboxId)
+			if err != nil {
+				log.Println("Inbox notification:", err)
+				break
+			}
+			err = FetchChatMessages(chat)
+			if err != nil {
+				log.Println("Error retrieving stored messages:", err)
+			}
+		case *server.ServerMessage_Status:
+			inboxId, serial, ok := chatCli.TakePending(payload.Status.MsgId)
+			if !ok {
+				log.Printf("Status for unknown message id %v", payload.Status.MsgId)
+				break
+			}
+			switch payload.Status.Status {
+			case server.DeliveryStatus_DELIVERY_FAILED:
+				log.Printf("Server failed to deliver message %v", serial)
+			case server.DeliveryStatus_DELIVERY_RATE_LIMITED:
+				log.Printf("Server dropped message %v, sending too fast", serial)
+			}
+			inboxId = chatInboxId(saveState, inboxId)
+			chat, ok := save.DirectChat(saveState, inboxId)
+			if !ok {
+				break
+			}
+			status := deliveryStatus(payload.Status.Status)
+			save.SetStatus(chat, []uint64{serial}, status)
+			chatCli.Emit(inboxId, StatusUpdate{InboxId: inboxId, Serials: []uint64{serial}, Status: status})
 		}
 	}
 }
@@ -0,0 +1,88 @@
+package service
+
+import (
+	"math/bits"
+
+	cli_proto "github.com/as283-ua/yappa/api/gen/client"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+)
+
+// Smallest size events are padded to. Above a key rotation's, so rotations, receipts and short texts all look
+// the same
+const PAD_MIN_SIZE = 2048
+
+// Smallest size double ratchet envelopes are padded to. Above one with a PAD_MIN_SIZE event and a header carrying
+// an ML-KEM ciphertext, so sends that step the ratchet look like the rest
+const ENVELOPE_MIN_SIZE = 2 * PAD_MIN_SIZE
+
+// Same in ClientEvent and Envelope
+const paddingField protowire.Number = 15
+
+// Size an event of n bytes is padded to. Past PAD_MIN_SIZE it's rounded up with Padmé, which leaks at most
+// O(log log n) bits of the size while wasting under 12%
+func PaddedSize(n int) int {
+	if n <= PAD_MIN_SIZE {
+		return PAD_MIN_SIZE
+	}
+	e := bits.Len(uint(n)) - 1
+	s := bits.Len(uint(e))
+	mask := 1<<(e-s) - 1
+	return (n + mask) &^ mask
+}
+
+// Size an envelope of n bytes is padded to
+func PaddedEnvelopeSize(n int) int {
+	return max(ENVELOPE_MIN_SIZE, PaddedSize(n))
+}
+
+// tag and length of an empty padding field
+const paddingFieldSize = 2
+
+// Marshals the event and appends a padding field bringing it to PaddedSize. Older clients parse the field as
+// unknown and ignore it
+func marshalPadded(event *cli_proto.ClientEvent) ([]byte, error) {
+	event.Padding = nil
+	raw, err := proto.Marshal(event)
+	if err != nil {
+		return nil, err
+	}
+	return appendPadding(raw, PaddedSize(len(raw)+paddingFieldSize)), nil
+}
+
+// Marshals the envelope with a padding field bringing it to PaddedEnvelopeSize
+func marshalEnvelope(env *cli_proto.Envelope) ([]byte, error) {
+	env.Padding = nil
+	raw, err := proto.Marshal(env)
+	if err != nil {
+		return nil, err
+	}
+	return appendPadding(raw, PaddedEnvelopeSize(len(raw)+paddingFieldSize)), nil
+}
+
+// Appends padding fields to the marshalled message until it is size bytes long, at least paddingFieldSize more
+func appendPadding(raw []byte, size int) []byte {
+	rest := size - len(raw)
+	fill := rest - 1 - protowire.SizeVarint(uint64(rest-2))
+	if 1+protowire.SizeVarint(uint64(fill))+fill != rest {
+		// the length would take one byte more than it leaves room for. An empty field first shifts it back,
+		// only the last occurrence of a field counts
+		raw = protowire.AppendTag(raw, paddingField, protowire.BytesType)
+		raw = protowire.AppendBytes(raw, nil)
+		rest -= paddingFieldSize
+		fill = rest - 1 - protowire.SizeVarint(uint64(rest-2))
+	}
+	raw = protowire.AppendTag(raw, paddingField, protowire.BytesType)
+	return protowire.AppendBytes(raw, make([]byte, fill))
+}
+
+// Unmarshals an event sent with marshalPadded, dropping the padding
+func unmarshalPadded(raw []byte) (*cli_proto.ClientEvent, error) {
+	event := &cli_proto.ClientEvent{}
+	err := proto.Unmarshal(raw, event)
+	if err != nil {
+		return nil, err
+	}
+	event.Padding = nil
+	return event, nil
+}
@@ -0,0 +1,68 @@
+package service
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+
+	cli_proto "github.com/as283-ua/yappa/api/gen/client"
+	"github.com/as283-ua/yappa/api/gen/server"
+	"google.golang.org/protobuf/proto"
+)
+
+// Messages the server takes at most with a report
+const MAX_REPORT_EVIDENCE = 50
+
+// Disclosable copies of the most recent events that are chat messages signed by the reported user. Anything else
+// is left out, the server would reject it anyway
+func ReportEvidence(reported string, events []*cli_proto.ClientEvent) ([]*server.ReportEvidence, error) {
+	evidence := make([]*server.ReportEvidence, 0)
+	for i := len(events) - 1; i >= 0 && len(evidence) < MAX_REPORT_EVIDENCE; i-- {
+		ev := events[i]
+		if ev.Sender != reported || ev.GetMessage() == nil || len(ev.Signature) == 0 {
+			continue
+		}
+		raw, err := SignedEventBytes(ev)
+		if err != nil {
+			return nil, err
+		}
+		evidence = append(evidence, &server.ReportEvidence{Event: raw, Signature: ev.Signature})
+	}
+	slices.Reverse(evidence)
+	return evidence, nil
+}
+
+// Reports the user to the server's admins. The events are only disclosed if the reporter chose to attach them.
+// Returns the id of the report
+func (c *ChatClient) Report(reported string, reason server.ReportReason, comment string, events []*cli_proto.ClientEvent) (int32, error) {
+	evidence, err := ReportEvidence(reported, events)
+	if err != nil {
+		return 0, err
+	}
+	payload, err := proto.Marshal(&server.Report{
+		Reported: reported,
+		Reason:   reason,
+		Comment:  comment,
+		Evidence: evidence,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	data, err := request(c.client, apiCall{
+		rpc:    server.RpcMethod_RPC_REPORT,
+		method: http.MethodPost,
+		path:   "/report",
+		body:   payload,
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to send report: %w", err)
+	}
+
+	received := &server.ReportReceived{}
+	err = proto.Unmarshal(data, received)
+	if err != nil {
+		return 0, err
+	}
+	return received.Id, nil
+}
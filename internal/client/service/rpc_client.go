@@ -0,0 +1,146 @@
+package service
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/as283-ua/yappa/api/gen/server"
+	"github.com/as283-ua/yappa/internal/client/settings"
+	"github.com/as283-ua/yappa/pkg/common"
+)
+
+const RPC_TIMEOUT = 10 * time.Second
+
+var ErrRpcUnavailable = errors.New("not connected, rpc unavailable")
+
+// Error response to a call, whether it went over the connection stream or to the REST endpoint
+type RpcError struct {
+	Code    server.RpcErrorCode
+	Message string
+}
+
+// The server's message is meant to be shown to the user as is
+func (e *RpcError) Error() string {
+	if e.Message == "" {
+		return e.Code.String()
+	}
+	return e.Message
+}
+
+// Returns the error code if err is an *RpcError, RPC_OK otherwise
+func rpcCode(err error) server.RpcErrorCode {
+	var rpcErr *RpcError
+	if errors.As(err, &rpcErr) {
+		return rpcErr.Code
+	}
+	return server.RpcErrorCode_RPC_OK
+}
+
+// Makes a call over the connection stream and waits for its response
+func (c *ChatClient) Call(method server.RpcMethod, params map[string]string, body []byte) ([]byte, error) {
+	if c == nil || !c.GetConnected() {
+		return nil, ErrRpcUnavailable
+	}
+
+	id := c.nextRpcId.Add(1)
+	result := make(chan *server.RpcResponse, 1)
+	c.callsMu.Lock()
+	c.calls[id] = result
+	c.callsMu.Unlock()
+	defer func() {
+		c.callsMu.Lock()
+		delete(c.calls, id)
+		c.callsMu.Unlock()
+	}()
+
+	err := c.Send(&server.ClientMessage{
+		Payload: &server.ClientMessage_Rpc{
+			Rpc: &server.RpcRequest{Id: id, Method: method, Params: params, Body: body},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrRpcUnavailable, err)
+	}
+
+	timer := time.NewTimer(RPC_TIMEOUT)
+	defer timer.Stop()
+	select {
+	case resp := <-result:
+		if resp.Error != nil && resp.Error.Code != server.RpcErrorCode_RPC_OK {
+			return nil, &RpcError{Code: resp.Error.Code, Message: resp.Error.Message}
+		}
+		return resp.Body, nil
+	case <-timer.C:
+		return nil, fmt.Errorf("rpc %v timed out", method)
+	case <-c.closed:
+		return nil, ErrRpcUnavailable
+	}
+}
+
+// Hands the response to the call waiting for it, if it hasn't given up yet
+func (c *ChatClient) resolveCall(resp *server.RpcResponse) {
+	c.callsMu.Lock()
+	result, ok := c.calls[resp.Id]
+	c.callsMu.Unlock()
+	if !ok {
+		return
+	}
+	select {
+	case result <- resp:
+	default:
+	}
+}
+
+// A chat operation, reachable both as an rpc and as a REST endpoint
+type apiCall struct {
+	rpc server.RpcMethod
+	// REST endpoint
+	method string
+	path   string
+	// headers or path values of the endpoint
+	params map[string]string
+	body   []byte
+}
+
+// Makes the call over the connection stream if connected, otherwise through its REST endpoint with httpClient.
+// Error responses are returned as *RpcError either way
+func request(httpClient *http.Client, call apiCall) ([]byte, error) {
+	body, err := GetChatClient().Call(call.rpc, call.params, call.body)
+	if !errors.Is(err, ErrRpcUnavailable) {
+		return body, err
+	}
+
+	url := fmt.Sprintf("https://%v%v", settings.CliSettings.ServerHost, call.path)
+	var reqBody io.Reader
+	if call.body != nil {
+		reqBody = bytes.NewReader(call.body)
+	}
+	req, err := http.NewRequest(call.method, url, reqBody)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range call.params {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, handleHttpErrors(err)
+	}
+	defer resp.Body.Close()
+
+	body, err = io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	code := common.RpcCodeFromStatus(resp.StatusCode)
+	if code != server.RpcErrorCode_RPC_OK {
+		return nil, &RpcError{Code: code, Message: string(bytes.TrimSpace(body))}
+	}
+	return body, nil
+}
@@ -2,11 +2,11 @@ package service
 
 import (
 	"fmt"
-	"io"
 	"net/http"
+	"net/url"
 
 	"github.com/as283-ua/yappa/api/gen/server"
-	"github.com/as283-ua/yappa/internal/client/settings"
+	"github.com/quic-go/quic-go/http3"
 	"google.golang.org/protobuf/proto"
 )
 
@@ -15,32 +15,20 @@ type UsersClient struct {
 }
 
 func (c UsersClient) GetUsers(page, size int, username string) ([]string, error) {
-	url := fmt.Sprintf("https://%v/users", settings.CliSettings.ServerHost)
-
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return nil, err
-	}
-
-	req.Header.Set("page", fmt.Sprintf("%d", page))
-	req.Header.Set("size", fmt.Sprintf("%d", size))
-	req.Header.Set("name", username)
-
-	resp, err := c.Client.Do(req)
-	if err != nil {
-		return nil, handleHttpErrors(err)
-	}
-	defer resp.Body.Close()
-
-	body, err := io.ReadAll(resp.Body)
+	body, err := request(c.Client, apiCall{
+		rpc:    server.RpcMethod_RPC_USERS,
+		method: http3.MethodGet0RTT,
+		path:   "/users",
+		params: map[string]string{
+			"page": fmt.Sprintf("%d", page),
+			"size": fmt.Sprintf("%d", size),
+			"name": username,
+		},
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("%v", string(body))
-	}
-
 	var userResp server.Usernames
 	err = proto.Unmarshal(body, &userResp)
 	if err != nil {
@@ -51,28 +39,16 @@ func (c UsersClient) GetUsers(page, size int, username string) ([]string, error)
 }
 
 func (c UsersClient) GetUserData(username string) (*server.UserData, error) {
-	url := fmt.Sprintf("https://%v/users/%s", settings.CliSettings.ServerHost, username)
-
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return nil, err
-	}
-
-	resp, err := c.Client.Do(req)
-	if err != nil {
-		return nil, handleHttpErrors(err)
-	}
-	defer resp.Body.Close()
-
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
-	}
-
-	if resp.StatusCode == http.StatusNotFound {
+	body, err := request(c.Client, apiCall{
+		rpc:    server.RpcMethod_RPC_USER_DATA,
+		method: http3.MethodGet0RTT,
+		path:   "/users/" + url.PathEscape(username),
+		params: map[string]string{"username": username},
+	})
+	if rpcCode(err) == server.RpcErrorCode_RPC_NOT_FOUND {
 		return nil, fmt.Errorf("user %q not found", username)
-	} else if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("%v", string(body))
+	} else if err != nil {
+		return nil, err
 	}
 
 	userData := &server.UserData{}
@@ -1,10 +1,18 @@
 package settings
 
+import "time"
+
 type Settings struct {
 	CertDir    string
 	CaCert     string
 	ServerHost string
 	CaHost     string
+	// share online status and typing with peers. Off by default
+	Presence bool
+	// average time between the frames sent with cover traffic on, 0 to send messages as soon as they are written
+	CoverInterval time.Duration
+	// frames sent every cover interval
+	CoverBatch int
 }
 
 var CliSettings Settings
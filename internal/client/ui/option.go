@@ -4,6 +4,7 @@ import (
 	"fmt"
 
 	cli_proto "github.com/as283-ua/yappa/api/gen/client"
+	"github.com/as283-ua/yappa/internal/client/save"
 	tea "github.com/charmbracelet/bubbletea"
 )
 
@@ -43,3 +44,31 @@ func (c GoToUsersPage) Select(save *cli_proto.SaveState) (tea.Model, tea.Cmd) {
 func (c GoToUsersPage) String() string {
 	return "My chats"
 }
+
+type GoToRequestsPage struct {
+	prev tea.Model
+	save *cli_proto.SaveState
+}
+
+func (c GoToRequestsPage) Select(save *cli_proto.SaveState) (tea.Model, tea.Cmd) {
+	return NewRequestsPage(save, c.prev), nil
+}
+
+func (c GoToRequestsPage) String() string {
+	if n := len(save.Requests(c.save)); n != 0 {
+		return fmt.Sprintf("Message requests (%v)", n)
+	}
+	return "Message requests"
+}
+
+type GoToBlockedPage struct {
+	prev tea.Model
+}
+
+func (c GoToBlockedPage) Select(save *cli_proto.SaveState) (tea.Model, tea.Cmd) {
+	return NewBlockedPage(save, c.prev), nil
+}
+
+func (c GoToBlockedPage) String() string {
+	return "Blocked users"
+}
@@ -0,0 +1,163 @@
+package ui
+
+import (
+	"log"
+
+	cli_proto "github.com/as283-ua/yappa/api/gen/client"
+	"github.com/as283-ua/yappa/internal/client/save"
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+type Unblocked string
+
+type BlockedOpt struct {
+	username string
+}
+
+func (r BlockedOpt) String() string {
+	return r.username
+}
+
+func (r BlockedOpt) Select(saveState *cli_proto.SaveState) (tea.Model, tea.Cmd) {
+	save.Unblock(saveState, r.username)
+	return nil, func() tea.Msg {
+		return Unblocked(r.username)
+	}
+}
+
+// Users whose invitations are discarded. Selecting one unblocks it
+type BlockedPage struct {
+	users []Option
+
+	cursor int
+
+	inputs Inputs
+	show   bool
+
+	save *cli_proto.SaveState
+	prev tea.Model
+}
+
+func (m BlockedPage) GetOptions() []Option {
+	return m.users
+}
+
+func (m BlockedPage) GetSelected() Option {
+	return m.users[m.cursor]
+}
+
+func (m *BlockedPage) Up() {
+	m.cursor--
+	if m.cursor < 0 {
+		m.cursor = len(m.users) - 1
+	}
+}
+
+func (m *BlockedPage) Down() {
+	m.cursor++
+	if m.cursor >= len(m.users) {
+		m.cursor = 0
+	}
+}
+
+func (m BlockedPage) GetInputs() Inputs {
+	return m.inputs
+}
+
+func (m BlockedPage) ToggleShow() Inputer {
+	m.show = !m.show
+	return m
+}
+
+func (m BlockedPage) Shows() bool {
+	return m.show
+}
+
+func (m BlockedPage) Save() *cli_proto.SaveState {
+	return m.save
+}
+
+func (m BlockedPage) Previous() tea.Model {
+	return m.prev
+}
+
+func (m *BlockedPage) reload() {
+	blocked := save.Blocked(m.save)
+	m.users = make([]Option, 0, len(blocked))
+	for _, username := range blocked {
+		m.users = append(m.users, BlockedOpt{username: username})
+	}
+	m.cursor = max(min(m.cursor, len(m.users)-1), 0)
+}
+
+func NewBlockedPage(saveState *cli_proto.SaveState, prev tea.Model) BlockedPage {
+	if saveState == nil {
+		log.Println("nil save state")
+		saveState = &cli_proto.SaveState{}
+	}
+
+	inputs := Inputs{
+		Inputs: make(map[string]Input),
+		Order:  make([]string, 0),
+	}
+
+	inputs.Add(DOWN)
+	inputs.Add(UP)
+	inputs.Add(SELECT)
+	inputs.Add(RETURN)
+	inputs.Add(QUIT)
+	inputs.Add(HELP)
+
+	page := BlockedPage{
+		inputs: inputs,
+		save:   saveState,
+		prev:   prev,
+	}
+	page.reload()
+	return page
+}
+
+func (m BlockedPage) Init() tea.Cmd {
+	return nil
+}
+
+func (m BlockedPage) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	var cmd tea.Cmd = nil
+	var model tea.Model = nil
+
+	switch msg := msg.(type) {
+	case tea.KeyMsg:
+		input, ok := m.inputs.Inputs[msg.String()]
+		if ok {
+			modelTemp, cmdTemp := input.Action(&m)
+			if modelTemp != nil {
+				model = modelTemp
+			}
+
+			if cmdTemp != nil {
+				cmd = tea.Batch(cmd, cmdTemp)
+			}
+		}
+	case Unblocked:
+		m.reload()
+	}
+
+	if model == nil {
+		model = m
+	}
+
+	return model, cmd
+}
+
+func (m BlockedPage) View() string {
+	s := Bold.Render("Blocked users") + "\n\n"
+	s += "Their chat invitations are discarded. Select one to unblock it.\n\n\n"
+	s += renderList(m.users, m.cursor, "No blocked users")
+
+	s += "\n\n"
+
+	s += Render(m)
+
+	s += "\n\n"
+	return s
+}
@@ -17,25 +17,58 @@ import (
 	"github.com/charmbracelet/lipgloss"
 )
 
-func messageToString(m *client.ClientEvent, senderStyle lipgloss.Style, debug bool) string {
+var tickStyle = lipgloss.NewStyle().Foreground(lipgloss.Color("#888"))
+var readTickStyle = lipgloss.NewStyle().Foreground(lipgloss.Color("#4af"))
+
+// Ticks shown next to the client's own messages
+func statusTick(status client.MessageStatus) string {
+	switch status {
+	case client.MessageStatus_STATUS_PENDING:
+		return tickStyle.Render(" ·")
+	case client.MessageStatus_STATUS_FAILED:
+		return Warning.Render(" ✗")
+	case client.MessageStatus_STATUS_EXPIRED:
+		return Warning.Render(" ✗ expired")
+	case client.MessageStatus_STATUS_STORED, client.MessageStatus_STATUS_RELAYED:
+		return tickStyle.Render(" ✓")
+	case client.MessageStatus_STATUS_DELIVERED:
+		return tickStyle.Render(" ✓✓")
+	case client.MessageStatus_STATUS_READ:
+		return readTickStyle.Render(" ✓✓")
+	}
+	return ""
+}
+
+// tick is appended after the timestamp of chat messages, empty for the peer's
+func messageToString(m *client.ClientEvent, senderStyle lipgloss.Style, debug bool, tick string) string {
 	t := time.Unix(int64(m.Timestamp), 0).UTC()
 	switch msg := m.Payload.(type) {
 	case *client.ClientEvent_Message:
 		if debug {
-			return fmt.Sprintf("%s - %s (serial %v)\n%s\n", senderStyle.Render(m.Sender), t.Format("2 Jan 2006 15:04:05"), m.Serial, msg.Message.Msg)
+			return fmt.Sprintf("%s - %s%s (serial %v)\n%s\n", senderStyle.Render(m.Sender), t.Format("2 Jan 2006 15:04:05"), tick, m.Serial, msg.Message.Msg)
 		}
-		return fmt.Sprintf("%s - %s\n%s\n", senderStyle.Render(m.Sender), t.Format("2 Jan 2006 15:04:05"), msg.Message.Msg)
+		return fmt.Sprintf("%s - %s%s\n%s\n", senderStyle.Render(m.Sender), t.Format("2 Jan 2006 15:04:05"), tick, msg.Message.Msg)
 	case *client.ClientEvent_KeyRotation:
 		if debug {
 			return fmt.Sprintf("%s - %s (serial %v) ~ ML-KEM Key Rotation\n%v ... %v\n", senderStyle.Render(m.Sender), t.Format("2 Jan 2006 15:04:05"), m.Serial, msg.KeyRotation.KeyExchangeData[:5], msg.KeyRotation.KeyExchangeData[len(msg.KeyRotation.KeyExchangeData)-5:])
 		}
+	case *client.ClientEvent_Receipt:
+		if debug {
+			return fmt.Sprintf("%s - %s (serial %v) ~ %v for %v\n", senderStyle.Render(m.Sender), t.Format("2 Jan 2006 15:04:05"), m.Serial, msg.Receipt.Type, msg.Receipt.Serials)
+		}
 	}
 	return ""
 }
 
+// The peer's typing line is hidden if it doesn't say it's still typing within TYPING_TIMEOUT. While typing, the
+// client repeats it every TYPING_RESEND
+const TYPING_TIMEOUT = 6 * time.Second
+const TYPING_RESEND = 3 * time.Second
+
+type TypingExpired struct{}
+
 type ChatPage struct {
 	peer         *server.UserData
-	encapKey     *mlkem.EncapsulationKey1024
 	chat         *client.Chat
 	viewport     viewport.Model
 	vpContent    string
@@ -53,7 +86,11 @@ type ChatPage struct {
 	prev tea.Model
 
 	subId        int
-	subscription <-chan *client.ClientEvent
+	subscription <-chan any
+
+	peerOnline bool
+	peerTyping time.Time
+	typingSent time.Time
 }
 
 type MsgSend struct{}
@@ -104,6 +141,7 @@ func NewChatPage(save *client.SaveState, prev tea.Model, user *server.UserData)
 	inputs.Add(QUIT)
 	inputs.Add(HELP)
 	inputs.Add(Debug)
+	inputs.Add(GoToReport)
 
 	vp := viewport.New(120, 20)
 	vp.KeyMap.Down.SetKeys("down")
@@ -153,6 +191,17 @@ func loadChat(saveState *client.SaveState, peer *server.UserData) tea.Cmd {
 		log.Println("Loading chat")
 		chat := save.DirectChatByUser(saveState, peer.Username)
 		var err error
+		if req, ok := save.RequestByUser(saveState, peer.Username); chat == nil && ok {
+			// opening the chat accepts the peer's request instead of starting another one
+			chat, err = service.AcceptRequest(saveState, req.Chat.Peer.InboxId)
+			if chat == nil {
+				return err
+			}
+			if err != nil {
+				log.Printf("Errors accepting request: %v", err)
+			}
+			return chat
+		}
 		if chat == nil {
 			log.Println("First time chatting, retrieving data...")
 			chat, err = service.GetChatClient().NewChat(peer)
@@ -160,6 +209,12 @@ func loadChat(saveState *client.SaveState, peer *server.UserData) tea.Cmd {
 				log.Printf("Error creating chat: %v", err)
 				return err
 			}
+			// saved right away so the peer's first reply can already be relayed
+			save.NewDirectChat(saveState, chat)
+			err = service.RegisterDelivery(saveState)
+			if err != nil {
+				log.Printf("Error registering delivery tokens: %v", err)
+			}
 		}
 		return chat
 	}
@@ -170,6 +225,57 @@ func (m ChatPage) waitMessage() tea.Msg {
 	return msg
 }
 
+func (m ChatPage) eventString(ev *client.ClientEvent) string {
+	if ev.Sender != service.GetUsername() {
+		return messageToString(ev, m.peerStyle, m.debugMode, "")
+	}
+	return messageToString(ev, m.selfStyle, m.debugMode, statusTick(save.Status(m.chat, ev.Serial)))
+}
+
+// Rebuilds the viewport from the chat history
+func (m *ChatPage) renderEvents() {
+	m.vpContent = ""
+	for _, ev := range m.chat.Events {
+		text := m.eventString(ev)
+		if text != "" {
+			m.vpContent += text + "\n"
+		}
+	}
+	m.viewport.SetContent(m.vpContent)
+}
+
+// Best effort, ephemeral events are only for whoever is connected right now
+func sendTyping(chat *client.Chat, typing bool) tea.Cmd {
+	return func() tea.Msg {
+		err := service.SendTyping(chat, typing)
+		if err != nil {
+			log.Printf("Error sending typing: %v", err)
+		}
+		return nil
+	}
+}
+
+func sendOnline(chat *client.Chat) tea.Cmd {
+	return func() tea.Msg {
+		err := service.SendOnline(chat, true)
+		if err != nil {
+			log.Printf("Error sending online: %v", err)
+		}
+		return nil
+	}
+}
+
+// Reports the peer's messages shown so far as read
+func markRead(chat *client.Chat) tea.Cmd {
+	return func() tea.Msg {
+		err := service.SendReceipt(chat, client.ReceiptType_RECEIPT_READ, save.TakeUnread(chat))
+		if err != nil {
+			log.Printf("Error sending read receipt: %v", err)
+		}
+		return nil
+	}
+}
+
 func (m ChatPage) Init() tea.Cmd {
 	return tea.Batch(tea.ClearScreen, loadChat(m.save, m.peer), m.waitMessage)
 }
@@ -185,6 +291,10 @@ func (m ChatPage) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	switch msg := msg.(type) {
 	case tea.KeyMsg:
 		input, ok := m.inputs.Inputs[msg.String()]
+		if !ok && m.chat != nil && time.Since(m.typingSent) > TYPING_RESEND {
+			m.typingSent = time.Now()
+			cmd = tea.Batch(cmd, sendTyping(m.chat, true))
+		}
 		if ok {
 			modelTemp, cmdTemp := input.Action(&m)
 			if modelTemp != nil {
@@ -201,26 +311,13 @@ func (m ChatPage) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		log.Printf("Loaded chat with %v\n", msg.Peer.Username)
 		m.chat = msg
 
-		var err error
-		m.encapKey, err = mlkem.NewEncapsulationKey1024(m.chat.Peer.KeyExchange)
+		_, err := mlkem.NewEncapsulationKey1024(m.chat.Peer.KeyExchange)
 		if err != nil {
 			cmd = tea.Batch(cmd, func() tea.Msg { return err })
 			break
 		}
 
-		m.vpContent = ""
-		text := ""
-		for _, ev := range m.chat.Events {
-			if ev.Sender == service.GetUsername() {
-				text = messageToString(ev, m.selfStyle, m.debugMode)
-			} else {
-				text = messageToString(ev, m.peerStyle, m.debugMode)
-			}
-			if text != "" {
-				m.vpContent += text + "\n"
-			}
-		}
-		m.viewport.SetContent(m.vpContent)
+		m.renderEvents()
 		m.viewport.GotoBottom()
 
 		subId, subscription := service.GetChatClient().Subscribe([32]byte(m.chat.Peer.InboxId))
@@ -229,66 +326,51 @@ func (m ChatPage) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		}
 		m.subId = subId
 		m.subscription = subscription
-		cmd = tea.Batch(cmd, m.waitMessage)
+		m.peerOnline = service.PeerOnline(m.chat.Peer.InboxId)
+		cmd = tea.Batch(cmd, m.waitMessage, markRead(m.chat), sendOnline(m.chat))
 	case MsgSend:
 		txt := strings.TrimSpace(m.textbox.Value())
 		if txt == "" {
 			break
 		}
-		encMsg, event, err := service.EncryptMessageForPeer(m.chat, txt)
-		if err != nil {
-			cmd = tea.Batch(cmd, func() tea.Msg { return err })
-			break
+		sent, err := service.SendMessage(m.chat, txt)
+		if len(sent) != 0 {
+			m.textbox.SetValue("")
+			m.typingSent = time.Time{}
+			cmd = tea.Batch(cmd, sendTyping(m.chat, false))
 		}
-
-		err = service.GetChatClient().Send(&server.ClientMessage{
-			Payload: &server.ClientMessage_Send{
-				Send: encMsg,
-			},
-		})
-		if err != nil {
-			cmd = tea.Batch(cmd, func() tea.Msg { return err })
-			break
-		}
-		save.NewEvent(m.chat, m.chat.CurrentSerial+1, service.Ratchet(m.chat.Key), event)
-		m.textbox.SetValue("")
-		msgTxt := messageToString(event, m.selfStyle, m.debugMode)
-		if msgTxt != "" {
-			m.vpContent += msgTxt + "\n"
-			m.viewport.SetContent(m.vpContent)
-			m.viewport.GotoBottom()
-		}
-
-		if service.KeyExchNeeded(m.chat) {
-			log.Printf("Sending key exchange on send. Current serial = %v, first message = %v. Frequency = %v", m.chat.CurrentSerial, m.chat.SerialStart, service.MLKEM_RATCHET_INTERVAL)
-			encMsg, kevent, key, err := service.KeyExchangeEvent(m.chat, m.encapKey)
-			if err != nil {
-				cmd = tea.Batch(cmd, func() tea.Msg { return err })
-				break
-			}
-			err = service.GetChatClient().Send(&server.ClientMessage{
-				Payload: &server.ClientMessage_Send{
-					Send: encMsg,
-				},
-			})
-			if err != nil {
-				cmd = tea.Batch(cmd, func() tea.Msg { return err })
-				break
-			}
-			save.NewEvent(m.chat, m.chat.CurrentSerial+1, key, kevent)
-			msgTxt := messageToString(kevent, m.selfStyle, m.debugMode)
+		for _, event := range sent {
+			msgTxt := m.eventString(event)
 			if msgTxt != "" {
 				m.vpContent += msgTxt + "\n"
 				m.viewport.SetContent(m.vpContent)
 				m.viewport.GotoBottom()
 			}
 		}
+		if err != nil {
+			cmd = tea.Batch(cmd, func() tea.Msg { return err })
+		}
 	case *client.ClientEvent:
-		style := m.peerStyle
-		if msg.Sender != m.peer.Username {
-			style = m.selfStyle
+		switch payload := msg.Payload.(type) {
+		case *client.ClientEvent_Typing:
+			m.peerTyping = time.Time{}
+			if payload.Typing.Typing {
+				m.peerTyping = time.Now()
+				cmd = tea.Batch(cmd, TimedCmd(TYPING_TIMEOUT, TypingExpired{}))
+			}
+			m.peerOnline = true
+			cmd = tea.Batch(cmd, m.waitMessage)
+			return m, cmd
+		case *client.ClientEvent_Online:
+			m.peerOnline = payload.Online.Online
+			cmd = tea.Batch(cmd, m.waitMessage)
+			return m, cmd
+		}
+		msgTxt := m.eventString(msg)
+		if _, ok := msg.Payload.(*client.ClientEvent_Message); ok && msg.Sender == m.peer.Username {
+			m.peerTyping = time.Time{}
+			cmd = tea.Batch(cmd, markRead(m.chat))
 		}
-		msgTxt := messageToString(msg, style, m.debugMode)
 		if msgTxt != "" {
 			goToBottom := false
 			if m.viewport.AtBottom() {
@@ -301,6 +383,21 @@ func (m ChatPage) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 			}
 		}
 		cmd = tea.Batch(cmd, m.waitMessage)
+	case service.StatusUpdate:
+		goToBottom := m.viewport.AtBottom()
+		m.renderEvents()
+		if goToBottom {
+			m.viewport.GotoBottom()
+		}
+		cmd = tea.Batch(cmd, m.waitMessage)
+	case service.PresenceUpdate:
+		m.peerOnline = msg.Online
+		if !msg.Online {
+			m.peerTyping = time.Time{}
+		}
+		cmd = tea.Batch(cmd, m.waitMessage)
+	case TypingExpired:
+		// redrawn without the typing line once it's stale
 	case error:
 		m.errorMessage = msg.Error()
 		cmd = tea.Batch(cmd, TimedCmd(5*time.Second, ClearErrorMsg{}))
@@ -308,19 +405,7 @@ func (m ChatPage) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		m.errorMessage = ""
 	case DebugToggle:
 		m.debugMode = !m.debugMode
-		m.vpContent = ""
-		text := ""
-		for _, ev := range m.chat.Events {
-			if ev.Sender == service.GetUsername() {
-				text = messageToString(ev, m.selfStyle, m.debugMode)
-			} else {
-				text = messageToString(ev, m.peerStyle, m.debugMode)
-			}
-			if text != "" {
-				m.vpContent += text + "\n"
-			}
-		}
-		m.viewport.SetContent(m.vpContent)
+		m.renderEvents()
 		m.viewport.GotoBottom()
 	}
 
@@ -334,17 +419,30 @@ func (m ChatPage) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 func (m ChatPage) View() string {
 	var s string
 
-	s = fmt.Sprintf("Chat with '%s'\n", m.peer.Username)
+	s = fmt.Sprintf("Chat with '%s'", m.peer.Username)
+	if m.peerOnline {
+		s += tickStyle.Render(" · online")
+	}
+	s += "\n"
 	if m.chat != nil && m.debugMode {
 		s += fmt.Sprintf("Inbox id: %v\n", m.chat.Peer.InboxId)
 		s += fmt.Sprintf("Current expected message serial: %v\n", m.chat.CurrentSerial)
 		s += fmt.Sprintf("Initiator: %v\n", m.chat.Initiator)
-		s += fmt.Sprintf("%v ... %v\n", m.chat.Key[:5], m.chat.Key[len(m.chat.Key)-5:])
+		key := m.chat.Key
+		if m.chat.Ratchet != nil {
+			key = m.chat.Ratchet.RootKey
+		}
+		if len(key) >= 10 {
+			s += fmt.Sprintf("%v ... %v\n", key[:5], key[len(key)-5:])
+		}
 	}
 
 	s += "________________________________________________________________________________\n"
 	s += m.viewport.View() + "\n"
-	s += "‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾\n\n"
+	if !m.peerTyping.IsZero() && time.Since(m.peerTyping) < TYPING_TIMEOUT {
+		s += tickStyle.Render(fmt.Sprintf("%s is typing...", m.peer.Username))
+	}
+	s += "\n‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾\n\n"
 	s += m.textbox.View() + "\n"
 
 	if m.errorMessage != "" {
@@ -90,12 +90,14 @@ func NewMainPage(save *cli_proto.SaveState) MainPage {
 	}
 	page.titleScreen = titleScreen
 
-	options := make([]Option, 0, 2)
+	options := make([]Option, 0, 4)
 
 	if !hasCert() {
 		options = append(options, GoToRegister{})
 	} else {
 		options = append(options, GoToUsersPage{prev: page})
+		options = append(options, GoToRequestsPage{prev: page, save: save})
+		options = append(options, GoToBlockedPage{prev: page})
 	}
 
 	options = append(options, Exit{})
@@ -0,0 +1,267 @@
+package ui
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	cli_proto "github.com/as283-ua/yappa/api/gen/client"
+	"github.com/as283-ua/yappa/api/gen/server"
+	"github.com/as283-ua/yappa/internal/client/service"
+	"github.com/charmbracelet/bubbles/textinput"
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+type ReportSent int32
+
+type ReasonOpt struct {
+	reason server.ReportReason
+	label  string
+}
+
+func (r ReasonOpt) String() string {
+	return r.label
+}
+
+// Submitting is done from the page, the reason alone isn't a report
+func (r ReasonOpt) Select(_ *cli_proto.SaveState) (tea.Model, tea.Cmd) {
+	return nil, nil
+}
+
+var reportReasons = []Option{
+	ReasonOpt{reason: server.ReportReason_REPORT_SPAM, label: "Spam"},
+	ReasonOpt{reason: server.ReportReason_REPORT_HARASSMENT, label: "Harassment"},
+	ReasonOpt{reason: server.ReportReason_REPORT_ILLEGAL, label: "Illegal content"},
+	ReasonOpt{reason: server.ReportReason_REPORT_OTHER, label: "Other"},
+}
+
+var GoToReport = Input{
+	Keys:        []string{"ctrl+r"},
+	Description: "Report user",
+	Action: func(m tea.Model) (tea.Model, tea.Cmd) {
+		page, ok := m.(*ChatPage)
+		if !ok || page.chat == nil {
+			return m, nil
+		}
+		return NewReportPage(page.save, *page, page.peer.Username, page.chat), nil
+	},
+}
+
+var AttachMessages = Input{
+	Keys:        []string{"ctrl+a"},
+	Description: "Attach messages",
+	Action: func(m tea.Model) (tea.Model, tea.Cmd) {
+		page, ok := m.(*ReportPage)
+		if !ok {
+			return m, nil
+		}
+		page.attach = !page.attach
+		return page, nil
+	},
+}
+
+var SubmitReport = Input{
+	Keys:        []string{"enter"},
+	Description: "Send report",
+	Action: func(m tea.Model) (tea.Model, tea.Cmd) {
+		page, ok := m.(*ReportPage)
+		if !ok || page.sending {
+			return m, nil
+		}
+		page.sending = true
+		return page, page.send()
+	},
+}
+
+// Reports a user to the server's admins. The messages of the chat stay private unless the reporter chooses to
+// attach them
+type ReportPage struct {
+	reported string
+	chat     *cli_proto.Chat
+	comment  textinput.Model
+	attach   bool
+	sending  bool
+
+	cursor       int
+	errorMessage string
+
+	inputs Inputs
+	show   bool
+
+	save *cli_proto.SaveState
+	prev tea.Model
+}
+
+func (m ReportPage) GetOptions() []Option {
+	return reportReasons
+}
+
+func (m ReportPage) GetSelected() Option {
+	return reportReasons[m.cursor]
+}
+
+func (m *ReportPage) Up() {
+	m.cursor--
+	if m.cursor < 0 {
+		m.cursor = len(reportReasons) - 1
+	}
+}
+
+func (m *ReportPage) Down() {
+	m.cursor++
+	if m.cursor >= len(reportReasons) {
+		m.cursor = 0
+	}
+}
+
+func (m ReportPage) GetInputs() Inputs {
+	return m.inputs
+}
+
+func (m ReportPage) ToggleShow() Inputer {
+	m.show = !m.show
+	return m
+}
+
+func (m ReportPage) Shows() bool {
+	return m.show
+}
+
+func (m ReportPage) Save() *cli_proto.SaveState {
+	return m.save
+}
+
+func (m ReportPage) Previous() tea.Model {
+	return m.prev
+}
+
+func NewReportPage(saveState *cli_proto.SaveState, prev tea.Model, reported string, chat *cli_proto.Chat) ReportPage {
+	if saveState == nil {
+		log.Println("nil save state")
+		saveState = &cli_proto.SaveState{}
+	}
+
+	inputs := Inputs{
+		Inputs: make(map[string]Input),
+		Order:  make([]string, 0),
+	}
+
+	inputs.Add(DOWN)
+	inputs.Add(UP)
+	inputs.Add(SubmitReport)
+	inputs.Add(AttachMessages)
+	inputs.Add(RETURN)
+	inputs.Add(QUIT)
+	inputs.Add(HELP)
+
+	comment := textinput.New()
+	comment.Placeholder = "Tell the admins what happened (optional)"
+	comment.Prompt = "◆ "
+	comment.CharLimit = 2000
+	comment.Width = 80
+	comment.Focus()
+
+	return ReportPage{
+		reported: reported,
+		chat:     chat,
+		comment:  comment,
+		inputs:   inputs,
+		save:     saveState,
+		prev:     prev,
+	}
+}
+
+// Signed messages of the reported user that attaching would disclose
+func (m ReportPage) evidenceCount() int {
+	evidence, err := service.ReportEvidence(m.reported, m.chat.Events)
+	if err != nil {
+		return 0
+	}
+	return len(evidence)
+}
+
+func (m ReportPage) send() tea.Cmd {
+	reason := m.GetSelected().(ReasonOpt).reason
+	comment := m.comment.Value()
+	var events []*cli_proto.ClientEvent
+	if m.attach {
+		events = m.chat.Events
+	}
+	return func() tea.Msg {
+		id, err := service.GetChatClient().Report(m.reported, reason, comment, events)
+		if err != nil {
+			return err
+		}
+		return ReportSent(id)
+	}
+}
+
+func (m ReportPage) Init() tea.Cmd {
+	return tea.ClearScreen
+}
+
+func (m ReportPage) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	var cmd tea.Cmd = nil
+	var model tea.Model = nil
+
+	m.comment, cmd = m.comment.Update(msg)
+
+	switch msg := msg.(type) {
+	case tea.KeyMsg:
+		input, ok := m.inputs.Inputs[msg.String()]
+		if ok {
+			modelTemp, cmdTemp := input.Action(&m)
+			if modelTemp != nil {
+				model = modelTemp
+			}
+
+			if cmdTemp != nil {
+				cmd = tea.Batch(cmd, cmdTemp)
+			}
+		}
+	case ReportSent:
+		log.Printf("Report %v against %v sent\n", msg, m.reported)
+		model = m.prev
+		cmd = m.prev.Init()
+	case error:
+		m.sending = false
+		m.errorMessage = msg.Error()
+		cmd = tea.Batch(cmd, TimedCmd(5*time.Second, ClearErrorMsg{}))
+	case ClearErrorMsg:
+		m.errorMessage = ""
+	}
+
+	if model == nil {
+		model = m
+	}
+
+	return model, cmd
+}
+
+func (m ReportPage) View() string {
+	s := Bold.Render(fmt.Sprintf("Report '%v'", m.reported)) + "\n\n"
+	s += "Reason:\n\n"
+	s += renderList(reportReasons, m.cursor, "")
+	s += "\n" + m.comment.View() + "\n\n"
+
+	if m.attach {
+		s += Warning.Render(fmt.Sprintf("Attaching their last %v signed messages, the admins will be able to read them", m.evidenceCount()))
+	} else {
+		s += "No messages attached. The chat stays private"
+	}
+
+	if m.sending {
+		s += "\n\nSending..."
+	}
+
+	if m.errorMessage != "" {
+		s += Warning.Render("\n\nError: ") + m.errorMessage
+	}
+
+	s += "\n\n"
+
+	s += Render(m)
+
+	s += "\n\n"
+	return s
+}
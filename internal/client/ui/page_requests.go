@@ -0,0 +1,231 @@
+package ui
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	cli_proto "github.com/as283-ua/yappa/api/gen/client"
+	"github.com/as283-ua/yappa/api/gen/server"
+	"github.com/as283-ua/yappa/internal/client/save"
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+type RequestOpt struct {
+	req *cli_proto.MessageRequest
+}
+
+func (r RequestOpt) String() string {
+	received := time.Unix(int64(r.req.ReceivedAt), 0).Format(time.DateTime)
+	return fmt.Sprintf("%v · %v", r.req.Chat.Peer.Username, received)
+}
+
+// Opening the chat accepts the request
+func (r RequestOpt) Select(_ *cli_proto.SaveState) (tea.Model, tea.Cmd) {
+	peer := r.req.Chat.Peer
+	return nil, func() tea.Msg {
+		return &server.UserData{
+			Username:       peer.Username,
+			Certificate:    string(peer.Cert),
+			PubKeyExchange: peer.KeyExchange,
+		}
+	}
+}
+
+var DeclineRequest = Input{
+	Keys:        []string{"ctrl+x"},
+	Description: "Decline request",
+	Action: func(m tea.Model) (tea.Model, tea.Cmd) {
+		page, ok := m.(*RequestsPage)
+		if !ok || len(page.requests) == 0 {
+			return m, nil
+		}
+		req := page.requests[page.cursor].(RequestOpt).req
+		save.DeclineRequest(page.save, req.Chat.Peer.InboxId)
+		page.reload()
+		return page, nil
+	},
+}
+
+var BlockSender = Input{
+	Keys:        []string{"ctrl+b"},
+	Description: "Block sender",
+	Action: func(m tea.Model) (tea.Model, tea.Cmd) {
+		page, ok := m.(*RequestsPage)
+		if !ok || len(page.requests) == 0 {
+			return m, nil
+		}
+		req := page.requests[page.cursor].(RequestOpt).req
+		save.Block(page.save, req.Chat.Peer.Username)
+		page.reload()
+		return page, nil
+	},
+}
+
+// Chat invitations from users without a chat yet, waiting to be accepted, declined or blocked
+type RequestsPage struct {
+	requests []Option
+
+	cursor       int
+	errorMessage string
+
+	inputs Inputs
+	show   bool
+
+	save *cli_proto.SaveState
+	prev tea.Model
+}
+
+func (m RequestsPage) GetOptions() []Option {
+	return m.requests
+}
+
+func (m RequestsPage) GetSelected() Option {
+	return m.requests[m.cursor]
+}
+
+func (m *RequestsPage) Up() {
+	m.cursor--
+	if m.cursor < 0 {
+		m.cursor = len(m.requests) - 1
+	}
+}
+
+func (m *RequestsPage) Down() {
+	m.cursor++
+	if m.cursor >= len(m.requests) {
+		m.cursor = 0
+	}
+}
+
+func (m RequestsPage) GetInputs() Inputs {
+	return m.inputs
+}
+
+func (m RequestsPage) ToggleShow() Inputer {
+	m.show = !m.show
+	return m
+}
+
+func (m RequestsPage) Shows() bool {
+	return m.show
+}
+
+func (m RequestsPage) Save() *cli_proto.SaveState {
+	return m.save
+}
+
+func (m RequestsPage) Previous() tea.Model {
+	return m.prev
+}
+
+func (m *RequestsPage) reload() {
+	reqs := save.Requests(m.save)
+	m.requests = make([]Option, 0, len(reqs))
+	for _, req := range reqs {
+		m.requests = append(m.requests, RequestOpt{req: req})
+	}
+	m.cursor = max(min(m.cursor, len(m.requests)-1), 0)
+}
+
+func NewRequestsPage(saveState *cli_proto.SaveState, prev tea.Model) RequestsPage {
+	if saveState == nil {
+		log.Println("nil save state")
+		saveState = &cli_proto.SaveState{}
+	}
+
+	inputs := Inputs{
+		Inputs: make(map[string]Input),
+		Order:  make([]string, 0),
+	}
+
+	inputs.Add(DOWN)
+	inputs.Add(UP)
+	inputs.Add(SELECT)
+	inputs.Add(DeclineRequest)
+	inputs.Add(BlockSender)
+	inputs.Add(RETURN)
+	inputs.Add(QUIT)
+	inputs.Add(HELP)
+
+	page := RequestsPage{
+		inputs: inputs,
+		save:   saveState,
+		prev:   prev,
+	}
+	page.reload()
+	return page
+}
+
+func (m RequestsPage) Init() tea.Cmd {
+	return nil
+}
+
+func (m RequestsPage) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	var cmd tea.Cmd = nil
+	var model tea.Model = nil
+
+	switch msg := msg.(type) {
+	case tea.KeyMsg:
+		input, ok := m.inputs.Inputs[msg.String()]
+		if ok {
+			modelTemp, cmdTemp := input.Action(&m)
+			if modelTemp != nil {
+				model = modelTemp
+			}
+
+			if cmdTemp != nil {
+				cmd = tea.Batch(cmd, cmdTemp)
+			}
+		}
+	case *server.UserData:
+		// back to the chats once done, the request is gone
+		model = NewChatPage(m.save, NewActiveChatsPage(m.save, m.prev), msg)
+		cmd = model.Init()
+	case error:
+		m.errorMessage = msg.Error()
+		cmd = tea.Batch(cmd, TimedCmd(5*time.Second, ClearErrorMsg{}))
+	case ClearErrorMsg:
+		m.errorMessage = ""
+	}
+
+	if model == nil {
+		model = m
+	}
+
+	return model, cmd
+}
+
+// Options one per line, the selected one highlighted
+func renderList(options []Option, cursor int, empty string) string {
+	if len(options) == 0 {
+		return WhiteForeground.Render(empty) + "\n"
+	}
+	s := ""
+	for idx, v := range options {
+		entry := fmt.Sprintf("%v. %v", idx+1, v.String())
+		if cursor == idx {
+			s += WhiteForeground.Render(entry) + "\n\n"
+		} else {
+			s += entry + "\n\n"
+		}
+	}
+	return s
+}
+
+func (m RequestsPage) View() string {
+	s := Bold.Render("Message requests") + "\n\n"
+	s += "Invitations from users you haven't chatted with. Their messages wait until you open the chat.\n\n\n"
+	s += renderList(m.requests, m.cursor, "No message requests")
+
+	if m.errorMessage != "" {
+		s += Warning.Render("\n\nError: ") + m.errorMessage
+	}
+
+	s += "\n\n"
+
+	s += Render(m)
+
+	s += "\n\n"
+	return s
+}
@@ -3,12 +3,18 @@ package chat
 import (
 	"bytes"
 	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
 	"errors"
 	"io"
+	"math"
 	"net/http"
+	"slices"
 
 	"github.com/as283-ua/yappa/api/gen/server"
+	"github.com/as283-ua/yappa/internal/server/db"
 	"github.com/as283-ua/yappa/internal/server/logging"
+	"github.com/as283-ua/yappa/internal/server/settings"
 	"github.com/as283-ua/yappa/pkg/common"
 	"github.com/jackc/pgerrcode"
 	"github.com/jackc/pgx/v5"
@@ -48,7 +54,8 @@ func CreateChatInbox(w http.ResponseWriter, r *http.Request) {
 	w.Write(raw)
 }
 
-// Puts the encrypted inbox id and sender username into the ChatInboxes table where users will check for new chats
+// Puts the encrypted inbox id and sender username into the receiver's invitation inbox where they will check for
+// new chats. The receiver's name is only used to compute the blinded inbox, it's not stored
 func NotifyChatInbox(w http.ResponseWriter, r *http.Request) {
 	logger := logging.GetLogger()
 	body, err := io.ReadAll(r.Body)
@@ -65,21 +72,50 @@ func NotifyChatInbox(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = Repo.ShareChatInbox(notify.Receiver, notify.EncSender, notify.EncInboxId, notify.EncSignature, notify.EncSerial, notify.KeyExchangeData)
+	inbox, err := InviteInbox(notify.Receiver)
+	if err != nil {
+		logger.Println("Invite inbox error:", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	maxPending := settings.ChatSettings.Limits.MaxPendingInvitationsOrDefault()
+	if maxPending > 0 {
+		// not atomic with the insert, concurrent notifies can go a few past it but they are rate limited anyway
+		pending, err := Repo.CountNewChats(inbox)
+		if err != nil {
+			logger.Println("DB error:", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if pending >= maxPending {
+			http.Error(w, "Receiver has too many pending invitations", http.StatusTooManyRequests)
+			return
+		}
+	}
+
+	err = Repo.ShareChatInbox(inbox, notify.EncSender, notify.EncInboxId, notify.EncSignature, notify.EncSerial, notify.KeyExchangeData, notify.EncRatchetKey, notify.Version)
 	if err != nil {
 		logger.Println("DB error:", err)
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
+	if OnNewChat != nil {
+		OnNewChat(notify.Receiver)
+	}
 	w.WriteHeader(http.StatusOK)
 }
 
 // Returns new chats for client and deletes the entries from db if successful
 func GetNewChats(w http.ResponseWriter, r *http.Request) {
 	logger := logging.GetLogger()
-	username := r.TLS.PeerCertificates[0].Subject.CommonName
+	inbox, err := InviteInbox(r.TLS.PeerCertificates[0].Subject.CommonName)
+	if err != nil {
+		logger.Println("Invite inbox error:", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
 
-	newChats, err := Repo.GetNewChats(username)
+	newChats, err := Repo.GetNewChats(inbox)
 	if err != nil {
 		logger.Println("DB error:", err)
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
@@ -95,6 +131,9 @@ func GetNewChats(w http.ResponseWriter, r *http.Request) {
 			KeyExchangeData: v.KeyExchangeData,
 			EncSerial:       v.EncSerial,
 			EncSign:         v.EncSignature,
+			EncRatchetKey:   v.EncRatchetKey,
+			Version:         uint32(v.Version),
+			CreatedAt:       uint64(v.CreatedAt.Time.Unix()),
 		})
 	}
 
@@ -113,7 +152,7 @@ func GetNewChats(w http.ResponseWriter, r *http.Request) {
 	}
 	w.WriteHeader(http.StatusOK)
 
-	err = Repo.DeleteNewChats(username)
+	err = Repo.DeleteNewChats(inbox)
 	if err != nil {
 		logger.Println("DB delete error:", err)
 	}
@@ -122,11 +161,22 @@ func GetNewChats(w http.ResponseWriter, r *http.Request) {
 // get encrypted inbox token for specified inbox specified in body (straight bytes, no formatting)
 func GetChatToken(w http.ResponseWriter, r *http.Request) {
 	logger := logging.GetLogger()
-	inboxId, err := io.ReadAll(r.Body)
-	if err != nil {
-		logger.Println("Body read error:", err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
-		return
+	var inboxId []byte
+	var err error
+	if r.Method == http.MethodGet {
+		// GET carries the inbox in a header so the request has no body and can be sent as 0-RTT
+		inboxId, err = base64.RawURLEncoding.DecodeString(r.Header.Get("inbox"))
+		if err != nil {
+			http.Error(w, "Invalid inbox id", http.StatusBadRequest)
+			return
+		}
+	} else {
+		inboxId, err = io.ReadAll(r.Body)
+		if err != nil {
+			logger.Println("Body read error:", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
 	}
 
 	token, err := Repo.GetToken(inboxId)
@@ -156,7 +206,65 @@ func GetChatToken(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
 
-// Returns new messages from inbox if the provided token is correct
+// Messages returned per page when the client doesn't ask for a size, and the most it can ask for
+const DEFAULT_MESSAGES_PAGE = 100
+const MAX_MESSAGES_PAGE = 500
+
+var errBadToken = errors.New("bad token")
+
+// Continuation tokens hold the row id of the first message of the next page. Messages are paged and acknowledged
+// in the order they were stored, not by serial, so an ack never covers a message stored after the fetch
+func encodePage(id int32) []byte {
+	return binary.BigEndian.AppendUint32(nil, uint32(id))
+}
+
+func decodePage(page []byte) (int32, error) {
+	if len(page) == 0 {
+		return 0, nil
+	}
+	if len(page) != 4 {
+		return 0, errors.New("invalid page token")
+	}
+	return int32(binary.BigEndian.Uint32(page)), nil
+}
+
+func pageSize(requested uint32) int {
+	if requested == 0 {
+		return DEFAULT_MESSAGES_PAGE
+	}
+	return min(int(requested), MAX_MESSAGES_PAGE)
+}
+
+// Checks the token against the inbox's current one
+func checkToken(inboxCode []byte, tokenObj db.GetInboxTokenRow, token []byte) error {
+	if tokenObj.CurrentTokenHash == nil {
+		return errBadToken
+	}
+	hash, err := tokenHash(inboxCode, tokenObj.CurrentTokenHash)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(hash, common.Hash(token)) {
+		return errBadToken
+	}
+	return nil
+}
+
+// Responds with the error of an operation on an inbox
+func inboxError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, pgx.ErrNoRows):
+		http.Error(w, "Inbox not found", http.StatusNotFound)
+	case errors.Is(err, errBadToken):
+		http.Error(w, "Bad token", http.StatusUnauthorized)
+	default:
+		logging.GetLogger().Println("DB error:", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	}
+}
+
+// Returns a page of the messages in the inbox if the provided token is correct. They are only deleted once the
+// client acknowledges them with AckMessages, so nothing is lost if the response is
 func GetNewMessages(w http.ResponseWriter, r *http.Request) {
 	logger := logging.GetLogger()
 
@@ -174,39 +282,48 @@ func GetNewMessages(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	token, err := Repo.GetToken(getMsgs.InboxId)
+	from, err := decodePage(getMsgs.Page)
 	if err != nil {
-		if errors.Is(err, pgx.ErrNoRows) {
-			http.Error(w, "Inbox not found", http.StatusNotFound)
-			return
-		}
-		logger.Println("DB error:", err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		http.Error(w, "Invalid page", http.StatusBadRequest)
 		return
 	}
+	size := pageSize(getMsgs.PageSize)
 
-	tokenHash := common.Hash(getMsgs.Token)
-	if !bytes.Equal(token.CurrentTokenHash, tokenHash) {
-		http.Error(w, "Bad token", http.StatusUnauthorized)
-		return
-	}
-
-	msgs, err := Repo.GetMessages(getMsgs.InboxId)
-	if err != nil {
-		if errors.Is(err, pgx.ErrNoRows) {
-			http.Error(w, "Inbox not found", http.StatusNotFound)
-			return
+	var msgs []db.GetMessagesPageRow
+	err = Repo.InTx(func(tx ChatRepo) error {
+		token, err := tx.GetToken(getMsgs.InboxId)
+		if err != nil {
+			return err
 		}
-		logger.Println("DB error:", err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		if token.CurrentTokenHash == nil {
+			// the token is set along with the first message and cleared once it's emptied, so there's nothing
+			// to hide. Spares the owner of a sealed inbox telling an emptied one apart from a bad token
+			return nil
+		}
+		err = checkToken(getMsgs.InboxId, token, getMsgs.Token)
+		if err != nil {
+			return err
+		}
+		// one more to know whether there's a next page and where it starts
+		msgs, err = tx.GetMessagesPage(getMsgs.InboxId, from, int32(size+1))
+		return err
+	})
+	if err != nil {
+		inboxError(w, err)
 		return
 	}
+
 	msgsProto := &server.ListNewMessages{}
+	if len(msgs) > size {
+		msgsProto.NextPage = encodePage(msgs[size].ID)
+		msgs = msgs[:size]
+	}
 	for _, msg := range msgs {
 		msgsProto.Msgs = append(msgsProto.Msgs, &server.Message{
 			EncMsg: msg.EncMsg,
 			Serial: uint64(msg.SerialN),
 		})
+		msgsProto.Cursor = uint64(msg.ID)
 	}
 	result, err := proto.Marshal(msgsProto)
 	if err != nil {
@@ -216,17 +333,105 @@ func GetNewMessages(w http.ResponseWriter, r *http.Request) {
 	}
 	w.Write(result)
 	w.WriteHeader(http.StatusOK)
+}
 
-	// this should be a transaction. look into it
-	err = Repo.FlushInbox(getMsgs.InboxId)
+// Deletes the inbox's messages up to the acknowledged cursor. Once the inbox is empty its token is cleared, so
+// the next stored message gets a new one
+func AckMessages(w http.ResponseWriter, r *http.Request) {
+	logger := logging.GetLogger()
+
+	body, err := io.ReadAll(r.Body)
 	if err != nil {
-		logger.Println("DB flush inbox error:", err)
+		logger.Println("Body read error:", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	ack := &server.AckMessages{}
+	err = proto.Unmarshal(body, ack)
+	if err != nil || ack.Cursor > math.MaxInt32 {
+		http.Error(w, "Incorrect body format", http.StatusBadRequest)
 		return
 	}
 
-	err = Repo.SetInboxToken(getMsgs.InboxId, nil, nil, nil)
+	err = Repo.InTx(func(tx ChatRepo) error {
+		token, err := tx.LockInbox(ack.InboxId)
+		if err != nil {
+			return err
+		}
+		err = checkToken(ack.InboxId, token, ack.Token)
+		if err != nil {
+			return err
+		}
+		_, err = tx.DeleteMessagesUpTo(ack.InboxId, int32(ack.Cursor))
+		if err != nil {
+			return err
+		}
+		left, err := tx.CountMessages(ack.InboxId)
+		if err != nil || left != 0 {
+			// stored after the client fetched, still readable with the same token
+			return err
+		}
+		return tx.SetInboxToken(ack.InboxId, nil, nil, nil)
+	})
 	if err != nil {
-		logging.GetLogger().Println("DB error:", err)
+		inboxError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// Max serials checked in a single CheckExpired
+const MAX_EXPIRED_CHECK = 1000
+
+// Tells the sender which of its stored messages expired before the receiver fetched them
+func CheckExpiredMessages(w http.ResponseWriter, r *http.Request) {
+	logger := logging.GetLogger()
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		logger.Println("Body read error:", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	check := &server.CheckExpired{}
+	err = proto.Unmarshal(body, check)
+	if err != nil || len(check.Serials) > MAX_EXPIRED_CHECK {
+		http.Error(w, "Incorrect body format", http.StatusBadRequest)
+		return
+	}
+	if len(check.Token) == 0 {
+		inboxError(w, errBadToken)
+		return
+	}
+
+	expired, err := Repo.GetExpiredMessages(check.InboxId, check.Serials)
+	if err != nil {
+		logger.Println("DB error:", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
+	// only messages stored with the hash of this token, so nobody else learns what the sender stored
+	hash := common.Hash(check.Token)
+	serials := make([]uint64, 0, len(expired))
+	for _, v := range expired {
+		auth, err := senderAuthHash(check.InboxId, v.SenderAuth)
+		if err != nil {
+			logger.Println("Sender auth unwrap error:", err)
+			continue
+		}
+		if bytes.Equal(auth, hash) && !slices.Contains(serials, uint64(v.SerialN)) {
+			serials = append(serials, uint64(v.SerialN))
+		}
+	}
+
+	result, err := proto.Marshal(&server.ExpiredMessages{Serials: serials})
+	if err != nil {
+		logger.Println("Marshal error:", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.Write(result)
+	w.WriteHeader(http.StatusOK)
 }
@@ -0,0 +1,70 @@
+package chat
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/as283-ua/yappa/internal/server/keys"
+	"github.com/as283-ua/yappa/internal/server/logging"
+	"github.com/as283-ua/yappa/pkg/common"
+)
+
+// Secret the invitation inboxes are blinded with. Only stored encrypted with the master key or outside the
+// database, so a leaked dump can't tell whose invitations are whose
+var inviteKey []byte
+
+// Name of the invite key among the server's secrets
+const INVITE_KEY_SECRET = "invite key"
+
+var ErrNoInviteKey = errors.New("no invite key loaded")
+
+// Loads the invite key from path, creating it if it doesn't exist. Without a path it's kept in the database,
+// wrapped with the master key, or if there is no keyring a random one is used, which leaves pending invitations
+// unreachable after a restart
+func LoadInviteKey(path string) error {
+	if path == "" && keys.Ring != nil {
+		key, err := keys.Ring.Secret(INVITE_KEY_SECRET)
+		if err != nil {
+			return err
+		}
+		inviteKey = key
+		return nil
+	}
+	if path == "" {
+		logging.GetLogger().Println("No invite key configured, invitations pending on restart will be lost")
+		inviteKey = make([]byte, common.KEY_SIZE)
+		rand.Read(inviteKey)
+		return nil
+	}
+
+	key, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		key = make([]byte, common.KEY_SIZE)
+		rand.Read(key)
+		err = os.WriteFile(path, key, 0600)
+	}
+	if err != nil {
+		return err
+	}
+	if len(key) < common.KEY_SIZE {
+		return fmt.Errorf("invite key must be at least %v bytes", common.KEY_SIZE)
+	}
+	inviteKey = key
+	return nil
+}
+
+// Blinded id of the user's invitation inbox: the username and bytes derived from it with the invite key, through
+// SHA-512. Only computed for the certificate owner fetching it or a sender naming them. Fails until
+// LoadInviteKey is called
+func InviteInbox(username string) ([]byte, error) {
+	if len(inviteKey) == 0 {
+		return nil, ErrNoInviteKey
+	}
+	salt, err := common.DeriveKey(inviteKey, common.LabelInviteInbox, []byte(username))
+	if err != nil {
+		return nil, err
+	}
+	return common.Hash(append([]byte(username), salt...)), nil
+}
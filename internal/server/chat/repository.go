@@ -2,60 +2,151 @@ package chat
 
 import (
 	"context"
+	"time"
 
 	"github.com/as283-ua/yappa/internal/server/db"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
 type ChatRepo interface {
-	ShareChatInbox(username string, encSender, encInboxCode, encSignature, encSerial, keyExchangeData []byte) error
+	ShareChatInbox(inbox []byte, encSender, encInboxCode, encSignature, encSerial, keyExchangeData, encRatchetKey []byte, version uint32) error
 	CreateChatInbox(inboxCode []byte) error
-	GetNewChats(username string) ([]db.GetNewUserInboxesRow, error)
-	DeleteNewChats(username string) error
+	GetNewChats(inbox []byte) ([]db.GetNewUserInboxesRow, error)
+	DeleteNewChats(inbox []byte) error
+	// How many invitations are waiting in the invitation inbox, see InviteInbox
+	CountNewChats(inbox []byte) (int64, error)
 	SetInboxToken(inboxCode, tokenHash, encToken, keyExchangeData []byte) error
 	GetToken(inboxCode []byte) (db.GetInboxTokenRow, error)
-	AddMessage(inboxCode []byte, serial uint64, encMsg []byte) error
+	// senderAuth is the hash of the token the sender checks the message's expiry with, nil if it sent none
+	AddMessage(inboxCode []byte, serial uint64, encMsg, senderAuth []byte) error
 	GetMessages(inboxCode []byte) ([]db.GetMessagesRow, error)
+	// Up to limit messages of the inbox in the order they were stored, starting at the given id
+	GetMessagesPage(inboxCode []byte, from int32, limit int32) ([]db.GetMessagesPageRow, error)
 	FlushInbox(inboxCode []byte) error
+
+	// Runs fn in a single transaction, committed if fn returns nil and rolled back otherwise. Every method of
+	// the repo passed to fn runs in the transaction
+	InTx(fn func(tx ChatRepo) error) error
+	// Same as GetToken, but the inbox stays locked until the transaction ends, so its token and messages can't
+	// change in between
+	LockInbox(inboxCode []byte) (db.GetInboxTokenRow, error)
+	// Same as LockInbox, creating the inbox first if it doesn't exist
+	LockOrCreateInbox(inboxCode []byte) (db.GetInboxTokenRow, error)
+	CountMessages(inboxCode []byte) (int64, error)
+	// Deletes the messages of the inbox stored up to the one with the given id. Returns how many were deleted
+	DeleteMessagesUpTo(inboxCode []byte, id int32) (int64, error)
+
+	// Deletes messages stored before the given time and, in each inbox, the first stored past maxMessages or
+	// maxBytes, recording them as expired. Returns how many were deleted
+	ExpireMessages(before time.Time, maxMessages, maxBytes int64) (int64, error)
+	// Deletes invitations stored before the given time
+	ExpireInvitations(before time.Time) (int64, error)
+	// Deletes the records of messages that expired before the given time
+	ForgetExpiredMessages(before time.Time) (int64, error)
+	// Records of the serials that expired in the inbox and were stored with a sender auth, wrapped as stored
+	GetExpiredMessages(inboxCode []byte, serials []uint64) ([]db.GetExpiredMessagesRow, error)
+	// Deletes the inboxes without messages created before the given time, skipping those locked by a store in
+	// progress. Returns how many were deleted
+	DeleteEmptyInboxes(before time.Time) (int64, error)
+
+	// Up to limit inboxes whose token hash doesn't start with the key id, i.e. isn't wrapped with that key
+	StaleTokens(keyId []byte, limit int32) ([]db.ListStaleInboxTokensRow, error)
+	// Replaces the inbox's token hash if it still is old. Returns false otherwise
+	RewrapToken(inboxCode, old, tokenHash []byte) (bool, error)
+	// Same as StaleTokens and RewrapToken for the sender auths of stored messages
+	StaleMessageAuths(keyId []byte, limit int32) ([]db.ListStaleMessageAuthsRow, error)
+	RewrapMessageAuth(id int32, old, senderAuth []byte) (bool, error)
+	// Same as StaleTokens and RewrapToken for the sender auths of expired messages
+	StaleExpiredAuths(keyId []byte, limit int32) ([]db.ListStaleExpiredAuthsRow, error)
+	RewrapExpiredAuth(id int32, old, senderAuth []byte) (bool, error)
 }
 
 type PgxChatRepo struct {
 	Pool *pgxpool.Pool
 	Ctx  context.Context
+
+	// only set in the repos InTx passes along
+	tx pgx.Tx
+}
+
+func (r PgxChatRepo) queries() *db.Queries {
+	if r.tx != nil {
+		return db.New(r.Pool).WithTx(r.tx)
+	}
+	return db.New(r.Pool)
+}
+
+func (r PgxChatRepo) InTx(fn func(tx ChatRepo) error) error {
+	if r.tx != nil {
+		// already in one
+		return fn(r)
+	}
+	return pgx.BeginFunc(r.Ctx, r.Pool, func(tx pgx.Tx) error {
+		txRepo := r
+		txRepo.tx = tx
+		return fn(txRepo)
+	})
+}
+
+func (r PgxChatRepo) LockInbox(inboxCode []byte) (db.GetInboxTokenRow, error) {
+	row, err := r.queries().LockInbox(r.Ctx, inboxCode)
+	return db.GetInboxTokenRow(row), err
+}
+
+func (r PgxChatRepo) LockOrCreateInbox(inboxCode []byte) (db.GetInboxTokenRow, error) {
+	row, err := r.queries().LockOrCreateInbox(r.Ctx, inboxCode)
+	return db.GetInboxTokenRow(row), err
+}
+
+func (r PgxChatRepo) CountMessages(inboxCode []byte) (int64, error) {
+	return r.queries().CountMessages(r.Ctx, inboxCode)
+}
+
+func (r PgxChatRepo) DeleteMessagesUpTo(inboxCode []byte, id int32) (int64, error) {
+	return r.queries().DeleteMessagesUpTo(r.Ctx, db.DeleteMessagesUpToParams{
+		InboxCode: inboxCode,
+		ID:        id,
+	})
 }
 
 var Repo ChatRepo
 
-func (r PgxChatRepo) ShareChatInbox(username string, encSender, encInboxCode, encSignature, encSerial, keyExchangeData []byte) error {
-	queries := db.New(r.Pool)
-	return queries.NewUserInbox(r.Ctx, db.NewUserInboxParams{
-		Username:        username,
+// Called after an invitation is stored for a user, so it can be pushed to their open sessions. May be nil
+var OnNewChat func(username string)
+
+func (r PgxChatRepo) ShareChatInbox(inbox []byte, encSender, encInboxCode, encSignature, encSerial, keyExchangeData, encRatchetKey []byte, version uint32) error {
+	return r.queries().NewUserInbox(r.Ctx, db.NewUserInboxParams{
+		Inbox:           inbox,
 		EncSender:       encSender,
 		EncInboxCode:    encInboxCode,
 		KeyExchangeData: keyExchangeData,
 		EncSignature:    encSignature,
 		EncSerial:       encSerial,
+		EncRatchetKey:   encRatchetKey,
+		Version:         int32(version),
 	})
 }
 
 func (r PgxChatRepo) CreateChatInbox(inboxCode []byte) error {
-	queries := db.New(r.Pool)
-	return queries.CreateInbox(r.Ctx, inboxCode)
+	return r.queries().CreateInbox(r.Ctx, inboxCode)
+}
+
+func (r PgxChatRepo) GetNewChats(inbox []byte) ([]db.GetNewUserInboxesRow, error) {
+	return r.queries().GetNewUserInboxes(r.Ctx, inbox)
 }
 
-func (r PgxChatRepo) GetNewChats(username string) ([]db.GetNewUserInboxesRow, error) {
-	queries := db.New(r.Pool)
-	return queries.GetNewUserInboxes(r.Ctx, username)
+func (r PgxChatRepo) DeleteNewChats(inbox []byte) error {
+	return r.queries().DeleteNewUserInboxes(r.Ctx, inbox)
 }
 
-func (r PgxChatRepo) DeleteNewChats(username string) error {
-	queries := db.New(r.Pool)
-	return queries.DeleteNewUserInboxes(r.Ctx, username)
+func (r PgxChatRepo) CountNewChats(inbox []byte) (int64, error) {
+	return r.queries().CountNewUserInboxes(r.Ctx, inbox)
 }
 
 func (r PgxChatRepo) SetInboxToken(inboxCode, tokenHash, encToken, keyExchangeData []byte) error {
-	queries := db.New(r.Pool)
-	return queries.SetToken(r.Ctx, db.SetTokenParams{
+	return r.queries().SetToken(r.Ctx, db.SetTokenParams{
 		Code:             inboxCode,
 		CurrentTokenHash: tokenHash,
 		EncToken:         encToken,
@@ -64,25 +155,113 @@ func (r PgxChatRepo) SetInboxToken(inboxCode, tokenHash, encToken, keyExchangeDa
 }
 
 func (r PgxChatRepo) GetToken(inboxCode []byte) (db.GetInboxTokenRow, error) {
-	queries := db.New(r.Pool)
-	return queries.GetInboxToken(r.Ctx, inboxCode)
+	return r.queries().GetInboxToken(r.Ctx, inboxCode)
 }
 
-func (r PgxChatRepo) AddMessage(inboxCode []byte, serial uint64, encMsg []byte) error {
-	queries := db.New(r.Pool)
-	return queries.AddMessage(r.Ctx, db.AddMessageParams{
-		InboxCode: inboxCode,
-		SerialN:   int64(serial),
-		EncMsg:    encMsg,
+func (r PgxChatRepo) AddMessage(inboxCode []byte, serial uint64, encMsg, senderAuth []byte) error {
+	return r.queries().AddMessage(r.Ctx, db.AddMessageParams{
+		InboxCode:  inboxCode,
+		SerialN:    int64(serial),
+		EncMsg:     encMsg,
+		SenderAuth: senderAuth,
 	})
 }
 
 func (r PgxChatRepo) GetMessages(inboxCode []byte) ([]db.GetMessagesRow, error) {
-	queries := db.New(r.Pool)
-	return queries.GetMessages(r.Ctx, inboxCode)
+	return r.queries().GetMessages(r.Ctx, inboxCode)
+}
+
+func (r PgxChatRepo) GetMessagesPage(inboxCode []byte, from int32, limit int32) ([]db.GetMessagesPageRow, error) {
+	return r.queries().GetMessagesPage(r.Ctx, db.GetMessagesPageParams{
+		InboxCode: inboxCode,
+		ID:        from,
+		Limit:     limit,
+	})
 }
 
 func (r PgxChatRepo) FlushInbox(inboxCode []byte) error {
-	queries := db.New(r.Pool)
-	return queries.FlushInbox(r.Ctx, inboxCode)
+	return r.queries().FlushInbox(r.Ctx, inboxCode)
+}
+
+func timestamptz(t time.Time) pgtype.Timestamptz {
+	return pgtype.Timestamptz{Time: t, Valid: true}
+}
+
+func (r PgxChatRepo) ExpireMessages(before time.Time, maxMessages, maxBytes int64) (int64, error) {
+	return r.queries().ExpireMessages(r.Ctx, db.ExpireMessagesParams{
+		CreatedAt:  timestamptz(before),
+		NewerCount: maxMessages,
+		NewerBytes: maxBytes,
+	})
+}
+
+func (r PgxChatRepo) ExpireInvitations(before time.Time) (int64, error) {
+	return r.queries().ExpireInvitations(r.Ctx, timestamptz(before))
+}
+
+func (r PgxChatRepo) ForgetExpiredMessages(before time.Time) (int64, error) {
+	return r.queries().ForgetExpiredMessages(r.Ctx, timestamptz(before))
+}
+
+func (r PgxChatRepo) GetExpiredMessages(inboxCode []byte, serials []uint64) ([]db.GetExpiredMessagesRow, error) {
+	serialsN := make([]int64, 0, len(serials))
+	for _, serial := range serials {
+		serialsN = append(serialsN, int64(serial))
+	}
+	return r.queries().GetExpiredMessages(r.Ctx, db.GetExpiredMessagesParams{
+		InboxCode: inboxCode,
+		Column2:   serialsN,
+	})
+}
+
+func (r PgxChatRepo) DeleteEmptyInboxes(before time.Time) (int64, error) {
+	return r.queries().DeleteEmptyInboxes(r.Ctx, timestamptz(before))
+}
+
+func (r PgxChatRepo) StaleTokens(keyId []byte, limit int32) ([]db.ListStaleInboxTokensRow, error) {
+	return r.queries().ListStaleInboxTokens(r.Ctx, db.ListStaleInboxTokensParams{
+		Column1: keyId,
+		Limit:   limit,
+	})
+}
+
+func (r PgxChatRepo) RewrapToken(inboxCode, old, tokenHash []byte) (bool, error) {
+	n, err := r.queries().RewrapInboxToken(r.Ctx, db.RewrapInboxTokenParams{
+		Code:               inboxCode,
+		CurrentTokenHash:   old,
+		CurrentTokenHash_2: tokenHash,
+	})
+	return n != 0, err
+}
+
+func (r PgxChatRepo) StaleMessageAuths(keyId []byte, limit int32) ([]db.ListStaleMessageAuthsRow, error) {
+	return r.queries().ListStaleMessageAuths(r.Ctx, db.ListStaleMessageAuthsParams{
+		Column1: keyId,
+		Limit:   limit,
+	})
+}
+
+func (r PgxChatRepo) RewrapMessageAuth(id int32, old, senderAuth []byte) (bool, error) {
+	n, err := r.queries().RewrapMessageAuth(r.Ctx, db.RewrapMessageAuthParams{
+		ID:           id,
+		SenderAuth:   old,
+		SenderAuth_2: senderAuth,
+	})
+	return n != 0, err
+}
+
+func (r PgxChatRepo) StaleExpiredAuths(keyId []byte, limit int32) ([]db.ListStaleExpiredAuthsRow, error) {
+	return r.queries().ListStaleExpiredAuths(r.Ctx, db.ListStaleExpiredAuthsParams{
+		Column1: keyId,
+		Limit:   limit,
+	})
+}
+
+func (r PgxChatRepo) RewrapExpiredAuth(id int32, old, senderAuth []byte) (bool, error) {
+	n, err := r.queries().RewrapExpiredAuth(r.Ctx, db.RewrapExpiredAuthParams{
+		ID:           id,
+		SenderAuth:   old,
+		SenderAuth_2: senderAuth,
+	})
+	return n != 0, err
 }
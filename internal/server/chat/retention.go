@@ -0,0 +1,81 @@
+package chat
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/as283-ua/yappa/internal/server/logging"
+	"github.com/as283-ua/yappa/internal/server/settings"
+)
+
+// Limits that aren't set never match anything
+func ageCutoff(now time.Time, maxAge time.Duration) time.Time {
+	if maxAge <= 0 {
+		return time.Time{}
+	}
+	return now.Add(-maxAge)
+}
+
+func limitOrMax(limit int64) int64 {
+	if limit <= 0 {
+		return math.MaxInt64
+	}
+	return limit
+}
+
+// Deletes what is past the retention limits once
+func Sweep(cfg settings.RetentionCfg) error {
+	logger := logging.GetLogger()
+	now := time.Now()
+
+	expired, err := Repo.ExpireMessages(ageCutoff(now, cfg.MaxAge), limitOrMax(cfg.MaxMessages), limitOrMax(cfg.MaxBytes))
+	if err != nil {
+		return err
+	}
+	invitations, err := Repo.ExpireInvitations(ageCutoff(now, cfg.InvitationMaxAge))
+	if err != nil {
+		return err
+	}
+	_, err = Repo.ForgetExpiredMessages(now.Add(-cfg.NoticeMaxAgeOrDefault()))
+	if err != nil {
+		return err
+	}
+	// inboxes are created again by the next message stored in them. Those of sealed sends are derived anew every
+	// epoch, the drained ones would pile up otherwise
+	_, err = Repo.DeleteEmptyInboxes(now.Add(-cfg.EmptyInboxAge()))
+	if err != nil {
+		return err
+	}
+	if expired != 0 || invitations != 0 {
+		logger.Printf("Expired %v messages and %v invitations\n", expired, invitations)
+	}
+	return nil
+}
+
+// Sweeps every interval until stop is called. Does nothing if no limit is set
+func StartSweeper(cfg settings.RetentionCfg) (stop func()) {
+	if !cfg.Enabled() {
+		return func() {}
+	}
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(cfg.SweepIntervalOrDefault())
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-done:
+				return
+			}
+			err := Sweep(cfg)
+			if err != nil {
+				logging.GetLogger().Println("Retention sweep error:", err)
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(done) })
+	}
+}
@@ -0,0 +1,189 @@
+package chat
+
+import (
+	"fmt"
+
+	"github.com/as283-ua/yappa/internal/server/keys"
+	"github.com/as283-ua/yappa/internal/server/logging"
+	"github.com/as283-ua/yappa/pkg/common"
+)
+
+// Inboxes or messages re-encrypted per page by ReencryptTokens and ReencryptSenderAuths
+const REENCRYPT_PAGE = 500
+
+// Token hashes are wrapped for their own inbox, one can't be moved to another
+func tokenAD(inboxCode []byte) common.AssociatedData {
+	return common.AssociatedData{
+		Version: common.PROTOCOL_VERSION,
+		Label:   common.LabelInboxToken,
+		InboxId: inboxCode,
+	}
+}
+
+// Encrypts the hash of the inbox's token with the server's data key before it's stored
+func WrapTokenHash(inboxCode, hash []byte) ([]byte, error) {
+	if keys.Ring == nil {
+		return nil, keys.ErrNoKeyring
+	}
+	return keys.Ring.Wrap(hash, tokenAD(inboxCode))
+}
+
+// Hash of the inbox's token from what is stored. Hashes stored before they were wrapped are returned as is
+func tokenHash(inboxCode, stored []byte) ([]byte, error) {
+	if len(stored) == common.HASH_SIZE {
+		return stored, nil
+	}
+	if keys.Ring == nil {
+		return nil, keys.ErrNoKeyring
+	}
+	return keys.Ring.Unwrap(stored, tokenAD(inboxCode))
+}
+
+// Wraps the token hashes stored under an older key, or before they were wrapped, with the active key. Inboxes
+// that can't be read are left as they are and logged, stopping once a page has nothing else
+func ReencryptTokens() error {
+	logger := logging.GetLogger()
+	if keys.Ring == nil {
+		return keys.ErrNoKeyring
+	}
+	active := keys.Ring.ActiveId()
+	var moved int
+	for {
+		stale, err := Repo.StaleTokens(active, REENCRYPT_PAGE)
+		if err != nil {
+			return err
+		}
+		done := 0
+		for _, v := range stale {
+			hash, err := tokenHash(v.Code, v.CurrentTokenHash)
+			if err != nil {
+				logger.Printf("Inbox token can't be re-encrypted: %v\n", err)
+				continue
+			}
+			wrapped, err := WrapTokenHash(v.Code, hash)
+			if err != nil {
+				return err
+			}
+			// changed since it was listed, then it's under the active key already or emptied
+			_, err = Repo.RewrapToken(v.Code, v.CurrentTokenHash, wrapped)
+			if err != nil {
+				return err
+			}
+			done++
+		}
+		moved += done
+		if len(stale) < REENCRYPT_PAGE || done == 0 {
+			if len(stale) != done {
+				return fmt.Errorf("%v inbox tokens couldn't be re-encrypted", len(stale)-done)
+			}
+			break
+		}
+	}
+	if moved != 0 {
+		logger.Printf("Re-encrypted %v inbox tokens\n", moved)
+	}
+	return nil
+}
+
+// Sender auths are wrapped for the inbox of their message
+func senderAuthAD(inboxCode []byte) common.AssociatedData {
+	return common.AssociatedData{
+		Version: common.PROTOCOL_VERSION,
+		Label:   common.LabelSenderAuth,
+		InboxId: inboxCode,
+	}
+}
+
+// Encrypts the hash of the sender's expiry token with the server's data key before it's stored with the message
+func WrapSenderAuth(inboxCode, hash []byte) ([]byte, error) {
+	if keys.Ring == nil {
+		return nil, keys.ErrNoKeyring
+	}
+	return keys.Ring.Wrap(hash, senderAuthAD(inboxCode))
+}
+
+// Hash of the sender's expiry token from what is stored. Hashes stored before they were wrapped are returned as is
+func senderAuthHash(inboxCode, stored []byte) ([]byte, error) {
+	if len(stored) == common.HASH_SIZE {
+		return stored, nil
+	}
+	if keys.Ring == nil {
+		return nil, keys.ErrNoKeyring
+	}
+	return keys.Ring.Unwrap(stored, senderAuthAD(inboxCode))
+}
+
+// A sender auth under an older key, of a stored or an expired message
+type staleAuth struct {
+	ID         int32
+	InboxCode  []byte
+	SenderAuth []byte
+}
+
+// Wraps the sender auths of stored and expired messages kept under an older key, or before they were wrapped, with
+// the active key. Same as ReencryptTokens otherwise
+func ReencryptSenderAuths() error {
+	if keys.Ring == nil {
+		return keys.ErrNoKeyring
+	}
+	err := reencryptAuths("stored message", func(keyId []byte) ([]staleAuth, error) {
+		rows, err := Repo.StaleMessageAuths(keyId, REENCRYPT_PAGE)
+		stale := make([]staleAuth, 0, len(rows))
+		for _, v := range rows {
+			stale = append(stale, staleAuth(v))
+		}
+		return stale, err
+	}, Repo.RewrapMessageAuth)
+	if err != nil {
+		return err
+	}
+	return reencryptAuths("expired message", func(keyId []byte) ([]staleAuth, error) {
+		rows, err := Repo.StaleExpiredAuths(keyId, REENCRYPT_PAGE)
+		stale := make([]staleAuth, 0, len(rows))
+		for _, v := range rows {
+			stale = append(stale, staleAuth(v))
+		}
+		return stale, err
+	}, Repo.RewrapExpiredAuth)
+}
+
+func reencryptAuths(what string, list func(keyId []byte) ([]staleAuth, error), rewrap func(id int32, old, senderAuth []byte) (bool, error)) error {
+	logger := logging.GetLogger()
+	active := keys.Ring.ActiveId()
+	var moved int
+	for {
+		stale, err := list(active)
+		if err != nil {
+			return err
+		}
+		done := 0
+		for _, v := range stale {
+			hash, err := senderAuthHash(v.InboxCode, v.SenderAuth)
+			if err != nil {
+				logger.Printf("Sender auth of %v %v can't be re-encrypted: %v\n", what, v.ID, err)
+				continue
+			}
+			wrapped, err := WrapSenderAuth(v.InboxCode, hash)
+			if err != nil {
+				return err
+			}
+			// changed since it was listed, then it's under the active key already or the message is gone
+			_, err = rewrap(v.ID, v.SenderAuth, wrapped)
+			if err != nil {
+				return err
+			}
+			done++
+		}
+		moved += done
+		if len(stale) < REENCRYPT_PAGE || done == 0 {
+			if len(stale) != done {
+				return fmt.Errorf("%v sender auths of %vs couldn't be re-encrypted", len(stale)-done, what)
+			}
+			break
+		}
+	}
+	if moved != 0 {
+		logger.Printf("Re-encrypted %v sender auths of %vs\n", moved, what)
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package connection
+
+import (
+	"sync"
+)
+
+// In-memory map of the delivery tokens registered by open sessions. Sealed sends carry one instead of the
+// receiver's name. A token is derived per chat and epoch and only ever registered by its receiver, so the server
+// can relay to it without learning who sends to whom or linking one inbox to the next. Nothing here is ever
+// stored
+type DeliveryRegistry struct {
+	mx        sync.Mutex
+	byToken   map[string]map[*Session]struct{}
+	bySession map[*Session][]string
+}
+
+func NewDeliveryRegistry() *DeliveryRegistry {
+	return &DeliveryRegistry{
+		byToken:   make(map[string]map[*Session]struct{}),
+		bySession: make(map[*Session][]string),
+	}
+}
+
+var Delivery = NewDeliveryRegistry()
+
+// Called with mx held
+func (d *DeliveryRegistry) remove(s *Session) {
+	for _, token := range d.bySession[s] {
+		holders := d.byToken[token]
+		delete(holders, s)
+		if len(holders) == 0 {
+			delete(d.byToken, token)
+		}
+	}
+	delete(d.bySession, s)
+}
+
+// Replaces the tokens of the session. Takes as many tokens as presence does
+func (d *DeliveryRegistry) Register(s *Session, tokens [][]byte) {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+	d.remove(s)
+	current := make([]string, 0, len(tokens))
+	for _, t := range limitTokens(tokens) {
+		token := string(t)
+		holders, ok := d.byToken[token]
+		if !ok {
+			holders = make(map[*Session]struct{})
+			d.byToken[token] = holders
+		}
+		if _, ok := holders[s]; ok {
+			continue
+		}
+		holders[s] = struct{}{}
+		current = append(current, token)
+	}
+	if len(current) != 0 {
+		d.bySession[s] = current
+	}
+}
+
+// Sessions that registered the token
+func (d *DeliveryRegistry) Get(token []byte) []*Session {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+	sessions := make([]*Session, 0, len(d.byToken[string(token)]))
+	for s := range d.byToken[string(token)] {
+		sessions = append(sessions, s)
+	}
+	return sessions
+}
+
+// Forgets every token of the session, e.g. once it's closed
+func (d *DeliveryRegistry) Remove(s *Session) {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+	d.remove(s)
+}
@@ -4,21 +4,22 @@ import (
 	"context"
 	"crypto/mlkem"
 	"crypto/rand"
-	"encoding/binary"
-	"io"
+	"errors"
+	"math"
 	"net/http"
+	"sync/atomic"
 
 	"github.com/as283-ua/yappa/api/gen/server"
 	"github.com/as283-ua/yappa/internal/server/auth"
 	"github.com/as283-ua/yappa/internal/server/chat"
 	"github.com/as283-ua/yappa/internal/server/logging"
+	"github.com/as283-ua/yappa/internal/server/ratelimit"
+	"github.com/as283-ua/yappa/internal/server/settings"
 	"github.com/as283-ua/yappa/pkg/common"
+	"github.com/quic-go/quic-go"
 	"github.com/quic-go/quic-go/http3"
-	"google.golang.org/protobuf/proto"
 )
 
-var sessions map[string]*http3.Stream = make(map[string]*http3.Stream)
-
 func upgrade(w http.ResponseWriter) (http3.Stream, error) {
 	w.WriteHeader(http.StatusOK)
 	w.(http.Flusher).Flush()
@@ -44,36 +45,66 @@ func Connection(w http.ResponseWriter, r *http.Request) {
 		logger.Println("Upgrade error:", err)
 		return
 	}
-	defer func() {
-		delete(sessions, username)
-		str.Close()
+	session := Sessions.Add(username, str)
+	defer Sessions.Remove(session)
+	defer Presence.Remove(session)
+	defer Delivery.Remove(session)
+	go func() {
+		// a reaped session must also stop the read loop below
+		<-session.Done()
+		str.CancelRead(quic.StreamErrorCode(http3.ErrCodeNoError))
 	}()
-	sessions[username] = &str
 
+	reader := common.NewFrameReader(str, settings.ChatSettings.Conn.MaxFrameSize)
 	for {
-		var lenBuf [4]byte
-		_, err := io.ReadFull(str, lenBuf[:])
-		if err != nil {
-			logger.Println("Connection error:", err)
-			return
-		}
-		msgLen := binary.BigEndian.Uint32(lenBuf[:])
-		var msg []byte = make([]byte, msgLen)
-
-		str.Read(msg)
-
 		protoMsg := &server.ClientMessage{}
-		err = proto.Unmarshal(msg, protoMsg)
+		err := reader.ReadMsg(protoMsg)
 
-		if err != nil {
+		var decodeErr *common.FrameDecodeError
+		if errors.As(err, &decodeErr) {
+			session.Touch()
 			logger.Println("Failed to unmarshall client data:", err)
+			continue
+		}
+		if err != nil {
+			logger.Println("Connection error:", err)
 			return
 		}
+		session.Touch()
 
 		switch payload := protoMsg.Payload.(type) {
 		case *server.ClientMessage_Send:
 			chatSend := payload.Send
-			handleMsg(chatSend)
+			if chatSend.Cover {
+				// charged to a limit of their own so they can't be used to flood, then dropped. Nothing is stored
+				// or answered
+				allowStream(session, settings.LIMIT_COVER)
+				break
+			}
+			if !allowSend(session, chatSend) {
+				break
+			}
+			handleMsg(session, chatSend)
+		case *server.ClientMessage_Rpc:
+			go handleRpc(r.Context(), session, r.TLS, payload.Rpc)
+		case *server.ClientMessage_Presence:
+			if !allowStream(session, settings.LIMIT_PRESENCE) {
+				break
+			}
+			Presence.Announce(session, payload.Presence.Tokens)
+		case *server.ClientMessage_PresenceQuery:
+			if !allowStream(session, settings.LIMIT_PRESENCE) {
+				break
+			}
+			sendPresence(session, &server.PresenceUpdate{
+				Online: Presence.Query(session, payload.PresenceQuery.Tokens),
+			})
+		case *server.ClientMessage_Delivery:
+			// as cheap as an announce and sent along with it
+			if !allowStream(session, settings.LIMIT_PRESENCE) {
+				break
+			}
+			Delivery.Register(session, payload.Delivery.Tokens)
 		case *server.ClientMessage_Hb:
 		default:
 			// Unknown or unset
@@ -81,32 +112,268 @@ func Connection(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func handleMsg(msg *server.SendMsg) {
-	conn, ok := sessions[msg.Receiver]
-	if !ok {
-		saveToInbox(msg)
+// Charges the message to the sender's send or ephemeral limit. Messages over it are dropped, telling the
+// sender with a DELIVERY_RATE_LIMITED status, or a StreamError for ephemeral ones as they get no status
+func allowSend(session *Session, msg *server.SendMsg) bool {
+	if msg.Ephemeral {
+		return allowStream(session, settings.LIMIT_EPHEMERAL)
+	}
+	if ok, _ := ratelimit.Limits.Allow(session.Username, settings.LIMIT_SEND); !ok {
+		sendStatus(session, msg, server.DeliveryStatus_DELIVERY_RATE_LIMITED)
+		return false
+	}
+	return true
+}
+
+// Charges a stream message to the named limit of the user, sending back a StreamError if it's over
+func allowStream(session *Session, limit string) bool {
+	ok, wait := ratelimit.Limits.Allow(session.Username, limit)
+	if ok {
+		return true
+	}
+	frame, err := encodeFrame(&server.ServerMessage{
+		Payload: &server.ServerMessage_Error{
+			Error: &server.StreamError{
+				Code:         server.StreamErrorCode_STREAM_RATE_LIMITED,
+				Message:      "Too many " + limit + " messages",
+				RetryAfterMs: retryAfterMs(wait),
+			},
+		},
+	})
+	if err != nil {
+		logging.GetLogger().Println("Marshal error:", err)
+		return false
+	}
+	session.Enqueue(frame, nil)
+	return false
+}
+
+// Pings every session in Sessions and closes those that stop answering, as configured
+func StartHeartbeats(cfg settings.ConnCfg) (stop func()) {
+	ping, err := encodeFrame(&server.ServerMessage{
+		Payload: &server.ServerMessage_Hb{Hb: &server.HeartBeat{}},
+	})
+	if err != nil {
+		logging.GetLogger().Println("Marshal error:", err)
+		return func() {}
+	}
+	return Sessions.StartHeartbeats(cfg.HeartbeatIntervalOrDefault(), cfg.MissedHeartbeatsOrDefault(), ping)
+}
+
+// Server frames aren't limited by the clients' max frame size
+func encodeFrame(msg *server.ServerMessage) ([]byte, error) {
+	return common.EncodeFrame(msg, math.MaxUint32)
+}
+
+// Tracks a message queued to several sessions of the receiver. Once all of them are done, the sender is told
+// whether it got through, and if none took it the message is stored in the inbox instead. Ephemeral messages
+// are dropped instead and the sender isn't told anything
+type delivery struct {
+	sender    *Session
+	msg       *server.SendMsg
+	pending   atomic.Int32
+	delivered atomic.Bool
+}
+
+func (d *delivery) result(ok bool) {
+	if ok {
+		d.delivered.Store(true)
+	}
+	d.release()
+}
+
+func (d *delivery) release() {
+	if d.pending.Add(-1) != 0 {
 		return
 	}
-	send := &server.ServerMessage{
-		Payload: &server.ServerMessage_Send{
-			Send: &server.ReceiveMsg{
-				Serial:  msg.Serial,
+	if d.msg.Ephemeral {
+		return
+	}
+	if d.delivered.Load() {
+		sendStatus(d.sender, d.msg, server.DeliveryStatus_DELIVERY_RELAYED)
+		return
+	}
+	// may be running in a receiver's writer goroutine, don't hold it up with the db
+	go fallbackToInbox(d.sender, d.msg)
+}
+
+func fallbackToInbox(sender *Session, msg *server.SendMsg) {
+	err := saveToInbox(msg)
+	if err != nil {
+		sendStatus(sender, msg, server.DeliveryStatus_DELIVERY_FAILED)
+		return
+	}
+	sendStatus(sender, msg, server.DeliveryStatus_DELIVERY_STORED)
+	// the receiver may be connected but too slow, let it know to fetch the inbox later
+	pushTo(receiversOf(msg), &server.ServerMessage{
+		Payload: &server.ServerMessage_Inbox{
+			Inbox: &server.InboxPending{InboxId: msg.InboxId},
+		},
+	})
+}
+
+// Tells the user's open sessions there are new chat invitations. Set as chat.OnNewChat
+func NotifyNewChats(username string) {
+	push(username, &server.ServerMessage{
+		Payload: &server.ServerMessage_NewChats{
+			NewChats: &server.NewChatsPending{},
+		},
+	})
+}
+
+// Best effort notification to every open session of the user. Clients fetch everything at startup anyway
+func push(username string, msg *server.ServerMessage) {
+	pushTo(Sessions.Get(username), msg)
+}
+
+func pushTo(receivers []*Session, msg *server.ServerMessage) {
+	if len(receivers) == 0 {
+		return
+	}
+	frame, err := encodeFrame(msg)
+	if err != nil {
+		logging.GetLogger().Println("Marshal error:", err)
+		return
+	}
+	for _, s := range receivers {
+		s.Enqueue(frame, nil)
+	}
+}
+
+// Best effort, statuses are dropped if the sender's queue is full
+func sendStatus(sender *Session, msg *server.SendMsg, status server.DeliveryStatus) {
+	frame, err := encodeFrame(&server.ServerMessage{
+		Payload: &server.ServerMessage_Status{
+			Status: &server.SendStatus{
 				InboxId: msg.InboxId,
-				EncData: msg.Message,
+				Serial:  msg.Serial,
+				Status:  status,
+				MsgId:   msg.MsgId,
 			},
 		},
+	})
+	if err != nil {
+		logging.GetLogger().Println("Marshal error:", err)
+		return
+	}
+	sender.Enqueue(frame, nil)
+}
+
+// Open sessions of the receiver, or those that registered the delivery token for sealed sends
+func receiversOf(msg *server.SendMsg) []*Session {
+	if msg.Receiver == "" {
+		return Delivery.Get(msg.DeliveryToken)
 	}
-	sendBytes, _ := proto.Marshal(send)
+	return Sessions.Get(msg.Receiver)
+}
 
-	messageLen := len(sendBytes)
-	lenBytes := make([]byte, 4)
-	binary.BigEndian.PutUint32(lenBytes, uint32(messageLen))
+// Queues the message to every open session of the receiver. Never blocks on the receiver, if no session can
+// take it the message is stored in the inbox, or dropped if it's ephemeral
+func handleMsg(sender *Session, msg *server.SendMsg) {
+	receivers := receiversOf(msg)
+	if len(receivers) == 0 {
+		if !msg.Ephemeral {
+			fallbackToInbox(sender, msg)
+		}
+		return
+	}
 
-	(*conn).Write((append(lenBytes, sendBytes...)))
+	frame, err := encodeFrame(&server.ServerMessage{
+		Payload: &server.ServerMessage_Send{
+			Send: &server.ReceiveMsg{
+				Serial:    msg.Serial,
+				InboxId:   msg.InboxId,
+				EncData:   msg.Message,
+				Ephemeral: msg.Ephemeral,
+			},
+		},
+	})
+	if err != nil {
+		logging.GetLogger().Println("Marshal error:", err)
+		if !msg.Ephemeral {
+			sendStatus(sender, msg, server.DeliveryStatus_DELIVERY_FAILED)
+		}
+		return
+	}
+
+	d := &delivery{sender: sender, msg: msg}
+	// one extra so the result can't be settled before every session has been tried
+	d.pending.Store(int32(len(receivers)) + 1)
+	for _, s := range receivers {
+		if !s.Enqueue(frame, d.result) {
+			logging.GetLogger().Printf("Outbound queue of session %v of %v unavailable\n", s.Id, s.Username)
+			d.result(false)
+		}
+	}
+	d.release()
 }
 
+// Stores the message in its inbox, creating the inbox and setting a new token for it as needed. Runs in a transaction
+// with the inbox locked, so the message can't land in between a client acknowledging the inbox and its token
+// being cleared
 func saveToInbox(msg *server.SendMsg) error {
-	tokenObj, err := chat.Repo.GetToken(msg.InboxId)
+	if msg.Ephemeral {
+		return errors.New("ephemeral messages are never stored")
+	}
+	return chat.Repo.InTx(func(tx chat.ChatRepo) error {
+		return storeInTx(tx, msg)
+	})
+}
+
+// Hash of the sender's expiry token wrapped for the inbox, see CheckExpired. Left out if malformed, the message
+// can't be checked then
+func senderAuth(msg *server.SendMsg) ([]byte, error) {
+	if len(msg.SenderAuth) != common.HASH_SIZE {
+		return nil, nil
+	}
+	return chat.WrapSenderAuth(msg.InboxId, msg.SenderAuth)
+}
+
+var errBadSealedSend = errors.New("sealed send without a valid inbox id or auth")
+
+// Sealed sends name an inbox derived by both ends of the chat, created here by the first message. The receiver
+// already knows its token, so only the hash the sender passed along is kept
+func storeSealedInTx(tx chat.ChatRepo, msg *server.SendMsg) error {
+	if len(msg.InboxId) != common.KEY_SIZE || len(msg.InboxAuth) != common.HASH_SIZE {
+		return errBadSealedSend
+	}
+	tokenObj, err := tx.LockOrCreateInbox(msg.InboxId)
+	if err != nil {
+		logging.GetLogger().Println("DB error:", err)
+		return err
+	}
+	if tokenObj.CurrentTokenHash == nil {
+		hash, err := chat.WrapTokenHash(msg.InboxId, msg.InboxAuth)
+		if err != nil {
+			logging.GetLogger().Println("Token wrap error:", err)
+			return err
+		}
+		err = tx.SetInboxToken(msg.InboxId, hash, nil, nil)
+		if err != nil {
+			logging.GetLogger().Println("DB error:", err)
+			return err
+		}
+	}
+
+	auth, err := senderAuth(msg)
+	if err != nil {
+		logging.GetLogger().Println("Sender auth wrap error:", err)
+		return err
+	}
+	err = tx.AddMessage(msg.InboxId, msg.Serial, msg.Message, auth)
+	if err != nil {
+		logging.GetLogger().Println("DB error:", err)
+		return err
+	}
+	return nil
+}
+
+func storeInTx(tx chat.ChatRepo, msg *server.SendMsg) error {
+	if msg.Receiver == "" {
+		return storeSealedInTx(tx, msg)
+	}
+	// emptied inboxes may have been swept in the meantime
+	tokenObj, err := tx.LockOrCreateInbox(msg.InboxId)
 	if err != nil {
 		return err
 	}
@@ -121,25 +388,44 @@ func saveToInbox(msg *server.SendMsg) error {
 			logging.GetLogger().Println("Kyber encapsulation parse error:", err)
 			return err
 		}
-		key, cipherText := kybKey.Encapsulate()
+		secret, cipherText := kybKey.Encapsulate()
+		key, err := common.DeriveKey(secret, common.LabelInboxToken, msg.InboxId)
+		if err != nil {
+			logging.GetLogger().Println("Key derivation error:", err)
+			return err
+		}
 
 		token := make([]byte, 32)
 		rand.Read(token)
 
-		tokenEnc, err := common.Encrypt(token, key)
+		tokenEnc, err := common.Seal(key, token, common.AssociatedData{
+			Version: common.PROTOCOL_VERSION,
+			Label:   common.LabelInboxToken,
+			InboxId: msg.InboxId,
+		})
 		if err != nil {
 			logging.GetLogger().Println("AES error enc:", err)
 			return err
 		}
 
-		err = chat.Repo.SetInboxToken(msg.InboxId, common.Hash(token), tokenEnc, cipherText)
+		hash, err := chat.WrapTokenHash(msg.InboxId, common.Hash(token))
+		if err != nil {
+			logging.GetLogger().Println("Token wrap error:", err)
+			return err
+		}
+		err = tx.SetInboxToken(msg.InboxId, hash, tokenEnc, cipherText)
 		if err != nil {
 			logging.GetLogger().Println("DB error:", err)
 			return err
 		}
 	}
 
-	err = chat.Repo.AddMessage(msg.InboxId, msg.Serial, msg.Message)
+	auth, err := senderAuth(msg)
+	if err != nil {
+		logging.GetLogger().Println("Sender auth wrap error:", err)
+		return err
+	}
+	err = tx.AddMessage(msg.InboxId, msg.Serial, msg.Message, auth)
 	if err != nil {
 		logging.GetLogger().Println("DB error:", err)
 		return err
@@ -2,7 +2,12 @@ package connection
 
 import (
 	"crypto/x509"
+	"math"
 	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/as283-ua/yappa/internal/server/ratelimit"
 )
 
 type MiddleWareCtx string
@@ -23,3 +28,21 @@ func RequireCertificate(tlsVerifyOpts x509.VerifyOptions, next http.Handler) htt
 		next.ServeHTTP(w, r)
 	})
 }
+
+// Responds 429 once the user runs out of the named limit. Goes inside RequireCertificate, users are told apart
+// by their certificate's CN
+func RateLimit(limit string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username := r.TLS.PeerCertificates[0].Subject.CommonName
+		if ok, wait := ratelimit.Limits.Allow(username, limit); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			http.Error(w, "Too many requests", http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func retryAfterMs(wait time.Duration) uint32 {
+	return uint32(min(wait.Milliseconds()+1, math.MaxUint32))
+}
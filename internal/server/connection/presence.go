@@ -0,0 +1,172 @@
+package connection
+
+import (
+	"sync"
+
+	"github.com/as283-ua/yappa/api/gen/server"
+	"github.com/as283-ua/yappa/internal/server/logging"
+)
+
+// Max tokens a session can announce or query at once, anything past it is ignored
+const MAX_PRESENCE_TOKENS = 1024
+
+// In-memory map of the presence tokens announced by open sessions. A token is derived from a chat's keys, so
+// the server learns that two sessions share some chat but not which one, and only while both are connected.
+// Nothing here is ever stored
+type PresenceRegistry struct {
+	mx        sync.Mutex
+	byToken   map[string]map[*Session]struct{}
+	bySession map[*Session]map[string]struct{}
+}
+
+func NewPresenceRegistry() *PresenceRegistry {
+	return &PresenceRegistry{
+		byToken:   make(map[string]map[*Session]struct{}),
+		bySession: make(map[*Session]map[string]struct{}),
+	}
+}
+
+var Presence = NewPresenceRegistry()
+
+func limitTokens(tokens [][]byte) [][]byte {
+	if len(tokens) > MAX_PRESENCE_TOKENS {
+		return tokens[:MAX_PRESENCE_TOKENS]
+	}
+	return tokens
+}
+
+// Whether a session of the user other than skip holds the token. Called with mx held
+func (p *PresenceRegistry) heldBy(token string, username string, skip *Session) bool {
+	for s := range p.byToken[token] {
+		if s != skip && s.Username == username {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether a session of some user other than username holds the token. Called with mx held
+func (p *PresenceRegistry) heldByOthers(token string, username string) bool {
+	for s := range p.byToken[token] {
+		if s.Username != username {
+			return true
+		}
+	}
+	return false
+}
+
+// Queues a change of the token to every session of other users holding it, unless the user was already or is
+// still visible with it through another session. Called with mx held
+func (p *PresenceRegistry) notify(updates map[*Session]*server.PresenceUpdate, from *Session, token string, online bool) {
+	if p.heldBy(token, from.Username, from) {
+		return
+	}
+	for s := range p.byToken[token] {
+		if s.Username == from.Username {
+			continue
+		}
+		update, ok := updates[s]
+		if !ok {
+			update = &server.PresenceUpdate{}
+			updates[s] = update
+		}
+		if online {
+			update.Online = append(update.Online, []byte(token))
+		} else {
+			update.Offline = append(update.Offline, []byte(token))
+		}
+	}
+}
+
+// Replaces the tokens of the session and tells the other holders of the tokens that changed. The session gets
+// back which of its tokens are online. An empty list makes the session invisible
+func (p *PresenceRegistry) Announce(s *Session, tokens [][]byte) {
+	updates := make(map[*Session]*server.PresenceUpdate)
+	reply := &server.PresenceUpdate{}
+
+	p.mx.Lock()
+	old := p.bySession[s]
+	current := make(map[string]struct{})
+	for _, t := range limitTokens(tokens) {
+		current[string(t)] = struct{}{}
+	}
+
+	for token := range old {
+		if _, ok := current[token]; ok {
+			continue
+		}
+		p.remove(s, token)
+		p.notify(updates, s, token, false)
+	}
+	for token := range current {
+		if _, ok := old[token]; !ok {
+			p.notify(updates, s, token, true)
+			holders, ok := p.byToken[token]
+			if !ok {
+				holders = make(map[*Session]struct{})
+				p.byToken[token] = holders
+			}
+			holders[s] = struct{}{}
+		}
+		if p.heldByOthers(token, s.Username) {
+			reply.Online = append(reply.Online, []byte(token))
+		}
+	}
+	if len(current) == 0 {
+		delete(p.bySession, s)
+	} else {
+		p.bySession[s] = current
+	}
+	p.mx.Unlock()
+
+	if len(current) != 0 {
+		updates[s] = reply
+	}
+	for target, update := range updates {
+		sendPresence(target, update)
+	}
+}
+
+// Called with mx held
+func (p *PresenceRegistry) remove(s *Session, token string) {
+	holders := p.byToken[token]
+	delete(holders, s)
+	if len(holders) == 0 {
+		delete(p.byToken, token)
+	}
+}
+
+// Forgets every token of the session, e.g. once it's closed
+func (p *PresenceRegistry) Remove(s *Session) {
+	p.Announce(s, nil)
+}
+
+// Which of the tokens are held by a session of a user other than the one asking. Only tokens the session
+// announced itself are answered, so presence is only visible to those who show theirs
+func (p *PresenceRegistry) Query(s *Session, tokens [][]byte) [][]byte {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+	own := p.bySession[s]
+	online := make([][]byte, 0)
+	for _, t := range limitTokens(tokens) {
+		if _, ok := own[string(t)]; !ok {
+			continue
+		}
+		if p.heldByOthers(string(t), s.Username) {
+			online = append(online, t)
+		}
+	}
+	return online
+}
+
+// Best effort, like statuses
+func sendPresence(s *Session, update *server.PresenceUpdate) {
+	frame, err := encodeFrame(&server.ServerMessage{
+		Payload: &server.ServerMessage_Presence{Presence: update},
+	})
+	if err != nil {
+		logging.GetLogger().Println("Marshal error:", err)
+		return
+	}
+	s.Enqueue(frame, nil)
+}
@@ -0,0 +1,121 @@
+package connection
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"net/http"
+	"strings"
+
+	"github.com/as283-ua/yappa/api/gen/server"
+	"github.com/as283-ua/yappa/internal/server/chat"
+	"github.com/as283-ua/yappa/internal/server/logging"
+	"github.com/as283-ua/yappa/internal/server/ratelimit"
+	"github.com/as283-ua/yappa/internal/server/report"
+	"github.com/as283-ua/yappa/internal/server/settings"
+	"github.com/as283-ua/yappa/internal/server/user"
+	"github.com/as283-ua/yappa/pkg/common"
+)
+
+type rpcRoute struct {
+	method  string
+	handler http.HandlerFunc
+	// same rate limit as the endpoint
+	limit string
+}
+
+// Same handlers as the REST endpoints. The certificate isn't checked again, the session was authenticated when
+// the stream was opened
+var rpcRoutes = map[server.RpcMethod]rpcRoute{
+	server.RpcMethod_RPC_CHAT_INIT:     {http.MethodGet, chat.CreateChatInbox, settings.LIMIT_CHAT_INIT},
+	server.RpcMethod_RPC_CHAT_NOTIFY:   {http.MethodPost, chat.NotifyChatInbox, settings.LIMIT_CHAT_NOTIFY},
+	server.RpcMethod_RPC_CHAT_NEW:      {http.MethodGet, chat.GetNewChats, settings.LIMIT_CHAT_READ},
+	server.RpcMethod_RPC_CHAT_TOKEN:    {http.MethodGet, chat.GetChatToken, settings.LIMIT_CHAT_READ},
+	server.RpcMethod_RPC_CHAT_MESSAGES: {http.MethodPost, chat.GetNewMessages, settings.LIMIT_CHAT_READ},
+	server.RpcMethod_RPC_CHAT_ACK:      {http.MethodPost, chat.AckMessages, settings.LIMIT_CHAT_READ},
+	server.RpcMethod_RPC_CHAT_EXPIRED:  {http.MethodPost, chat.CheckExpiredMessages, settings.LIMIT_CHAT_READ},
+	server.RpcMethod_RPC_REPORT:        {http.MethodPost, report.SubmitReport, settings.LIMIT_REPORT},
+	server.RpcMethod_RPC_USERS:         {http.MethodGet, user.GetUsernames, settings.LIMIT_USERS},
+	server.RpcMethod_RPC_USER_DATA:     {http.MethodGet, user.GetUserData, settings.LIMIT_USERS},
+}
+
+// Collects what a handler responds with
+type rpcResponseWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (w *rpcResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *rpcResponseWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.body.Write(p)
+}
+
+func (w *rpcResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+// Runs the call as if it was a request to its REST endpoint made over the session's connection
+func callRpc(ctx context.Context, connState *tls.ConnectionState, req *server.RpcRequest) *server.RpcResponse {
+	resp := &server.RpcResponse{Id: req.Id}
+	route, ok := rpcRoutes[req.Method]
+	if !ok {
+		resp.Error = &server.RpcError{Code: server.RpcErrorCode_RPC_UNKNOWN_METHOD, Message: "unknown method"}
+		return resp
+	}
+	username := connState.PeerCertificates[0].Subject.CommonName
+	if ok, _ := ratelimit.Limits.Allow(username, route.limit); !ok {
+		resp.Error = &server.RpcError{Code: server.RpcErrorCode_RPC_RATE_LIMITED, Message: "Too many requests"}
+		return resp
+	}
+
+	r, err := http.NewRequestWithContext(ctx, route.method, "/", bytes.NewReader(req.Body))
+	if err != nil {
+		resp.Error = &server.RpcError{Code: server.RpcErrorCode_RPC_INTERNAL, Message: "Internal server error"}
+		return resp
+	}
+	r.TLS = connState
+	for k, v := range req.Params {
+		r.Header.Set(k, v)
+		r.SetPathValue(k, v)
+	}
+
+	w := &rpcResponseWriter{header: http.Header{}}
+	route.handler(w, r)
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+
+	code := common.RpcCodeFromStatus(w.status)
+	if code != server.RpcErrorCode_RPC_OK {
+		resp.Error = &server.RpcError{Code: code, Message: strings.TrimSpace(w.body.String())}
+		return resp
+	}
+	resp.Body = w.body.Bytes()
+	return resp
+}
+
+// Answers the call on the session it came from. Runs on its own goroutine so slow calls don't hold up the stream
+func handleRpc(ctx context.Context, session *Session, connState *tls.ConnectionState, req *server.RpcRequest) {
+	resp := callRpc(ctx, connState, req)
+	frame, err := encodeFrame(&server.ServerMessage{
+		Payload: &server.ServerMessage_Rpc{Rpc: resp},
+	})
+	if err != nil {
+		logging.GetLogger().Println("Marshal error:", err)
+		return
+	}
+	// the client waits for it until RPC_TIMEOUT, it's written even if the queue is full
+	err = session.EnqueueOrWrite(frame)
+	if err != nil {
+		logging.GetLogger().Printf("Response to rpc %v of %v not sent: %v\n", req.Id, session.Username, err)
+	}
+}
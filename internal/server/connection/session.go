@@ -0,0 +1,316 @@
+package connection
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/as283-ua/yappa/internal/server/logging"
+	"github.com/as283-ua/yappa/internal/server/settings"
+)
+
+var ErrSessionClosed = errors.New("session closed")
+
+// Max number of frames waiting to be written to a session. Anything past it is refused so a slow receiver
+// never blocks whoever is sending to it
+const OUTBOUND_QUEUE_SIZE = 64
+
+type outbound struct {
+	frame []byte
+	// called once the frame is written or dropped. may be nil
+	result func(ok bool)
+}
+
+// Streams that can bound how long a write blocks, like the http3 ones
+type writeDeadliner interface {
+	SetWriteDeadline(t time.Time) error
+}
+
+// A single connected device. Writes are serialized so frames from different senders never interleave.
+// Frames queued with Enqueue are written by the session's own writer goroutine, which also closes the stream
+// once the session is closed
+type Session struct {
+	Id       uint64
+	Username string
+
+	str          io.WriteCloser
+	writeMx      sync.Mutex
+	writeTimeout time.Duration
+
+	stateMx sync.RWMutex
+	closed  bool
+	done    chan struct{}
+	queue   chan outbound
+
+	// unix nanoseconds of the last frame received from the client
+	lastSeen atomic.Int64
+}
+
+// Marks the client as alive, called for every frame it sends
+func (s *Session) Touch() {
+	s.lastSeen.Store(time.Now().UnixNano())
+}
+
+func (s *Session) LastSeen() time.Time {
+	return time.Unix(0, s.lastSeen.Load())
+}
+
+func (s *Session) isClosed() bool {
+	s.stateMx.RLock()
+	defer s.stateMx.RUnlock()
+	return s.closed
+}
+
+// Writes a whole frame to the session's stream. A client that stops reading makes it fail once the write
+// timeout passes, instead of holding up everything queued behind it
+func (s *Session) Write(frame []byte) error {
+	s.writeMx.Lock()
+	defer s.writeMx.Unlock()
+	if s.isClosed() {
+		return ErrSessionClosed
+	}
+	if d, ok := s.str.(writeDeadliner); ok && s.writeTimeout > 0 {
+		d.SetWriteDeadline(time.Now().Add(s.writeTimeout))
+	}
+	_, err := s.str.Write(frame)
+	return err
+}
+
+// Queues a frame for the writer goroutine. Returns false without calling result if the queue is full or the
+// session is closed, so the caller can deal with the frame some other way
+func (s *Session) Enqueue(frame []byte, result func(ok bool)) bool {
+	// held so close can't happen between the check and the send, leaving the frame unhandled in the queue
+	s.stateMx.RLock()
+	defer s.stateMx.RUnlock()
+	if s.closed {
+		return false
+	}
+	select {
+	case s.queue <- outbound{frame: frame, result: result}:
+		return true
+	default:
+		return false
+	}
+}
+
+// Queues the frame like Enqueue or, if the queue is full, waits to write it directly. For frames the client is
+// waiting on that can't be dropped, sent from a goroutine of their own. A write is bounded by the write timeout
+func (s *Session) EnqueueOrWrite(frame []byte) error {
+	if s.Enqueue(frame, nil) {
+		return nil
+	}
+	return s.Write(frame)
+}
+
+func (s *Session) writeLoop() {
+	for {
+		select {
+		case out := <-s.queue:
+			err := s.Write(out.frame)
+			if out.result != nil {
+				out.result(err == nil)
+			}
+			if err != nil {
+				// stream is unusable from now on
+				s.close()
+			}
+		case <-s.done:
+			s.drain()
+			s.writeMx.Lock()
+			s.str.Close()
+			s.writeMx.Unlock()
+			return
+		}
+	}
+}
+
+// Drops whatever is left in the queue once the session is closed
+func (s *Session) drain() {
+	for {
+		select {
+		case out := <-s.queue:
+			if out.result != nil {
+				out.result(false)
+			}
+		default:
+			return
+		}
+	}
+}
+
+// Closed once the session is removed from its manager
+func (s *Session) Done() <-chan struct{} {
+	return s.done
+}
+
+func (s *Session) close() {
+	s.stateMx.Lock()
+	defer s.stateMx.Unlock()
+	if s.closed {
+		return
+	}
+	s.closed = true
+	close(s.done)
+}
+
+// Registry of connected sessions, keyed by username and session id. A user may have several sessions open at
+// once, one per device
+type SessionManager struct {
+	mx       sync.RWMutex
+	sessions map[string]map[uint64]*Session
+	nextId   atomic.Uint64
+
+	// called when a user's first session opens and when their last one closes. May be nil
+	OnPresence func(username string, online bool)
+	// of sessions added from then on, 0 for none
+	WriteTimeout time.Duration
+}
+
+func NewSessionManager() *SessionManager {
+	return &SessionManager{
+		sessions:     make(map[string]map[uint64]*Session),
+		WriteTimeout: settings.DEFAULT_WRITE_TIMEOUT,
+	}
+}
+
+var Sessions = NewSessionManager()
+
+// Registers a new session for the user. Existing sessions of the same user are left untouched
+func (m *SessionManager) Add(username string, str io.WriteCloser) *Session {
+	s := &Session{
+		Id:           m.nextId.Add(1),
+		Username:     username,
+		str:          str,
+		writeTimeout: m.WriteTimeout,
+		done:         make(chan struct{}),
+		queue:        make(chan outbound, OUTBOUND_QUEUE_SIZE),
+	}
+	s.Touch()
+	go s.writeLoop()
+
+	m.mx.Lock()
+	userSessions, ok := m.sessions[username]
+	if !ok {
+		userSessions = make(map[uint64]*Session)
+		m.sessions[username] = userSessions
+	}
+	userSessions[s.Id] = s
+	m.mx.Unlock()
+
+	if !ok {
+		m.presence(username, true)
+	}
+	return s
+}
+
+func (m *SessionManager) presence(username string, online bool) {
+	if m.OnPresence != nil {
+		m.OnPresence(username, online)
+	}
+}
+
+// Unregisters and closes the session. Only ever removes that exact session, so a stale connection going away
+// doesn't affect newer ones of the same user
+func (m *SessionManager) Remove(s *Session) {
+	offline := false
+	m.mx.Lock()
+	if userSessions, ok := m.sessions[s.Username]; ok {
+		_, found := userSessions[s.Id]
+		delete(userSessions, s.Id)
+		if len(userSessions) == 0 {
+			delete(m.sessions, s.Username)
+			offline = found
+		}
+	}
+	m.mx.Unlock()
+
+	s.close()
+	if offline {
+		m.presence(s.Username, false)
+	}
+}
+
+// Snapshot of the user's open sessions
+func (m *SessionManager) Get(username string) []*Session {
+	m.mx.RLock()
+	defer m.mx.RUnlock()
+	userSessions := m.sessions[username]
+	result := make([]*Session, 0, len(userSessions))
+	for _, s := range userSessions {
+		result = append(result, s)
+	}
+	return result
+}
+
+func (m *SessionManager) Count(username string) int {
+	m.mx.RLock()
+	defer m.mx.RUnlock()
+	return len(m.sessions[username])
+}
+
+// Removes every session that hasn't sent anything in maxIdle. Returns the removed sessions
+func (m *SessionManager) Reap(maxIdle time.Duration) []*Session {
+	cutoff := time.Now().Add(-maxIdle)
+	idle := make([]*Session, 0)
+	m.mx.RLock()
+	for _, userSessions := range m.sessions {
+		for _, s := range userSessions {
+			if s.LastSeen().Before(cutoff) {
+				idle = append(idle, s)
+			}
+		}
+	}
+	m.mx.RUnlock()
+
+	for _, s := range idle {
+		m.Remove(s)
+	}
+	return idle
+}
+
+// Pings every session each interval and reaps those that missed the given number of heartbeats in a row, so a
+// dead client doesn't keep taking messages that should go to its inbox. Runs until stop is called
+func (m *SessionManager) StartHeartbeats(interval time.Duration, missed int, ping []byte) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-done:
+				return
+			}
+			for _, s := range m.Reap(interval * time.Duration(missed)) {
+				logging.GetLogger().Printf("Session %v of %v missed %v heartbeats, closed\n", s.Id, s.Username, missed)
+			}
+			m.mx.RLock()
+			for _, userSessions := range m.sessions {
+				for _, s := range userSessions {
+					s.Enqueue(ping, nil)
+				}
+			}
+			m.mx.RUnlock()
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(done) })
+	}
+}
+
+// Closes every session, used when shutting down
+func (m *SessionManager) CloseAll() {
+	m.mx.Lock()
+	all := m.sessions
+	m.sessions = make(map[string]map[uint64]*Session)
+	m.mx.Unlock()
+
+	for _, userSessions := range all {
+		for _, s := range userSessions {
+			s.close()
+		}
+	}
+}
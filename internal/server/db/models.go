@@ -4,18 +4,67 @@
 
 package db
 
+import (
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
 type ChatInbox struct {
 	Code             []byte
 	CurrentTokenHash []byte
 	EncToken         []byte
 	KeyExchangeData  []byte
+	CreatedAt        pgtype.Timestamptz
 }
 
 type ChatInboxMessage struct {
+	ID         int32
+	SerialN    int64
+	InboxCode  []byte
+	EncMsg     []byte
+	SenderAuth []byte
+	CreatedAt  pgtype.Timestamptz
+}
+
+type ExpiredMessage struct {
+	ID         int32
+	InboxCode  []byte
+	SerialN    int64
+	SenderAuth []byte
+	ExpiredAt  pgtype.Timestamptz
+}
+
+type Report struct {
+	ID         int32
+	Reporter   string
+	Reported   string
+	Reason     int32
+	Comment    string
+	Status     string
+	CreatedAt  pgtype.Timestamptz
+	ResolvedAt pgtype.Timestamptz
+}
+
+type ReportEvidence struct {
 	ID        int32
-	SerialN   int64
-	InboxCode []byte
-	EncMsg    []byte
+	ReportID  int32
+	Event     []byte
+	Signature []byte
+}
+
+type ServerKey struct {
+	ID         int32
+	Salt       []byte
+	TimeCost   int32
+	MemoryKib  int32
+	Threads    int32
+	WrappedKey []byte
+	Active     bool
+	CreatedAt  pgtype.Timestamptz
+}
+
+type ServerSecret struct {
+	Name  string
+	Value []byte
 }
 
 type User struct {
@@ -27,10 +76,13 @@ type User struct {
 
 type UserInbox struct {
 	ID              int32
-	Username        string
+	Inbox           []byte
 	EncSender       []byte
 	EncSignature    []byte
 	EncSerial       []byte
 	EncInboxCode    []byte
 	KeyExchangeData []byte
+	EncRatchetKey   []byte
+	Version         int32
+	CreatedAt       pgtype.Timestamptz
 }
@@ -7,25 +7,128 @@ package db
 
 import (
 	"context"
+
+	"github.com/jackc/pgx/v5/pgtype"
 )
 
+const activateServerKey = `-- name: ActivateServerKey :exec
+UPDATE server_keys
+SET active = (id = $1)
+`
+
+func (q *Queries) ActivateServerKey(ctx context.Context, id int32) error {
+	_, err := q.db.Exec(ctx, activateServerKey, id)
+	return err
+}
+
 const addMessage = `-- name: AddMessage :exec
-INSERT INTO chat_inbox_messages (inbox_code, serial_n, enc_msg) 
-VALUES ($1, $2, $3)
+INSERT INTO chat_inbox_messages (inbox_code, serial_n, enc_msg, sender_auth) 
+VALUES ($1, $2, $3, $4)
 `
 
 type AddMessageParams struct {
-	InboxCode []byte
-	SerialN   int64
-	EncMsg    []byte
+	InboxCode  []byte
+	SerialN    int64
+	EncMsg     []byte
+	SenderAuth []byte
 }
 
 // -- CHAT MESSAGES
 func (q *Queries) AddMessage(ctx context.Context, arg AddMessageParams) error {
-	_, err := q.db.Exec(ctx, addMessage, arg.InboxCode, arg.SerialN, arg.EncMsg)
+	_, err := q.db.Exec(ctx, addMessage,
+		arg.InboxCode,
+		arg.SerialN,
+		arg.EncMsg,
+		arg.SenderAuth,
+	)
+	return err
+}
+
+const addReportEvidence = `-- name: AddReportEvidence :exec
+INSERT INTO report_evidence (report_id, event, signature)
+VALUES ($1, $2, $3)
+`
+
+type AddReportEvidenceParams struct {
+	ReportID  int32
+	Event     []byte
+	Signature []byte
+}
+
+func (q *Queries) AddReportEvidence(ctx context.Context, arg AddReportEvidenceParams) error {
+	_, err := q.db.Exec(ctx, addReportEvidence, arg.ReportID, arg.Event, arg.Signature)
 	return err
 }
 
+const addServerKey = `-- name: AddServerKey :one
+INSERT INTO server_keys (salt, time_cost, memory_kib, threads, wrapped_key)
+VALUES ($1, $2, $3, $4, $5)
+RETURNING id
+`
+
+type AddServerKeyParams struct {
+	Salt       []byte
+	TimeCost   int32
+	MemoryKib  int32
+	Threads    int32
+	WrappedKey []byte
+}
+
+func (q *Queries) AddServerKey(ctx context.Context, arg AddServerKeyParams) (int32, error) {
+	row := q.db.QueryRow(ctx, addServerKey,
+		arg.Salt,
+		arg.TimeCost,
+		arg.MemoryKib,
+		arg.Threads,
+		arg.WrappedKey,
+	)
+	var id int32
+	err := row.Scan(&id)
+	return id, err
+}
+
+const addServerSecret = `-- name: AddServerSecret :exec
+INSERT INTO server_secrets (name, value)
+VALUES ($1, $2)
+ON CONFLICT (name) DO NOTHING
+`
+
+type AddServerSecretParams struct {
+	Name  string
+	Value []byte
+}
+
+func (q *Queries) AddServerSecret(ctx context.Context, arg AddServerSecretParams) error {
+	_, err := q.db.Exec(ctx, addServerSecret, arg.Name, arg.Value)
+	return err
+}
+
+const countMessages = `-- name: CountMessages :one
+SELECT COUNT(*)
+FROM chat_inbox_messages
+WHERE inbox_code = $1
+`
+
+func (q *Queries) CountMessages(ctx context.Context, inboxCode []byte) (int64, error) {
+	row := q.db.QueryRow(ctx, countMessages, inboxCode)
+	var count int64
+	err := row.Scan(&count)
+	return count, err
+}
+
+const countNewUserInboxes = `-- name: CountNewUserInboxes :one
+SELECT COUNT(*)
+FROM user_inboxes
+WHERE inbox = $1
+`
+
+func (q *Queries) CountNewUserInboxes(ctx context.Context, inbox []byte) (int64, error) {
+	row := q.db.QueryRow(ctx, countNewUserInboxes, inbox)
+	var count int64
+	err := row.Scan(&count)
+	return count, err
+}
+
 const createInbox = `-- name: CreateInbox :exec
 INSERT INTO chat_inboxes (code, current_token_hash, enc_token, key_exchange_data) 
 VALUES ($1, NULL, NULL, NULL)
@@ -37,6 +140,31 @@ func (q *Queries) CreateInbox(ctx context.Context, code []byte) error {
 	return err
 }
 
+const createReport = `-- name: CreateReport :one
+INSERT INTO reports (reporter, reported, reason, comment)
+VALUES ($1, $2, $3, $4)
+RETURNING id
+`
+
+type CreateReportParams struct {
+	Reporter string
+	Reported string
+	Reason   int32
+	Comment  string
+}
+
+func (q *Queries) CreateReport(ctx context.Context, arg CreateReportParams) (int32, error) {
+	row := q.db.QueryRow(ctx, createReport,
+		arg.Reporter,
+		arg.Reported,
+		arg.Reason,
+		arg.Comment,
+	)
+	var id int32
+	err := row.Scan(&id)
+	return id, err
+}
+
 const createUser = `-- name: CreateUser :exec
 INSERT INTO users (username, certificate, pub_key_exchange) 
 VALUES ($1, $2, $3)
@@ -53,16 +181,110 @@ func (q *Queries) CreateUser(ctx context.Context, arg CreateUserParams) error {
 	return err
 }
 
+const deleteEmptyInboxes = `-- name: DeleteEmptyInboxes :execrows
+DELETE FROM chat_inboxes
+WHERE code IN (
+    SELECT code FROM chat_inboxes i
+    WHERE i.created_at < $1
+        AND NOT EXISTS (SELECT 1 FROM chat_inbox_messages WHERE inbox_code = i.code)
+    FOR UPDATE SKIP LOCKED
+)
+`
+
+func (q *Queries) DeleteEmptyInboxes(ctx context.Context, createdAt pgtype.Timestamptz) (int64, error) {
+	result, err := q.db.Exec(ctx, deleteEmptyInboxes, createdAt)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
+const deleteInactiveServerKeys = `-- name: DeleteInactiveServerKeys :execrows
+DELETE FROM server_keys
+WHERE NOT active
+`
+
+func (q *Queries) DeleteInactiveServerKeys(ctx context.Context) (int64, error) {
+	result, err := q.db.Exec(ctx, deleteInactiveServerKeys)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
+const deleteMessagesUpTo = `-- name: DeleteMessagesUpTo :execrows
+DELETE FROM chat_inbox_messages
+WHERE inbox_code = $1 AND id <= $2
+`
+
+type DeleteMessagesUpToParams struct {
+	InboxCode []byte
+	ID        int32
+}
+
+func (q *Queries) DeleteMessagesUpTo(ctx context.Context, arg DeleteMessagesUpToParams) (int64, error) {
+	result, err := q.db.Exec(ctx, deleteMessagesUpTo, arg.InboxCode, arg.ID)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
 const deleteNewUserInboxes = `-- name: DeleteNewUserInboxes :exec
 DELETE FROM user_inboxes
-WHERE username = $1
+WHERE inbox = $1
 `
 
-func (q *Queries) DeleteNewUserInboxes(ctx context.Context, username string) error {
-	_, err := q.db.Exec(ctx, deleteNewUserInboxes, username)
+func (q *Queries) DeleteNewUserInboxes(ctx context.Context, inbox []byte) error {
+	_, err := q.db.Exec(ctx, deleteNewUserInboxes, inbox)
 	return err
 }
 
+const expireInvitations = `-- name: ExpireInvitations :execrows
+DELETE FROM user_inboxes
+WHERE created_at < $1
+`
+
+func (q *Queries) ExpireInvitations(ctx context.Context, createdAt pgtype.Timestamptz) (int64, error) {
+	result, err := q.db.Exec(ctx, expireInvitations, createdAt)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
+const expireMessages = `-- name: ExpireMessages :execrows
+WITH expired AS (
+    DELETE FROM chat_inbox_messages m
+    USING (
+        SELECT id, created_at,
+            ROW_NUMBER() OVER w AS newer_count,
+            SUM(octet_length(enc_msg)) OVER w AS newer_bytes
+        FROM chat_inbox_messages
+        WINDOW w AS (PARTITION BY inbox_code ORDER BY id DESC)
+    ) ranked
+    WHERE m.id = ranked.id
+        AND (ranked.created_at < $1 OR ranked.newer_count > $2 OR ranked.newer_bytes > $3)
+    RETURNING m.inbox_code, m.serial_n, m.sender_auth
+)
+INSERT INTO expired_messages (inbox_code, serial_n, sender_auth)
+SELECT inbox_code, serial_n, sender_auth FROM expired
+`
+
+type ExpireMessagesParams struct {
+	CreatedAt  pgtype.Timestamptz
+	NewerCount int64
+	NewerBytes int64
+}
+
+func (q *Queries) ExpireMessages(ctx context.Context, arg ExpireMessagesParams) (int64, error) {
+	result, err := q.db.Exec(ctx, expireMessages, arg.CreatedAt, arg.NewerCount, arg.NewerBytes)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
 const flushInbox = `-- name: FlushInbox :exec
 DELETE FROM chat_inbox_messages
 WHERE inbox_code = $1
@@ -73,6 +295,55 @@ func (q *Queries) FlushInbox(ctx context.Context, inboxCode []byte) error {
 	return err
 }
 
+const forgetExpiredMessages = `-- name: ForgetExpiredMessages :execrows
+DELETE FROM expired_messages
+WHERE expired_at < $1
+`
+
+func (q *Queries) ForgetExpiredMessages(ctx context.Context, expiredAt pgtype.Timestamptz) (int64, error) {
+	result, err := q.db.Exec(ctx, forgetExpiredMessages, expiredAt)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
+const getExpiredMessages = `-- name: GetExpiredMessages :many
+SELECT serial_n, sender_auth
+FROM expired_messages
+WHERE inbox_code = $1 AND sender_auth IS NOT NULL AND serial_n = ANY($2::BIGINT[])
+`
+
+type GetExpiredMessagesParams struct {
+	InboxCode []byte
+	Column2   []int64
+}
+
+type GetExpiredMessagesRow struct {
+	SerialN    int64
+	SenderAuth []byte
+}
+
+func (q *Queries) GetExpiredMessages(ctx context.Context, arg GetExpiredMessagesParams) ([]GetExpiredMessagesRow, error) {
+	rows, err := q.db.Query(ctx, getExpiredMessages, arg.InboxCode, arg.Column2)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []GetExpiredMessagesRow
+	for rows.Next() {
+		var i GetExpiredMessagesRow
+		if err := rows.Scan(&i.SerialN, &i.SenderAuth); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
 const getInboxToken = `-- name: GetInboxToken :one
 SELECT current_token_hash, enc_token, key_exchange_data
 FROM chat_inboxes
@@ -96,6 +367,7 @@ const getMessages = `-- name: GetMessages :many
 SELECT enc_msg, serial_n
 FROM chat_inbox_messages
 WHERE inbox_code = $1
+ORDER BY serial_n
 `
 
 type GetMessagesRow struct {
@@ -123,10 +395,50 @@ func (q *Queries) GetMessages(ctx context.Context, inboxCode []byte) ([]GetMessa
 	return items, nil
 }
 
+const getMessagesPage = `-- name: GetMessagesPage :many
+SELECT id, enc_msg, serial_n
+FROM chat_inbox_messages
+WHERE inbox_code = $1 AND id >= $2
+ORDER BY id
+LIMIT $3
+`
+
+type GetMessagesPageParams struct {
+	InboxCode []byte
+	ID        int32
+	Limit     int32
+}
+
+type GetMessagesPageRow struct {
+	ID      int32
+	EncMsg  []byte
+	SerialN int64
+}
+
+func (q *Queries) GetMessagesPage(ctx context.Context, arg GetMessagesPageParams) ([]GetMessagesPageRow, error) {
+	rows, err := q.db.Query(ctx, getMessagesPage, arg.InboxCode, arg.ID, arg.Limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []GetMessagesPageRow
+	for rows.Next() {
+		var i GetMessagesPageRow
+		if err := rows.Scan(&i.ID, &i.EncMsg, &i.SerialN); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
 const getNewUserInboxes = `-- name: GetNewUserInboxes :many
-SELECT enc_sender, enc_inbox_code, enc_serial, enc_signature, key_exchange_data
+SELECT enc_sender, enc_inbox_code, enc_serial, enc_signature, key_exchange_data, enc_ratchet_key, version, created_at
 FROM user_inboxes
-WHERE username = $1
+WHERE inbox = $1
 `
 
 type GetNewUserInboxesRow struct {
@@ -135,10 +447,13 @@ type GetNewUserInboxesRow struct {
 	EncSerial       []byte
 	EncSignature    []byte
 	KeyExchangeData []byte
+	EncRatchetKey   []byte
+	Version         int32
+	CreatedAt       pgtype.Timestamptz
 }
 
-func (q *Queries) GetNewUserInboxes(ctx context.Context, username string) ([]GetNewUserInboxesRow, error) {
-	rows, err := q.db.Query(ctx, getNewUserInboxes, username)
+func (q *Queries) GetNewUserInboxes(ctx context.Context, inbox []byte) ([]GetNewUserInboxesRow, error) {
+	rows, err := q.db.Query(ctx, getNewUserInboxes, inbox)
 	if err != nil {
 		return nil, err
 	}
@@ -152,6 +467,9 @@ func (q *Queries) GetNewUserInboxes(ctx context.Context, username string) ([]Get
 			&i.EncSerial,
 			&i.EncSignature,
 			&i.KeyExchangeData,
+			&i.EncRatchetKey,
+			&i.Version,
+			&i.CreatedAt,
 		); err != nil {
 			return nil, err
 		}
@@ -163,6 +481,122 @@ func (q *Queries) GetNewUserInboxes(ctx context.Context, username string) ([]Get
 	return items, nil
 }
 
+const getReport = `-- name: GetReport :one
+SELECT id, reporter, reported, reason, comment, status, created_at, resolved_at
+FROM reports
+WHERE id = $1
+`
+
+func (q *Queries) GetReport(ctx context.Context, id int32) (Report, error) {
+	row := q.db.QueryRow(ctx, getReport, id)
+	var i Report
+	err := row.Scan(
+		&i.ID,
+		&i.Reporter,
+		&i.Reported,
+		&i.Reason,
+		&i.Comment,
+		&i.Status,
+		&i.CreatedAt,
+		&i.ResolvedAt,
+	)
+	return i, err
+}
+
+const getReportEvidence = `-- name: GetReportEvidence :many
+SELECT event, signature
+FROM report_evidence
+WHERE report_id = $1
+ORDER BY id
+`
+
+type GetReportEvidenceRow struct {
+	Event     []byte
+	Signature []byte
+}
+
+func (q *Queries) GetReportEvidence(ctx context.Context, reportID int32) ([]GetReportEvidenceRow, error) {
+	rows, err := q.db.Query(ctx, getReportEvidence, reportID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []GetReportEvidenceRow
+	for rows.Next() {
+		var i GetReportEvidenceRow
+		if err := rows.Scan(&i.Event, &i.Signature); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getServerKeys = `-- name: GetServerKeys :many
+SELECT id, salt, time_cost, memory_kib, threads, wrapped_key, active, created_at
+FROM server_keys
+ORDER BY id
+`
+
+// -- SERVER KEYS
+func (q *Queries) GetServerKeys(ctx context.Context) ([]ServerKey, error) {
+	rows, err := q.db.Query(ctx, getServerKeys)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []ServerKey
+	for rows.Next() {
+		var i ServerKey
+		if err := rows.Scan(
+			&i.ID,
+			&i.Salt,
+			&i.TimeCost,
+			&i.MemoryKib,
+			&i.Threads,
+			&i.WrappedKey,
+			&i.Active,
+			&i.CreatedAt,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getServerSecrets = `-- name: GetServerSecrets :many
+SELECT name, value
+FROM server_secrets
+ORDER BY name
+`
+
+func (q *Queries) GetServerSecrets(ctx context.Context) ([]ServerSecret, error) {
+	rows, err := q.db.Query(ctx, getServerSecrets)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []ServerSecret
+	for rows.Next() {
+		var i ServerSecret
+		if err := rows.Scan(&i.Name, &i.Value); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
 const getUserData = `-- name: GetUserData :one
 SELECT id, username, certificate, pub_key_exchange
 FROM users
@@ -215,33 +649,358 @@ func (q *Queries) GetUsers(ctx context.Context, arg GetUsersParams) ([]string, e
 	return items, nil
 }
 
+const listReports = `-- name: ListReports :many
+SELECT id, reporter, reported, reason, comment, status, created_at, resolved_at
+FROM reports
+WHERE status = $1
+ORDER BY created_at
+LIMIT $2
+`
+
+type ListReportsParams struct {
+	Status string
+	Limit  int32
+}
+
+func (q *Queries) ListReports(ctx context.Context, arg ListReportsParams) ([]Report, error) {
+	rows, err := q.db.Query(ctx, listReports, arg.Status, arg.Limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []Report
+	for rows.Next() {
+		var i Report
+		if err := rows.Scan(
+			&i.ID,
+			&i.Reporter,
+			&i.Reported,
+			&i.Reason,
+			&i.Comment,
+			&i.Status,
+			&i.CreatedAt,
+			&i.ResolvedAt,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listStaleExpiredAuths = `-- name: ListStaleExpiredAuths :many
+SELECT id, inbox_code, sender_auth
+FROM expired_messages
+WHERE sender_auth IS NOT NULL AND substring(sender_auth FROM 1 FOR 4) <> $1::BYTEA
+LIMIT $2
+`
+
+type ListStaleExpiredAuthsParams struct {
+	Column1 []byte
+	Limit   int32
+}
+
+type ListStaleExpiredAuthsRow struct {
+	ID         int32
+	InboxCode  []byte
+	SenderAuth []byte
+}
+
+func (q *Queries) ListStaleExpiredAuths(ctx context.Context, arg ListStaleExpiredAuthsParams) ([]ListStaleExpiredAuthsRow, error) {
+	rows, err := q.db.Query(ctx, listStaleExpiredAuths, arg.Column1, arg.Limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []ListStaleExpiredAuthsRow
+	for rows.Next() {
+		var i ListStaleExpiredAuthsRow
+		if err := rows.Scan(&i.ID, &i.InboxCode, &i.SenderAuth); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listStaleInboxTokens = `-- name: ListStaleInboxTokens :many
+SELECT code, current_token_hash
+FROM chat_inboxes
+WHERE current_token_hash IS NOT NULL AND substring(current_token_hash FROM 1 FOR 4) <> $1::BYTEA
+LIMIT $2
+`
+
+type ListStaleInboxTokensParams struct {
+	Column1 []byte
+	Limit   int32
+}
+
+type ListStaleInboxTokensRow struct {
+	Code             []byte
+	CurrentTokenHash []byte
+}
+
+func (q *Queries) ListStaleInboxTokens(ctx context.Context, arg ListStaleInboxTokensParams) ([]ListStaleInboxTokensRow, error) {
+	rows, err := q.db.Query(ctx, listStaleInboxTokens, arg.Column1, arg.Limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []ListStaleInboxTokensRow
+	for rows.Next() {
+		var i ListStaleInboxTokensRow
+		if err := rows.Scan(&i.Code, &i.CurrentTokenHash); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listStaleMessageAuths = `-- name: ListStaleMessageAuths :many
+SELECT id, inbox_code, sender_auth
+FROM chat_inbox_messages
+WHERE sender_auth IS NOT NULL AND substring(sender_auth FROM 1 FOR 4) <> $1::BYTEA
+LIMIT $2
+`
+
+type ListStaleMessageAuthsParams struct {
+	Column1 []byte
+	Limit   int32
+}
+
+type ListStaleMessageAuthsRow struct {
+	ID         int32
+	InboxCode  []byte
+	SenderAuth []byte
+}
+
+func (q *Queries) ListStaleMessageAuths(ctx context.Context, arg ListStaleMessageAuthsParams) ([]ListStaleMessageAuthsRow, error) {
+	rows, err := q.db.Query(ctx, listStaleMessageAuths, arg.Column1, arg.Limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []ListStaleMessageAuthsRow
+	for rows.Next() {
+		var i ListStaleMessageAuthsRow
+		if err := rows.Scan(&i.ID, &i.InboxCode, &i.SenderAuth); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const lockInbox = `-- name: LockInbox :one
+SELECT current_token_hash, enc_token, key_exchange_data
+FROM chat_inboxes
+WHERE code = $1
+FOR UPDATE
+`
+
+type LockInboxRow struct {
+	CurrentTokenHash []byte
+	EncToken         []byte
+	KeyExchangeData  []byte
+}
+
+func (q *Queries) LockInbox(ctx context.Context, code []byte) (LockInboxRow, error) {
+	row := q.db.QueryRow(ctx, lockInbox, code)
+	var i LockInboxRow
+	err := row.Scan(&i.CurrentTokenHash, &i.EncToken, &i.KeyExchangeData)
+	return i, err
+}
+
+const lockOrCreateInbox = `-- name: LockOrCreateInbox :one
+INSERT INTO chat_inboxes (code, current_token_hash, enc_token, key_exchange_data)
+VALUES ($1, NULL, NULL, NULL)
+ON CONFLICT (code) DO UPDATE SET code = EXCLUDED.code
+RETURNING current_token_hash, enc_token, key_exchange_data
+`
+
+type LockOrCreateInboxRow struct {
+	CurrentTokenHash []byte
+	EncToken         []byte
+	KeyExchangeData  []byte
+}
+
+func (q *Queries) LockOrCreateInbox(ctx context.Context, code []byte) (LockOrCreateInboxRow, error) {
+	row := q.db.QueryRow(ctx, lockOrCreateInbox, code)
+	var i LockOrCreateInboxRow
+	err := row.Scan(&i.CurrentTokenHash, &i.EncToken, &i.KeyExchangeData)
+	return i, err
+}
+
 const newUserInbox = `-- name: NewUserInbox :exec
-INSERT INTO user_inboxes (username, enc_sender, enc_signature, enc_serial, enc_inbox_code, key_exchange_data)
-VALUES ($1, $2, $3, $4, $5, $6)
+INSERT INTO user_inboxes (inbox, enc_sender, enc_signature, enc_serial, enc_inbox_code, key_exchange_data, enc_ratchet_key, version)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
 `
 
 type NewUserInboxParams struct {
-	Username        string
+	Inbox           []byte
 	EncSender       []byte
 	EncSignature    []byte
 	EncSerial       []byte
 	EncInboxCode    []byte
 	KeyExchangeData []byte
+	EncRatchetKey   []byte
+	Version         int32
 }
 
 // -- USER PERSONAL INBOXES
 func (q *Queries) NewUserInbox(ctx context.Context, arg NewUserInboxParams) error {
 	_, err := q.db.Exec(ctx, newUserInbox,
-		arg.Username,
+		arg.Inbox,
 		arg.EncSender,
 		arg.EncSignature,
 		arg.EncSerial,
 		arg.EncInboxCode,
 		arg.KeyExchangeData,
+		arg.EncRatchetKey,
+		arg.Version,
+	)
+	return err
+}
+
+const resolveReport = `-- name: ResolveReport :execrows
+UPDATE reports
+SET status = $2, resolved_at = now()
+WHERE id = $1 AND status = 'open'
+`
+
+type ResolveReportParams struct {
+	ID     int32
+	Status string
+}
+
+func (q *Queries) ResolveReport(ctx context.Context, arg ResolveReportParams) (int64, error) {
+	result, err := q.db.Exec(ctx, resolveReport, arg.ID, arg.Status)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
+const rewrapExpiredAuth = `-- name: RewrapExpiredAuth :execrows
+UPDATE expired_messages
+SET sender_auth = $3
+WHERE id = $1 AND sender_auth = $2
+`
+
+type RewrapExpiredAuthParams struct {
+	ID           int32
+	SenderAuth   []byte
+	SenderAuth_2 []byte
+}
+
+func (q *Queries) RewrapExpiredAuth(ctx context.Context, arg RewrapExpiredAuthParams) (int64, error) {
+	result, err := q.db.Exec(ctx, rewrapExpiredAuth, arg.ID, arg.SenderAuth, arg.SenderAuth_2)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
+const rewrapInboxToken = `-- name: RewrapInboxToken :execrows
+UPDATE chat_inboxes
+SET current_token_hash = $3
+WHERE code = $1 AND current_token_hash = $2
+`
+
+type RewrapInboxTokenParams struct {
+	Code               []byte
+	CurrentTokenHash   []byte
+	CurrentTokenHash_2 []byte
+}
+
+func (q *Queries) RewrapInboxToken(ctx context.Context, arg RewrapInboxTokenParams) (int64, error) {
+	result, err := q.db.Exec(ctx, rewrapInboxToken, arg.Code, arg.CurrentTokenHash, arg.CurrentTokenHash_2)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
+const rewrapMessageAuth = `-- name: RewrapMessageAuth :execrows
+UPDATE chat_inbox_messages
+SET sender_auth = $3
+WHERE id = $1 AND sender_auth = $2
+`
+
+type RewrapMessageAuthParams struct {
+	ID           int32
+	SenderAuth   []byte
+	SenderAuth_2 []byte
+}
+
+func (q *Queries) RewrapMessageAuth(ctx context.Context, arg RewrapMessageAuthParams) (int64, error) {
+	result, err := q.db.Exec(ctx, rewrapMessageAuth, arg.ID, arg.SenderAuth, arg.SenderAuth_2)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
+const rewrapServerKey = `-- name: RewrapServerKey :exec
+UPDATE server_keys
+SET salt = $2, time_cost = $3, memory_kib = $4, threads = $5, wrapped_key = $6
+WHERE id = $1
+`
+
+type RewrapServerKeyParams struct {
+	ID         int32
+	Salt       []byte
+	TimeCost   int32
+	MemoryKib  int32
+	Threads    int32
+	WrappedKey []byte
+}
+
+func (q *Queries) RewrapServerKey(ctx context.Context, arg RewrapServerKeyParams) error {
+	_, err := q.db.Exec(ctx, rewrapServerKey,
+		arg.ID,
+		arg.Salt,
+		arg.TimeCost,
+		arg.MemoryKib,
+		arg.Threads,
+		arg.WrappedKey,
 	)
 	return err
 }
 
+const rewrapServerSecret = `-- name: RewrapServerSecret :execrows
+UPDATE server_secrets
+SET value = $3
+WHERE name = $1 AND value = $2
+`
+
+type RewrapServerSecretParams struct {
+	Name    string
+	Value   []byte
+	Value_2 []byte
+}
+
+func (q *Queries) RewrapServerSecret(ctx context.Context, arg RewrapServerSecretParams) (int64, error) {
+	result, err := q.db.Exec(ctx, rewrapServerSecret, arg.Name, arg.Value, arg.Value_2)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
 const setToken = `-- name: SetToken :exec
 UPDATE chat_inboxes
 SET current_token_hash = $2, enc_token = $3, key_exchange_data = $4
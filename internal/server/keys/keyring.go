@@ -0,0 +1,301 @@
+package keys
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+
+	"github.com/as283-ua/yappa/internal/server/db"
+	"github.com/as283-ua/yappa/pkg/common"
+	"golang.org/x/crypto/argon2"
+)
+
+// Argon2id parameters data keys are wrapped with. Stored with each key, so changing them only affects keys
+// wrapped from then on
+const (
+	ARGON2_TIME       = 3
+	ARGON2_MEMORY_KIB = 64 * 1024
+	ARGON2_THREADS    = 4
+	SALT_SIZE         = 16
+)
+
+// Wrapped secrets start with the id of the data key, big endian
+const KEY_ID_SIZE = 4
+
+var ErrWrongMasterKey = errors.New("wrong master key")
+
+// Returned by whatever needs Ring before SetupServer loaded it
+var ErrNoKeyring = errors.New("no keyring loaded")
+
+// Data keys of the server, unwrapped with the master passphrase. Every secret the server keeps in the database
+// is encrypted with the active one. Older ones are kept until Reencrypt moves what they encrypted to the active
+// one
+type Keyring struct {
+	repo KeyRepo
+
+	mx     sync.RWMutex
+	keys   map[int32][]byte
+	active int32
+}
+
+// Set up by SetupServer
+var Ring *Keyring
+
+func keyAD(salt []byte) common.AssociatedData {
+	return common.AssociatedData{
+		Version: common.PROTOCOL_VERSION,
+		Label:   common.LabelServerKey,
+		Context: salt,
+	}
+}
+
+func deriveKek(passphrase []byte, key db.ServerKey) []byte {
+	return argon2.IDKey(passphrase, key.Salt, uint32(key.TimeCost), uint32(key.MemoryKib), uint8(key.Threads), common.KEY_SIZE)
+}
+
+// Wraps the data key with the passphrase, under a new salt
+func wrapKey(passphrase, dataKey []byte) (db.ServerKey, error) {
+	key := db.ServerKey{
+		Salt:      make([]byte, SALT_SIZE),
+		TimeCost:  ARGON2_TIME,
+		MemoryKib: ARGON2_MEMORY_KIB,
+		Threads:   ARGON2_THREADS,
+	}
+	rand.Read(key.Salt)
+	var err error
+	key.WrappedKey, err = common.Seal(deriveKek(passphrase, key), dataKey, keyAD(key.Salt))
+	return key, err
+}
+
+func unwrapKey(passphrase []byte, key db.ServerKey) ([]byte, error) {
+	dataKey, err := common.Open(deriveKek(passphrase, key), key.WrappedKey, keyAD(key.Salt))
+	if err != nil {
+		return nil, ErrWrongMasterKey
+	}
+	return dataKey, nil
+}
+
+// Stores a new random data key wrapped with the passphrase
+func addKey(repo KeyRepo, passphrase []byte) (int32, []byte, error) {
+	dataKey := make([]byte, common.KEY_SIZE)
+	rand.Read(dataKey)
+	key, err := wrapKey(passphrase, dataKey)
+	if err != nil {
+		return 0, nil, err
+	}
+	id, err := repo.AddKey(key)
+	return id, dataKey, err
+}
+
+// Unwraps every data key with the master passphrase. The first time a data key is created for it
+func Load(repo KeyRepo, passphrase []byte) (*Keyring, error) {
+	ring := &Keyring{repo: repo, keys: make(map[int32][]byte), active: -1}
+	err := repo.InTx(func(tx KeyRepo) error {
+		stored, err := tx.GetKeys()
+		if err != nil {
+			return err
+		}
+		if len(stored) == 0 {
+			id, dataKey, err := addKey(tx, passphrase)
+			if err != nil {
+				return err
+			}
+			ring.keys[id] = dataKey
+			ring.active = id
+			return tx.ActivateKey(id)
+		}
+		for _, key := range stored {
+			dataKey, err := unwrapKey(passphrase, key)
+			if err != nil {
+				return err
+			}
+			ring.keys[key.ID] = dataKey
+			if key.Active {
+				ring.active = key.ID
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if ring.active < 0 {
+		return nil, errors.New("no active server key")
+	}
+	return ring, nil
+}
+
+// Moves every data key from the old passphrase to the new one and adds a new active data key. The old passphrase
+// opens nothing afterwards. What the older keys encrypted is moved to the new one by Reencrypt, once the server
+// is started with the new passphrase. Returns the id of the new key
+func Rotate(repo KeyRepo, oldPassphrase, newPassphrase []byte) (int32, error) {
+	var id int32
+	err := repo.InTx(func(tx KeyRepo) error {
+		stored, err := tx.GetKeys()
+		if err != nil {
+			return err
+		}
+		for _, key := range stored {
+			dataKey, err := unwrapKey(oldPassphrase, key)
+			if err != nil {
+				return err
+			}
+			rewrapped, err := wrapKey(newPassphrase, dataKey)
+			if err != nil {
+				return err
+			}
+			rewrapped.ID = key.ID
+			err = tx.RewrapKey(rewrapped)
+			if err != nil {
+				return err
+			}
+		}
+		id, _, err = addKey(tx, newPassphrase)
+		if err != nil {
+			return err
+		}
+		return tx.ActivateKey(id)
+	})
+	return id, err
+}
+
+// Key id wrapped secrets of the active key start with
+func (k *Keyring) ActiveId() []byte {
+	k.mx.RLock()
+	defer k.mx.RUnlock()
+	return binary.BigEndian.AppendUint32(nil, uint32(k.active))
+}
+
+// Whether the secret was wrapped with the active key
+func (k *Keyring) IsActive(wrapped []byte) bool {
+	return bytes.HasPrefix(wrapped, k.ActiveId())
+}
+
+// Encrypts the secret with the active key, binding it to the associated data
+func (k *Keyring) Wrap(secret []byte, ad common.AssociatedData) ([]byte, error) {
+	k.mx.RLock()
+	id, key := k.active, k.keys[k.active]
+	k.mx.RUnlock()
+	enc, err := common.Seal(key, secret, ad)
+	if err != nil {
+		return nil, err
+	}
+	return append(binary.BigEndian.AppendUint32(nil, uint32(id)), enc...), nil
+}
+
+// Decrypts a secret wrapped with any of the keys
+func (k *Keyring) Unwrap(wrapped []byte, ad common.AssociatedData) ([]byte, error) {
+	if len(wrapped) < KEY_ID_SIZE {
+		return nil, errors.New("wrapped secret too short")
+	}
+	id := int32(binary.BigEndian.Uint32(wrapped))
+	k.mx.RLock()
+	key, ok := k.keys[id]
+	k.mx.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("secret wrapped with unknown key %v", id)
+	}
+	return common.Open(key, wrapped[KEY_ID_SIZE:], ad)
+}
+
+// Wraps the secret again with the active key
+func (k *Keyring) Rewrap(wrapped []byte, ad common.AssociatedData) ([]byte, error) {
+	secret, err := k.Unwrap(wrapped, ad)
+	if err != nil {
+		return nil, err
+	}
+	return k.Wrap(secret, ad)
+}
+
+func secretAD(name string) common.AssociatedData {
+	return common.AssociatedData{
+		Version: common.PROTOCOL_VERSION,
+		Label:   common.LabelServerSecret,
+		Context: []byte(name),
+	}
+}
+
+// Random secret of the server stored under the name, created the first time it's asked for
+func (k *Keyring) Secret(name string) ([]byte, error) {
+	find := func() ([]byte, bool, error) {
+		secrets, err := k.repo.GetSecrets()
+		if err != nil {
+			return nil, false, err
+		}
+		i := slices.IndexFunc(secrets, func(s db.ServerSecret) bool { return s.Name == name })
+		if i < 0 {
+			return nil, false, nil
+		}
+		secret, err := k.Unwrap(secrets[i].Value, secretAD(name))
+		return secret, true, err
+	}
+
+	secret, ok, err := find()
+	if ok || err != nil {
+		return secret, err
+	}
+	secret = make([]byte, common.KEY_SIZE)
+	rand.Read(secret)
+	wrapped, err := k.Wrap(secret, secretAD(name))
+	if err != nil {
+		return nil, err
+	}
+	err = k.repo.AddSecret(name, wrapped)
+	if err != nil {
+		return nil, err
+	}
+	// another server may have stored one first
+	secret, _, err = find()
+	return secret, err
+}
+
+// Moves the server's own secrets to the active key
+func (k *Keyring) reencryptSecrets() error {
+	secrets, err := k.repo.GetSecrets()
+	if err != nil {
+		return err
+	}
+	for _, s := range secrets {
+		if k.IsActive(s.Value) {
+			continue
+		}
+		wrapped, err := k.Rewrap(s.Value, secretAD(s.Name))
+		if err != nil {
+			return fmt.Errorf("secret %v: %w", s.Name, err)
+		}
+		_, err = k.repo.RewrapSecret(s.Name, s.Value, wrapped)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Re-encrypts everything still under an older key with the active one: the server's own secrets and whatever the
+// jobs go through. Once all of them succeed the older keys are deleted. Returns how many were
+func (k *Keyring) Reencrypt(jobs ...func() error) (int64, error) {
+	jobs = append(jobs, k.reencryptSecrets)
+	for _, job := range jobs {
+		err := job()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	retired, err := k.repo.DeleteInactiveKeys()
+	if err != nil {
+		return 0, err
+	}
+	k.mx.Lock()
+	for id := range k.keys {
+		if id != k.active {
+			delete(k.keys, id)
+		}
+	}
+	k.mx.Unlock()
+	return retired, nil
+}
@@ -0,0 +1,110 @@
+package keys
+
+import (
+	"context"
+
+	"github.com/as283-ua/yappa/internal/server/db"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+type KeyRepo interface {
+	// Every data key, active or not, oldest first
+	GetKeys() ([]db.ServerKey, error)
+	// Stores a new inactive data key. Returns its id
+	AddKey(key db.ServerKey) (int32, error)
+	// Replaces how the key is wrapped, keeping the key itself
+	RewrapKey(key db.ServerKey) error
+	// Makes the key the active one and every other inactive
+	ActivateKey(id int32) error
+	// Returns how many were deleted
+	DeleteInactiveKeys() (int64, error)
+
+	GetSecrets() ([]db.ServerSecret, error)
+	// Stores the secret unless there is one with the name already
+	AddSecret(name string, value []byte) error
+	// Replaces the secret's value if it still is old. Returns false otherwise
+	RewrapSecret(name string, old, value []byte) (bool, error)
+
+	// Runs fn in a single transaction, committed if fn returns nil and rolled back otherwise
+	InTx(fn func(tx KeyRepo) error) error
+}
+
+type PgxKeyRepo struct {
+	Pool *pgxpool.Pool
+	Ctx  context.Context
+
+	// only set in the repos InTx passes along
+	tx pgx.Tx
+}
+
+func (r PgxKeyRepo) queries() *db.Queries {
+	if r.tx != nil {
+		return db.New(r.Pool).WithTx(r.tx)
+	}
+	return db.New(r.Pool)
+}
+
+func (r PgxKeyRepo) InTx(fn func(tx KeyRepo) error) error {
+	if r.tx != nil {
+		return fn(r)
+	}
+	return pgx.BeginFunc(r.Ctx, r.Pool, func(tx pgx.Tx) error {
+		txRepo := r
+		txRepo.tx = tx
+		return fn(txRepo)
+	})
+}
+
+func (r PgxKeyRepo) GetKeys() ([]db.ServerKey, error) {
+	return r.queries().GetServerKeys(r.Ctx)
+}
+
+func (r PgxKeyRepo) AddKey(key db.ServerKey) (int32, error) {
+	return r.queries().AddServerKey(r.Ctx, db.AddServerKeyParams{
+		Salt:       key.Salt,
+		TimeCost:   key.TimeCost,
+		MemoryKib:  key.MemoryKib,
+		Threads:    key.Threads,
+		WrappedKey: key.WrappedKey,
+	})
+}
+
+func (r PgxKeyRepo) RewrapKey(key db.ServerKey) error {
+	return r.queries().RewrapServerKey(r.Ctx, db.RewrapServerKeyParams{
+		ID:         key.ID,
+		Salt:       key.Salt,
+		TimeCost:   key.TimeCost,
+		MemoryKib:  key.MemoryKib,
+		Threads:    key.Threads,
+		WrappedKey: key.WrappedKey,
+	})
+}
+
+func (r PgxKeyRepo) ActivateKey(id int32) error {
+	return r.queries().ActivateServerKey(r.Ctx, id)
+}
+
+func (r PgxKeyRepo) DeleteInactiveKeys() (int64, error) {
+	return r.queries().DeleteInactiveServerKeys(r.Ctx)
+}
+
+func (r PgxKeyRepo) GetSecrets() ([]db.ServerSecret, error) {
+	return r.queries().GetServerSecrets(r.Ctx)
+}
+
+func (r PgxKeyRepo) AddSecret(name string, value []byte) error {
+	return r.queries().AddServerSecret(r.Ctx, db.AddServerSecretParams{
+		Name:  name,
+		Value: value,
+	})
+}
+
+func (r PgxKeyRepo) RewrapSecret(name string, old, value []byte) (bool, error) {
+	n, err := r.queries().RewrapServerSecret(r.Ctx, db.RewrapServerSecretParams{
+		Name:    name,
+		Value:   old,
+		Value_2: value,
+	})
+	return n != 0, err
+}
@@ -0,0 +1,101 @@
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/as283-ua/yappa/internal/server/settings"
+)
+
+// Every this many calls to Allow, buckets that have refilled are forgotten
+const SWEEP_EVERY = 1024
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+type key struct {
+	username string
+	limit    string
+}
+
+// Token buckets per user and limit, all in memory. A nil Limiter allows everything
+type Limiter struct {
+	mx      sync.Mutex
+	cfg     settings.LimitsCfg
+	buckets map[key]*bucket
+	calls   int
+	// replaced in tests
+	Now func() time.Time
+}
+
+func NewLimiter(cfg settings.LimitsCfg) *Limiter {
+	return &Limiter{
+		cfg:     cfg,
+		buckets: make(map[key]*bucket),
+		Now:     time.Now,
+	}
+}
+
+// Set up by SetupServer with the configured limits
+var Limits *Limiter
+
+// Takes a token from the user's bucket for the limit. If there is none left, returns false along with how long
+// until there is one
+func (l *Limiter) Allow(username, limit string) (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+	l.mx.Lock()
+	defer l.mx.Unlock()
+	rate, ok := l.cfg.RateOf(limit)
+	if !ok {
+		return true, 0
+	}
+
+	now := l.Now()
+	l.calls++
+	if l.calls%SWEEP_EVERY == 0 {
+		l.sweep(now)
+	}
+
+	k := key{username, limit}
+	b, ok := l.buckets[k]
+	if !ok {
+		b = &bucket{tokens: float64(rate.Burst), last: now}
+		l.buckets[k] = b
+	}
+	elapsed := now.Sub(b.last).Seconds()
+	if elapsed > 0 {
+		b.tokens = math.Min(float64(rate.Burst), b.tokens+elapsed*rate.Rate)
+		b.last = now
+	}
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	wait := time.Duration((1 - b.tokens) / rate.Rate * float64(time.Second))
+	return false, wait
+}
+
+// Replaces the limits and forgets every bucket, returns the limits in use until now
+func (l *Limiter) Configure(cfg settings.LimitsCfg) settings.LimitsCfg {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+	prev := l.cfg
+	l.cfg = cfg
+	l.buckets = make(map[key]*bucket)
+	return prev
+}
+
+// Forgets the buckets that would be full by now, they're the same as new ones. Called with mx held
+func (l *Limiter) sweep(now time.Time) {
+	for k, b := range l.buckets {
+		rate, ok := l.cfg.RateOf(k.limit)
+		if !ok || b.tokens+now.Sub(b.last).Seconds()*rate.Rate >= float64(rate.Burst) {
+			delete(l.buckets, k)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package report
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/as283-ua/yappa/api/gen/client"
+	"github.com/as283-ua/yappa/api/gen/server"
+	"github.com/as283-ua/yappa/internal/server/auth"
+	"github.com/as283-ua/yappa/internal/server/db"
+	"github.com/as283-ua/yappa/internal/server/logging"
+	"github.com/as283-ua/yappa/pkg/common"
+	"github.com/jackc/pgx/v5"
+	"google.golang.org/protobuf/proto"
+)
+
+const MAX_REPORT_EVIDENCE = 50
+const MAX_REPORT_COMMENT = 2000
+
+// Checks that a disclosed message was signed by the reported user for the reporter, so a report can't put words
+// in someone's mouth. The certificate stored at registration is trusted as is
+func CheckEvidence(reported db.User, reporter string, ev *server.ReportEvidence) error {
+	err := common.VerifyEventSignature([]byte(reported.Certificate), reporter, ev.Event, ev.Signature)
+	if err != nil {
+		return err
+	}
+	event := &client.ClientEvent{}
+	err = proto.Unmarshal(ev.Event, event)
+	if err != nil {
+		return err
+	}
+	if event.Sender != reported.Username {
+		return fmt.Errorf("message sent by %v", event.Sender)
+	}
+	if event.GetMessage() == nil {
+		return errors.New("only chat messages can be attached")
+	}
+	return nil
+}
+
+// Queues a report against another user for an admin to review. Attached messages must carry the reported
+// user's signature
+func SubmitReport(w http.ResponseWriter, r *http.Request) {
+	logger := logging.GetLogger()
+	reporter := r.TLS.PeerCertificates[0].Subject.CommonName
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		logger.Println("Body read error:", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	report := &server.Report{}
+	err = proto.Unmarshal(body, report)
+	if err != nil {
+		http.Error(w, "Incorrect body format", http.StatusBadRequest)
+		return
+	}
+	if report.Reported == "" || report.Reported == reporter {
+		http.Error(w, "Invalid reported user", http.StatusBadRequest)
+		return
+	}
+	if _, ok := server.ReportReason_name[int32(report.Reason)]; !ok || report.Reason == server.ReportReason_REPORT_UNKNOWN {
+		http.Error(w, "Invalid reason", http.StatusBadRequest)
+		return
+	}
+	if len(report.Comment) > MAX_REPORT_COMMENT || len(report.Evidence) > MAX_REPORT_EVIDENCE {
+		http.Error(w, "Report too large", http.StatusBadRequest)
+		return
+	}
+
+	reported, err := auth.Repo.GetUserData(r.Context(), report.Reported)
+	if errors.Is(err, pgx.ErrNoRows) {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logger.Println("Get user error:", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	for i, ev := range report.Evidence {
+		err = CheckEvidence(reported, reporter, ev)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid evidence %v: %v", i, err), http.StatusBadRequest)
+			return
+		}
+	}
+
+	id, err := Repo.CreateReport(reporter, report.Reported, int32(report.Reason), report.Comment, report.Evidence)
+	if err != nil {
+		logger.Println("DB error:", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	logger.Printf("Report %v against %v received\n", id, report.Reported)
+
+	data, err := proto.Marshal(&server.ReportReceived{Id: id})
+	if err != nil {
+		logger.Println("Marshal error:", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
@@ -0,0 +1,81 @@
+package report
+
+import (
+	"context"
+
+	"github.com/as283-ua/yappa/api/gen/server"
+	"github.com/as283-ua/yappa/internal/server/db"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Status of a report. Only open reports can be resolved
+const (
+	STATUS_OPEN      = "open"
+	STATUS_DISMISSED = "dismissed"
+	STATUS_ACTIONED  = "actioned"
+)
+
+type ReportRepo interface {
+	// Stores the report along with its evidence. Returns its id
+	CreateReport(reporter, reported string, reason int32, comment string, evidence []*server.ReportEvidence) (int32, error)
+	// Oldest reports with the status first
+	ListReports(status string, limit int32) ([]db.Report, error)
+	GetReport(id int32) (db.Report, error)
+	GetEvidence(id int32) ([]db.GetReportEvidenceRow, error)
+	// Closes an open report with the given status. Returns false if it wasn't open
+	ResolveReport(id int32, status string) (bool, error)
+}
+
+type PgxReportRepo struct {
+	Pool *pgxpool.Pool
+	Ctx  context.Context
+}
+
+var Repo ReportRepo
+
+func (r PgxReportRepo) CreateReport(reporter, reported string, reason int32, comment string, evidence []*server.ReportEvidence) (int32, error) {
+	var id int32
+	err := pgx.BeginFunc(r.Ctx, r.Pool, func(tx pgx.Tx) error {
+		queries := db.New(r.Pool).WithTx(tx)
+		var err error
+		id, err = queries.CreateReport(r.Ctx, db.CreateReportParams{
+			Reporter: reporter,
+			Reported: reported,
+			Reason:   reason,
+			Comment:  comment,
+		})
+		if err != nil {
+			return err
+		}
+		for _, ev := range evidence {
+			err = queries.AddReportEvidence(r.Ctx, db.AddReportEvidenceParams{
+				ReportID:  id,
+				Event:     ev.Event,
+				Signature: ev.Signature,
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return id, err
+}
+
+func (r PgxReportRepo) ListReports(status string, limit int32) ([]db.Report, error) {
+	return db.New(r.Pool).ListReports(r.Ctx, db.ListReportsParams{Status: status, Limit: limit})
+}
+
+func (r PgxReportRepo) GetReport(id int32) (db.Report, error) {
+	return db.New(r.Pool).GetReport(r.Ctx, id)
+}
+
+func (r PgxReportRepo) GetEvidence(id int32) ([]db.GetReportEvidenceRow, error) {
+	return db.New(r.Pool).GetReportEvidence(r.Ctx, id)
+}
+
+func (r PgxReportRepo) ResolveReport(id int32, status string) (bool, error) {
+	n, err := db.New(r.Pool).ResolveReport(r.Ctx, db.ResolveReportParams{ID: id, Status: status})
+	return n != 0, err
+}
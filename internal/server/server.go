@@ -14,7 +14,10 @@ import (
 	"github.com/as283-ua/yappa/internal/server/auth"
 	"github.com/as283-ua/yappa/internal/server/chat"
 	"github.com/as283-ua/yappa/internal/server/connection"
+	"github.com/as283-ua/yappa/internal/server/keys"
 	"github.com/as283-ua/yappa/internal/server/logging"
+	"github.com/as283-ua/yappa/internal/server/ratelimit"
+	"github.com/as283-ua/yappa/internal/server/report"
 	"github.com/as283-ua/yappa/internal/server/settings"
 	"github.com/as283-ua/yappa/internal/server/user"
 	"github.com/as283-ua/yappa/pkg/common"
@@ -37,21 +40,30 @@ func getEnv(key, fallback string) string {
 	return fallback
 }
 
-func SetupPgxDb(ctx context.Context) (*auth.PgxUserRepo, *chat.PgxChatRepo) {
-	user := getEnv("YAPPA_DB_USER", "yappa")
-	host := getEnv("YAPPA_DB_HOST", "localhost:5432")
-	pass, exists := os.LookupEnv("YAPPA_MASTER_KEY")
-
-	if !exists {
-		fmt.Print("YAPPA_MASTER_KEY not set. Enter the password: ")
-		password, err := term.ReadPassword(int(syscall.Stdin))
-		fmt.Println()
-		if err != nil {
-			log.Fatalf("Error reading from stdin: %v", err)
-		}
+func readSecret(env, prompt string) []byte {
+	if value, exists := os.LookupEnv(env); exists {
+		return []byte(value)
+	}
 
-		pass = string(password)
+	fmt.Printf("%v not set. %v: ", env, prompt)
+	secret, err := term.ReadPassword(int(syscall.Stdin))
+	fmt.Println()
+	if err != nil {
+		log.Fatalf("Error reading from stdin: %v", err)
 	}
+	return secret
+}
+
+// Passphrase the server's data keys are wrapped with, from YAPPA_MASTER_KEY or asked for
+func ReadMasterKey() []byte {
+	return readSecret("YAPPA_MASTER_KEY", "Enter the master key")
+}
+
+// Connects to the database with the password in YAPPA_DB_PASSWORD, the master key if not set
+func SetupPgxDb(ctx context.Context, masterKey []byte) (*auth.PgxUserRepo, *chat.PgxChatRepo, *report.PgxReportRepo, *keys.PgxKeyRepo) {
+	user := getEnv("YAPPA_DB_USER", "yappa")
+	host := getEnv("YAPPA_DB_HOST", "localhost:5432")
+	pass := getEnv("YAPPA_DB_PASSWORD", string(masterKey))
 
 	uri := fmt.Sprintf("postgres://%v:%v@%v/yappa-chat", user, pass, host)
 
@@ -65,7 +77,7 @@ func SetupPgxDb(ctx context.Context) (*auth.PgxUserRepo, *chat.PgxChatRepo) {
 		log.Fatalf("DB connection error: %v", err)
 	}
 
-	return &auth.PgxUserRepo{Pool: pool}, &chat.PgxChatRepo{Pool: pool, Ctx: context.Background()}
+	return &auth.PgxUserRepo{Pool: pool}, &chat.PgxChatRepo{Pool: pool, Ctx: context.Background()}, &report.PgxReportRepo{Pool: pool, Ctx: context.Background()}, &keys.PgxKeyRepo{Pool: pool, Ctx: context.Background()}
 }
 
 func getTlsConfig() (*tls.Config, error) {
@@ -98,7 +110,7 @@ func getTlsConfig() (*tls.Config, error) {
 	}, nil
 }
 
-func SetupServer(cfg *settings.ChatCfg, authRepo auth.UserRepo, chatRepo chat.ChatRepo) (*http3.Server, error) {
+func SetupServer(cfg *settings.ChatCfg, ring *keys.Keyring, authRepo auth.UserRepo, chatRepo chat.ChatRepo, reportRepo report.ReportRepo) (*http3.Server, error) {
 	settings.ChatSettings = cfg
 	err := settings.ChatSettings.Validate()
 
@@ -108,6 +120,27 @@ func SetupServer(cfg *settings.ChatCfg, authRepo auth.UserRepo, chatRepo chat.Ch
 
 	auth.Repo = authRepo
 	chat.Repo = chatRepo
+	report.Repo = reportRepo
+	keys.Ring = ring
+	chat.OnNewChat = connection.NotifyNewChats
+	err = chat.LoadInviteKey(cfg.InviteKey)
+	if err != nil {
+		return nil, err
+	}
+	// older keys stay loaded if it fails, everything stored under them can still be read
+	retired, err := ring.Reencrypt(chat.ReencryptTokens, chat.ReencryptSenderAuths)
+	if err != nil {
+		logging.GetLogger().Printf("Re-encryption with the active key failed, older keys kept: %v\n", err)
+	} else if retired != 0 {
+		logging.GetLogger().Printf("Re-encrypted with the new master key, %v old keys deleted\n", retired)
+	}
+	connection.Sessions.OnPresence = func(username string, online bool) {
+		logging.GetLogger().Printf("Presence of %v changed, online: %v\n", username, online)
+	}
+	connection.Sessions.WriteTimeout = cfg.Conn.WriteTimeoutOrDefault()
+	ratelimit.Limits = ratelimit.NewLimiter(cfg.Limits)
+	connection.StartHeartbeats(cfg.Conn)
+	chat.StartSweeper(cfg.Retention)
 
 	err = common.InitHttp3Client(settings.ChatSettings.Ca.Cert)
 	if err != nil {
@@ -134,15 +167,20 @@ func SetupServer(cfg *settings.ChatCfg, authRepo auth.UserRepo, chatRepo chat.Ch
 	router.Handle("POST /register", http.HandlerFunc(auth.RegisterInit))
 	router.Handle("POST /register/confirm", http.HandlerFunc(auth.RegisterComplete))
 
-	router.Handle("CONNECT /connect", connection.RequireCertificate(tlsVerifyOpts, http.HandlerFunc(connection.Connection)))
-	router.Handle("GET /chat/init", connection.RequireCertificate(tlsVerifyOpts, http.HandlerFunc(chat.CreateChatInbox)))
-	router.Handle("POST /chat/notify", connection.RequireCertificate(tlsVerifyOpts, http.HandlerFunc(chat.NotifyChatInbox)))
-	router.Handle("GET /chat/new", connection.RequireCertificate(tlsVerifyOpts, http.HandlerFunc(chat.GetNewChats)))
-	router.Handle("POST /chat/token", connection.RequireCertificate(tlsVerifyOpts, http.HandlerFunc(chat.GetChatToken)))
-	router.Handle("POST /chat/messages", connection.RequireCertificate(tlsVerifyOpts, http.HandlerFunc(chat.GetNewMessages)))
+	router.Handle("CONNECT /connect", connection.RequireCertificate(tlsVerifyOpts, connection.RateLimit(settings.LIMIT_CONNECT, http.HandlerFunc(connection.Connection))))
+	router.Handle("GET /chat/init", connection.RequireCertificate(tlsVerifyOpts, connection.RateLimit(settings.LIMIT_CHAT_INIT, http.HandlerFunc(chat.CreateChatInbox))))
+	router.Handle("POST /chat/notify", connection.RequireCertificate(tlsVerifyOpts, connection.RateLimit(settings.LIMIT_CHAT_NOTIFY, http.HandlerFunc(chat.NotifyChatInbox))))
+	router.Handle("GET /chat/new", connection.RequireCertificate(tlsVerifyOpts, connection.RateLimit(settings.LIMIT_CHAT_READ, http.HandlerFunc(chat.GetNewChats))))
+	router.Handle("POST /chat/token", connection.RequireCertificate(tlsVerifyOpts, connection.RateLimit(settings.LIMIT_CHAT_READ, http.HandlerFunc(chat.GetChatToken))))
+	router.Handle("GET /chat/token", connection.RequireCertificate(tlsVerifyOpts, connection.RateLimit(settings.LIMIT_CHAT_READ, http.HandlerFunc(chat.GetChatToken))))
+	router.Handle("POST /chat/messages", connection.RequireCertificate(tlsVerifyOpts, connection.RateLimit(settings.LIMIT_CHAT_READ, http.HandlerFunc(chat.GetNewMessages))))
+	router.Handle("POST /chat/messages/ack", connection.RequireCertificate(tlsVerifyOpts, connection.RateLimit(settings.LIMIT_CHAT_READ, http.HandlerFunc(chat.AckMessages))))
+	router.Handle("POST /chat/expired", connection.RequireCertificate(tlsVerifyOpts, connection.RateLimit(settings.LIMIT_CHAT_READ, http.HandlerFunc(chat.CheckExpiredMessages))))
+
+	router.Handle("POST /report", connection.RequireCertificate(tlsVerifyOpts, connection.RateLimit(settings.LIMIT_REPORT, http.HandlerFunc(report.SubmitReport))))
 
-	router.Handle("GET /users", connection.RequireCertificate(tlsVerifyOpts, http.HandlerFunc(user.GetUsernames)))
-	router.Handle("GET /users/{username}", connection.RequireCertificate(tlsVerifyOpts, http.HandlerFunc(user.GetUserData)))
+	router.Handle("GET /users", connection.RequireCertificate(tlsVerifyOpts, connection.RateLimit(settings.LIMIT_USERS, http.HandlerFunc(user.GetUsernames))))
+	router.Handle("GET /users/{username}", connection.RequireCertificate(tlsVerifyOpts, connection.RateLimit(settings.LIMIT_USERS, http.HandlerFunc(user.GetUserData))))
 
 	server := &http3.Server{
 		Addr:        settings.ChatSettings.Addr,
@@ -151,6 +189,8 @@ func SetupServer(cfg *settings.ChatCfg, authRepo auth.UserRepo, chatRepo chat.Ch
 		IdleTimeout: 60 * time.Second,
 		QUICConfig: &quic.Config{
 			Tracer: qlog.DefaultConnectionTracer,
+			// clients only send idempotent GETs as early data, since it can be replayed
+			Allow0RTT: true,
 		},
 	}
 
@@ -1,6 +1,10 @@
 package settings
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+	"time"
+)
 
 // type ChatCfg struct {
 // 	Addr   string
@@ -14,8 +18,161 @@ import "errors"
 type ChatCfg struct {
 	Addr string
 	Logs string
-	Tls  TlsCfg `toml:"tls"`
-	Ca   CaCfg  `toml:"ca"`
+	// file with the secret invitation inboxes are blinded with, created if missing. Empty to keep it in the
+	// database, encrypted with the master key
+	InviteKey string       `toml:"invite_key"`
+	Tls       TlsCfg       `toml:"tls"`
+	Ca        CaCfg        `toml:"ca"`
+	Conn      ConnCfg      `toml:"connection"`
+	Retention RetentionCfg `toml:"retention"`
+	Limits    LimitsCfg    `toml:"limits"`
+}
+
+const DEFAULT_HEARTBEAT_INTERVAL = 20 * time.Second
+const DEFAULT_MISSED_HEARTBEATS = 3
+const DEFAULT_WRITE_TIMEOUT = 10 * time.Second
+
+// Settings of the /connect streams. Zero values use the defaults
+type ConnCfg struct {
+	// max size in bytes of a single frame sent by clients
+	MaxFrameSize uint32 `toml:"max_frame_size"`
+	// how often sessions are pinged, e.g. "20s"
+	HeartbeatInterval time.Duration `toml:"heartbeat_interval"`
+	// sessions silent for this many intervals are closed
+	MissedHeartbeats int `toml:"missed_heartbeats"`
+	// a frame not written within this closes the session, e.g. "10s". Its messages go to the inbox instead
+	WriteTimeout time.Duration `toml:"write_timeout"`
+}
+
+func (c ConnCfg) HeartbeatIntervalOrDefault() time.Duration {
+	if c.HeartbeatInterval <= 0 {
+		return DEFAULT_HEARTBEAT_INTERVAL
+	}
+	return c.HeartbeatInterval
+}
+
+func (c ConnCfg) MissedHeartbeatsOrDefault() int {
+	if c.MissedHeartbeats <= 0 {
+		return DEFAULT_MISSED_HEARTBEATS
+	}
+	return c.MissedHeartbeats
+}
+
+func (c ConnCfg) WriteTimeoutOrDefault() time.Duration {
+	if c.WriteTimeout <= 0 {
+		return DEFAULT_WRITE_TIMEOUT
+	}
+	return c.WriteTimeout
+}
+
+const DEFAULT_SWEEP_INTERVAL = 10 * time.Minute
+const DEFAULT_EXPIRED_NOTICE_AGE = 30 * 24 * time.Hour
+const DEFAULT_EMPTY_INBOX_AGE = 7 * 24 * time.Hour
+
+// Limits on what is kept for users who don't connect. Zero values mean no limit, except for the sweep interval
+// and notice age which use the defaults
+type RetentionCfg struct {
+	// undelivered messages older than this are deleted, e.g. "720h"
+	MaxAge time.Duration `toml:"max_age"`
+	// per inbox. The oldest messages past either limit are deleted
+	MaxMessages int64 `toml:"max_messages"`
+	MaxBytes    int64 `toml:"max_bytes"`
+	// chat invitations not retrieved within this are deleted
+	InvitationMaxAge time.Duration `toml:"invitation_max_age"`
+	// how often expired rows are deleted
+	SweepInterval time.Duration `toml:"sweep_interval"`
+	// for how long senders can still learn their messages expired
+	NoticeMaxAge time.Duration `toml:"notice_max_age"`
+}
+
+// Whether anything ever expires
+func (c RetentionCfg) Enabled() bool {
+	return c.MaxAge > 0 || c.MaxMessages > 0 || c.MaxBytes > 0 || c.InvitationMaxAge > 0
+}
+
+func (c RetentionCfg) SweepIntervalOrDefault() time.Duration {
+	if c.SweepInterval <= 0 {
+		return DEFAULT_SWEEP_INTERVAL
+	}
+	return c.SweepInterval
+}
+
+func (c RetentionCfg) NoticeMaxAgeOrDefault() time.Duration {
+	if c.NoticeMaxAge <= 0 {
+		return DEFAULT_EXPIRED_NOTICE_AGE
+	}
+	return c.NoticeMaxAge
+}
+
+// Age at which empty inboxes are deleted. Those still holding a key exchange for messages to come are only
+// lost once messages as old would have expired anyway
+func (c RetentionCfg) EmptyInboxAge() time.Duration {
+	if c.MaxAge <= 0 {
+		return DEFAULT_EMPTY_INBOX_AGE
+	}
+	return c.MaxAge
+}
+
+// Names of the rate limits, keys of LimitsCfg.Rates
+const (
+	LIMIT_CONNECT     = "connect"
+	LIMIT_CHAT_INIT   = "chat_init"
+	LIMIT_CHAT_NOTIFY = "chat_notify"
+	// the other /chat endpoints, which only read or acknowledge
+	LIMIT_CHAT_READ = "chat_read"
+	LIMIT_USERS     = "users"
+	LIMIT_REPORT    = "report"
+	// messages sent over the connection stream
+	LIMIT_SEND      = "send"
+	LIMIT_EPHEMERAL = "ephemeral"
+	LIMIT_PRESENCE  = "presence"
+	// dummies of clients with cover traffic on, kept apart so they never hold up real messages
+	LIMIT_COVER = "cover"
+)
+
+var DEFAULT_RATES = map[string]RateCfg{
+	LIMIT_CONNECT:     {Rate: 0.5, Burst: 10},
+	LIMIT_CHAT_INIT:   {Rate: 0.2, Burst: 20},
+	LIMIT_CHAT_NOTIFY: {Rate: 0.2, Burst: 20},
+	LIMIT_CHAT_READ:   {Rate: 10, Burst: 100},
+	LIMIT_USERS:       {Rate: 5, Burst: 50},
+	LIMIT_REPORT:      {Rate: 0.01, Burst: 10},
+	LIMIT_SEND:        {Rate: 20, Burst: 200},
+	LIMIT_EPHEMERAL:   {Rate: 5, Burst: 20},
+	LIMIT_PRESENCE:    {Rate: 1, Burst: 10},
+	LIMIT_COVER:       {Rate: 5, Burst: 50},
+}
+
+const DEFAULT_MAX_PENDING_INVITATIONS = 100
+
+// Token bucket: up to Burst requests at once, refilled at Rate per second
+type RateCfg struct {
+	Rate  float64 `toml:"rate"`
+	Burst int     `toml:"burst"`
+}
+
+// Per user limits, users being told apart by their certificate's CN
+type LimitsCfg struct {
+	// by limit name. Missing or zero entries use DEFAULT_RATES, a negative rate disables the limit
+	Rates map[string]RateCfg `toml:"rates"`
+	// invitations waiting in /chat/new for a single user. 0 for the default, negative for no limit
+	MaxPendingInvitations int64 `toml:"max_pending_invitations"`
+}
+
+// Rate of the named limit and whether there is one at all
+func (c LimitsCfg) RateOf(name string) (RateCfg, bool) {
+	rate, ok := c.Rates[name]
+	if !ok || rate.Rate == 0 || rate.Burst <= 0 {
+		rate, ok = DEFAULT_RATES[name]
+	}
+	return rate, ok && rate.Rate > 0
+}
+
+func (c LimitsCfg) MaxPendingInvitationsOrDefault() int64 {
+	if c.MaxPendingInvitations == 0 {
+		return DEFAULT_MAX_PENDING_INVITATIONS
+	}
+	return c.MaxPendingInvitations
 }
 
 type TlsCfg struct {
@@ -49,6 +206,16 @@ func (c *ChatCfg) Validate() error {
 		return errors.New("ca host address must not be empty")
 	}
 
+	if c.Retention.MaxAge < 0 || c.Retention.InvitationMaxAge < 0 || c.Retention.MaxMessages < 0 || c.Retention.MaxBytes < 0 {
+		return errors.New("retention limits must not be negative")
+	}
+
+	for name := range c.Limits.Rates {
+		if _, ok := DEFAULT_RATES[name]; !ok {
+			return fmt.Errorf("unknown rate limit %q", name)
+		}
+	}
+
 	return nil
 }
 
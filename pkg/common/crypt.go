@@ -5,17 +5,88 @@ import (
 	"crypto/cipher"
 	"crypto/rand"
 	"crypto/sha512"
+	"encoding/binary"
 	"errors"
 	"io"
 )
 
-func Encrypt(data, key []byte) (out []byte, err error) {
+// Version of the associated data layout. Bumped whenever the set of fields bound to ciphertexts changes
+const PROTOCOL_VERSION uint32 = 1
+
+// Labels identifying what a ciphertext is, so one can't be passed off as another
+const (
+	LabelChatMessage      = "chat message"
+	LabelInviteSender     = "invite sender"
+	LabelInviteSerial     = "invite serial"
+	LabelInviteSignature  = "invite signature"
+	LabelInviteInboxId    = "invite inbox id"
+	LabelInviteRatchetKey = "invite ratchet key"
+	LabelInboxToken       = "inbox token"
+	LabelSenderAuth       = "sender auth"
+	LabelSaveFile         = "save file"
+	LabelEphemeralEvent   = "ephemeral event"
+	LabelEventSignature   = "event signature"
+	LabelServerKey        = "server key"
+	LabelServerSecret     = "server secret"
+)
+
+// Context bound to a ciphertext as additional authenticated data. Opening fails unless the exact same
+// values are provided
+type AssociatedData struct {
+	Version uint32
+	Label   string
+	InboxId []byte
+	Serial  uint64
+	// anything else the ciphertext depends on, e.g. the header sent next to it
+	Context []byte
+}
+
+// Fields are length prefixed so bytes can't be moved from one field to the next
+func (ad AssociatedData) Bytes() []byte {
+	out := make([]byte, 0, 4+8+len(ad.Label)+8+len(ad.InboxId)+8+8+len(ad.Context))
+	out = binary.BigEndian.AppendUint32(out, ad.Version)
+	out = appendField(out, []byte(ad.Label))
+	out = appendField(out, ad.InboxId)
+	out = binary.BigEndian.AppendUint64(out, ad.Serial)
+	out = appendField(out, ad.Context)
+	return out
+}
+
+func appendField(out, field []byte) []byte {
+	out = binary.BigEndian.AppendUint64(out, uint64(len(field)))
+	return append(out, field...)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
 	block, err := aes.NewCipher(key)
 	if err != nil {
 		return nil, err
 	}
 
-	gcm, err := cipher.NewGCM(block)
+	return cipher.NewGCM(block)
+}
+
+// AES-GCM encryption binding the ciphertext to the associated data. Output is nonce + ciphertext
+func Seal(key, data []byte, ad AssociatedData) ([]byte, error) {
+	return seal(key, data, ad.Bytes())
+}
+
+func Open(key, data []byte, ad AssociatedData) ([]byte, error) {
+	return open(key, data, ad.Bytes())
+}
+
+// Encrypt without associated data. Only kept for data read by clients from before Seal existed
+func Encrypt(data, key []byte) (out []byte, err error) {
+	return seal(key, data, nil)
+}
+
+// Decrypt without associated data. Only kept to read data written before Seal existed
+func Decrypt(data, key []byte) (out []byte, err error) {
+	return open(key, data, nil)
+}
+
+func seal(key, data, ad []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
 	if err != nil {
 		return nil, err
 	}
@@ -25,18 +96,13 @@ func Encrypt(data, key []byte) (out []byte, err error) {
 		return nil, err
 	}
 
-	ciphertext := gcm.Seal(nil, nonce, data, nil)
-	out = append(nonce, ciphertext...)
+	ciphertext := gcm.Seal(nil, nonce, data, ad)
+	out := append(nonce, ciphertext...)
 	return out, nil
 }
 
-func Decrypt(data, key []byte) (out []byte, err error) {
-	block, err := aes.NewCipher(key)
-	if err != nil {
-		return nil, err
-	}
-
-	gcm, err := cipher.NewGCM(block)
+func open(key, data, ad []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
 	if err != nil {
 		return nil, err
 	}
@@ -47,10 +113,12 @@ func Decrypt(data, key []byte) (out []byte, err error) {
 	}
 
 	nonce, ciphertext := data[:nonceSize], data[nonceSize:]
-	out, err = gcm.Open(nil, nonce, ciphertext, nil)
-	return
+	return gcm.Open(nil, nonce, ciphertext, ad)
 }
 
+// Length of the digests returned by Hash
+const HASH_SIZE = sha512.Size
+
 func Hash(data []byte) []byte {
 	h := sha512.New()
 	h.Write(data)
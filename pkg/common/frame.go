@@ -0,0 +1,171 @@
+package common
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// Frames are a 4 byte big endian length followed by that many bytes of a marshalled protobuf message
+
+const FRAME_HEADER_SIZE = 4
+
+// Used when no max frame size is configured
+const DEFAULT_MAX_FRAME_SIZE uint32 = 1 << 20
+
+// Buffers bigger than this aren't returned to the pool, so one large frame doesn't pin memory forever
+const maxPooledBuffer = 64 << 10
+
+var ErrTruncatedFrame = errors.New("stream ended in the middle of a frame")
+
+// The peer announced a frame over the allowed size. The stream can't be resynchronized after it
+type FrameTooLargeError struct {
+	Size uint32
+	Max  uint32
+}
+
+func (e *FrameTooLargeError) Error() string {
+	return fmt.Sprintf("frame of %v bytes exceeds max frame size %v", e.Size, e.Max)
+}
+
+// The frame was read whole but isn't a valid message. The stream is still in sync
+type FrameDecodeError struct {
+	Err error
+}
+
+func (e *FrameDecodeError) Error() string {
+	return fmt.Sprintf("invalid frame: %v", e.Err)
+}
+
+func (e *FrameDecodeError) Unwrap() error {
+	return e.Err
+}
+
+var framePool = sync.Pool{
+	New: func() any {
+		b := make([]byte, 0, 4096)
+		return &b
+	},
+}
+
+func getBuffer(size int) *[]byte {
+	buf := framePool.Get().(*[]byte)
+	if cap(*buf) < size {
+		*buf = make([]byte, size)
+	}
+	*buf = (*buf)[:size]
+	return buf
+}
+
+func putBuffer(buf *[]byte) {
+	if cap(*buf) > maxPooledBuffer {
+		return
+	}
+	*buf = (*buf)[:0]
+	framePool.Put(buf)
+}
+
+func maxOrDefault(max uint32) uint32 {
+	if max == 0 {
+		return DEFAULT_MAX_FRAME_SIZE
+	}
+	return max
+}
+
+// Reads frames from a stream. Not safe for concurrent use
+type FrameReader struct {
+	r      io.Reader
+	max    uint32
+	header [FRAME_HEADER_SIZE]byte
+}
+
+// maxSize 0 means DEFAULT_MAX_FRAME_SIZE
+func NewFrameReader(r io.Reader, maxSize uint32) *FrameReader {
+	return &FrameReader{r: r, max: maxOrDefault(maxSize)}
+}
+
+// Reads the next frame into msg. io.EOF is only returned if the stream ends cleanly between frames
+func (f *FrameReader) ReadMsg(msg proto.Message) error {
+	_, err := io.ReadFull(f.r, f.header[:])
+	if err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return ErrTruncatedFrame
+		}
+		return err
+	}
+
+	size := binary.BigEndian.Uint32(f.header[:])
+	if size > f.max {
+		return &FrameTooLargeError{Size: size, Max: f.max}
+	}
+
+	buf := getBuffer(int(size))
+	defer putBuffer(buf)
+
+	_, err = io.ReadFull(f.r, *buf)
+	if err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return ErrTruncatedFrame
+		}
+		return err
+	}
+
+	err = proto.Unmarshal(*buf, msg)
+	if err != nil {
+		return &FrameDecodeError{Err: err}
+	}
+	return nil
+}
+
+// Writes frames to a stream. Safe for concurrent use, each frame is written with a single Write
+type FrameWriter struct {
+	w   io.Writer
+	max uint32
+	mx  sync.Mutex
+}
+
+// maxSize 0 means DEFAULT_MAX_FRAME_SIZE
+func NewFrameWriter(w io.Writer, maxSize uint32) *FrameWriter {
+	return &FrameWriter{w: w, max: maxOrDefault(maxSize)}
+}
+
+func (f *FrameWriter) WriteMsg(msg proto.Message) error {
+	buf := getBuffer(FRAME_HEADER_SIZE)
+	defer putBuffer(buf)
+
+	frame, err := appendFrame((*buf)[:0], msg, f.max)
+	if err != nil {
+		return err
+	}
+	*buf = frame
+
+	f.mx.Lock()
+	defer f.mx.Unlock()
+	_, err = f.w.Write(frame)
+	return err
+}
+
+// Encodes msg as a standalone frame, for when it is written later by someone else
+func EncodeFrame(msg proto.Message, maxSize uint32) ([]byte, error) {
+	return appendFrame(nil, msg, maxOrDefault(maxSize))
+}
+
+func appendFrame(out []byte, msg proto.Message, max uint32) ([]byte, error) {
+	start := len(out)
+	out = append(out, make([]byte, FRAME_HEADER_SIZE)...)
+	out, err := proto.MarshalOptions{}.MarshalAppend(out, msg)
+	if err != nil {
+		return nil, err
+	}
+
+	size := len(out) - start - FRAME_HEADER_SIZE
+	if uint64(size) > uint64(max) {
+		return nil, &FrameTooLargeError{Size: uint32(min(uint64(size), uint64(^uint32(0)))), Max: max}
+	}
+	binary.BigEndian.PutUint32(out[start:], uint32(size))
+	return out, nil
+}
@@ -0,0 +1,208 @@
+package common
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// Round tripper that keeps a single QUIC connection per server, shared by every request and by the streams opened
+// with OpenStream. TLS sessions are cached, so after reconnecting the handshake is resumed and requests sent with
+// http3.MethodGet0RTT go out as 0-RTT data. Connections run over a MigratingConn and survive network changes
+type SharedTransport struct {
+	TLSClientConfig *tls.Config
+	QUICConfig      *quic.Config
+
+	h3 http3.Transport
+
+	mx    sync.Mutex
+	udp   *MigratingConn
+	tr    *quic.Transport
+	conns map[string]*sharedConn
+}
+
+type sharedConn struct {
+	conn   quic.EarlyConnection
+	client *http3.ClientConn
+}
+
+func (c *sharedConn) alive() bool {
+	select {
+	case <-c.conn.Context().Done():
+		return false
+	default:
+		return true
+	}
+}
+
+func NewSharedTransport(tlsConfig *tls.Config, quicConfig *quic.Config) *SharedTransport {
+	if tlsConfig.ClientSessionCache == nil {
+		tlsConfig.ClientSessionCache = tls.NewLRUClientSessionCache(0)
+	}
+	return &SharedTransport{
+		TLSClientConfig: tlsConfig,
+		QUICConfig:      quicConfig,
+		conns:           make(map[string]*sharedConn),
+	}
+}
+
+// host:port, defaulting to the https port
+func authority(u *url.URL) string {
+	if u.Port() == "" {
+		return net.JoinHostPort(u.Hostname(), "443")
+	}
+	return u.Host
+}
+
+// Returns the open connection to the host, dialing a new one if there is none
+func (t *SharedTransport) conn(ctx context.Context, host string) (*sharedConn, error) {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+
+	c, ok := t.conns[host]
+	if ok && c.alive() {
+		return c, nil
+	}
+
+	if t.tr == nil {
+		udp, err := ListenMigratingConn()
+		if err != nil {
+			return nil, err
+		}
+		t.udp = udp
+		t.tr = &quic.Transport{Conn: udp}
+	}
+
+	addr, err := net.ResolveUDPAddr("udp", host)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := t.TLSClientConfig.Clone()
+	if tlsConfig.ServerName == "" {
+		sni, _, err := net.SplitHostPort(host)
+		if err != nil {
+			sni = host
+		}
+		tlsConfig.ServerName = sni
+	}
+	tlsConfig.NextProtos = []string{http3.NextProtoH3}
+
+	conn, err := t.tr.DialEarly(ctx, addr, tlsConfig, t.QUICConfig)
+	if err != nil {
+		return nil, err
+	}
+	c = &sharedConn{conn: conn, client: t.h3.NewClientConn(conn)}
+	t.conns[host] = c
+	return c, nil
+}
+
+func (t *SharedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	c, err := t.conn(req.Context(), authority(req.URL))
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.client.RoundTrip(req)
+	if err != nil && !c.alive() && req.Context().Err() == nil && retryable(req.Method) {
+		// the shared connection went away since the last request, e.g. it timed out while idle
+		c, err = t.conn(req.Context(), authority(req.URL))
+		if err != nil {
+			return nil, err
+		}
+		return c.client.RoundTrip(req)
+	}
+	return resp, err
+}
+
+// The request may have reached the server before the connection went away, so only those safe to run twice are
+// sent again. Those are the ones sent as 0-RTT data, which can be replayed anyway. Plain GETs aren't, some change
+// what the server keeps, like GET /chat/new deleting the invitations it returns
+func retryable(method string) bool {
+	switch method {
+	case http3.MethodGet0RTT, http3.MethodHead0RTT:
+		return true
+	default:
+		return false
+	}
+}
+
+// Opens an Extended CONNECT stream to the url over the shared connection. Closing the stream leaves the
+// connection open for other requests
+func (t *SharedTransport) OpenStream(ctx context.Context, u *url.URL, header http.Header) (*BiStream, error) {
+	c, err := t.conn(ctx, authority(u))
+	if err != nil {
+		return nil, err
+	}
+	str, err := openStream(ctx, u, c.conn, c.client, header)
+	if err != nil {
+		return nil, err
+	}
+	str.sharedConn = true
+	return str, nil
+}
+
+// Switches to a new local socket, e.g. after the network changed. Open connections migrate to it
+func (t *SharedTransport) Rebind() error {
+	t.mx.Lock()
+	udp := t.udp
+	t.mx.Unlock()
+	if udp == nil {
+		return nil
+	}
+	return udp.Rebind()
+}
+
+// Address the server currently sees this client at
+func (t *SharedTransport) LocalAddr() net.Addr {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	if t.udp == nil {
+		return nil
+	}
+	return t.udp.LocalAddr()
+}
+
+// Closes every connection. Cached TLS sessions are kept, so the next ones are resumed
+func (t *SharedTransport) CloseConnections() {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	t.closeConnections()
+}
+
+func (t *SharedTransport) closeConnections() {
+	for host, c := range t.conns {
+		c.conn.CloseWithError(0, "")
+		delete(t.conns, host)
+	}
+}
+
+// Closes every connection and forgets the cached TLS sessions. Needed after the TLS config changes, e.g. when a
+// client certificate is added, since resumed sessions keep the identity of the original handshake
+func (t *SharedTransport) Reset() {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	t.closeConnections()
+	t.TLSClientConfig.ClientSessionCache = tls.NewLRUClientSessionCache(0)
+}
+
+func (t *SharedTransport) Close() error {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	t.closeConnections()
+	if t.tr == nil {
+		return nil
+	}
+	// the transport doesn't close a socket it didn't create
+	t.tr.Close()
+	err := t.udp.Close()
+	t.tr = nil
+	t.udp = nil
+	return err
+}
@@ -19,6 +19,8 @@ type BiStream struct {
 	h3Conn *http3.ClientConn
 	stream *http3.RequestStream
 	resp   *http.Response
+	// the connection belongs to a SharedTransport and outlives the stream
+	sharedConn bool
 }
 
 func (s BiStream) Context() context.Context {
@@ -38,9 +40,11 @@ func (s BiStream) Close() error {
 	if err != nil {
 		log.Println("Close error: ", err)
 	}
-	err = (*s.qconn).CloseWithError(0, "Client closed connection")
-	if err != nil {
-		log.Println("Close error: ", err)
+	if !s.sharedConn {
+		err = (*s.qconn).CloseWithError(0, "Client closed connection")
+		if err != nil {
+			log.Println("Close error: ", err)
+		}
 	}
 	err = (*s.stream).Close()
 	if err != nil {
@@ -50,8 +54,23 @@ func (s BiStream) Close() error {
 	return nil
 }
 
+// Dials a dedicated connection for the stream, closed along with it. See SharedTransport.OpenStream for opening
+// streams over a shared connection
 func Http3Stream(ctx context.Context, url *url.URL, tr *http3.Transport, header http.Header) (*BiStream, error) {
-	result := &BiStream{}
+	conn, err := quic.DialAddr(ctx, url.Host, tr.TLSClientConfig, tr.QUICConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect: %v", err)
+	}
+
+	str, err := openStream(ctx, url, conn, tr.NewClientConn(conn), header)
+	if err != nil {
+		conn.CloseWithError(0, "")
+		return &BiStream{}, err
+	}
+	return str, nil
+}
+
+func openStream(ctx context.Context, url *url.URL, conn quic.Connection, clientConn *http3.ClientConn, header http.Header) (*BiStream, error) {
 	req := &http.Request{
 		Method: http.MethodConnect,
 		Proto:  "HTTP/3",
@@ -61,41 +80,36 @@ func Http3Stream(ctx context.Context, url *url.URL, tr *http3.Transport, header
 	}
 	req = req.WithContext(ctx)
 
-	conn, err := quic.DialAddr(ctx, url.Host, tr.TLSClientConfig, tr.QUICConfig)
-	if err != nil {
-		return nil, fmt.Errorf("failed to connect: %v", err)
-	}
-
-	clientConn := tr.NewClientConn(conn)
-
 	select {
 	case <-clientConn.ReceivedSettings():
 	case <-ctx.Done():
-		return result, fmt.Errorf("connection closed")
+		return nil, fmt.Errorf("connection closed")
+	case <-conn.Context().Done():
+		return nil, fmt.Errorf("connection closed")
 	}
 
 	settings := clientConn.Settings()
 	if !settings.EnableExtendedConnect {
-		return result, fmt.Errorf("server didn't enable Extended CONNECT")
+		return nil, fmt.Errorf("server didn't enable Extended CONNECT")
 	}
 
 	requestStr, err := clientConn.OpenRequestStream(ctx)
 	if err != nil {
-		return result, err
+		return nil, err
 	}
 
 	if err := requestStr.SendRequestHeader(req); err != nil {
-		return result, err
+		return nil, err
 	}
 
 	rsp, err := requestStr.ReadResponse()
 
 	if err != nil {
-		return result, err
+		return nil, err
 	}
 
 	if rsp.StatusCode < 200 || rsp.StatusCode >= 300 {
-		return result, fmt.Errorf("received status %v", rsp.Status)
+		return nil, fmt.Errorf("received status %v", rsp.Status)
 	}
 
 	return &BiStream{qconn: &conn, h3Conn: clientConn, stream: &requestStr, resp: rsp}, nil
@@ -0,0 +1,36 @@
+package common
+
+import (
+	"crypto/hkdf"
+	"crypto/sha256"
+	"errors"
+)
+
+const KEY_SIZE = 32
+
+// Labels only used for key derivation. Keys for ciphertexts use the same labels as their associated data
+const (
+	LabelRatchetRoot      = "ratchet root"
+	LabelRatchetBootstrap = "ratchet initiator chain"
+	LabelPresenceToken    = "presence token"
+	LabelInboxSecret      = "inbox secret"
+	LabelInboxId          = "inbox id"
+	LabelDeliveryToken    = "delivery token"
+	LabelInviteInbox      = "invite inbox"
+	LabelExpiryToken      = "expiry token"
+)
+
+const kdfDomain = "yappa kdf v1: "
+
+// Derives a key from secret for a single purpose. The label says what the key is used for and the session
+// ties it to one chat, inbox, key exchange or user, so a secret never yields the same key twice.
+// session may be nil when the purpose is already unique
+func DeriveKey(secret []byte, label string, session []byte) ([]byte, error) {
+	if len(secret) == 0 {
+		return nil, errors.New("empty secret")
+	}
+	if label == "" {
+		return nil, errors.New("empty label")
+	}
+	return hkdf.Key(sha256.New, secret, session, kdfDomain+label, KEY_SIZE)
+}
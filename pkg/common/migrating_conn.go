@@ -0,0 +1,105 @@
+package common
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// UDP socket whose local address can be changed with Rebind while the QUIC connections using it stay open.
+// The server sees packets coming from the new address, validates the path and migrates the connection to it
+type MigratingConn struct {
+	mx     sync.RWMutex
+	conn   *net.UDPConn
+	closed bool
+}
+
+func ListenMigratingConn() (*MigratingConn, error) {
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, err
+	}
+	return &MigratingConn{conn: conn}, nil
+}
+
+func (c *MigratingConn) current() *net.UDPConn {
+	c.mx.RLock()
+	defer c.mx.RUnlock()
+	return c.conn
+}
+
+// Moves to a new socket with a new local port, like after switching networks. Whatever was in flight to the
+// old socket is lost and retransmitted by QUIC
+func (c *MigratingConn) Rebind() error {
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return err
+	}
+
+	c.mx.Lock()
+	if c.closed {
+		c.mx.Unlock()
+		conn.Close()
+		return net.ErrClosed
+	}
+	old := c.conn
+	c.conn = conn
+	c.mx.Unlock()
+
+	// unblocks the reader waiting on the old socket, which moves on to the new one
+	return old.Close()
+}
+
+// Whether the socket was swapped for another by Rebind, so its errors only mean it's gone
+func (c *MigratingConn) replaced(conn *net.UDPConn) bool {
+	c.mx.RLock()
+	defer c.mx.RUnlock()
+	return !c.closed && c.conn != conn
+}
+
+func (c *MigratingConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		conn := c.current()
+		n, addr, err := conn.ReadFrom(p)
+		if err != nil && c.replaced(conn) {
+			continue
+		}
+		return n, addr, err
+	}
+}
+
+func (c *MigratingConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	for {
+		conn := c.current()
+		n, err := conn.WriteTo(p, addr)
+		// a write racing Rebind finds the old socket closed. Any other error is quic-go's to handle
+		if errors.Is(err, net.ErrClosed) && c.replaced(conn) {
+			continue
+		}
+		return n, err
+	}
+}
+
+func (c *MigratingConn) Close() error {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	c.closed = true
+	return c.conn.Close()
+}
+
+func (c *MigratingConn) LocalAddr() net.Addr {
+	return c.current().LocalAddr()
+}
+
+func (c *MigratingConn) SetDeadline(t time.Time) error {
+	return c.current().SetDeadline(t)
+}
+
+func (c *MigratingConn) SetReadDeadline(t time.Time) error {
+	return c.current().SetReadDeadline(t)
+}
+
+func (c *MigratingConn) SetWriteDeadline(t time.Time) error {
+	return c.current().SetWriteDeadline(t)
+}
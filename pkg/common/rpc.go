@@ -0,0 +1,27 @@
+package common
+
+import (
+	"net/http"
+
+	"github.com/as283-ua/yappa/api/gen/server"
+)
+
+// Error code an RPC gets for the status its REST endpoint responds with, so both ways report errors alike
+func RpcCodeFromStatus(status int) server.RpcErrorCode {
+	switch {
+	case status >= 200 && status < 300:
+		return server.RpcErrorCode_RPC_OK
+	case status == http.StatusBadRequest:
+		return server.RpcErrorCode_RPC_BAD_REQUEST
+	case status == http.StatusUnauthorized, status == http.StatusForbidden:
+		return server.RpcErrorCode_RPC_UNAUTHORIZED
+	case status == http.StatusNotFound:
+		return server.RpcErrorCode_RPC_NOT_FOUND
+	case status == http.StatusMethodNotAllowed:
+		return server.RpcErrorCode_RPC_UNKNOWN_METHOD
+	case status == http.StatusTooManyRequests:
+		return server.RpcErrorCode_RPC_RATE_LIMITED
+	default:
+		return server.RpcErrorCode_RPC_INTERNAL
+	}
+}
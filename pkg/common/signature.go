@@ -0,0 +1,48 @@
+package common
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+)
+
+var ErrBadEventSignature = errors.New("event isn't signed by its sender")
+
+// What the sender of an event signs. Binds the receiver, so a signed event can't be presented as sent to
+// someone else
+func EventDigest(receiver string, event []byte) []byte {
+	ad := AssociatedData{
+		Version: PROTOCOL_VERSION,
+		Label:   LabelEventSignature,
+		Context: []byte(receiver),
+	}
+	return Hash(appendField(ad.Bytes(), event))
+}
+
+func SignEvent(key *ecdsa.PrivateKey, receiver string, event []byte) ([]byte, error) {
+	return ecdsa.SignASN1(rand.Reader, key, EventDigest(receiver, event))
+}
+
+// Checks the signature with the key of the sender's PEM certificate. The certificate itself isn't verified,
+// callers pass one they already trust
+func VerifyEventSignature(certPem []byte, receiver string, event, signature []byte) error {
+	block, _ := pem.Decode(certPem)
+	if block == nil {
+		return errors.New("certificate isn't PEM encoded")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return err
+	}
+	pubKey, ok := cert.PublicKey.(*ecdsa.PublicKey)
+	if !ok {
+		return fmt.Errorf("certificate of %v has no ECDSA key", cert.Subject.CommonName)
+	}
+	if !ecdsa.VerifyASN1(pubKey, EventDigest(receiver, event), signature) {
+		return ErrBadEventSignature
+	}
+	return nil
+}
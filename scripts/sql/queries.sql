@@ -17,17 +17,22 @@ VALUES ($1, $2, $3);
 
 ---- USER PERSONAL INBOXES
 -- name: NewUserInbox :exec
-INSERT INTO user_inboxes (username, enc_sender, enc_signature, enc_serial, enc_inbox_code, key_exchange_data)
-VALUES ($1, $2, $3, $4, $5, $6);
+INSERT INTO user_inboxes (inbox, enc_sender, enc_signature, enc_serial, enc_inbox_code, key_exchange_data, enc_ratchet_key, version)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8);
 
 -- name: GetNewUserInboxes :many
-SELECT enc_sender, enc_inbox_code, enc_serial, enc_signature, key_exchange_data
+SELECT enc_sender, enc_inbox_code, enc_serial, enc_signature, key_exchange_data, enc_ratchet_key, version, created_at
 FROM user_inboxes
-WHERE username = $1;
+WHERE inbox = $1;
+
+-- name: CountNewUserInboxes :one
+SELECT COUNT(*)
+FROM user_inboxes
+WHERE inbox = $1;
 
 -- name: DeleteNewUserInboxes :exec
 DELETE FROM user_inboxes
-WHERE username = $1;
+WHERE inbox = $1;
 
 
 ---- CHAT INBOXES
@@ -35,6 +40,12 @@ WHERE username = $1;
 INSERT INTO chat_inboxes (code, current_token_hash, enc_token, key_exchange_data) 
 VALUES ($1, NULL, NULL, NULL);
 
+-- name: LockOrCreateInbox :one
+INSERT INTO chat_inboxes (code, current_token_hash, enc_token, key_exchange_data)
+VALUES ($1, NULL, NULL, NULL)
+ON CONFLICT (code) DO UPDATE SET code = EXCLUDED.code
+RETURNING current_token_hash, enc_token, key_exchange_data;
+
 -- name: SetToken :exec
 UPDATE chat_inboxes
 SET current_token_hash = $2, enc_token = $3, key_exchange_data = $4
@@ -45,17 +56,188 @@ SELECT current_token_hash, enc_token, key_exchange_data
 FROM chat_inboxes
 WHERE code = $1;
 
+-- name: LockInbox :one
+SELECT current_token_hash, enc_token, key_exchange_data
+FROM chat_inboxes
+WHERE code = $1
+FOR UPDATE;
+
+-- name: ListStaleInboxTokens :many
+SELECT code, current_token_hash
+FROM chat_inboxes
+WHERE current_token_hash IS NOT NULL AND substring(current_token_hash FROM 1 FOR 4) <> $1::BYTEA
+LIMIT $2;
+
+-- name: RewrapInboxToken :execrows
+UPDATE chat_inboxes
+SET current_token_hash = $3
+WHERE code = $1 AND current_token_hash = $2;
+
 
 ---- CHAT MESSAGES
 -- name: AddMessage :exec
-INSERT INTO chat_inbox_messages (inbox_code, serial_n, enc_msg) 
-VALUES ($1, $2, $3);
+INSERT INTO chat_inbox_messages (inbox_code, serial_n, enc_msg, sender_auth) 
+VALUES ($1, $2, $3, $4);
 
 -- name: GetMessages :many
 SELECT enc_msg, serial_n
 FROM chat_inbox_messages
+WHERE inbox_code = $1
+ORDER BY serial_n;
+
+-- name: GetMessagesPage :many
+SELECT id, enc_msg, serial_n
+FROM chat_inbox_messages
+WHERE inbox_code = $1 AND id >= $2
+ORDER BY id
+LIMIT $3;
+
+-- name: CountMessages :one
+SELECT COUNT(*)
+FROM chat_inbox_messages
 WHERE inbox_code = $1;
 
+-- name: DeleteMessagesUpTo :execrows
+DELETE FROM chat_inbox_messages
+WHERE inbox_code = $1 AND id <= $2;
+
 -- name: FlushInbox :exec
 DELETE FROM chat_inbox_messages
 WHERE inbox_code = $1;
+
+-- name: DeleteEmptyInboxes :execrows
+DELETE FROM chat_inboxes
+WHERE code IN (
+    SELECT code FROM chat_inboxes i
+    WHERE i.created_at < $1
+        AND NOT EXISTS (SELECT 1 FROM chat_inbox_messages WHERE inbox_code = i.code)
+    FOR UPDATE SKIP LOCKED
+);
+
+
+---- RETENTION
+-- name: ExpireMessages :execrows
+WITH expired AS (
+    DELETE FROM chat_inbox_messages m
+    USING (
+        SELECT id, created_at,
+            ROW_NUMBER() OVER w AS newer_count,
+            SUM(octet_length(enc_msg)) OVER w AS newer_bytes
+        FROM chat_inbox_messages
+        WINDOW w AS (PARTITION BY inbox_code ORDER BY id DESC)
+    ) ranked
+    WHERE m.id = ranked.id
+        AND (ranked.created_at < $1 OR ranked.newer_count > $2 OR ranked.newer_bytes > $3)
+    RETURNING m.inbox_code, m.serial_n, m.sender_auth
+)
+INSERT INTO expired_messages (inbox_code, serial_n, sender_auth)
+SELECT inbox_code, serial_n, sender_auth FROM expired;
+
+-- name: ExpireInvitations :execrows
+DELETE FROM user_inboxes
+WHERE created_at < $1;
+
+-- name: ForgetExpiredMessages :execrows
+DELETE FROM expired_messages
+WHERE expired_at < $1;
+
+-- name: GetExpiredMessages :many
+SELECT serial_n, sender_auth
+FROM expired_messages
+WHERE inbox_code = $1 AND sender_auth IS NOT NULL AND serial_n = ANY($2::BIGINT[]);
+
+-- name: ListStaleMessageAuths :many
+SELECT id, inbox_code, sender_auth
+FROM chat_inbox_messages
+WHERE sender_auth IS NOT NULL AND substring(sender_auth FROM 1 FOR 4) <> $1::BYTEA
+LIMIT $2;
+
+-- name: RewrapMessageAuth :execrows
+UPDATE chat_inbox_messages
+SET sender_auth = $3
+WHERE id = $1 AND sender_auth = $2;
+
+-- name: ListStaleExpiredAuths :many
+SELECT id, inbox_code, sender_auth
+FROM expired_messages
+WHERE sender_auth IS NOT NULL AND substring(sender_auth FROM 1 FOR 4) <> $1::BYTEA
+LIMIT $2;
+
+-- name: RewrapExpiredAuth :execrows
+UPDATE expired_messages
+SET sender_auth = $3
+WHERE id = $1 AND sender_auth = $2;
+
+
+---- REPORTS
+-- name: CreateReport :one
+INSERT INTO reports (reporter, reported, reason, comment)
+VALUES ($1, $2, $3, $4)
+RETURNING id;
+
+-- name: AddReportEvidence :exec
+INSERT INTO report_evidence (report_id, event, signature)
+VALUES ($1, $2, $3);
+
+-- name: ListReports :many
+SELECT id, reporter, reported, reason, comment, status, created_at, resolved_at
+FROM reports
+WHERE status = $1
+ORDER BY created_at
+LIMIT $2;
+
+-- name: GetReport :one
+SELECT id, reporter, reported, reason, comment, status, created_at, resolved_at
+FROM reports
+WHERE id = $1;
+
+-- name: GetReportEvidence :many
+SELECT event, signature
+FROM report_evidence
+WHERE report_id = $1
+ORDER BY id;
+
+-- name: ResolveReport :execrows
+UPDATE reports
+SET status = $2, resolved_at = now()
+WHERE id = $1 AND status = 'open';
+
+
+---- SERVER KEYS
+-- name: GetServerKeys :many
+SELECT id, salt, time_cost, memory_kib, threads, wrapped_key, active, created_at
+FROM server_keys
+ORDER BY id;
+
+-- name: AddServerKey :one
+INSERT INTO server_keys (salt, time_cost, memory_kib, threads, wrapped_key)
+VALUES ($1, $2, $3, $4, $5)
+RETURNING id;
+
+-- name: RewrapServerKey :exec
+UPDATE server_keys
+SET salt = $2, time_cost = $3, memory_kib = $4, threads = $5, wrapped_key = $6
+WHERE id = $1;
+
+-- name: ActivateServerKey :exec
+UPDATE server_keys
+SET active = (id = $1);
+
+-- name: DeleteInactiveServerKeys :execrows
+DELETE FROM server_keys
+WHERE NOT active;
+
+-- name: GetServerSecrets :many
+SELECT name, value
+FROM server_secrets
+ORDER BY name;
+
+-- name: AddServerSecret :exec
+INSERT INTO server_secrets (name, value)
+VALUES ($1, $2)
+ON CONFLICT (name) DO NOTHING;
+
+-- name: RewrapServerSecret :execrows
+UPDATE server_secrets
+SET value = $3
+WHERE name = $1 AND value = $2;
@@ -2,6 +2,11 @@ DROP TABLE IF EXISTS user_inboxes CASCADE;
 DROP TABLE IF EXISTS users CASCADE;
 DROP TABLE IF EXISTS chat_inboxes CASCADE;
 DROP TABLE IF EXISTS chat_inbox_messages CASCADE;
+DROP TABLE IF EXISTS expired_messages CASCADE;
+DROP TABLE IF EXISTS reports CASCADE;
+DROP TABLE IF EXISTS report_evidence CASCADE;
+DROP TABLE IF EXISTS server_keys CASCADE;
+DROP TABLE IF EXISTS server_secrets CASCADE;
 
 CREATE TABLE users (
     id SERIAL PRIMARY KEY,
@@ -12,20 +17,25 @@ CREATE TABLE users (
 
 CREATE TABLE user_inboxes (
     id SERIAL PRIMARY KEY,
-    username TEXT NOT NULL,
+    inbox BYTEA NOT NULL,
     enc_sender BYTEA NOT NULL,
     enc_signature BYTEA NOT NULL,
     enc_serial BYTEA NOT NULL,
     enc_inbox_code BYTEA NOT NULL,
     key_exchange_data BYTEA NOT NULL,
-    FOREIGN KEY (username) REFERENCES users(username)
+    enc_ratchet_key BYTEA,
+    version INTEGER NOT NULL DEFAULT 0,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
 );
 
+CREATE INDEX user_inboxes_inbox ON user_inboxes (inbox);
+
 CREATE TABLE chat_inboxes (
     code BYTEA PRIMARY KEY,
     current_token_hash BYTEA,
     enc_token BYTEA,
-    key_exchange_data BYTEA
+    key_exchange_data BYTEA,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
 );
 
 CREATE TABLE chat_inbox_messages (
@@ -33,5 +43,66 @@ CREATE TABLE chat_inbox_messages (
     serial_n BIGINT NOT NULL,
     inbox_code BYTEA NOT NULL,
     enc_msg BYTEA NOT NULL,
+    -- hash of the token the sender checks for the message's expiry with, wrapped with a data key. See
+    -- expired_messages
+    sender_auth BYTEA,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
     FOREIGN KEY (inbox_code) REFERENCES chat_inboxes(code)
 );
+
+CREATE INDEX chat_inbox_messages_inbox_serial ON chat_inbox_messages (inbox_code, serial_n);
+
+-- messages deleted by the retention sweeper before being fetched, kept for a while so their senders can learn
+CREATE TABLE expired_messages (
+    id SERIAL PRIMARY KEY,
+    inbox_code BYTEA NOT NULL,
+    serial_n BIGINT NOT NULL,
+    sender_auth BYTEA,
+    expired_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX expired_messages_inbox_serial ON expired_messages (inbox_code, serial_n);
+
+-- abuse reports waiting for an admin. status is open, dismissed or actioned
+CREATE TABLE reports (
+    id SERIAL PRIMARY KEY,
+    reporter TEXT NOT NULL,
+    reported TEXT NOT NULL,
+    reason INTEGER NOT NULL,
+    comment TEXT NOT NULL DEFAULT '',
+    status TEXT NOT NULL DEFAULT 'open',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    resolved_at TIMESTAMPTZ,
+    FOREIGN KEY (reporter) REFERENCES users(username),
+    FOREIGN KEY (reported) REFERENCES users(username)
+);
+
+CREATE INDEX reports_status ON reports (status, created_at);
+
+-- messages disclosed by the reporter, as signed by the reported user
+CREATE TABLE report_evidence (
+    id SERIAL PRIMARY KEY,
+    report_id INTEGER NOT NULL,
+    event BYTEA NOT NULL,
+    signature BYTEA NOT NULL,
+    FOREIGN KEY (report_id) REFERENCES reports(id) ON DELETE CASCADE
+);
+
+-- data keys of the server, wrapped with a key derived from the master passphrase and the salt with Argon2id.
+-- Secrets are encrypted with the active one, the others are only kept until nothing uses them
+CREATE TABLE server_keys (
+    id SERIAL PRIMARY KEY,
+    salt BYTEA NOT NULL,
+    time_cost INTEGER NOT NULL,
+    memory_kib INTEGER NOT NULL,
+    threads INTEGER NOT NULL,
+    wrapped_key BYTEA NOT NULL,
+    active BOOLEAN NOT NULL DEFAULT false,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+-- secrets of the server itself, like the invite key, encrypted with a data key
+CREATE TABLE server_secrets (
+    name TEXT PRIMARY KEY,
+    value BYTEA NOT NULL
+);
@@ -0,0 +1,125 @@
+package test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"os"
+	"testing"
+
+	cli_proto "github.com/as283-ua/yappa/api/gen/client"
+	serv_proto "github.com/as283-ua/yappa/api/gen/server"
+	"github.com/as283-ua/yappa/internal/client/save"
+	"github.com/as283-ua/yappa/internal/client/service"
+	"github.com/as283-ua/yappa/pkg/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/zalando/go-keyring"
+	"google.golang.org/protobuf/proto"
+)
+
+// chat from before versions existed
+func legacyChat() *cli_proto.Chat {
+	chat := hashChainChat()
+	chat.Version = 0
+	return chat
+}
+
+func TestLegacyChatMessages(t *testing.T) {
+	receive := func(chat *cli_proto.Chat, serial uint64, encRaw []byte) (*service.PeerEvent, error) {
+		return service.DecryptPeerMessage(chat, &serv_proto.ServerMessage_Send{
+			Send: &serv_proto.ReceiveMsg{Serial: serial, InboxId: chat.Peer.InboxId, EncData: encRaw},
+		})
+	}
+	event := &cli_proto.ClientEvent{Sender: "bob", Payload: &cli_proto.ClientEvent_Message{Message: &cli_proto.ChatMessage{Msg: "old"}}}
+	raw, err := proto.Marshal(event)
+	if !assert.NoError(t, err) {
+		return
+	}
+	unbound, err := common.Encrypt(raw, legacyChat().Key)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	t.Run("read_without_ad", func(t *testing.T) {
+		peerEvent, err := receive(legacyChat(), 0, unbound)
+		if assert.NoError(t, err) {
+			assert.Equal(t, "old", peerEvent.Event.GetMessage().Msg)
+		}
+	})
+
+	t.Run("sent_without_ad", func(t *testing.T) {
+		// the peer may still run a release that knows nothing about associated data
+		msg, _, err := service.EncryptMessageForPeer(legacyChat(), "to an old client")
+		if !assert.NoError(t, err) {
+			return
+		}
+		sent, err := common.Decrypt(msg.Message, legacyChat().Key)
+		if !assert.NoError(t, err) {
+			return
+		}
+		event := &cli_proto.ClientEvent{}
+		assert.NoError(t, proto.Unmarshal(sent, event))
+		assert.Equal(t, "to an old client", event.GetMessage().Msg)
+	})
+
+	t.Run("versioned_chats_require_ad", func(t *testing.T) {
+		_, err := receive(hashChainChat(), 0, unbound)
+		assert.Error(t, err)
+
+		msg, _, err := service.EncryptMessageForPeer(hashChainChat(), "bound")
+		if !assert.NoError(t, err) {
+			return
+		}
+		_, err = common.Decrypt(msg.Message, hashChainChat().Key)
+		assert.Error(t, err)
+		_, err = receive(hashChainChat(), 1, msg.Message)
+		assert.Error(t, err, "bound to its serial")
+		peerEvent, err := receive(hashChainChat(), 0, msg.Message)
+		if assert.NoError(t, err) {
+			assert.Equal(t, "bound", peerEvent.Event.GetMessage().Msg)
+		}
+	})
+}
+
+func TestLegacySave(t *testing.T) {
+	keyring.MockInit()
+	t.Chdir(t.TempDir())
+	save.SetSavepathUsername("legacy_user")
+	defer save.SetSavepathUsername("")
+
+	state := &cli_proto.SaveState{Chats: []*cli_proto.Chat{legacyChat()}}
+	raw, err := proto.Marshal(state)
+	if !assert.NoError(t, err) {
+		return
+	}
+	var buf bytes.Buffer
+	gzipWriter := gzip.NewWriter(&buf)
+	gzipWriter.Write(raw)
+	gzipWriter.Close()
+
+	// written with the keyring secret as the key, without magic or associated data
+	secret := bytes.Repeat([]byte{7}, 32)
+	enc, err := common.Encrypt(buf.Bytes(), secret)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, keyring.Set(save.SERVICE_NAME, "legacy_user", base64.StdEncoding.EncodeToString(secret)))
+	assert.NoError(t, os.WriteFile("chats_legacy_user.data", enc, 0600))
+
+	loaded, err := save.LoadChats()
+	if !assert.NoError(t, err) || !assert.Len(t, loaded.Chats, 1) {
+		return
+	}
+	assert.Equal(t, "bob", loaded.Chats[0].Peer.Username)
+
+	// rewritten in the current format, and still read back
+	assert.NoError(t, save.SaveChats(loaded))
+	written, err := os.ReadFile("chats_legacy_user.data")
+	if assert.NoError(t, err) {
+		assert.True(t, bytes.HasPrefix(written, []byte(save.SAVE_MAGIC)))
+	}
+	again, err := save.LoadChats()
+	if assert.NoError(t, err) && assert.Len(t, again.Chats, 1) {
+		assert.True(t, proto.Equal(loaded.Chats[0], again.Chats[0]))
+	}
+}
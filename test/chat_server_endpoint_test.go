@@ -3,6 +3,7 @@ package test
 import (
 	"bytes"
 	"context"
+	"encoding/base64"
 	"encoding/binary"
 	"fmt"
 	"io"
@@ -16,11 +17,14 @@ import (
 	"github.com/as283-ua/yappa/api/gen/ca"
 	serv_proto "github.com/as283-ua/yappa/api/gen/server"
 	"github.com/as283-ua/yappa/internal/client/service"
+	cli_settings "github.com/as283-ua/yappa/internal/client/settings"
 	"github.com/as283-ua/yappa/internal/server"
 	"github.com/as283-ua/yappa/internal/server/chat"
+	"github.com/as283-ua/yappa/internal/server/keys"
 	"github.com/as283-ua/yappa/internal/server/settings"
 	"github.com/as283-ua/yappa/pkg/common"
 	"github.com/as283-ua/yappa/test/mock"
+	"github.com/quic-go/quic-go"
 	"github.com/quic-go/quic-go/http3"
 	"github.com/stretchr/testify/assert"
 	"google.golang.org/protobuf/proto"
@@ -45,7 +49,11 @@ func setup() {
 func RunChatServer() *http3.Server {
 	userRepo := mock.EmptyMockUserRepo()
 	chatRepo := mock.EmptyMockChatRepo()
-	server, err := server.SetupServer(&DefaultChatServerArgs, userRepo, chatRepo)
+	ring, err := keys.Load(mock.EmptyMockKeyRepo(), []byte(os.Getenv("YAPPA_MASTER_KEY")))
+	if err != nil {
+		log.Fatal("Error loading server keys: ", err)
+	}
+	server, err := server.SetupServer(&DefaultChatServerArgs, ring, userRepo, chatRepo, mock.EmptyMockReportRepo())
 	userRepo.CreateUser(context.Background(), "test_ok", "", []byte{})
 
 	if err != nil {
@@ -263,6 +271,163 @@ func TestConnection(t *testing.T) {
 	})
 }
 
+func readServerMessage(t *testing.T, str io.Reader) *serv_proto.ServerMessage {
+	var lenBytes [4]byte
+	_, err := io.ReadFull(str, lenBytes[:])
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	raw := make([]byte, binary.BigEndian.Uint32(lenBytes[:]))
+	_, err = io.ReadFull(str, raw)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	msg := &serv_proto.ServerMessage{}
+	assert.NoError(t, proto.Unmarshal(raw, msg))
+	return msg
+}
+
+func TestSendAck(t *testing.T) {
+	setup()
+
+	serverURL := "https://" + DefaultChatServerArgs.Addr + "/connect"
+	u, err := url.Parse(serverURL)
+	if !assert.NoError(t, err) {
+		return
+	}
+	client := GetHttp3Client(TEST_CERTS_DIR, "test_ok", DefaultChatServerArgs.Ca.Cert)
+
+	str, err := common.Http3Stream(context.Background(), u, client.Transport.(*http3.Transport), http.Header{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer str.Close()
+
+	// sent to itself, so the server relays it to this same session
+	inboxId := make([]byte, 32)
+	m, err := proto.Marshal(&serv_proto.ClientMessage{
+		Payload: &serv_proto.ClientMessage_Send{
+			Send: &serv_proto.SendMsg{Serial: 7, Receiver: "test_ok", InboxId: inboxId, Message: []byte("hi"), MsgId: 42},
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	lenBytes := make([]byte, 4)
+	binary.BigEndian.PutUint32(lenBytes, uint32(len(m)))
+	_, err = str.Write(append(lenBytes, m...))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	var received *serv_proto.ReceiveMsg
+	var status *serv_proto.SendStatus
+	for received == nil || status == nil {
+		msg := readServerMessage(t, str)
+		switch payload := msg.Payload.(type) {
+		case *serv_proto.ServerMessage_Send:
+			received = payload.Send
+		case *serv_proto.ServerMessage_Status:
+			status = payload.Status
+		}
+	}
+
+	assert.Equal(t, []byte("hi"), received.EncData)
+	assert.Equal(t, uint64(42), status.MsgId)
+	assert.Equal(t, uint64(7), status.Serial)
+	assert.Equal(t, serv_proto.DeliveryStatus_DELIVERY_RELAYED, status.Status)
+}
+
+func TestEphemeralNotStored(t *testing.T) {
+	setup()
+
+	u, err := url.Parse("https://" + DefaultChatServerArgs.Addr + "/connect")
+	if !assert.NoError(t, err) {
+		return
+	}
+	client := GetHttp3Client(TEST_CERTS_DIR, "test_ok", DefaultChatServerArgs.Ca.Cert)
+
+	str, err := common.Http3Stream(context.Background(), u, client.Transport.(*http3.Transport), http.Header{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer str.Close()
+
+	send := func(msg *serv_proto.SendMsg) {
+		m, err := proto.Marshal(&serv_proto.ClientMessage{
+			Payload: &serv_proto.ClientMessage_Send{Send: msg},
+		})
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		lenBytes := make([]byte, 4)
+		binary.BigEndian.PutUint32(lenBytes, uint32(len(m)))
+		_, err = str.Write(append(lenBytes, m...))
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+	}
+
+	inboxId := bytes.Repeat([]byte{9}, 32)
+	// nobody to relay it to, it's dropped instead of stored
+	send(&serv_proto.SendMsg{Receiver: "offline_user", InboxId: inboxId, Message: []byte("typing"), MsgId: 1, Ephemeral: true})
+	// relayed to this same session, without a status
+	send(&serv_proto.SendMsg{Receiver: "test_ok", InboxId: inboxId, Message: []byte("typing"), MsgId: 2, Ephemeral: true})
+	send(&serv_proto.SendMsg{Serial: 3, Receiver: "test_ok", InboxId: inboxId, Message: []byte("hi"), MsgId: 3})
+
+	var ephemeral *serv_proto.ReceiveMsg
+	for {
+		msg := readServerMessage(t, str)
+		if received := msg.GetSend(); received != nil && received.Ephemeral {
+			ephemeral = received
+		}
+		if status := msg.GetStatus(); status != nil {
+			assert.Equal(t, uint64(3), status.MsgId)
+			break
+		}
+	}
+
+	if assert.NotNil(t, ephemeral) {
+		assert.Equal(t, []byte("typing"), ephemeral.EncData)
+	}
+	msgs, err := chat.Repo.GetMessages(inboxId)
+	assert.NoError(t, err)
+	assert.Empty(t, msgs)
+}
+
+func TestNewChatPush(t *testing.T) {
+	setup()
+
+	u, err := url.Parse("https://" + DefaultChatServerArgs.Addr + "/connect")
+	if !assert.NoError(t, err) {
+		return
+	}
+	client := GetHttp3Client(TEST_CERTS_DIR, "test_ok", DefaultChatServerArgs.Ca.Cert)
+
+	str, err := common.Http3Stream(context.Background(), u, client.Transport.(*http3.Transport), http.Header{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer str.Close()
+
+	notify, err := proto.Marshal(&serv_proto.ChatInitNotify{Receiver: "test_ok", KeyExchangeData: []byte{1}})
+	if !assert.NoError(t, err) {
+		return
+	}
+	resp, err := client.Post(fmt.Sprintf("https://%v/chat/notify", DefaultChatServerArgs.Addr), "application/x-protobuf", bytes.NewReader(notify))
+	if !assert.NoError(t, err) {
+		return
+	}
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	msg := readServerMessage(t, str)
+	assert.NotNil(t, msg.GetNewChats())
+
+	// leave no invitation behind for other tests
+	chat.Repo.DeleteNewChats(inviteInbox(t, "test_ok"))
+}
+
 func TestChatInit(t *testing.T) {
 	setup()
 
@@ -280,3 +445,440 @@ func TestChatInit(t *testing.T) {
 		assert.Equal(t, len(repo.GetChatInboxes()), 1)
 	})
 }
+
+func TestSharedConnection(t *testing.T) {
+	setup()
+
+	newTransport := func() *common.SharedTransport {
+		tlsConfig := GetHttp3Client(TEST_CERTS_DIR, "test_ok", DefaultChatServerArgs.Ca.Cert).Transport.(*http3.Transport).TLSClientConfig
+		return common.NewSharedTransport(tlsConfig, &quic.Config{KeepAlivePeriod: time.Second})
+	}
+	usersUrl := fmt.Sprintf("https://%v/users", DefaultChatServerArgs.Addr)
+
+	t.Run("address_change", func(t *testing.T) {
+		transport := newTransport()
+		defer transport.Close()
+		client := &http.Client{Transport: transport}
+
+		u, err := url.Parse("https://" + DefaultChatServerArgs.Addr + "/connect")
+		if !assert.NoError(t, err) {
+			return
+		}
+		str, err := transport.OpenStream(context.Background(), u, http.Header{})
+		if !assert.NoError(t, err) {
+			return
+		}
+		defer str.Close()
+
+		before := transport.LocalAddr().String()
+		if !assert.NoError(t, transport.Rebind()) {
+			return
+		}
+		assert.NotEqual(t, before, transport.LocalAddr().String())
+
+		// the stream opened before the change keeps working, and requests keep using the same connection
+		notify, err := proto.Marshal(&serv_proto.ChatInitNotify{Receiver: "test_ok", KeyExchangeData: []byte{1}})
+		if !assert.NoError(t, err) {
+			return
+		}
+		resp, err := client.Post(fmt.Sprintf("https://%v/chat/notify", DefaultChatServerArgs.Addr), "application/x-protobuf", bytes.NewReader(notify))
+		if !assert.NoError(t, err) {
+			return
+		}
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		msg := readServerMessage(t, str)
+		assert.NotNil(t, msg.GetNewChats())
+		assert.NoError(t, str.Context().Err())
+
+		chat.Repo.DeleteNewChats(inviteInbox(t, "test_ok"))
+	})
+
+	t.Run("rebind_on_reconnect", func(t *testing.T) {
+		prevHost := cli_settings.CliSettings.ServerHost
+		cli_settings.CliSettings.ServerHost = DefaultChatServerArgs.Addr
+		defer func() { cli_settings.CliSettings.ServerHost = prevHost }()
+
+		transport := newTransport()
+		defer transport.Close()
+		client := service.InitChatClient(&http.Client{Transport: transport})
+		defer client.Close()
+		go client.KeepConnected()
+
+		connected := func() bool {
+			select {
+			case <-client.ConnectedSig:
+				return true
+			case <-time.After(5 * time.Second):
+				return false
+			}
+		}
+		if !assert.True(t, connected()) {
+			return
+		}
+		before := transport.LocalAddr().String()
+
+		// lost like after a network change, the client comes back from a new socket
+		transport.CloseConnections()
+		if !assert.True(t, connected()) {
+			return
+		}
+		assert.NotEqual(t, before, transport.LocalAddr().String())
+	})
+
+	t.Run("0rtt_resumption", func(t *testing.T) {
+		transport := newTransport()
+		defer transport.Close()
+		client := &http.Client{Transport: transport}
+
+		resp, err := client.Get(usersUrl)
+		if !assert.NoError(t, err) {
+			return
+		}
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.False(t, resp.TLS.DidResume)
+
+		// new connection resumes the session and sends the request as early data
+		transport.CloseConnections()
+		req, err := http.NewRequest(http3.MethodGet0RTT, usersUrl, nil)
+		if !assert.NoError(t, err) {
+			return
+		}
+		resp, err = client.Do(req)
+		if !assert.NoError(t, err) {
+			return
+		}
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.True(t, resp.TLS.DidResume)
+
+		resp, err = client.Get(fmt.Sprintf("https://%v/chat/init", DefaultChatServerArgs.Addr))
+		if !assert.NoError(t, err) {
+			return
+		}
+		initRaw, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		chatInit := &serv_proto.ChatInit{}
+		if !assert.NoError(t, proto.Unmarshal(initRaw, chatInit)) {
+			return
+		}
+
+		req, err = http.NewRequest(http3.MethodGet0RTT, fmt.Sprintf("https://%v/chat/token", DefaultChatServerArgs.Addr), nil)
+		if !assert.NoError(t, err) {
+			return
+		}
+		req.Header.Set("inbox", base64.RawURLEncoding.EncodeToString(chatInit.InboxId))
+		resp, err = client.Do(req)
+		if !assert.NoError(t, err) {
+			return
+		}
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	})
+}
+
+func TestRpc(t *testing.T) {
+	setup()
+
+	u, err := url.Parse("https://" + DefaultChatServerArgs.Addr + "/connect")
+	if !assert.NoError(t, err) {
+		return
+	}
+	client := GetHttp3Client(TEST_CERTS_DIR, "test_ok", DefaultChatServerArgs.Ca.Cert)
+
+	str, err := common.Http3Stream(context.Background(), u, client.Transport.(*http3.Transport), http.Header{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer str.Close()
+	writer := common.NewFrameWriter(str, 0)
+
+	call := func(req *serv_proto.RpcRequest) *serv_proto.RpcResponse {
+		err := writer.WriteMsg(&serv_proto.ClientMessage{Payload: &serv_proto.ClientMessage_Rpc{Rpc: req}})
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		resp := readServerMessage(t, str).GetRpc()
+		if !assert.NotNil(t, resp) {
+			t.FailNow()
+		}
+		assert.Equal(t, req.Id, resp.Id)
+		return resp
+	}
+
+	t.Run("chat_init_and_token", func(t *testing.T) {
+		resp := call(&serv_proto.RpcRequest{Id: 1, Method: serv_proto.RpcMethod_RPC_CHAT_INIT})
+		assert.Nil(t, resp.Error)
+		chatInit := &serv_proto.ChatInit{}
+		if !assert.NoError(t, proto.Unmarshal(resp.Body, chatInit)) {
+			return
+		}
+		assert.Len(t, chatInit.InboxId, 32)
+
+		resp = call(&serv_proto.RpcRequest{
+			Id:     2,
+			Method: serv_proto.RpcMethod_RPC_CHAT_TOKEN,
+			Params: map[string]string{"inbox": base64.RawURLEncoding.EncodeToString(chatInit.InboxId)},
+		})
+		assert.Nil(t, resp.Error)
+	})
+
+	t.Run("user_data", func(t *testing.T) {
+		resp := call(&serv_proto.RpcRequest{
+			Id:     3,
+			Method: serv_proto.RpcMethod_RPC_USER_DATA,
+			Params: map[string]string{"username": "test_ok"},
+		})
+		assert.Nil(t, resp.Error)
+		userData := &serv_proto.UserData{}
+		assert.NoError(t, proto.Unmarshal(resp.Body, userData))
+		assert.Equal(t, "test_ok", userData.Username)
+	})
+
+	t.Run("typed_errors", func(t *testing.T) {
+		resp := call(&serv_proto.RpcRequest{
+			Id:     4,
+			Method: serv_proto.RpcMethod_RPC_CHAT_TOKEN,
+			Params: map[string]string{"inbox": "not base64!"},
+		})
+		if assert.NotNil(t, resp.Error) {
+			assert.Equal(t, serv_proto.RpcErrorCode_RPC_BAD_REQUEST, resp.Error.Code)
+		}
+		assert.Empty(t, resp.Body)
+
+		resp = call(&serv_proto.RpcRequest{Id: 5, Method: serv_proto.RpcMethod(1000)})
+		if assert.NotNil(t, resp.Error) {
+			assert.Equal(t, serv_proto.RpcErrorCode_RPC_UNKNOWN_METHOD, resp.Error.Code)
+		}
+	})
+}
+
+func TestFetchAndAck(t *testing.T) {
+	setup()
+	client := GetHttp3Client(TEST_CERTS_DIR, "test_ok", DefaultChatServerArgs.Ca.Cert)
+
+	inboxId := bytes.Repeat([]byte{4}, 32)
+	token := []byte("inbox token")
+	assert.NoError(t, chat.Repo.CreateChatInbox(inboxId))
+	assert.NoError(t, chat.Repo.SetInboxToken(inboxId, common.Hash(token), []byte("enc token"), []byte("kex")))
+	assert.NoError(t, chat.Repo.AddMessage(inboxId, 1, []byte("one"), nil))
+	assert.NoError(t, chat.Repo.AddMessage(inboxId, 2, []byte("two"), nil))
+
+	post := func(path string, msg proto.Message) *http.Response {
+		body, err := proto.Marshal(msg)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		resp, err := client.Post(fmt.Sprintf("https://%v%v", DefaultChatServerArgs.Addr, path), "application/x-protobuf", bytes.NewReader(body))
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		return resp
+	}
+	fetch := func() *serv_proto.ListNewMessages {
+		resp := post("/chat/messages", &serv_proto.GetNewMessages{InboxId: inboxId, Token: token})
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		raw, err := io.ReadAll(resp.Body)
+		assert.NoError(t, err)
+		msgs := &serv_proto.ListNewMessages{}
+		assert.NoError(t, proto.Unmarshal(raw, msgs))
+		return msgs
+	}
+	ack := func(cursor uint64, token []byte) int {
+		resp := post("/chat/messages/ack", &serv_proto.AckMessages{InboxId: inboxId, Token: token, Cursor: cursor})
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// fetching alone deletes nothing
+	msgs := fetch()
+	assert.Len(t, msgs.Msgs, 2)
+	assert.Len(t, fetch().Msgs, 2)
+
+	// stored between the fetch and the ack, must survive it. Even with a serial lower than the fetched ones, as
+	// when a sender retries a message its first attempt failed to store
+	assert.NoError(t, chat.Repo.AddMessage(inboxId, 3, []byte("three"), nil))
+	assert.NoError(t, chat.Repo.AddMessage(inboxId, 0, []byte("zero"), nil))
+	assert.Equal(t, http.StatusUnauthorized, ack(msgs.Cursor, []byte("wrong token")))
+	assert.Equal(t, http.StatusOK, ack(msgs.Cursor, token))
+
+	msgs = fetch()
+	if assert.Len(t, msgs.Msgs, 2) {
+		assert.Equal(t, []byte("three"), msgs.Msgs[0].EncMsg)
+		assert.Equal(t, []byte("zero"), msgs.Msgs[1].EncMsg)
+	}
+	tokenObj, err := chat.Repo.GetToken(inboxId)
+	assert.NoError(t, err)
+	assert.NotNil(t, tokenObj.CurrentTokenHash)
+
+	// emptied, so the token is cleared for the next stored message
+	assert.Equal(t, http.StatusOK, ack(msgs.Cursor, token))
+	left, err := chat.Repo.GetMessages(inboxId)
+	assert.NoError(t, err)
+	assert.Empty(t, left)
+	tokenObj, err = chat.Repo.GetToken(inboxId)
+	assert.NoError(t, err)
+	assert.Nil(t, tokenObj.CurrentTokenHash)
+	assert.Equal(t, http.StatusUnauthorized, ack(msgs.Cursor, token))
+}
+
+func TestPagedFetch(t *testing.T) {
+	setup()
+	client := GetHttp3Client(TEST_CERTS_DIR, "test_ok", DefaultChatServerArgs.Ca.Cert)
+
+	inboxId := bytes.Repeat([]byte{5}, 32)
+	token := []byte("inbox token")
+	assert.NoError(t, chat.Repo.CreateChatInbox(inboxId))
+	assert.NoError(t, chat.Repo.SetInboxToken(inboxId, common.Hash(token), []byte("enc token"), []byte("kex")))
+	for _, serial := range []uint64{4, 1, 5, 3, 2} {
+		assert.NoError(t, chat.Repo.AddMessage(inboxId, serial, []byte{byte(serial)}, nil))
+	}
+
+	fetch := func(page []byte) (*serv_proto.ListNewMessages, int) {
+		body, err := proto.Marshal(&serv_proto.GetNewMessages{InboxId: inboxId, Token: token, Page: page, PageSize: 2})
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		resp, err := client.Post(fmt.Sprintf("https://%v/chat/messages", DefaultChatServerArgs.Addr), "application/x-protobuf", bytes.NewReader(body))
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		defer resp.Body.Close()
+		raw, err := io.ReadAll(resp.Body)
+		assert.NoError(t, err)
+		msgs := &serv_proto.ListNewMessages{}
+		if resp.StatusCode == http.StatusOK {
+			assert.NoError(t, proto.Unmarshal(raw, msgs))
+		}
+		return msgs, resp.StatusCode
+	}
+
+	serials := make([]uint64, 0)
+	var page []byte
+	var cursor uint64
+	pages := 0
+	for {
+		msgs, status := fetch(page)
+		if !assert.Equal(t, http.StatusOK, status) {
+			return
+		}
+		pages++
+		for _, msg := range msgs.Msgs {
+			serials = append(serials, msg.Serial)
+		}
+		assert.Greater(t, msgs.Cursor, cursor)
+		cursor = msgs.Cursor
+		if len(msgs.NextPage) == 0 {
+			break
+		}
+		page = msgs.NextPage
+	}
+	assert.Equal(t, 3, pages)
+	// in the order they were stored
+	assert.Equal(t, []uint64{4, 1, 5, 3, 2}, serials)
+
+	_, status := fetch([]byte("bad"))
+	assert.Equal(t, http.StatusBadRequest, status)
+}
+
+func TestRetention(t *testing.T) {
+	setup()
+	client := GetHttp3Client(TEST_CERTS_DIR, "test_ok", DefaultChatServerArgs.Ca.Cert)
+
+	// sweeps delete from every inbox, keep other tests' data out of it
+	repo := chat.Repo.(*mock.MockChatRepo)
+	defer repo.Isolate()()
+
+	full := bytes.Repeat([]byte{6}, 32)
+	small := bytes.Repeat([]byte{7}, 32)
+	// waiting for its first message, its key exchange must outlive the sweeps
+	pending := bytes.Repeat([]byte{8}, 32)
+	// its last stored message has the lower serial, as with a late key rotation
+	late := bytes.Repeat([]byte{9}, 32)
+	for _, inbox := range [][]byte{full, small, pending, late} {
+		assert.NoError(t, repo.CreateChatInbox(inbox))
+	}
+	assert.NoError(t, repo.SetInboxToken(pending, nil, []byte("enc token"), []byte("kex")))
+	senderToken := []byte("sender token")
+	for serial := uint64(1); serial <= 4; serial++ {
+		auth, err := chat.WrapSenderAuth(full, common.Hash(senderToken))
+		assert.NoError(t, err)
+		assert.NoError(t, repo.AddMessage(full, serial, []byte("msg"), auth))
+	}
+	assert.NoError(t, repo.AddMessage(small, 1, []byte("msg"), nil))
+	assert.NoError(t, repo.AddMessage(late, 5, []byte("msg"), nil))
+	assert.NoError(t, repo.AddMessage(late, 2, []byte("msg"), nil))
+	assert.NoError(t, repo.ShareChatInbox(inviteInbox(t, "test_ok"), nil, nil, nil, nil, []byte{1}, nil, 3))
+
+	// nothing is old enough, only the count limit applies
+	err := chat.Sweep(settings.RetentionCfg{MaxAge: time.Hour, MaxMessages: 2, InvitationMaxAge: time.Hour})
+	assert.NoError(t, err)
+
+	left, _ := repo.GetMessages(full)
+	assert.Len(t, left, 2)
+	left, _ = repo.GetMessages(small)
+	assert.Len(t, left, 1)
+	invitations, _ := repo.GetNewChats(inviteInbox(t, "test_ok"))
+	assert.Len(t, invitations, 1)
+
+	assert.NoError(t, chat.Sweep(settings.RetentionCfg{MaxBytes: 3}))
+	left, _ = repo.GetMessages(full)
+	if assert.Len(t, left, 1) {
+		assert.Equal(t, int64(4), left[0].SerialN)
+	}
+	// the last stored is kept, not the highest serial
+	left, _ = repo.GetMessages(late)
+	if assert.Len(t, left, 1) {
+		assert.Equal(t, int64(2), left[0].SerialN)
+	}
+
+	checkExpired := func(token []byte) ([]uint64, int) {
+		body, err := proto.Marshal(&serv_proto.CheckExpired{InboxId: full, Serials: []uint64{1, 2, 3, 4, 5}, Token: token})
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		resp, err := client.Post(fmt.Sprintf("https://%v/chat/expired", DefaultChatServerArgs.Addr), "application/x-protobuf", bytes.NewReader(body))
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		defer resp.Body.Close()
+		raw, err := io.ReadAll(resp.Body)
+		assert.NoError(t, err)
+		expired := &serv_proto.ExpiredMessages{}
+		if resp.StatusCode == http.StatusOK {
+			assert.NoError(t, proto.Unmarshal(raw, expired))
+		}
+		return expired.Serials, resp.StatusCode
+	}
+	serials, status := checkExpired(senderToken)
+	assert.Equal(t, http.StatusOK, status)
+	assert.ElementsMatch(t, []uint64{1, 2, 3}, serials)
+
+	// only the sender can tell what expired
+	serials, status = checkExpired([]byte("other token"))
+	assert.Equal(t, http.StatusOK, status)
+	assert.Empty(t, serials)
+	_, status = checkExpired(nil)
+	assert.Equal(t, http.StatusUnauthorized, status)
+
+	// the records go away after the notice age
+	_, err = repo.ForgetExpiredMessages(time.Now().Add(time.Minute))
+	assert.NoError(t, err)
+	records, err := repo.GetExpiredMessages(full, []uint64{1, 2, 3})
+	assert.NoError(t, err)
+	assert.Empty(t, records)
+
+	// empty inboxes only go once old enough
+	_, err = repo.GetToken(pending)
+	assert.NoError(t, err)
+	deleted, err := repo.DeleteEmptyInboxes(time.Now().Add(time.Minute))
+	assert.NoError(t, err)
+	assert.EqualValues(t, 1, deleted)
+	_, err = repo.GetToken(pending)
+	assert.Error(t, err)
+	_, err = repo.GetToken(full)
+	assert.NoError(t, err)
+}
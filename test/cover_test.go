@@ -0,0 +1,201 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	cli_proto "github.com/as283-ua/yappa/api/gen/client"
+	serv_proto "github.com/as283-ua/yappa/api/gen/server"
+	"github.com/as283-ua/yappa/internal/client/service"
+	cli_settings "github.com/as283-ua/yappa/internal/client/settings"
+	"github.com/as283-ua/yappa/internal/server/chat"
+	"github.com/as283-ua/yappa/internal/server/settings"
+	"github.com/as283-ua/yappa/pkg/common"
+	"github.com/as283-ua/yappa/test/mock"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestCoverTraffic(t *testing.T) {
+	setup()
+
+	// dummies would otherwise be stored in inboxes of their own
+	repo := chat.Repo.(*mock.MockChatRepo)
+	defer repo.Isolate()()
+
+	u, err := url.Parse("https://" + DefaultChatServerArgs.Addr + "/connect")
+	if !assert.NoError(t, err) {
+		return
+	}
+	tlsConfig := GetHttp3Client(TEST_CERTS_DIR, "test_ok", DefaultChatServerArgs.Ca.Cert).Transport.(*http3.Transport).TLSClientConfig
+	str, err := common.Http3Stream(context.Background(), u, &http3.Transport{TLSClientConfig: tlsConfig}, http.Header{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer str.Close()
+
+	write := func(msg *serv_proto.ClientMessage) {
+		m, err := proto.Marshal(msg)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		lenBytes := make([]byte, 4)
+		binary.BigEndian.PutUint32(lenBytes, uint32(len(m)))
+		_, err = str.Write(append(lenBytes, m...))
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+	}
+	// next relayed message, skipping anything else
+	received := func() *serv_proto.ReceiveMsg {
+		for {
+			if msg := readServerMessage(t, str).GetSend(); msg != nil {
+				return msg
+			}
+		}
+	}
+
+	delivery := bytes.Repeat([]byte{4}, common.KEY_SIZE)
+	inboxId := bytes.Repeat([]byte{5}, common.KEY_SIZE)
+	auth := common.Hash([]byte("cover inbox token"))
+	write(&serv_proto.ClientMessage{Payload: &serv_proto.ClientMessage_Delivery{
+		Delivery: &serv_proto.DeliveryRegister{Tokens: [][]byte{delivery}},
+	}})
+
+	t.Run("dropped", func(t *testing.T) {
+		write(&serv_proto.ClientMessage{Payload: &serv_proto.ClientMessage_Send{Send: &serv_proto.SendMsg{
+			Serial: 1, InboxId: inboxId, Message: []byte("dummy"), MsgId: 1,
+			InboxAuth: auth, DeliveryToken: delivery, Cover: true,
+		}}})
+		write(&serv_proto.ClientMessage{Payload: &serv_proto.ClientMessage_Send{Send: &serv_proto.SendMsg{
+			Serial: 1, InboxId: inboxId, Message: []byte("real"), MsgId: 2,
+			InboxAuth: auth, DeliveryToken: delivery,
+		}}})
+
+		// neither relayed nor answered
+		var status *serv_proto.SendStatus
+		for status == nil {
+			msg := readServerMessage(t, str)
+			if send := msg.GetSend(); send != nil {
+				assert.Equal(t, []byte("real"), send.EncData)
+			}
+			status = msg.GetStatus()
+		}
+		assert.Equal(t, uint64(2), status.MsgId)
+	})
+
+	t.Run("own_budget", func(t *testing.T) {
+		useLimits(t, map[string]settings.RateCfg{
+			settings.LIMIT_SEND:  {Rate: 0.001, Burst: 1},
+			settings.LIMIT_COVER: {Rate: 0.001, Burst: 1},
+		})
+		for range 2 {
+			write(&serv_proto.ClientMessage{Payload: &serv_proto.ClientMessage_Send{Send: &serv_proto.SendMsg{
+				Serial: 3, InboxId: inboxId, Message: []byte("dummy"), MsgId: 3,
+				InboxAuth: auth, DeliveryToken: delivery, Cover: true,
+			}}})
+		}
+		var streamErr *serv_proto.StreamError
+		for streamErr == nil {
+			streamErr = readServerMessage(t, str).GetError()
+		}
+		assert.Equal(t, serv_proto.StreamErrorCode_STREAM_RATE_LIMITED, streamErr.Code)
+
+		// the dummies left the send limit alone
+		write(&serv_proto.ClientMessage{Payload: &serv_proto.ClientMessage_Send{Send: &serv_proto.SendMsg{
+			Serial: 3, InboxId: inboxId, Message: []byte("real"), MsgId: 4,
+			InboxAuth: auth, DeliveryToken: delivery,
+		}}})
+		var status *serv_proto.SendStatus
+		for status == nil {
+			status = readServerMessage(t, str).GetStatus()
+		}
+		assert.Equal(t, uint64(4), status.MsgId)
+		assert.Equal(t, serv_proto.DeliveryStatus_DELIVERY_RELAYED, status.Status)
+	})
+
+	t.Run("held_for_slots", func(t *testing.T) {
+		prevHost := cli_settings.CliSettings.ServerHost
+		cli_settings.CliSettings.ServerHost = DefaultChatServerArgs.Addr
+		defer func() { cli_settings.CliSettings.ServerHost = prevHost }()
+
+		transport := common.NewSharedTransport(tlsConfig, &quic.Config{KeepAlivePeriod: time.Second})
+		defer transport.Close()
+		client := service.InitChatClient(&http.Client{Transport: transport})
+		defer client.Close()
+		if !assert.NoError(t, client.Connect()) {
+			return
+		}
+		interval := 100 * time.Millisecond
+		client.StartCover(interval, 1)
+
+		err := client.SendMsg(&serv_proto.SendMsg{
+			Serial: 2, InboxId: inboxId, Message: []byte("held"),
+			InboxAuth: auth, DeliveryToken: delivery,
+		})
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Equal(t, 1, client.Held())
+		assert.Equal(t, []byte("held"), received().EncData)
+
+		// a few slots go by with only dummies, and none of them ends up stored
+		time.Sleep(5 * interval)
+		assert.Zero(t, client.Held())
+		assert.Empty(t, repo.GetChatInboxes())
+	})
+}
+
+func TestCoverSize(t *testing.T) {
+	alice, bob, asAlice, asBob := ratchetChats(t)
+	dummy := (&service.ChatClient{}).CoverMsg()
+
+	// frames of a real send and a dummy, their serial and message id being the same
+	sameFrameSize := func(msg *serv_proto.SendMsg) {
+		send := proto.Clone(msg).(*serv_proto.SendMsg)
+		send.MsgId = dummy.GetSend().MsgId
+		sent := &serv_proto.ClientMessage{Payload: &serv_proto.ClientMessage_Send{Send: send}}
+
+		fake := proto.Clone(dummy).(*serv_proto.ClientMessage)
+		fake.GetSend().Serial = msg.Serial
+		assert.Equal(t, proto.Size(sent), proto.Size(fake))
+	}
+	send := func(from *cli_proto.Chat, txt string) *serv_proto.SendMsg {
+		msg, event, err := service.EncryptMessageForPeer(from, txt)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		service.CommitSentEvent(from, event)
+		return msg
+	}
+	receive := func(to *cli_proto.Chat, msg *serv_proto.SendMsg) {
+		receiveRatchet(t, to, &serv_proto.ServerMessage_Send{Send: &serv_proto.ReceiveMsg{Serial: msg.Serial, InboxId: msg.InboxId, EncData: msg.Message}}, "hi")
+	}
+
+	asAlice()
+	first := send(alice, "hi")
+	asBob()
+	receive(bob, first)
+	// steps the ratchet, its header carries an ML-KEM ciphertext
+	reply := send(bob, "hi")
+	env := &cli_proto.Envelope{}
+	if assert.NoError(t, proto.Unmarshal(reply.Message, env)) {
+		assert.NotEmpty(t, env.Header.KemCiphertext)
+	}
+	asAlice()
+	receive(alice, reply)
+	second := send(alice, "hi")
+
+	for _, msg := range []*serv_proto.SendMsg{first, reply, second} {
+		assert.Len(t, msg.Message, service.ENVELOPE_MIN_SIZE)
+		assert.NotEmpty(t, msg.SenderAuth)
+		sameFrameSize(msg)
+	}
+}
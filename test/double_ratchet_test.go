@@ -0,0 +1,163 @@
+package test
+
+import (
+	"bytes"
+	"crypto/mlkem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	cli_proto "github.com/as283-ua/yappa/api/gen/client"
+	serv_proto "github.com/as283-ua/yappa/api/gen/server"
+	"github.com/as283-ua/yappa/internal/client/save"
+	"github.com/as283-ua/yappa/internal/client/service"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/proto"
+)
+
+var ratchetUsers int
+
+// Both ends of a new double ratchet chat. The ML-KEM key of this client is global, decrypting as one of them
+// takes loading their key first with the function returned for them
+func ratchetChats(t *testing.T) (alice, bob *cli_proto.Chat, asAlice, asBob func()) {
+	keyFile := func(name string) (*mlkem.DecapsulationKey1024, func()) {
+		decap, err := mlkem.GenerateKey1024()
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		path := filepath.Join(t.TempDir(), name+".key")
+		if !assert.NoError(t, os.WriteFile(path, decap.Bytes(), 0600)) {
+			t.FailNow()
+		}
+		return decap, func() {
+			if !assert.NoError(t, service.UseMlkemKey(path)) {
+				t.FailNow()
+			}
+		}
+	}
+	aliceKey, asAlice := keyFile("alice")
+	bobKey, asBob := keyFile("bob")
+
+	// peer keys are cached by username
+	ratchetUsers++
+	aliceName, bobName := fmt.Sprint("ratchet_alice_", ratchetUsers), fmt.Sprint("ratchet_bob_", ratchetUsers)
+
+	inboxId := bytes.Repeat([]byte{6}, 32)
+	alice, secret, keyExchData, err := service.ChatData(&serv_proto.UserData{
+		Username:       bobName,
+		PubKeyExchange: bobKey.EncapsulationKey().Bytes(),
+	}, inboxId)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	bob, err = service.InvitedChat(
+		&serv_proto.NewChat{Version: alice.Version, KeyExchangeData: keyExchData, CreatedAt: uint64(time.Now().Unix())},
+		&service.Invitation{InboxId: inboxId, Sender: aliceName, Serial: alice.CurrentSerial, RatchetKey: alice.Ratchet.DhPub},
+		secret,
+		&serv_proto.UserData{Username: aliceName, PubKeyExchange: aliceKey.EncapsulationKey().Bytes()},
+	)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	return alice, bob, asAlice, asBob
+}
+
+func sendRatchet(t *testing.T, from *cli_proto.Chat, txt string) *serv_proto.ServerMessage_Send {
+	msg, event, err := service.EncryptMessageForPeer(from, txt)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	service.CommitSentEvent(from, event)
+	return &serv_proto.ServerMessage_Send{Send: &serv_proto.ReceiveMsg{Serial: msg.Serial, InboxId: msg.InboxId, EncData: msg.Message}}
+}
+
+func receiveRatchet(t *testing.T, to *cli_proto.Chat, msg *serv_proto.ServerMessage_Send, txt string) bool {
+	peerEvent, err := service.DecryptPeerMessage(to, msg)
+	if !assert.NoError(t, err, txt) {
+		return false
+	}
+	assert.NoError(t, service.AcceptPeerEvent(to, peerEvent))
+	return assert.Equal(t, txt, peerEvent.Event.GetMessage().Msg)
+}
+
+func TestDoubleRatchet(t *testing.T) {
+	t.Run("out_of_order_across_steps", func(t *testing.T) {
+		alice, bob, asAlice, asBob := ratchetChats(t)
+
+		a1, a2, a3 := sendRatchet(t, alice, "a1"), sendRatchet(t, alice, "a2"), sendRatchet(t, alice, "a3")
+		asBob()
+		receiveRatchet(t, bob, a1, "a1")
+
+		// bob's reply moves alice to a new DH and ML-KEM step
+		b1 := sendRatchet(t, bob, "b1")
+		asAlice()
+		receiveRatchet(t, alice, b1, "b1")
+		a4 := sendRatchet(t, alice, "a4")
+		a4Env := &cli_proto.Envelope{}
+		if assert.NoError(t, proto.Unmarshal(a4.Send.EncData, a4Env)) {
+			assert.NotEqual(t, alice.Ratchet.PeerDhPub, a4Env.Header.DhPub)
+			assert.NotEmpty(t, a4Env.Header.KemCiphertext)
+			assert.EqualValues(t, 3, a4Env.Header.Pn)
+		}
+
+		// the new chain arrives before the rest of the old one
+		asBob()
+		receiveRatchet(t, bob, a4, "a4")
+		assert.Len(t, bob.Ratchet.SkippedKeys, 2)
+		receiveRatchet(t, bob, a3, "a3")
+		receiveRatchet(t, bob, a2, "a2")
+		assert.Empty(t, bob.Ratchet.SkippedKeys)
+
+		// a replay has no key left
+		_, err := service.DecryptPeerMessage(bob, a2)
+		assert.Error(t, err)
+		_, err = service.DecryptPeerMessage(bob, a4)
+		assert.Error(t, err)
+
+		b2 := sendRatchet(t, bob, "b2")
+		asAlice()
+		receiveRatchet(t, alice, b2, "b2")
+	})
+
+	t.Run("tampered_header", func(t *testing.T) {
+		alice, bob, _, asBob := ratchetChats(t)
+		msg := sendRatchet(t, alice, "hi")
+		asBob()
+
+		env := &cli_proto.Envelope{}
+		if !assert.NoError(t, proto.Unmarshal(msg.Send.EncData, env)) {
+			return
+		}
+		env.Header.Pn++
+		tampered, err := proto.Marshal(env)
+		if !assert.NoError(t, err) {
+			return
+		}
+		_, err = service.DecryptPeerMessage(bob, &serv_proto.ServerMessage_Send{Send: &serv_proto.ReceiveMsg{Serial: msg.Send.Serial, EncData: tampered}})
+		assert.Error(t, err)
+
+		// bound to its serial as well
+		_, err = service.DecryptPeerMessage(bob, &serv_proto.ServerMessage_Send{Send: &serv_proto.ReceiveMsg{Serial: msg.Send.Serial + 1, EncData: msg.Send.EncData}})
+		assert.Error(t, err)
+
+		// failed attempts leave the state untouched
+		receiveRatchet(t, bob, msg, "hi")
+	})
+
+	t.Run("skip_limit", func(t *testing.T) {
+		alice, bob, _, asBob := ratchetChats(t)
+		for range save.MAX_RATCHET_CYCLE {
+			sendRatchet(t, alice, "lost")
+		}
+		last := sendRatchet(t, alice, "last")
+		asBob()
+		receiveRatchet(t, bob, last, "last")
+		assert.Len(t, bob.Ratchet.SkippedKeys, save.MAX_RATCHET_CYCLE)
+
+		alice.Ratchet.SendN += save.MAX_RATCHET_CYCLE + 1
+		_, err := service.DecryptPeerMessage(bob, sendRatchet(t, alice, "too far"))
+		assert.ErrorContains(t, err, "MAX RATCHET CYCLE")
+	})
+}
@@ -0,0 +1,185 @@
+package test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"testing/iotest"
+
+	serv_proto "github.com/as283-ua/yappa/api/gen/server"
+	"github.com/as283-ua/yappa/pkg/common"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/proto"
+)
+
+func sendFrame(t *testing.T, serial uint64, payload []byte) []byte {
+	frame, err := common.EncodeFrame(&serv_proto.ClientMessage{
+		Payload: &serv_proto.ClientMessage_Send{
+			Send: &serv_proto.SendMsg{Serial: serial, Message: payload},
+		},
+	}, 0)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	return frame
+}
+
+func TestFrameReader(t *testing.T) {
+	t.Run("short_reads", func(t *testing.T) {
+		var stream bytes.Buffer
+		stream.Write(sendFrame(t, 1, bytes.Repeat([]byte("a"), 10000)))
+		stream.Write(sendFrame(t, 2, []byte("b")))
+
+		reader := common.NewFrameReader(iotest.OneByteReader(&stream), 0)
+		msg := &serv_proto.ClientMessage{}
+		assert.NoError(t, reader.ReadMsg(msg))
+		assert.Equal(t, uint64(1), msg.GetSend().Serial)
+		assert.Len(t, msg.GetSend().Message, 10000)
+
+		msg = &serv_proto.ClientMessage{}
+		assert.NoError(t, reader.ReadMsg(msg))
+		assert.Equal(t, uint64(2), msg.GetSend().Serial)
+
+		assert.ErrorIs(t, reader.ReadMsg(msg), io.EOF)
+	})
+
+	t.Run("too_large", func(t *testing.T) {
+		reader := common.NewFrameReader(bytes.NewReader(sendFrame(t, 1, make([]byte, 200))), 100)
+		err := reader.ReadMsg(&serv_proto.ClientMessage{})
+		var tooLarge *common.FrameTooLargeError
+		if assert.ErrorAs(t, err, &tooLarge) {
+			assert.Equal(t, uint32(100), tooLarge.Max)
+		}
+
+		header := binary.BigEndian.AppendUint32(nil, ^uint32(0))
+		reader = common.NewFrameReader(bytes.NewReader(header), 0)
+		assert.ErrorAs(t, reader.ReadMsg(&serv_proto.ClientMessage{}), &tooLarge)
+	})
+
+	t.Run("truncated", func(t *testing.T) {
+		frame := sendFrame(t, 1, []byte("hello"))
+		for _, cut := range []int{2, len(frame) - 1} {
+			reader := common.NewFrameReader(bytes.NewReader(frame[:cut]), 0)
+			assert.ErrorIs(t, reader.ReadMsg(&serv_proto.ClientMessage{}), common.ErrTruncatedFrame)
+		}
+	})
+
+	t.Run("invalid_message_keeps_sync", func(t *testing.T) {
+		var stream bytes.Buffer
+		stream.Write(binary.BigEndian.AppendUint32(nil, 2))
+		stream.Write([]byte{0xff, 0xff})
+		stream.Write(sendFrame(t, 3, nil))
+
+		reader := common.NewFrameReader(&stream, 0)
+		var decodeErr *common.FrameDecodeError
+		assert.ErrorAs(t, reader.ReadMsg(&serv_proto.ClientMessage{}), &decodeErr)
+
+		msg := &serv_proto.ClientMessage{}
+		assert.NoError(t, reader.ReadMsg(msg))
+		assert.Equal(t, uint64(3), msg.GetSend().Serial)
+	})
+
+	t.Run("writer_limit", func(t *testing.T) {
+		var stream bytes.Buffer
+		writer := common.NewFrameWriter(&stream, 100)
+		err := writer.WriteMsg(&serv_proto.SendMsg{Message: make([]byte, 200)})
+		var tooLarge *common.FrameTooLargeError
+		assert.ErrorAs(t, err, &tooLarge)
+		assert.Equal(t, 0, stream.Len())
+	})
+
+	t.Run("concurrent_writes", func(t *testing.T) {
+		var stream lockedBuffer
+		writer := common.NewFrameWriter(&stream, 0)
+
+		var wg sync.WaitGroup
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func(serial uint64) {
+				defer wg.Done()
+				assert.NoError(t, writer.WriteMsg(&serv_proto.SendMsg{Serial: serial, Message: make([]byte, 5000)}))
+			}(uint64(i))
+		}
+		wg.Wait()
+
+		reader := common.NewFrameReader(&stream.buf, 0)
+		seen := map[uint64]bool{}
+		for i := 0; i < 20; i++ {
+			msg := &serv_proto.SendMsg{}
+			if !assert.NoError(t, reader.ReadMsg(msg)) {
+				return
+			}
+			seen[msg.Serial] = true
+		}
+		assert.Len(t, seen, 20)
+	})
+}
+
+type lockedBuffer struct {
+	mx  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	return b.buf.Write(p)
+}
+
+// Arbitrary input must only ever produce one of the codec's errors, never a panic or a read past the limit
+func FuzzFrameReader(f *testing.F) {
+	f.Add([]byte{})
+	f.Add([]byte{0, 0, 0, 0})
+	f.Add([]byte{0, 0, 0, 2, 0xff, 0xff})
+	f.Add([]byte{0xff, 0xff, 0xff, 0xff})
+	frame, _ := common.EncodeFrame(&serv_proto.ClientMessage{Payload: &serv_proto.ClientMessage_Send{Send: &serv_proto.SendMsg{Serial: 1}}}, 0)
+	f.Add(frame)
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		reader := common.NewFrameReader(bytes.NewReader(data), 1024)
+		for {
+			err := reader.ReadMsg(&serv_proto.ClientMessage{})
+			if err == nil {
+				continue
+			}
+			var tooLarge *common.FrameTooLargeError
+			var decodeErr *common.FrameDecodeError
+			switch {
+			case errors.Is(err, io.EOF), errors.Is(err, common.ErrTruncatedFrame), errors.As(err, &tooLarge):
+				return
+			case errors.As(err, &decodeErr):
+				continue
+			default:
+				t.Fatalf("unexpected error type: %v", err)
+			}
+		}
+	})
+}
+
+func FuzzFrameRoundTrip(f *testing.F) {
+	f.Add(uint64(0), []byte{}, "")
+	f.Add(uint64(1<<63), []byte("payload"), "receiver")
+
+	f.Fuzz(func(t *testing.T, serial uint64, payload []byte, receiver string) {
+		sent := &serv_proto.SendMsg{Serial: serial, Message: payload, Receiver: receiver}
+
+		var stream bytes.Buffer
+		err := common.NewFrameWriter(&stream, 0).WriteMsg(sent)
+		if err != nil {
+			// invalid utf-8 in the string field can't be marshalled
+			return
+		}
+
+		received := &serv_proto.SendMsg{}
+		err = common.NewFrameReader(iotest.HalfReader(&stream), 0).ReadMsg(received)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !proto.Equal(sent, received) {
+			t.Fatalf("sent %v, received %v", sent, received)
+		}
+	})
+}
@@ -0,0 +1,172 @@
+package test
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	serv_proto "github.com/as283-ua/yappa/api/gen/server"
+	"github.com/as283-ua/yappa/internal/client/service"
+	"github.com/as283-ua/yappa/internal/server/chat"
+	"github.com/as283-ua/yappa/pkg/common"
+	"github.com/as283-ua/yappa/test/mock"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/proto"
+)
+
+func inviteInbox(t *testing.T, username string) []byte {
+	inbox, err := chat.InviteInbox(username)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	return inbox
+}
+
+func TestBlindedInvitations(t *testing.T) {
+	setup()
+	client := GetHttp3Client(TEST_CERTS_DIR, "test_ok", DefaultChatServerArgs.Ca.Cert)
+
+	repo := chat.Repo.(*mock.MockChatRepo)
+	defer repo.Isolate()()
+
+	notify, err := proto.Marshal(&serv_proto.ChatInitNotify{Receiver: "test_ok", EncSender: []byte("sender"), KeyExchangeData: []byte{1}})
+	if !assert.NoError(t, err) {
+		return
+	}
+	resp, err := client.Post(fmt.Sprintf("https://%v/chat/notify", DefaultChatServerArgs.Addr), "application/x-protobuf", bytes.NewReader(notify))
+	if !assert.NoError(t, err) {
+		return
+	}
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// nothing stored names the receiver
+	stored := repo.GetUserInboxes()
+	assert.Len(t, stored, 1)
+	for inbox, invitations := range stored {
+		assert.Equal(t, inviteInbox(t, "test_ok"), []byte(inbox))
+		assert.NotContains(t, inbox, "test_ok")
+		for _, v := range invitations {
+			assert.NotContains(t, string(v.Inbox), "test_ok")
+		}
+	}
+	assert.NotEqual(t, inviteInbox(t, "test_ok"), inviteInbox(t, "someone"))
+
+	resp, err = client.Get(fmt.Sprintf("https://%v/chat/new", DefaultChatServerArgs.Addr))
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	raw, _ := io.ReadAll(resp.Body)
+	chats := &serv_proto.ListNewChats{}
+	assert.NoError(t, proto.Unmarshal(raw, chats))
+	if assert.Len(t, chats.Chats, 1) {
+		assert.Equal(t, []byte("sender"), chats.Chats[0].EncSender)
+	}
+	pending, _ := repo.CountNewChats(inviteInbox(t, "test_ok"))
+	assert.Zero(t, pending)
+}
+
+func TestInviteKey(t *testing.T) {
+	setup()
+
+	path := filepath.Join(t.TempDir(), "invite.key")
+	if !assert.NoError(t, chat.LoadInviteKey(path)) {
+		return
+	}
+	first := inviteInbox(t, "test_ok")
+
+	// the key is kept, pending invitations are still found after a restart
+	assert.NoError(t, chat.LoadInviteKey(path))
+	assert.Equal(t, first, inviteInbox(t, "test_ok"))
+
+	assert.NoError(t, chat.LoadInviteKey(""))
+	assert.NotEqual(t, first, inviteInbox(t, "test_ok"))
+}
+
+func TestOpenInvitation(t *testing.T) {
+	signKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if !assert.NoError(t, err) {
+		return
+	}
+	key := bytes.Repeat([]byte{3}, 32)
+	keyExchData := bytes.Repeat([]byte{4}, 64)
+	inboxId := bytes.Repeat([]byte{5}, 32)
+	notify, err := service.EncryptChatData("bob", "alice", 42, inboxId, key, keyExchData, []byte("ratchet key"), signKey)
+	if !assert.NoError(t, err) {
+		return
+	}
+	received := &serv_proto.NewChat{
+		EncSender:       notify.EncSender,
+		EncInboxCode:    notify.EncInboxId,
+		EncSign:         notify.EncSignature,
+		EncSerial:       notify.EncSerial,
+		KeyExchangeData: notify.KeyExchangeData,
+		EncRatchetKey:   notify.EncRatchetKey,
+		Version:         notify.Version,
+	}
+
+	inv, err := service.OpenInvitation(received, "bob", key)
+	if assert.NoError(t, err) {
+		assert.Equal(t, inboxId, inv.InboxId)
+		assert.Equal(t, "alice", inv.Sender)
+		assert.EqualValues(t, 42, inv.Serial)
+		assert.Equal(t, []byte("ratchet key"), inv.RatchetKey)
+		assert.NotEmpty(t, inv.Signature)
+	}
+
+	t.Run("wrong_receiver", func(t *testing.T) {
+		_, err := service.OpenInvitation(received, "mallory", key)
+		assert.Error(t, err)
+	})
+
+	t.Run("swapped_fields", func(t *testing.T) {
+		swapped := proto.Clone(received).(*serv_proto.NewChat)
+		swapped.EncSender, swapped.EncInboxCode = received.EncInboxCode, received.EncSender
+		_, err := service.OpenInvitation(swapped, "bob", key)
+		assert.Error(t, err)
+	})
+
+	t.Run("downgraded", func(t *testing.T) {
+		older := proto.Clone(received).(*serv_proto.NewChat)
+		older.Version = service.CHAT_VERSION_KEY_SEPARATION
+		_, err := service.OpenInvitation(older, "bob", key)
+		assert.Error(t, err)
+	})
+
+	t.Run("legacy", func(t *testing.T) {
+		seal := func(data []byte) []byte {
+			enc, err := common.Encrypt(data, key)
+			assert.NoError(t, err)
+			return enc
+		}
+		legacy := &serv_proto.NewChat{
+			EncSender:       seal([]byte("alice")),
+			EncInboxCode:    seal(inboxId),
+			EncSerial:       seal(binary.LittleEndian.AppendUint64(nil, 7)),
+			KeyExchangeData: keyExchData,
+		}
+		inv, err := service.OpenInvitation(legacy, "bob", key)
+		if assert.NoError(t, err) {
+			assert.Equal(t, inboxId, inv.InboxId)
+			assert.Equal(t, "alice", inv.Sender)
+			assert.EqualValues(t, 7, inv.Serial)
+			assert.Empty(t, inv.Signature)
+		}
+	})
+
+	t.Run("unsupported", func(t *testing.T) {
+		newer := proto.Clone(received).(*serv_proto.NewChat)
+		newer.Version = service.CHAT_VERSION_SEALED_INBOX + 1
+		_, err := service.OpenInvitation(newer, "bob", key)
+		assert.ErrorContains(t, err, "unsupported")
+	})
+}
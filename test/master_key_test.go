@@ -0,0 +1,176 @@
+package test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/as283-ua/yappa/internal/server/chat"
+	"github.com/as283-ua/yappa/internal/server/keys"
+	"github.com/as283-ua/yappa/pkg/common"
+	"github.com/as283-ua/yappa/test/mock"
+	"github.com/stretchr/testify/assert"
+)
+
+func tokenAD(inboxCode []byte) common.AssociatedData {
+	return common.AssociatedData{Version: common.PROTOCOL_VERSION, Label: common.LabelInboxToken, InboxId: inboxCode}
+}
+
+func senderAuthAD(inboxCode []byte) common.AssociatedData {
+	return common.AssociatedData{Version: common.PROTOCOL_VERSION, Label: common.LabelSenderAuth, InboxId: inboxCode}
+}
+
+func TestKeyring(t *testing.T) {
+	repo := mock.EmptyMockKeyRepo()
+	ring, err := keys.Load(repo, []byte("pass"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	stored, _ := repo.GetKeys()
+	if assert.Len(t, stored, 1) {
+		assert.True(t, stored[0].Active)
+		assert.NotContains(t, string(stored[0].WrappedKey), "pass")
+	}
+
+	_, err = keys.Load(repo, []byte("wrong"))
+	assert.ErrorIs(t, err, keys.ErrWrongMasterKey)
+
+	wrapped, err := ring.Wrap([]byte("secret"), tokenAD([]byte("inbox")))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.True(t, ring.IsActive(wrapped))
+
+	// the same key comes out of the database again
+	again, err := keys.Load(repo, []byte("pass"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	secret, err := again.Unwrap(wrapped, tokenAD([]byte("inbox")))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("secret"), secret)
+
+	// bound to the inbox it was wrapped for
+	_, err = again.Unwrap(wrapped, tokenAD([]byte("other")))
+	assert.Error(t, err)
+
+	first, err := ring.Secret("name")
+	if assert.NoError(t, err) {
+		assert.Len(t, first, common.KEY_SIZE)
+		second, err := again.Secret("name")
+		assert.NoError(t, err)
+		assert.Equal(t, first, second)
+	}
+}
+
+func TestRotateMasterKey(t *testing.T) {
+	setup()
+
+	repo := mock.EmptyMockKeyRepo()
+	ring, err := keys.Load(repo, []byte("old"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	secret, err := ring.Secret("name")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	chatRepo := mock.EmptyMockChatRepo()
+	prevRepo, prevRing := chat.Repo, keys.Ring
+	chat.Repo, keys.Ring = chatRepo, ring
+	defer func() { chat.Repo, keys.Ring = prevRepo, prevRing }()
+
+	wrapped, err := chat.WrapTokenHash([]byte("wrapped"), common.Hash([]byte("token")))
+	if !assert.NoError(t, err) {
+		return
+	}
+	legacy := common.Hash([]byte("legacy"))
+	for code, hash := range map[string][]byte{"wrapped": wrapped, "legacy": legacy} {
+		chatRepo.CreateChatInbox([]byte(code))
+		chatRepo.SetInboxToken([]byte(code), hash, nil, nil)
+	}
+	// the first message of each inbox expires, so there are sender auths both stored and expired
+	wrappedAuth, err := chat.WrapSenderAuth([]byte("wrapped"), common.Hash([]byte("sender")))
+	if !assert.NoError(t, err) {
+		return
+	}
+	for code, auth := range map[string][]byte{"wrapped": wrappedAuth, "legacy": common.Hash([]byte("sender"))} {
+		for serial := uint64(1); serial <= 2; serial++ {
+			chatRepo.AddMessage([]byte(code), serial, []byte("msg"), auth)
+		}
+	}
+	_, err = chatRepo.ExpireMessages(time.Time{}, 1, 1<<20)
+	assert.NoError(t, err)
+
+	_, err = keys.Rotate(repo, []byte("wrong"), []byte("new"))
+	assert.ErrorIs(t, err, keys.ErrWrongMasterKey)
+
+	newId, err := keys.Rotate(repo, []byte("old"), []byte("new"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = keys.Load(repo, []byte("old"))
+	assert.ErrorIs(t, err, keys.ErrWrongMasterKey)
+
+	ring, err = keys.Load(repo, []byte("new"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	keys.Ring = ring
+	assert.False(t, ring.IsActive(wrapped))
+
+	retired, err := ring.Reencrypt(chat.ReencryptTokens, chat.ReencryptSenderAuths)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.EqualValues(t, 1, retired)
+	stored, _ := repo.GetKeys()
+	if assert.Len(t, stored, 1) {
+		assert.Equal(t, newId, stored[0].ID)
+	}
+
+	for code, token := range map[string]string{"wrapped": "token", "legacy": "legacy"} {
+		tokenObj, err := chatRepo.GetToken([]byte(code))
+		if !assert.NoError(t, err) {
+			continue
+		}
+		assert.True(t, ring.IsActive(tokenObj.CurrentTokenHash))
+		hash, err := ring.Unwrap(tokenObj.CurrentTokenHash, tokenAD([]byte(code)))
+		assert.NoError(t, err)
+		assert.Equal(t, common.Hash([]byte(token)), hash)
+	}
+
+	stale, _ := chatRepo.StaleMessageAuths(ring.ActiveId(), 10)
+	assert.Empty(t, stale)
+	staleExpired, _ := chatRepo.StaleExpiredAuths(ring.ActiveId(), 10)
+	assert.Empty(t, staleExpired)
+	for _, code := range []string{"wrapped", "legacy"} {
+		expired, _ := chatRepo.GetExpiredMessages([]byte(code), []uint64{1})
+		if assert.Len(t, expired, 1) {
+			hash, err := ring.Unwrap(expired[0].SenderAuth, senderAuthAD([]byte(code)))
+			assert.NoError(t, err)
+			assert.Equal(t, common.Hash([]byte("sender")), hash)
+		}
+	}
+
+	secrets, _ := repo.GetSecrets()
+	if assert.Len(t, secrets, 1) {
+		assert.True(t, ring.IsActive(secrets[0].Value))
+	}
+	again, err := ring.Secret("name")
+	assert.NoError(t, err)
+	assert.Equal(t, secret, again)
+}
+
+func TestNoKeyring(t *testing.T) {
+	prevRing := keys.Ring
+	keys.Ring = nil
+	defer func() { keys.Ring = prevRing }()
+
+	_, err := chat.WrapTokenHash([]byte("inbox"), common.Hash([]byte("token")))
+	assert.ErrorIs(t, err, keys.ErrNoKeyring)
+	assert.ErrorIs(t, chat.ReencryptTokens(), keys.ErrNoKeyring)
+	_, err = chat.WrapSenderAuth([]byte("inbox"), common.Hash([]byte("token")))
+	assert.ErrorIs(t, err, keys.ErrNoKeyring)
+	assert.ErrorIs(t, chat.ReencryptSenderAuths(), keys.ErrNoKeyring)
+}
@@ -0,0 +1,53 @@
+package test
+
+import (
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/as283-ua/yappa/pkg/common"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMigratingConnWrites(t *testing.T) {
+	peer, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer peer.Close()
+	conn, err := common.ListenMigratingConn()
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// writes racing a rebind move on to the new socket instead of failing
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				_, err := conn.WriteTo([]byte("packet"), peer.LocalAddr())
+				if !assert.NoError(t, err) {
+					return
+				}
+			}
+		}()
+	}
+	for range 1000 {
+		assert.NoError(t, conn.Rebind())
+	}
+	close(done)
+	wg.Wait()
+
+	assert.NoError(t, conn.Close())
+	_, err = conn.WriteTo([]byte("packet"), peer.LocalAddr())
+	assert.ErrorIs(t, err, net.ErrClosed)
+	assert.ErrorIs(t, conn.Rebind(), net.ErrClosed)
+}
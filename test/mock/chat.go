@@ -3,15 +3,31 @@ package mock
 import (
 	"bytes"
 	"errors"
+	"slices"
+	"sort"
+	"sync"
+	"time"
 
+	"github.com/as283-ua/yappa/internal/server/chat"
 	"github.com/as283-ua/yappa/internal/server/db"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
 )
 
 type MockChatRepo struct {
+	// by blinded inbox id
 	userInboxes       map[string][]db.UserInbox
 	userInboxSerial   int
 	chatInboxes       []db.ChatInbox
 	chatInboxMessages []db.ChatInboxMessage
+	lastMessageId     int32
+	expiredMessages   []db.ExpiredMessage
+	lastExpiredId     int32
+
+	// transactions run one at a time, as if every one locked the whole repo
+	txMx *sync.Mutex
+	// guards the data above, the server writes it from its handlers while tests read it
+	mx *sync.Mutex
 }
 
 func EmptyMockChatRepo() *MockChatRepo {
@@ -20,56 +36,110 @@ func EmptyMockChatRepo() *MockChatRepo {
 		userInboxSerial:   0,
 		chatInboxes:       make([]db.ChatInbox, 0),
 		chatInboxMessages: make([]db.ChatInboxMessage, 0),
+		txMx:              &sync.Mutex{},
+		mx:                &sync.Mutex{},
 	}
 }
 
-func (r MockChatRepo) GetChatInboxes() []db.ChatInbox {
-	return r.chatInboxes
+// Empties the repo, returning a function that puts back what it held. Tests that need a repo of their own use it
+// instead of swapping chat.Repo, which the server's handlers read without a lock
+func (r *MockChatRepo) Isolate() func() {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	userInboxes, userInboxSerial, chatInboxes := r.userInboxes, r.userInboxSerial, r.chatInboxes
+	chatInboxMessages, expiredMessages := r.chatInboxMessages, r.expiredMessages
+	r.userInboxes, r.userInboxSerial, r.chatInboxes = map[string][]db.UserInbox{}, 0, make([]db.ChatInbox, 0)
+	r.chatInboxMessages, r.expiredMessages = make([]db.ChatInboxMessage, 0), nil
+	return func() {
+		r.mx.Lock()
+		defer r.mx.Unlock()
+		r.userInboxes, r.userInboxSerial, r.chatInboxes = userInboxes, userInboxSerial, chatInboxes
+		r.chatInboxMessages, r.expiredMessages = chatInboxMessages, expiredMessages
+	}
 }
 
-func (r MockChatRepo) GetUserInboxes() map[string][]db.UserInbox {
-	return r.userInboxes
+func (r *MockChatRepo) GetChatInboxes() []db.ChatInbox {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	return append([]db.ChatInbox{}, r.chatInboxes...)
 }
 
-func (r *MockChatRepo) ShareChatInbox(username string, encSender, encInboxCode, encSignature, encSerial, keyExchangeData []byte) error {
-	r.userInboxes[username] = append(r.userInboxes[username], db.UserInbox{
+func (r *MockChatRepo) GetUserInboxes() map[string][]db.UserInbox {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	inboxes := make(map[string][]db.UserInbox, len(r.userInboxes))
+	for inbox, invitations := range r.userInboxes {
+		inboxes[inbox] = append([]db.UserInbox{}, invitations...)
+	}
+	return inboxes
+}
+
+func (r *MockChatRepo) ShareChatInbox(inbox []byte, encSender, encInboxCode, encSignature, encSerial, keyExchangeData, encRatchetKey []byte, version uint32) error {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	r.userInboxes[string(inbox)] = append(r.userInboxes[string(inbox)], db.UserInbox{
 		ID:              int32(r.userInboxSerial),
-		Username:        username,
+		Inbox:           inbox,
 		EncSender:       encSender,
 		EncInboxCode:    encInboxCode,
 		KeyExchangeData: keyExchangeData,
 		EncSignature:    encSignature,
 		EncSerial:       encSerial,
+		EncRatchetKey:   encRatchetKey,
+		Version:         int32(version),
+		CreatedAt:       pgtype.Timestamptz{Time: time.Now(), Valid: true},
 	})
 	r.userInboxSerial++
 	return nil
 }
 
 func (r *MockChatRepo) CreateChatInbox(inboxCode []byte) error {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	return r.createChatInbox(inboxCode)
+}
+
+func (r *MockChatRepo) createChatInbox(inboxCode []byte) error {
 	r.chatInboxes = append(r.chatInboxes, db.ChatInbox{
-		Code: inboxCode,
+		Code:      inboxCode,
+		CreatedAt: pgtype.Timestamptz{Time: time.Now(), Valid: true},
 	})
 	return nil
 }
 
-func (r MockChatRepo) GetNewChats(username string) ([]db.GetNewUserInboxesRow, error) {
+func (r *MockChatRepo) GetNewChats(inbox []byte) ([]db.GetNewUserInboxesRow, error) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
 	result := []db.GetNewUserInboxesRow{}
-	for _, v := range r.userInboxes[username] {
+	for _, v := range r.userInboxes[string(inbox)] {
 		result = append(result, db.GetNewUserInboxesRow{
 			EncInboxCode:    v.EncInboxCode,
 			EncSender:       v.EncSender,
 			KeyExchangeData: v.KeyExchangeData,
+			EncRatchetKey:   v.EncRatchetKey,
+			Version:         v.Version,
+			CreatedAt:       v.CreatedAt,
 		})
 	}
 	return result, nil
 }
 
-func (r *MockChatRepo) DeleteNewChats(username string) error {
-	r.userInboxes[username] = []db.UserInbox{}
+func (r *MockChatRepo) DeleteNewChats(inbox []byte) error {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	r.userInboxes[string(inbox)] = []db.UserInbox{}
 	return nil
 }
 
+func (r *MockChatRepo) CountNewChats(inbox []byte) (int64, error) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	return int64(len(r.userInboxes[string(inbox)])), nil
+}
+
 func (r *MockChatRepo) SetInboxToken(inboxCode, tokenHash, encToken, keyExchangeData []byte) error {
+	r.mx.Lock()
+	defer r.mx.Unlock()
 	idx := -1
 	for i, v := range r.chatInboxes {
 		if bytes.Equal(v.Code, inboxCode) {
@@ -80,39 +150,59 @@ func (r *MockChatRepo) SetInboxToken(inboxCode, tokenHash, encToken, keyExchange
 	if idx != -1 {
 		r.chatInboxes[idx].CurrentTokenHash = tokenHash
 		r.chatInboxes[idx].EncToken = encToken
+		r.chatInboxes[idx].KeyExchangeData = keyExchangeData
 	} else {
 		return errors.New("inbox not found")
 	}
 	return nil
 }
 
-func (r MockChatRepo) GetToken(inboxCode []byte) (db.GetInboxTokenRow, error) {
+func (r *MockChatRepo) GetToken(inboxCode []byte) (db.GetInboxTokenRow, error) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	return r.getToken(inboxCode)
+}
+
+func (r *MockChatRepo) getToken(inboxCode []byte) (db.GetInboxTokenRow, error) {
 	for _, v := range r.chatInboxes {
 		if bytes.Equal(v.Code, inboxCode) {
 			return db.GetInboxTokenRow{
 				CurrentTokenHash: v.CurrentTokenHash,
 				EncToken:         v.EncToken,
+				KeyExchangeData:  v.KeyExchangeData,
 			}, nil
 		}
 	}
 
-	return db.GetInboxTokenRow{}, errors.New("inbox not found")
+	return db.GetInboxTokenRow{}, pgx.ErrNoRows
 }
 
-func (r *MockChatRepo) AddMessage(inboxCode []byte, serial uint64, encMsg []byte) error {
-	_, err := r.GetToken(inboxCode)
+func (r *MockChatRepo) AddMessage(inboxCode []byte, serial uint64, encMsg, senderAuth []byte) error {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	_, err := r.getToken(inboxCode)
 	if err != nil {
 		return err
 	}
+	r.lastMessageId++
 	r.chatInboxMessages = append(r.chatInboxMessages, db.ChatInboxMessage{
-		InboxCode: inboxCode,
-		EncMsg:    encMsg,
-		SerialN:   int64(serial),
+		ID:         r.lastMessageId,
+		InboxCode:  inboxCode,
+		EncMsg:     encMsg,
+		SerialN:    int64(serial),
+		SenderAuth: senderAuth,
+		CreatedAt:  pgtype.Timestamptz{Time: time.Now(), Valid: true},
 	})
 	return nil
 }
 
-func (r MockChatRepo) GetMessages(inboxCode []byte) ([]db.GetMessagesRow, error) {
+func (r *MockChatRepo) GetMessages(inboxCode []byte) ([]db.GetMessagesRow, error) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	return r.getMessages(inboxCode)
+}
+
+func (r *MockChatRepo) getMessages(inboxCode []byte) ([]db.GetMessagesRow, error) {
 	result := make([]db.GetMessagesRow, 0)
 	for _, v := range r.chatInboxMessages {
 		if bytes.Equal(v.InboxCode, inboxCode) {
@@ -125,7 +215,31 @@ func (r MockChatRepo) GetMessages(inboxCode []byte) ([]db.GetMessagesRow, error)
 	return result, nil
 }
 
+func (r *MockChatRepo) GetMessagesPage(inboxCode []byte, from int32, limit int32) ([]db.GetMessagesPageRow, error) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	result := make([]db.GetMessagesPageRow, 0)
+	for _, v := range r.chatInboxMessages {
+		if bytes.Equal(v.InboxCode, inboxCode) && v.ID >= from {
+			result = append(result, db.GetMessagesPageRow{
+				ID:      v.ID,
+				EncMsg:  v.EncMsg,
+				SerialN: v.SerialN,
+			})
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].ID < result[j].ID
+	})
+	if len(result) > int(limit) {
+		result = result[:limit]
+	}
+	return result, nil
+}
+
 func (r *MockChatRepo) FlushInbox(inboxCode []byte) error {
+	r.mx.Lock()
+	defer r.mx.Unlock()
 	newList := make([]db.ChatInboxMessage, 0)
 	for _, v := range r.chatInboxMessages {
 		if !bytes.Equal(v.InboxCode, inboxCode) {
@@ -135,3 +249,216 @@ func (r *MockChatRepo) FlushInbox(inboxCode []byte) error {
 	r.chatInboxMessages = newList
 	return nil
 }
+
+func (r *MockChatRepo) InTx(fn func(tx chat.ChatRepo) error) error {
+	r.txMx.Lock()
+	defer r.txMx.Unlock()
+	return fn(r)
+}
+
+func (r *MockChatRepo) LockInbox(inboxCode []byte) (db.GetInboxTokenRow, error) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	return r.getToken(inboxCode)
+}
+
+func (r *MockChatRepo) LockOrCreateInbox(inboxCode []byte) (db.GetInboxTokenRow, error) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	token, err := r.getToken(inboxCode)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return token, r.createChatInbox(inboxCode)
+	}
+	return token, err
+}
+
+func (r *MockChatRepo) CountMessages(inboxCode []byte) (int64, error) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	msgs, err := r.getMessages(inboxCode)
+	return int64(len(msgs)), err
+}
+
+func (r *MockChatRepo) DeleteMessagesUpTo(inboxCode []byte, id int32) (int64, error) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	newList := make([]db.ChatInboxMessage, 0)
+	for _, v := range r.chatInboxMessages {
+		if !bytes.Equal(v.InboxCode, inboxCode) || v.ID > id {
+			newList = append(newList, v)
+		}
+	}
+	deleted := len(r.chatInboxMessages) - len(newList)
+	r.chatInboxMessages = newList
+	return int64(deleted), nil
+}
+
+func (r *MockChatRepo) ExpireMessages(before time.Time, maxMessages, maxBytes int64) (int64, error) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	newestFirst := make([]db.ChatInboxMessage, len(r.chatInboxMessages))
+	copy(newestFirst, r.chatInboxMessages)
+	sort.SliceStable(newestFirst, func(i, j int) bool {
+		return newestFirst[i].ID > newestFirst[j].ID
+	})
+
+	counts := make(map[string]int64)
+	sizes := make(map[string]int64)
+	kept := make([]db.ChatInboxMessage, 0)
+	for _, v := range newestFirst {
+		inbox := string(v.InboxCode)
+		counts[inbox]++
+		sizes[inbox] += int64(len(v.EncMsg))
+		if v.CreatedAt.Time.Before(before) || counts[inbox] > maxMessages || sizes[inbox] > maxBytes {
+			r.expiredMessages = append(r.expiredMessages, db.ExpiredMessage{
+				ID:         r.nextExpiredId(),
+				InboxCode:  v.InboxCode,
+				SerialN:    v.SerialN,
+				SenderAuth: v.SenderAuth,
+				ExpiredAt:  pgtype.Timestamptz{Time: time.Now(), Valid: true},
+			})
+			continue
+		}
+		kept = append(kept, v)
+	}
+	expired := len(r.chatInboxMessages) - len(kept)
+	r.chatInboxMessages = kept
+	return int64(expired), nil
+}
+
+func (r *MockChatRepo) ExpireInvitations(before time.Time) (int64, error) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	var expired int64
+	for inbox, invitations := range r.userInboxes {
+		kept := make([]db.UserInbox, 0)
+		for _, v := range invitations {
+			if v.CreatedAt.Time.Before(before) {
+				expired++
+				continue
+			}
+			kept = append(kept, v)
+		}
+		r.userInboxes[inbox] = kept
+	}
+	return expired, nil
+}
+
+func (r *MockChatRepo) ForgetExpiredMessages(before time.Time) (int64, error) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	kept := make([]db.ExpiredMessage, 0)
+	for _, v := range r.expiredMessages {
+		if !v.ExpiredAt.Time.Before(before) {
+			kept = append(kept, v)
+		}
+	}
+	forgotten := len(r.expiredMessages) - len(kept)
+	r.expiredMessages = kept
+	return int64(forgotten), nil
+}
+
+func (r *MockChatRepo) GetExpiredMessages(inboxCode []byte, serials []uint64) ([]db.GetExpiredMessagesRow, error) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	result := make([]db.GetExpiredMessagesRow, 0)
+	for _, v := range r.expiredMessages {
+		if bytes.Equal(v.InboxCode, inboxCode) && v.SenderAuth != nil && slices.Contains(serials, uint64(v.SerialN)) {
+			result = append(result, db.GetExpiredMessagesRow{SerialN: v.SerialN, SenderAuth: v.SenderAuth})
+		}
+	}
+	return result, nil
+}
+
+func (r *MockChatRepo) DeleteEmptyInboxes(before time.Time) (int64, error) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	kept := make([]db.ChatInbox, 0)
+	for _, v := range r.chatInboxes {
+		msgs, _ := r.getMessages(v.Code)
+		if len(msgs) != 0 || !v.CreatedAt.Time.Before(before) {
+			kept = append(kept, v)
+		}
+	}
+	deleted := len(r.chatInboxes) - len(kept)
+	r.chatInboxes = kept
+	return int64(deleted), nil
+}
+
+func (r *MockChatRepo) StaleTokens(keyId []byte, limit int32) ([]db.ListStaleInboxTokensRow, error) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	result := make([]db.ListStaleInboxTokensRow, 0)
+	for _, v := range r.chatInboxes {
+		if v.CurrentTokenHash != nil && !bytes.HasPrefix(v.CurrentTokenHash, keyId) && len(result) < int(limit) {
+			result = append(result, db.ListStaleInboxTokensRow{Code: v.Code, CurrentTokenHash: v.CurrentTokenHash})
+		}
+	}
+	return result, nil
+}
+
+func (r *MockChatRepo) RewrapToken(inboxCode, old, tokenHash []byte) (bool, error) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	for i, v := range r.chatInboxes {
+		if bytes.Equal(v.Code, inboxCode) && bytes.Equal(v.CurrentTokenHash, old) {
+			r.chatInboxes[i].CurrentTokenHash = tokenHash
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Called with mx held
+func (r *MockChatRepo) nextExpiredId() int32 {
+	r.lastExpiredId++
+	return r.lastExpiredId
+}
+
+func (r *MockChatRepo) StaleMessageAuths(keyId []byte, limit int32) ([]db.ListStaleMessageAuthsRow, error) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	result := make([]db.ListStaleMessageAuthsRow, 0)
+	for _, v := range r.chatInboxMessages {
+		if v.SenderAuth != nil && !bytes.HasPrefix(v.SenderAuth, keyId) && len(result) < int(limit) {
+			result = append(result, db.ListStaleMessageAuthsRow{ID: v.ID, InboxCode: v.InboxCode, SenderAuth: v.SenderAuth})
+		}
+	}
+	return result, nil
+}
+
+func (r *MockChatRepo) RewrapMessageAuth(id int32, old, senderAuth []byte) (bool, error) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	for i, v := range r.chatInboxMessages {
+		if v.ID == id && bytes.Equal(v.SenderAuth, old) {
+			r.chatInboxMessages[i].SenderAuth = senderAuth
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (r *MockChatRepo) StaleExpiredAuths(keyId []byte, limit int32) ([]db.ListStaleExpiredAuthsRow, error) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	result := make([]db.ListStaleExpiredAuthsRow, 0)
+	for _, v := range r.expiredMessages {
+		if v.SenderAuth != nil && !bytes.HasPrefix(v.SenderAuth, keyId) && len(result) < int(limit) {
+			result = append(result, db.ListStaleExpiredAuthsRow{ID: v.ID, InboxCode: v.InboxCode, SenderAuth: v.SenderAuth})
+		}
+	}
+	return result, nil
+}
+
+func (r *MockChatRepo) RewrapExpiredAuth(id int32, old, senderAuth []byte) (bool, error) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	for i, v := range r.expiredMessages {
+		if v.ID == id && bytes.Equal(v.SenderAuth, old) {
+			r.expiredMessages[i].SenderAuth = senderAuth
+			return true, nil
+		}
+	}
+	return false, nil
+}
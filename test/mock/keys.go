@@ -0,0 +1,94 @@
+package mock
+
+import (
+	"bytes"
+	"slices"
+	"sync"
+
+	"github.com/as283-ua/yappa/internal/server/db"
+	"github.com/as283-ua/yappa/internal/server/keys"
+)
+
+type MockKeyRepo struct {
+	keys    []db.ServerKey
+	secrets []db.ServerSecret
+	nextId  int32
+
+	// transactions run one at a time, as if every one locked the whole repo
+	txMx *sync.Mutex
+}
+
+func EmptyMockKeyRepo() *MockKeyRepo {
+	return &MockKeyRepo{
+		keys:    make([]db.ServerKey, 0),
+		secrets: make([]db.ServerSecret, 0),
+		nextId:  1,
+		txMx:    &sync.Mutex{},
+	}
+}
+
+func (r *MockKeyRepo) GetKeys() ([]db.ServerKey, error) {
+	return slices.Clone(r.keys), nil
+}
+
+func (r *MockKeyRepo) AddKey(key db.ServerKey) (int32, error) {
+	key.ID = r.nextId
+	key.Active = false
+	r.nextId++
+	r.keys = append(r.keys, key)
+	return key.ID, nil
+}
+
+func (r *MockKeyRepo) RewrapKey(key db.ServerKey) error {
+	for i, v := range r.keys {
+		if v.ID == key.ID {
+			r.keys[i].Salt = key.Salt
+			r.keys[i].TimeCost = key.TimeCost
+			r.keys[i].MemoryKib = key.MemoryKib
+			r.keys[i].Threads = key.Threads
+			r.keys[i].WrappedKey = key.WrappedKey
+		}
+	}
+	return nil
+}
+
+func (r *MockKeyRepo) ActivateKey(id int32) error {
+	for i, v := range r.keys {
+		r.keys[i].Active = v.ID == id
+	}
+	return nil
+}
+
+func (r *MockKeyRepo) DeleteInactiveKeys() (int64, error) {
+	before := len(r.keys)
+	r.keys = slices.DeleteFunc(r.keys, func(k db.ServerKey) bool { return !k.Active })
+	return int64(before - len(r.keys)), nil
+}
+
+func (r *MockKeyRepo) GetSecrets() ([]db.ServerSecret, error) {
+	return slices.Clone(r.secrets), nil
+}
+
+func (r *MockKeyRepo) AddSecret(name string, value []byte) error {
+	if slices.ContainsFunc(r.secrets, func(s db.ServerSecret) bool { return s.Name == name }) {
+		return nil
+	}
+	r.secrets = append(r.secrets, db.ServerSecret{Name: name, Value: value})
+	return nil
+}
+
+func (r *MockKeyRepo) RewrapSecret(name string, old, value []byte) (bool, error) {
+	for i, v := range r.secrets {
+		if v.Name == name && bytes.Equal(v.Value, old) {
+			r.secrets[i].Value = value
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (r *MockKeyRepo) InTx(fn func(tx keys.KeyRepo) error) error {
+	r.txMx.Lock()
+	defer r.txMx.Unlock()
+	return fn(r)
+}
@@ -0,0 +1,84 @@
+package mock
+
+import (
+	"sync"
+	"time"
+
+	"github.com/as283-ua/yappa/api/gen/server"
+	"github.com/as283-ua/yappa/internal/server/db"
+	"github.com/as283-ua/yappa/internal/server/report"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+type MockReportRepo struct {
+	reports  []db.Report
+	evidence map[int32][]db.GetReportEvidenceRow
+
+	mx *sync.Mutex
+}
+
+func EmptyMockReportRepo() *MockReportRepo {
+	return &MockReportRepo{
+		reports:  make([]db.Report, 0),
+		evidence: map[int32][]db.GetReportEvidenceRow{},
+		mx:       &sync.Mutex{},
+	}
+}
+
+func (r *MockReportRepo) CreateReport(reporter, reported string, reason int32, comment string, evidence []*server.ReportEvidence) (int32, error) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	id := int32(len(r.reports) + 1)
+	r.reports = append(r.reports, db.Report{
+		ID:        id,
+		Reporter:  reporter,
+		Reported:  reported,
+		Reason:    reason,
+		Comment:   comment,
+		Status:    report.STATUS_OPEN,
+		CreatedAt: pgtype.Timestamptz{Time: time.Now(), Valid: true},
+	})
+	for _, ev := range evidence {
+		r.evidence[id] = append(r.evidence[id], db.GetReportEvidenceRow{Event: ev.Event, Signature: ev.Signature})
+	}
+	return id, nil
+}
+
+func (r *MockReportRepo) ListReports(status string, limit int32) ([]db.Report, error) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	reports := make([]db.Report, 0)
+	for _, v := range r.reports {
+		if v.Status == status && len(reports) < int(limit) {
+			reports = append(reports, v)
+		}
+	}
+	return reports, nil
+}
+
+func (r *MockReportRepo) GetReport(id int32) (db.Report, error) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	if id < 1 || int(id) > len(r.reports) {
+		return db.Report{}, pgx.ErrNoRows
+	}
+	return r.reports[id-1], nil
+}
+
+func (r *MockReportRepo) GetEvidence(id int32) ([]db.GetReportEvidenceRow, error) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	return r.evidence[id], nil
+}
+
+func (r *MockReportRepo) ResolveReport(id int32, status string) (bool, error) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	if id < 1 || int(id) > len(r.reports) || r.reports[id-1].Status != report.STATUS_OPEN {
+		return false, nil
+	}
+	r.reports[id-1].Status = status
+	r.reports[id-1].ResolvedAt = pgtype.Timestamptz{Time: time.Now(), Valid: true}
+	return true, nil
+}
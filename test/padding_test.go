@@ -0,0 +1,125 @@
+package test
+
+import (
+	"bytes"
+	"crypto/mlkem"
+	"strings"
+	"testing"
+	"time"
+
+	cli_proto "github.com/as283-ua/yappa/api/gen/client"
+	serv_proto "github.com/as283-ua/yappa/api/gen/server"
+	"github.com/as283-ua/yappa/internal/client/service"
+	"github.com/as283-ua/yappa/pkg/common"
+	"github.com/stretchr/testify/assert"
+)
+
+func hashChainChat() *cli_proto.Chat {
+	return &cli_proto.Chat{
+		Version: service.CHAT_VERSION_HASH_CHAIN,
+		Key:     bytes.Repeat([]byte{5}, common.KEY_SIZE),
+		Peer:    &cli_proto.PeerData{Username: "bob", InboxId: bytes.Repeat([]byte{1}, 32)},
+	}
+}
+
+func TestPaddedSize(t *testing.T) {
+	for _, n := range []int{0, 1, 100, service.PAD_MIN_SIZE} {
+		assert.Equal(t, service.PAD_MIN_SIZE, service.PaddedSize(n))
+	}
+	prev := service.PAD_MIN_SIZE
+	for n := service.PAD_MIN_SIZE + 1; n < 1<<20; n += 97 {
+		size := service.PaddedSize(n)
+		assert.GreaterOrEqual(t, size, n)
+		assert.GreaterOrEqual(t, size, prev)
+		// padmé wastes under 12%
+		assert.Less(t, float64(size-n)/float64(n), 0.12)
+		prev = size
+	}
+}
+
+func TestPaddedEvents(t *testing.T) {
+	decrypt := func(chat *cli_proto.Chat, msg *serv_proto.SendMsg) *cli_proto.ClientEvent {
+		peerEvent, err := service.DecryptPeerMessage(chat, &serv_proto.ServerMessage_Send{
+			Send: &serv_proto.ReceiveMsg{Serial: msg.Serial, InboxId: msg.InboxId, EncData: msg.Message},
+		})
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		return peerEvent.Event
+	}
+
+	encap, err := mlkem.GenerateKey1024()
+	if !assert.NoError(t, err) {
+		return
+	}
+	rotation, _, _, err := service.KeyExchangeEvent(hashChainChat(), encap.EncapsulationKey())
+	if !assert.NoError(t, err) {
+		return
+	}
+	short, _, err := service.EncryptMessageForPeer(hashChainChat(), "hi")
+	if !assert.NoError(t, err) {
+		return
+	}
+	longer, _, err := service.EncryptMessageForPeer(hashChainChat(), strings.Repeat("a", 1000))
+	if !assert.NoError(t, err) {
+		return
+	}
+	receipt, _, err := service.EncryptReceiptForPeer(hashChainChat(), cli_proto.ReceiptType_RECEIPT_READ, []uint64{1, 2, 3})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// nothing tells them apart by size
+	for _, msg := range []*serv_proto.SendMsg{short, longer, receipt} {
+		assert.Equal(t, len(rotation.Message), len(msg.Message))
+	}
+
+	t.Run("unpadded", func(t *testing.T) {
+		event := decrypt(hashChainChat(), short)
+		assert.Equal(t, "hi", event.GetMessage().Msg)
+		assert.Empty(t, event.Padding)
+		assert.NotNil(t, decrypt(hashChainChat(), rotation).GetKeyRotation())
+	})
+
+	t.Run("large", func(t *testing.T) {
+		txt := strings.Repeat("b", 5000)
+		msg, _, err := service.EncryptMessageForPeer(hashChainChat(), txt)
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Greater(t, len(msg.Message), len(rotation.Message))
+		assert.Equal(t, txt, decrypt(hashChainChat(), msg).GetMessage().Msg)
+	})
+
+	t.Run("every_length", func(t *testing.T) {
+		// also where the padding's own length takes one byte more than is left for it
+		overhead := len(short.Message) - service.PAD_MIN_SIZE
+		for n := 0; n < 20000; n++ {
+			txt := strings.Repeat("c", n)
+			msg, _, err := service.EncryptMessageForPeer(hashChainChat(), txt)
+			if !assert.NoError(t, err) {
+				return
+			}
+			size := len(msg.Message) - overhead
+			if !assert.Equal(t, service.PaddedSize(size), size, "length %v", n) {
+				return
+			}
+			if !assert.Equal(t, txt, decrypt(hashChainChat(), msg).GetMessage().Msg) {
+				return
+			}
+		}
+	})
+
+	t.Run("ephemeral", func(t *testing.T) {
+		alice, bob := ephemeralChats()
+		msg, err := service.EncryptEphemeralForPeer(alice, typingEvent("alice", time.Now()))
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Equal(t, len(rotation.Message), len(msg.Message))
+		event, err := service.DecryptEphemeral(bob, &serv_proto.ReceiveMsg{EncData: msg.Message, Ephemeral: true})
+		if assert.NoError(t, err) {
+			assert.Empty(t, event.Padding)
+		}
+	})
+}
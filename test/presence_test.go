@@ -0,0 +1,176 @@
+package test
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	cli_proto "github.com/as283-ua/yappa/api/gen/client"
+	serv_proto "github.com/as283-ua/yappa/api/gen/server"
+	"github.com/as283-ua/yappa/internal/client/service"
+	"github.com/as283-ua/yappa/internal/server/connection"
+	"github.com/as283-ua/yappa/pkg/common"
+	"github.com/stretchr/testify/assert"
+)
+
+// Presence updates written to the stream so far
+func presenceUpdates(s *bufferStream) []*serv_proto.PresenceUpdate {
+	s.mx.Lock()
+	raw := bytes.Clone(s.buf.Bytes())
+	s.mx.Unlock()
+
+	updates := make([]*serv_proto.PresenceUpdate, 0)
+	reader := common.NewFrameReader(bytes.NewReader(raw), 0)
+	for {
+		msg := &serv_proto.ServerMessage{}
+		if reader.ReadMsg(msg) != nil {
+			return updates
+		}
+		if update := msg.GetPresence(); update != nil {
+			updates = append(updates, update)
+		}
+	}
+}
+
+func waitUpdates(t *testing.T, s *bufferStream, n int) []*serv_proto.PresenceUpdate {
+	assert.Eventually(t, func() bool { return len(presenceUpdates(s)) >= n }, time.Second, 10*time.Millisecond)
+	return presenceUpdates(s)
+}
+
+func TestPresence(t *testing.T) {
+	token := []byte("token shared by alice and bob")
+	other := []byte("token of another chat")
+
+	t.Run("online_and_offline", func(t *testing.T) {
+		m := connection.NewSessionManager()
+		p := connection.NewPresenceRegistry()
+		aliceStr, bobStr := &bufferStream{}, &bufferStream{}
+		alice := m.Add("alice", aliceStr)
+		bob := m.Add("bob", bobStr)
+
+		p.Announce(alice, [][]byte{token, other})
+		updates := waitUpdates(t, aliceStr, 1)
+		assert.Empty(t, updates[0].Online)
+
+		p.Announce(bob, [][]byte{token})
+		updates = waitUpdates(t, bobStr, 1)
+		assert.Equal(t, [][]byte{token}, updates[0].Online)
+		updates = waitUpdates(t, aliceStr, 2)
+		assert.Equal(t, [][]byte{token}, updates[1].Online)
+
+		p.Remove(bob)
+		updates = waitUpdates(t, aliceStr, 3)
+		assert.Equal(t, [][]byte{token}, updates[2].Offline)
+		assert.Empty(t, p.Query(alice, [][]byte{token}))
+	})
+
+	t.Run("same_user_sessions", func(t *testing.T) {
+		m := connection.NewSessionManager()
+		p := connection.NewPresenceRegistry()
+		aliceStr := &bufferStream{}
+		alice := m.Add("alice", aliceStr)
+		phone := m.Add("bob", &bufferStream{})
+		laptop := m.Add("bob", &bufferStream{})
+
+		p.Announce(alice, [][]byte{token})
+		p.Announce(phone, [][]byte{token})
+		p.Announce(laptop, [][]byte{token})
+		waitUpdates(t, aliceStr, 2)
+
+		// bob is still online through the laptop
+		p.Remove(phone)
+		assert.Equal(t, [][]byte{token}, p.Query(alice, [][]byte{token}))
+		p.Remove(laptop)
+		updates := waitUpdates(t, aliceStr, 3)
+		assert.Len(t, updates, 3)
+		assert.Equal(t, [][]byte{token}, updates[2].Offline)
+	})
+
+	t.Run("query_needs_own_token", func(t *testing.T) {
+		m := connection.NewSessionManager()
+		p := connection.NewPresenceRegistry()
+		alice := m.Add("alice", &bufferStream{})
+		bob := m.Add("bob", &bufferStream{})
+		carol := m.Add("carol", &bufferStream{})
+
+		p.Announce(alice, [][]byte{token})
+		p.Announce(bob, [][]byte{token})
+		assert.Equal(t, [][]byte{token}, p.Query(bob, [][]byte{token, other}))
+		assert.Empty(t, p.Query(carol, [][]byte{token}))
+
+		// turning presence off also hides the others
+		p.Announce(bob, nil)
+		assert.Empty(t, p.Query(bob, [][]byte{token}))
+		assert.Empty(t, p.Query(alice, [][]byte{token}))
+	})
+}
+
+func ephemeralChats() (alice *cli_proto.Chat, bob *cli_proto.Chat) {
+	key := bytes.Repeat([]byte{7}, common.KEY_SIZE)
+	inboxId := bytes.Repeat([]byte{1}, 32)
+	alice = &cli_proto.Chat{
+		Version:      service.CHAT_VERSION_KEY_SEPARATION,
+		EphemeralKey: key,
+		Peer:         &cli_proto.PeerData{Username: "bob", InboxId: inboxId},
+	}
+	bob = &cli_proto.Chat{
+		Version:      service.CHAT_VERSION_KEY_SEPARATION,
+		EphemeralKey: key,
+		Peer:         &cli_proto.PeerData{Username: "alice", InboxId: inboxId},
+	}
+	return alice, bob
+}
+
+func typingEvent(sender string, sent time.Time) *cli_proto.ClientEvent {
+	return &cli_proto.ClientEvent{
+		Timestamp: uint64(sent.Unix()),
+		Sender:    sender,
+		Payload:   &cli_proto.ClientEvent_Typing{Typing: &cli_proto.Typing{Typing: true}},
+	}
+}
+
+func TestEphemeralEvents(t *testing.T) {
+	t.Run("round_trip", func(t *testing.T) {
+		alice, bob := ephemeralChats()
+		msg, err := service.EncryptEphemeralForPeer(alice, typingEvent("alice", time.Now()))
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.True(t, msg.Ephemeral)
+		assert.Equal(t, "bob", msg.Receiver)
+
+		event, err := service.DecryptEphemeral(bob, &serv_proto.ReceiveMsg{InboxId: msg.InboxId, EncData: msg.Message, Ephemeral: true})
+		if assert.NoError(t, err) {
+			assert.True(t, event.GetTyping().Typing)
+		}
+		// both members derive the same token
+		assert.Equal(t, service.PresenceToken(alice), service.PresenceToken(bob))
+	})
+
+	t.Run("rejects_bad_events", func(t *testing.T) {
+		alice, bob := ephemeralChats()
+
+		msg, err := service.EncryptEphemeralForPeer(alice, typingEvent("mallory", time.Now()))
+		if assert.NoError(t, err) {
+			_, err = service.DecryptEphemeral(bob, &serv_proto.ReceiveMsg{EncData: msg.Message})
+			assert.Error(t, err)
+		}
+
+		msg, err = service.EncryptEphemeralForPeer(alice, typingEvent("alice", time.Now().Add(-time.Minute)))
+		if assert.NoError(t, err) {
+			_, err = service.DecryptEphemeral(bob, &serv_proto.ReceiveMsg{EncData: msg.Message})
+			assert.Error(t, err)
+		}
+
+		_, err = service.EncryptEphemeralForPeer(alice, &cli_proto.ClientEvent{
+			Sender:  "alice",
+			Payload: &cli_proto.ClientEvent_Message{Message: &cli_proto.ChatMessage{Msg: "hi"}},
+		})
+		assert.Error(t, err)
+
+		alice.EphemeralKey = nil
+		_, err = service.EncryptEphemeralForPeer(alice, typingEvent("alice", time.Now()))
+		assert.ErrorIs(t, err, service.ErrNoEphemeralKey)
+		assert.Nil(t, service.PresenceToken(alice))
+	})
+}
@@ -0,0 +1,186 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	serv_proto "github.com/as283-ua/yappa/api/gen/server"
+	"github.com/as283-ua/yappa/internal/server/chat"
+	"github.com/as283-ua/yappa/internal/server/ratelimit"
+	"github.com/as283-ua/yappa/internal/server/settings"
+	"github.com/as283-ua/yappa/pkg/common"
+	"github.com/as283-ua/yappa/test/mock"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestLimiter(t *testing.T) {
+	now := time.Unix(1000, 0)
+	l := ratelimit.NewLimiter(settings.LimitsCfg{
+		Rates: map[string]settings.RateCfg{
+			settings.LIMIT_CHAT_INIT: {Rate: 1, Burst: 2},
+			settings.LIMIT_USERS:     {Rate: -1, Burst: 1},
+		},
+	})
+	l.Now = func() time.Time { return now }
+
+	t.Run("burst_then_refill", func(t *testing.T) {
+		for range 2 {
+			ok, _ := l.Allow("alice", settings.LIMIT_CHAT_INIT)
+			assert.True(t, ok)
+		}
+		ok, wait := l.Allow("alice", settings.LIMIT_CHAT_INIT)
+		assert.False(t, ok)
+		assert.Equal(t, time.Second, wait)
+
+		// other users have their own buckets
+		ok, _ = l.Allow("bob", settings.LIMIT_CHAT_INIT)
+		assert.True(t, ok)
+
+		now = now.Add(time.Second)
+		ok, _ = l.Allow("alice", settings.LIMIT_CHAT_INIT)
+		assert.True(t, ok)
+		ok, _ = l.Allow("alice", settings.LIMIT_CHAT_INIT)
+		assert.False(t, ok)
+	})
+
+	t.Run("disabled_and_defaults", func(t *testing.T) {
+		for range 10 {
+			ok, _ := l.Allow("alice", settings.LIMIT_USERS)
+			assert.True(t, ok)
+		}
+		for range settings.DEFAULT_RATES[settings.LIMIT_PRESENCE].Burst {
+			ok, _ := l.Allow("alice", settings.LIMIT_PRESENCE)
+			assert.True(t, ok)
+		}
+		ok, _ := l.Allow("alice", settings.LIMIT_PRESENCE)
+		assert.False(t, ok)
+
+		var none *ratelimit.Limiter
+		ok, _ = none.Allow("alice", settings.LIMIT_PRESENCE)
+		assert.True(t, ok)
+	})
+}
+
+// Replaces the server's limits for the rest of the test. The limiter itself stays, handlers still running read it
+func useLimits(t *testing.T, rates map[string]settings.RateCfg) {
+	prev := ratelimit.Limits.Configure(settings.LimitsCfg{Rates: rates})
+	t.Cleanup(func() { ratelimit.Limits.Configure(prev) })
+}
+
+func TestRateLimits(t *testing.T) {
+	setup()
+	client := GetHttp3Client(TEST_CERTS_DIR, "test_ok", DefaultChatServerArgs.Ca.Cert)
+
+	t.Run("endpoint", func(t *testing.T) {
+		useLimits(t, map[string]settings.RateCfg{settings.LIMIT_USERS: {Rate: 0.001, Burst: 1}})
+
+		url := fmt.Sprintf("https://%v/users", DefaultChatServerArgs.Addr)
+		resp, err := client.Get(url)
+		if !assert.NoError(t, err) {
+			return
+		}
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		resp, err = client.Get(url)
+		if !assert.NoError(t, err) {
+			return
+		}
+		resp.Body.Close()
+		assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+		assert.NotEmpty(t, resp.Header.Get("Retry-After"))
+	})
+
+	t.Run("stream", func(t *testing.T) {
+		useLimits(t, map[string]settings.RateCfg{
+			settings.LIMIT_SEND:     {Rate: 0.001, Burst: 1},
+			settings.LIMIT_PRESENCE: {Rate: 0.001, Burst: 1},
+		})
+
+		u, err := url.Parse("https://" + DefaultChatServerArgs.Addr + "/connect")
+		if !assert.NoError(t, err) {
+			return
+		}
+		str, err := common.Http3Stream(context.Background(), u, client.Transport.(*http3.Transport), http.Header{})
+		if !assert.NoError(t, err) {
+			return
+		}
+		defer str.Close()
+
+		send := func(msg *serv_proto.ClientMessage) {
+			frame, err := common.EncodeFrame(msg, 1<<20)
+			if assert.NoError(t, err) {
+				_, err = str.Write(frame)
+				assert.NoError(t, err)
+			}
+		}
+		for id := uint64(1); id <= 2; id++ {
+			send(&serv_proto.ClientMessage{
+				Payload: &serv_proto.ClientMessage_Send{
+					Send: &serv_proto.SendMsg{Serial: id, Receiver: "test_ok", InboxId: make([]byte, 32), Message: []byte("hi"), MsgId: id},
+				},
+			})
+		}
+		statuses := make(map[uint64]serv_proto.DeliveryStatus)
+		for len(statuses) < 2 {
+			if status := readServerMessage(t, str).GetStatus(); status != nil {
+				statuses[status.MsgId] = status.Status
+			}
+		}
+		assert.Equal(t, serv_proto.DeliveryStatus_DELIVERY_RELAYED, statuses[1])
+		assert.Equal(t, serv_proto.DeliveryStatus_DELIVERY_RATE_LIMITED, statuses[2])
+
+		for range 2 {
+			send(&serv_proto.ClientMessage{
+				Payload: &serv_proto.ClientMessage_PresenceQuery{PresenceQuery: &serv_proto.PresenceQuery{}},
+			})
+		}
+		var streamErr *serv_proto.StreamError
+		for streamErr == nil {
+			streamErr = readServerMessage(t, str).GetError()
+		}
+		assert.Equal(t, serv_proto.StreamErrorCode_STREAM_RATE_LIMITED, streamErr.Code)
+		assert.NotZero(t, streamErr.RetryAfterMs)
+	})
+
+	t.Run("pending_invitations", func(t *testing.T) {
+		repo := chat.Repo.(*mock.MockChatRepo)
+		defer repo.Isolate()()
+
+		// the default cap, all but one already taken
+		max := settings.ChatSettings.Limits.MaxPendingInvitationsOrDefault()
+		for range max - 1 {
+			assert.NoError(t, repo.ShareChatInbox(inviteInbox(t, "someone"), nil, nil, nil, nil, []byte{1}, nil, 0))
+		}
+
+		notify, err := proto.Marshal(&serv_proto.ChatInitNotify{Receiver: "someone", KeyExchangeData: []byte{1}})
+		if !assert.NoError(t, err) {
+			return
+		}
+		for i, want := range []int{http.StatusOK, http.StatusTooManyRequests} {
+			resp, err := client.Post(fmt.Sprintf("https://%v/chat/notify", DefaultChatServerArgs.Addr), "application/x-protobuf", bytes.NewReader(notify))
+			if !assert.NoError(t, err) {
+				return
+			}
+			resp.Body.Close()
+			assert.Equal(t, want, resp.StatusCode, "notify %v", i)
+		}
+		pending, _ := repo.CountNewChats(inviteInbox(t, "someone"))
+		assert.Equal(t, max, pending)
+
+		// the receiver fetching them makes room again
+		assert.NoError(t, repo.DeleteNewChats(inviteInbox(t, "someone")))
+		resp, err := client.Post(fmt.Sprintf("https://%v/chat/notify", DefaultChatServerArgs.Addr), "application/x-protobuf", bytes.NewReader(notify))
+		if assert.NoError(t, err) {
+			resp.Body.Close()
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+		}
+	})
+}
@@ -0,0 +1,48 @@
+package test
+
+import (
+	"testing"
+
+	cli_proto "github.com/as283-ua/yappa/api/gen/client"
+	serv_proto "github.com/as283-ua/yappa/api/gen/server"
+	"github.com/as283-ua/yappa/internal/client/save"
+	"github.com/as283-ua/yappa/internal/client/service"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReceipts(t *testing.T) {
+	t.Run("hash_chain", func(t *testing.T) {
+		chat := hashChainChat()
+		// nothing is sent, there's no chat client to send it with
+		assert.NoError(t, service.SendReceipt(chat, cli_proto.ReceiptType_RECEIPT_READ, []uint64{0}))
+		assert.Zero(t, chat.CurrentSerial)
+		assert.Empty(t, chat.Events)
+	})
+
+	t.Run("double_ratchet", func(t *testing.T) {
+		alice, bob, asAlice, asBob := ratchetChats(t)
+		msg := sendRatchet(t, alice, "hi")
+		asBob()
+		receiveRatchet(t, bob, msg, "hi")
+
+		receipt, event, err := service.EncryptReceiptForPeer(bob, cli_proto.ReceiptType_RECEIPT_READ, []uint64{msg.Send.Serial})
+		if !assert.NoError(t, err) {
+			return
+		}
+		service.CommitSentEvent(bob, event)
+		assert.Equal(t, msg.Send.Serial+2, bob.CurrentSerial)
+		assert.Len(t, bob.Events, 1, "only the message is kept")
+
+		asAlice()
+		peerEvent, err := service.DecryptPeerMessage(alice, &serv_proto.ServerMessage_Send{
+			Send: &serv_proto.ReceiveMsg{Serial: receipt.Serial, InboxId: receipt.InboxId, EncData: receipt.Message},
+		})
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.NoError(t, service.AcceptPeerEvent(alice, peerEvent))
+		assert.Equal(t, cli_proto.MessageStatus_STATUS_READ, save.Status(alice, msg.Send.Serial))
+		assert.Equal(t, bob.CurrentSerial, alice.CurrentSerial)
+		assert.Len(t, alice.Events, 1)
+	})
+}
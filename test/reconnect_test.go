@@ -0,0 +1,27 @@
+package test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/as283-ua/yappa/internal/client/service"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReconnectDelay(t *testing.T) {
+	for attempt := 0; attempt < 100; attempt++ {
+		expected := min(service.RECONNECT_BASE_DELAY<<min(attempt, 16), service.RECONNECT_MAX_DELAY)
+		for i := 0; i < 20; i++ {
+			delay := service.ReconnectDelay(attempt)
+			assert.GreaterOrEqual(t, delay, expected/2)
+			assert.LessOrEqual(t, delay, expected)
+		}
+	}
+
+	// jittered, so clients disconnected together don't all retry at the same moment
+	seen := map[time.Duration]bool{}
+	for i := 0; i < 20; i++ {
+		seen[service.ReconnectDelay(3)] = true
+	}
+	assert.Greater(t, len(seen), 1)
+}
@@ -0,0 +1,227 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"testing"
+	"time"
+
+	cli_proto "github.com/as283-ua/yappa/api/gen/client"
+	serv_proto "github.com/as283-ua/yappa/api/gen/server"
+	"github.com/as283-ua/yappa/internal/client/service"
+	"github.com/as283-ua/yappa/internal/server/auth"
+	"github.com/as283-ua/yappa/internal/server/report"
+	"github.com/as283-ua/yappa/internal/server/settings"
+	"github.com/as283-ua/yappa/pkg/common"
+	"github.com/as283-ua/yappa/test/mock"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/proto"
+)
+
+// Key and self signed PEM certificate for a user. Event signatures are checked against the certificate stored
+// at registration, so it doesn't need to come from the CA
+func userKey(t *testing.T, username string) (*ecdsa.PrivateKey, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: username},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+func signedMessage(t *testing.T, key *ecdsa.PrivateKey, sender, receiver, txt string) *cli_proto.ClientEvent {
+	event := &cli_proto.ClientEvent{
+		Timestamp: uint64(time.Now().Unix()),
+		Sender:    sender,
+		Payload:   &cli_proto.ClientEvent_Message{Message: &cli_proto.ChatMessage{Msg: txt}},
+	}
+	raw, err := service.SignedEventBytes(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	event.Signature, err = common.SignEvent(key, receiver, raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return event
+}
+
+func TestEventSignature(t *testing.T) {
+	key, certPem := userKey(t, "mallory")
+	event := signedMessage(t, key, "mallory", "test_ok", "hello")
+	raw, err := service.SignedEventBytes(event)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.NoError(t, common.VerifyEventSignature(certPem, "test_ok", raw, event.Signature))
+	// shown to someone it wasn't sent to
+	assert.ErrorIs(t, common.VerifyEventSignature(certPem, "eve", raw, event.Signature), common.ErrBadEventSignature)
+
+	event.GetMessage().Msg = "something else"
+	raw, err = service.SignedEventBytes(event)
+	if assert.NoError(t, err) {
+		assert.ErrorIs(t, common.VerifyEventSignature(certPem, "test_ok", raw, event.Signature), common.ErrBadEventSignature)
+	}
+
+	t.Run("evidence", func(t *testing.T) {
+		events := []*cli_proto.ClientEvent{
+			signedMessage(t, key, "mallory", "test_ok", "one"),
+			// own messages and unsigned ones are never attached
+			signedMessage(t, key, "test_ok", "mallory", "two"),
+			{Sender: "mallory", Payload: &cli_proto.ClientEvent_Message{Message: &cli_proto.ChatMessage{Msg: "three"}}},
+		}
+		for range service.MAX_REPORT_EVIDENCE {
+			events = append(events, signedMessage(t, key, "mallory", "test_ok", "more"))
+		}
+		evidence, err := service.ReportEvidence("mallory", events)
+		if !assert.NoError(t, err) {
+			return
+		}
+		// the most recent ones
+		assert.Len(t, evidence, service.MAX_REPORT_EVIDENCE)
+		for _, v := range evidence {
+			assert.NoError(t, common.VerifyEventSignature(certPem, "test_ok", v.Event, v.Signature))
+		}
+	})
+}
+
+func TestReport(t *testing.T) {
+	setup()
+	useLimits(t, map[string]settings.RateCfg{settings.LIMIT_REPORT: {Rate: -1}})
+	client := GetHttp3Client(TEST_CERTS_DIR, "test_ok", DefaultChatServerArgs.Ca.Cert)
+
+	key, certPem := userKey(t, "mallory")
+	users := mock.EmptyMockUserRepo()
+	users.CreateUser(context.Background(), "test_ok", "", []byte{})
+	users.CreateUser(context.Background(), "mallory", string(certPem), []byte{})
+	reports := mock.EmptyMockReportRepo()
+	prevUsers, prevReports := auth.Repo, report.Repo
+	auth.Repo, report.Repo = users, reports
+	defer func() { auth.Repo, report.Repo = prevUsers, prevReports }()
+
+	submit := func(rep *serv_proto.Report) *http.Response {
+		body, err := proto.Marshal(rep)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := client.Post(fmt.Sprintf("https://%v/report", DefaultChatServerArgs.Addr), "application/x-protobuf", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	evidenceOf := func(events ...*cli_proto.ClientEvent) []*serv_proto.ReportEvidence {
+		evidence := make([]*serv_proto.ReportEvidence, 0, len(events))
+		for _, ev := range events {
+			raw, err := service.SignedEventBytes(ev)
+			if err != nil {
+				t.Fatal(err)
+			}
+			evidence = append(evidence, &serv_proto.ReportEvidence{Event: raw, Signature: ev.Signature})
+		}
+		return evidence
+	}
+
+	t.Run("with_evidence", func(t *testing.T) {
+		resp := submit(&serv_proto.Report{
+			Reported: "mallory",
+			Reason:   serv_proto.ReportReason_REPORT_HARASSMENT,
+			Comment:  "keeps insulting me",
+			Evidence: evidenceOf(signedMessage(t, key, "mallory", "test_ok", "insult")),
+		})
+		defer resp.Body.Close()
+		if !assert.Equal(t, http.StatusOK, resp.StatusCode) {
+			return
+		}
+
+		raw, err := io.ReadAll(resp.Body)
+		if !assert.NoError(t, err) {
+			return
+		}
+		received := &serv_proto.ReportReceived{}
+		assert.NoError(t, proto.Unmarshal(raw, received))
+		rep, err := reports.GetReport(received.Id)
+		if assert.NoError(t, err) {
+			assert.Equal(t, "test_ok", rep.Reporter)
+			assert.Equal(t, "mallory", rep.Reported)
+			assert.Equal(t, report.STATUS_OPEN, rep.Status)
+		}
+		evidence, _ := reports.GetEvidence(received.Id)
+		assert.Len(t, evidence, 1)
+
+		ok, err := reports.ResolveReport(received.Id, report.STATUS_DISMISSED)
+		assert.True(t, ok)
+		assert.NoError(t, err)
+		ok, _ = reports.ResolveReport(received.Id, report.STATUS_ACTIONED)
+		assert.False(t, ok)
+	})
+
+	t.Run("forged_evidence", func(t *testing.T) {
+		forged := signedMessage(t, key, "mallory", "test_ok", "what was said")
+		forged.GetMessage().Msg = "what wasn't"
+		resp := submit(&serv_proto.Report{
+			Reported: "mallory",
+			Reason:   serv_proto.ReportReason_REPORT_SPAM,
+			Evidence: evidenceOf(forged),
+		})
+		resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+		// signed by the reporter's own key instead
+		otherKey, _ := userKey(t, "test_ok")
+		resp = submit(&serv_proto.Report{
+			Reported: "mallory",
+			Reason:   serv_proto.ReportReason_REPORT_SPAM,
+			Evidence: evidenceOf(signedMessage(t, otherKey, "mallory", "test_ok", "spam")),
+		})
+		resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+		// signed by mallory, but sent to someone else
+		resp = submit(&serv_proto.Report{
+			Reported: "mallory",
+			Reason:   serv_proto.ReportReason_REPORT_SPAM,
+			Evidence: evidenceOf(signedMessage(t, key, "mallory", "eve", "spam")),
+		})
+		resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		for name, rep := range map[string]*serv_proto.Report{
+			"self":      {Reported: "test_ok", Reason: serv_proto.ReportReason_REPORT_SPAM},
+			"no_reason": {Reported: "mallory"},
+		} {
+			resp := submit(rep)
+			resp.Body.Close()
+			assert.Equal(t, http.StatusBadRequest, resp.StatusCode, name)
+		}
+
+		resp := submit(&serv_proto.Report{Reported: "nobody", Reason: serv_proto.ReportReason_REPORT_SPAM})
+		resp.Body.Close()
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	})
+
+	pending, _ := reports.ListReports(report.STATUS_OPEN, 10)
+	assert.Empty(t, pending)
+}
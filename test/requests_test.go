@@ -0,0 +1,108 @@
+package test
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+	"testing"
+
+	cli_proto "github.com/as283-ua/yappa/api/gen/client"
+	"github.com/as283-ua/yappa/internal/client/save"
+	"github.com/as283-ua/yappa/internal/client/service"
+	"github.com/stretchr/testify/assert"
+)
+
+func invitation(sender string, inbox byte) *cli_proto.Chat {
+	return &cli_proto.Chat{
+		Peer: &cli_proto.PeerData{Username: sender, InboxId: bytes.Repeat([]byte{inbox}, 32)},
+	}
+}
+
+func TestInvitationFiltering(t *testing.T) {
+	state := &cli_proto.SaveState{}
+	save.NewDirectChat(state, invitation("friend", 1))
+
+	assert.Equal(t, save.INVITATION_ADDED, save.NewInvitation(state, invitation("friend", 2)))
+	assert.Equal(t, save.INVITATION_REQUEST, save.NewInvitation(state, invitation("stranger", 3)))
+	// the same invitation fetched twice
+	assert.Equal(t, save.INVITATION_REQUEST, save.NewInvitation(state, invitation("stranger", 3)))
+	assert.Len(t, state.Chats, 2)
+	assert.Len(t, state.Requests, 1)
+
+	t.Run("held_messages", func(t *testing.T) {
+		req, ok := save.Request(state, bytes.Repeat([]byte{3}, 32))
+		if !assert.True(t, ok) {
+			return
+		}
+		for serial := range uint64(save.MAX_HELD_MESSAGES) {
+			assert.True(t, save.HoldMessage(req, serial, []byte("msg")))
+		}
+		assert.False(t, save.HoldMessage(req, save.MAX_HELD_MESSAGES, []byte("msg")))
+	})
+
+	t.Run("accept", func(t *testing.T) {
+		req, ok := save.AcceptRequest(state, bytes.Repeat([]byte{3}, 32))
+		if assert.True(t, ok) {
+			assert.Len(t, req.Held, save.MAX_HELD_MESSAGES)
+		}
+		assert.Empty(t, state.Requests)
+		assert.NotNil(t, save.DirectChatByUser(state, "stranger"))
+		// known now
+		assert.Equal(t, save.INVITATION_ADDED, save.NewInvitation(state, invitation("stranger", 4)))
+	})
+
+	t.Run("block", func(t *testing.T) {
+		save.NewInvitation(state, invitation("spammer", 5))
+		save.NewInvitation(state, invitation("spammer", 6))
+		save.NewInvitation(state, invitation("other", 7))
+		assert.Len(t, state.Requests, 3)
+
+		save.Block(state, "spammer")
+		assert.Len(t, state.Requests, 1)
+		assert.Equal(t, save.INVITATION_BLOCKED, save.NewInvitation(state, invitation("spammer", 8)))
+		assert.Len(t, state.Requests, 1)
+
+		assert.True(t, save.DeclineRequest(state, bytes.Repeat([]byte{7}, 32)))
+		assert.Empty(t, state.Requests)
+
+		save.Unblock(state, "spammer")
+		assert.Empty(t, save.Blocked(state))
+		assert.Equal(t, save.INVITATION_REQUEST, save.NewInvitation(state, invitation("spammer", 8)))
+	})
+}
+
+func TestInviteSignature(t *testing.T) {
+	certPem, err := os.ReadFile(TEST_CERTS_DIR + "/test_ok/test_ok.crt")
+	if !assert.NoError(t, err) {
+		return
+	}
+	keyPair, err := tls.LoadX509KeyPair(TEST_CERTS_DIR+"/test_ok/test_ok.crt", TEST_CERTS_DIR+"/test_ok/test_ok.key")
+	if !assert.NoError(t, err) {
+		return
+	}
+	caPem, err := os.ReadFile(DefaultChatServerArgs.Ca.Cert)
+	if !assert.NoError(t, err) {
+		return
+	}
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(caPem)
+
+	inboxId := bytes.Repeat([]byte{9}, 32)
+	signature, err := keyPair.PrivateKey.(*ecdsa.PrivateKey).Sign(rand.Reader, inboxId, crypto.BLAKE2b_256)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.NoError(t, service.VerifyInviteSignature(roots, "test_ok", certPem, inboxId, signature))
+	// someone else's inbox id
+	err = service.VerifyInviteSignature(roots, "test_ok", certPem, bytes.Repeat([]byte{8}, 32), signature)
+	assert.ErrorIs(t, err, service.ErrBadInviteSignature)
+	// a sender claiming the certificate of another user
+	assert.Error(t, service.VerifyInviteSignature(roots, "mallory", certPem, inboxId, signature))
+	// a certificate the CA didn't issue
+	assert.Error(t, service.VerifyInviteSignature(x509.NewCertPool(), "test_ok", certPem, inboxId, signature))
+}
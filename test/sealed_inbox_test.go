@@ -0,0 +1,182 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	cli_proto "github.com/as283-ua/yappa/api/gen/client"
+	serv_proto "github.com/as283-ua/yappa/api/gen/server"
+	"github.com/as283-ua/yappa/internal/client/service"
+	"github.com/as283-ua/yappa/internal/server/chat"
+	"github.com/as283-ua/yappa/internal/server/keys"
+	"github.com/as283-ua/yappa/pkg/common"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/proto"
+)
+
+func sealedChats() (alice *cli_proto.Chat, bob *cli_proto.Chat) {
+	alice, bob = ephemeralChats()
+	secret := bytes.Repeat([]byte{3}, common.KEY_SIZE)
+	for _, c := range []*cli_proto.Chat{alice, bob} {
+		c.Version = service.CHAT_VERSION_SEALED_INBOX
+		c.InboxSecret = secret
+	}
+	return alice, bob
+}
+
+func TestDerivedInboxes(t *testing.T) {
+	alice, bob := sealedChats()
+	epoch := service.InboxEpoch(uint64(time.Now().Unix()))
+
+	// both ends agree on each direction's inbox, and nothing links one to the next
+	toBob, err := service.DerivedInboxId(alice, "bob", epoch)
+	if !assert.NoError(t, err) {
+		return
+	}
+	same, _ := service.DerivedInboxId(bob, "bob", epoch)
+	toAlice, _ := service.DerivedInboxId(bob, "alice", epoch)
+	nextToBob, _ := service.DerivedInboxId(alice, "bob", epoch+1)
+	assert.Equal(t, toBob, same)
+	assert.Len(t, toBob, 32)
+	assert.NotEqual(t, toBob, toAlice)
+	assert.NotEqual(t, toBob, nextToBob)
+
+	t.Run("sealed_send", func(t *testing.T) {
+		msg, err := service.EncryptEphemeralForPeer(alice, typingEvent("alice", time.Now()))
+		if !assert.NoError(t, err) {
+			return
+		}
+		delivery, _ := service.DeliveryToken(bob, "bob", epoch)
+		assert.Empty(t, msg.Receiver)
+		assert.Equal(t, toBob, msg.InboxId)
+		assert.Equal(t, delivery, msg.DeliveryToken)
+		assert.Len(t, msg.InboxAuth, common.HASH_SIZE)
+
+		// the chat's own id is still what binds the event
+		event, err := service.DecryptEphemeral(bob, &serv_proto.ReceiveMsg{InboxId: msg.InboxId, EncData: msg.Message, Ephemeral: true})
+		if assert.NoError(t, err) {
+			assert.True(t, event.GetTyping().Typing)
+		}
+	})
+
+	t.Run("legacy_send", func(t *testing.T) {
+		legacy, _ := ephemeralChats()
+		msg, err := service.EncryptEphemeralForPeer(legacy, typingEvent("alice", time.Now()))
+		if assert.NoError(t, err) {
+			assert.Equal(t, "bob", msg.Receiver)
+			assert.Equal(t, legacy.Peer.InboxId, msg.InboxId)
+			assert.Empty(t, msg.DeliveryToken)
+		}
+	})
+}
+
+func TestSealedSend(t *testing.T) {
+	setup()
+
+	u, err := url.Parse("https://" + DefaultChatServerArgs.Addr + "/connect")
+	if !assert.NoError(t, err) {
+		return
+	}
+	client := GetHttp3Client(TEST_CERTS_DIR, "test_ok", DefaultChatServerArgs.Ca.Cert)
+
+	str, err := common.Http3Stream(context.Background(), u, client.Transport.(*http3.Transport), http.Header{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer str.Close()
+
+	write := func(msg *serv_proto.ClientMessage) {
+		m, err := proto.Marshal(msg)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		lenBytes := make([]byte, 4)
+		binary.BigEndian.PutUint32(lenBytes, uint32(len(m)))
+		_, err = str.Write(append(lenBytes, m...))
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+	}
+	status := func(msgId uint64) *serv_proto.SendStatus {
+		for {
+			msg := readServerMessage(t, str)
+			if s := msg.GetStatus(); s != nil && s.MsgId == msgId {
+				return s
+			}
+		}
+	}
+
+	delivery := bytes.Repeat([]byte{1}, 32)
+	inboxId := bytes.Repeat([]byte{2}, 32)
+	token := []byte("derived inbox token")
+	write(&serv_proto.ClientMessage{Payload: &serv_proto.ClientMessage_Delivery{
+		Delivery: &serv_proto.DeliveryRegister{Tokens: [][]byte{delivery}},
+	}})
+
+	t.Run("relayed", func(t *testing.T) {
+		write(&serv_proto.ClientMessage{Payload: &serv_proto.ClientMessage_Send{Send: &serv_proto.SendMsg{
+			Serial: 1, InboxId: inboxId, Message: []byte("hi"), MsgId: 1,
+			InboxAuth: common.Hash(token), DeliveryToken: delivery,
+		}}})
+
+		var received *serv_proto.ReceiveMsg
+		for received == nil {
+			received = readServerMessage(t, str).GetSend()
+		}
+		assert.Equal(t, inboxId, received.InboxId)
+		assert.Equal(t, []byte("hi"), received.EncData)
+		assert.Equal(t, serv_proto.DeliveryStatus_DELIVERY_RELAYED, status(1).Status)
+	})
+
+	t.Run("stored", func(t *testing.T) {
+		// nobody registered this one, the inbox is created for it
+		write(&serv_proto.ClientMessage{Payload: &serv_proto.ClientMessage_Send{Send: &serv_proto.SendMsg{
+			Serial: 2, InboxId: inboxId, Message: []byte("later"), MsgId: 2,
+			InboxAuth: common.Hash(token), DeliveryToken: bytes.Repeat([]byte{9}, 32),
+		}}})
+		assert.Equal(t, serv_proto.DeliveryStatus_DELIVERY_STORED, status(2).Status)
+
+		tokenObj, err := chat.Repo.GetToken(inboxId)
+		if assert.NoError(t, err) {
+			// stored wrapped with the server's data key, for this inbox only
+			assert.True(t, keys.Ring.IsActive(tokenObj.CurrentTokenHash))
+			hash, err := keys.Ring.Unwrap(tokenObj.CurrentTokenHash, tokenAD(inboxId))
+			assert.NoError(t, err)
+			assert.Equal(t, common.Hash(token), hash)
+			assert.Empty(t, tokenObj.KeyExchangeData)
+		}
+
+		body, err := proto.Marshal(&serv_proto.GetNewMessages{InboxId: inboxId, Token: token})
+		if !assert.NoError(t, err) {
+			return
+		}
+		resp, err := client.Post(fmt.Sprintf("https://%v/chat/messages", DefaultChatServerArgs.Addr), "application/x-protobuf", bytes.NewReader(body))
+		if !assert.NoError(t, err) {
+			return
+		}
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		raw, _ := io.ReadAll(resp.Body)
+		msgs := &serv_proto.ListNewMessages{}
+		assert.NoError(t, proto.Unmarshal(raw, msgs))
+		if assert.Len(t, msgs.Msgs, 1) {
+			assert.Equal(t, []byte("later"), msgs.Msgs[0].EncMsg)
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		write(&serv_proto.ClientMessage{Payload: &serv_proto.ClientMessage_Send{Send: &serv_proto.SendMsg{
+			Serial: 3, InboxId: []byte("short"), Message: []byte("hi"), MsgId: 3,
+			InboxAuth: common.Hash(token), DeliveryToken: bytes.Repeat([]byte{9}, 32),
+		}}})
+		assert.Equal(t, serv_proto.DeliveryStatus_DELIVERY_FAILED, status(3).Status)
+	})
+}
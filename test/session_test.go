@@ -0,0 +1,331 @@
+package test
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/as283-ua/yappa/internal/server/connection"
+	"github.com/stretchr/testify/assert"
+)
+
+type bufferStream struct {
+	mx     sync.Mutex
+	buf    bytes.Buffer
+	closed bool
+}
+
+func (s *bufferStream) Write(p []byte) (int, error) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	return s.buf.Write(p)
+}
+
+func (s *bufferStream) Close() error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	s.closed = true
+	return nil
+}
+
+func (s *bufferStream) isClosed() bool {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	return s.closed
+}
+
+// Write blocks until unblock is closed, like a receiver that stopped reading
+type stuckStream struct {
+	unblock chan struct{}
+}
+
+func (s *stuckStream) Write(p []byte) (int, error) {
+	<-s.unblock
+	return 0, errors.New("stream reset")
+}
+
+func (s *stuckStream) Close() error {
+	return nil
+}
+
+// Write blocks until the deadline set on it, like a receiver that stopped reading on a real stream
+type deadlineStream struct {
+	mx       sync.Mutex
+	deadline time.Time
+}
+
+func (s *deadlineStream) SetWriteDeadline(t time.Time) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	s.deadline = t
+	return nil
+}
+
+func (s *deadlineStream) Write(p []byte) (int, error) {
+	s.mx.Lock()
+	deadline := s.deadline
+	s.mx.Unlock()
+	if deadline.IsZero() {
+		select {}
+	}
+	time.Sleep(time.Until(deadline))
+	return 0, os.ErrDeadlineExceeded
+}
+
+func (s *deadlineStream) Close() error {
+	return nil
+}
+
+// Write blocks until unblock is closed, then writes like a bufferStream
+type gatedStream struct {
+	bufferStream
+	unblock chan struct{}
+}
+
+func (s *gatedStream) Write(p []byte) (int, error) {
+	<-s.unblock
+	return s.bufferStream.Write(p)
+}
+
+func TestSessionManager(t *testing.T) {
+	t.Run("multiple_devices", func(t *testing.T) {
+		m := connection.NewSessionManager()
+		first := m.Add("alice", &bufferStream{})
+		second := m.Add("alice", &bufferStream{})
+		m.Add("bob", &bufferStream{})
+
+		assert.NotEqual(t, first.Id, second.Id)
+		assert.Equal(t, 2, m.Count("alice"))
+		assert.Equal(t, 1, m.Count("bob"))
+	})
+
+	t.Run("remove_old_keeps_new", func(t *testing.T) {
+		m := connection.NewSessionManager()
+		oldStr := &bufferStream{}
+		old := m.Add("alice", oldStr)
+		newer := m.Add("alice", &bufferStream{})
+
+		m.Remove(old)
+		assert.Eventually(t, oldStr.isClosed, time.Second, 10*time.Millisecond)
+		sessions := m.Get("alice")
+		if assert.Len(t, sessions, 1) {
+			assert.Equal(t, newer.Id, sessions[0].Id)
+		}
+
+		assert.ErrorIs(t, old.Write([]byte("x")), connection.ErrSessionClosed)
+		m.Remove(old)
+
+		m.Remove(newer)
+		assert.Equal(t, 0, m.Count("alice"))
+	})
+
+	t.Run("writes_do_not_interleave", func(t *testing.T) {
+		m := connection.NewSessionManager()
+		str := &bufferStream{}
+		s := m.Add("alice", str)
+
+		frames := [][]byte{bytes.Repeat([]byte("a"), 4096), bytes.Repeat([]byte("b"), 4096)}
+		var wg sync.WaitGroup
+		for i := 0; i < 50; i++ {
+			wg.Add(1)
+			go func(frame []byte) {
+				defer wg.Done()
+				s.Write(frame)
+			}(frames[i%2])
+		}
+		wg.Wait()
+
+		out := str.buf.Bytes()
+		assert.Len(t, out, 50*4096)
+		for i := 0; i < len(out); i += 4096 {
+			assert.True(t, bytes.Equal(out[i:i+4096], frames[0]) || bytes.Equal(out[i:i+4096], frames[1]))
+		}
+	})
+
+	t.Run("queue_full_refuses", func(t *testing.T) {
+		m := connection.NewSessionManager()
+		str := &stuckStream{unblock: make(chan struct{})}
+		s := m.Add("alice", str)
+
+		var mx sync.Mutex
+		results := []bool{}
+		result := func(ok bool) {
+			mx.Lock()
+			defer mx.Unlock()
+			results = append(results, ok)
+		}
+
+		accepted := 0
+		for i := 0; i < connection.OUTBOUND_QUEUE_SIZE+10; i++ {
+			if s.Enqueue([]byte("x"), result) {
+				accepted++
+			}
+		}
+		// the writer holds one frame while stuck
+		assert.LessOrEqual(t, accepted, connection.OUTBOUND_QUEUE_SIZE+1)
+		assert.GreaterOrEqual(t, accepted, connection.OUTBOUND_QUEUE_SIZE)
+
+		// failed write closes the session and every queued frame is reported as not sent
+		close(str.unblock)
+		assert.Eventually(t, func() bool {
+			mx.Lock()
+			defer mx.Unlock()
+			return len(results) == accepted
+		}, time.Second, 10*time.Millisecond)
+		for _, ok := range results {
+			assert.False(t, ok)
+		}
+		assert.False(t, s.Enqueue([]byte("x"), result))
+	})
+
+	t.Run("write_timeout", func(t *testing.T) {
+		m := connection.NewSessionManager()
+		m.WriteTimeout = 50 * time.Millisecond
+		s := m.Add("alice", &deadlineStream{})
+
+		results := make(chan bool, 2)
+		assert.True(t, s.Enqueue([]byte("x"), func(ok bool) { results <- ok }))
+		assert.True(t, s.Enqueue([]byte("y"), func(ok bool) { results <- ok }))
+		for range 2 {
+			select {
+			case ok := <-results:
+				assert.False(t, ok)
+			case <-time.After(time.Second):
+				t.Fatal("write never timed out")
+			}
+		}
+		select {
+		case <-s.Done():
+		case <-time.After(time.Second):
+			t.Fatal("session left open")
+		}
+	})
+
+	t.Run("queue_full_writes_directly", func(t *testing.T) {
+		m := connection.NewSessionManager()
+		str := &gatedStream{unblock: make(chan struct{})}
+		s := m.Add("alice", str)
+		// the writer holds the first frame while stuck, the rest fill the queue
+		assert.True(t, s.Enqueue([]byte("x"), nil))
+		time.Sleep(20 * time.Millisecond)
+		for s.Enqueue([]byte("x"), nil) {
+		}
+
+		written := make(chan error, 1)
+		go func() { written <- s.EnqueueOrWrite([]byte("response")) }()
+		// waiting for the stuck write instead of being dropped
+		time.Sleep(50 * time.Millisecond)
+		select {
+		case <-written:
+			t.Fatal("returned while the queue was full")
+		default:
+		}
+		close(str.unblock)
+		select {
+		case err := <-written:
+			assert.NoError(t, err)
+		case <-time.After(time.Second):
+			t.Fatal("frame never written")
+		}
+		assert.Eventually(t, func() bool {
+			str.mx.Lock()
+			defer str.mx.Unlock()
+			return bytes.Contains(str.buf.Bytes(), []byte("response"))
+		}, time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("queued_frames_written", func(t *testing.T) {
+		m := connection.NewSessionManager()
+		str := &bufferStream{}
+		s := m.Add("alice", str)
+
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			assert.True(t, s.Enqueue([]byte("ab"), func(ok bool) {
+				assert.True(t, ok)
+				wg.Done()
+			}))
+		}
+		wg.Wait()
+		str.mx.Lock()
+		assert.Equal(t, 20, str.buf.Len())
+		str.mx.Unlock()
+	})
+
+	t.Run("reap_idle", func(t *testing.T) {
+		m := connection.NewSessionManager()
+		var mx sync.Mutex
+		presence := []bool{}
+		m.OnPresence = func(username string, online bool) {
+			mx.Lock()
+			defer mx.Unlock()
+			assert.Equal(t, "alice", username)
+			presence = append(presence, online)
+		}
+
+		idleStr := &bufferStream{}
+		idle := m.Add("alice", idleStr)
+		time.Sleep(50 * time.Millisecond)
+		alive := m.Add("alice", &bufferStream{})
+
+		reaped := m.Reap(30 * time.Millisecond)
+		if assert.Len(t, reaped, 1) {
+			assert.Equal(t, idle.Id, reaped[0].Id)
+		}
+		assert.Eventually(t, idleStr.isClosed, time.Second, 10*time.Millisecond)
+		assert.Equal(t, 1, m.Count("alice"))
+
+		time.Sleep(50 * time.Millisecond)
+		alive.Touch()
+		assert.Empty(t, m.Reap(30*time.Millisecond))
+
+		time.Sleep(50 * time.Millisecond)
+		assert.Len(t, m.Reap(30*time.Millisecond), 1)
+		assert.Equal(t, 0, m.Count("alice"))
+
+		mx.Lock()
+		defer mx.Unlock()
+		assert.Equal(t, []bool{true, false}, presence)
+	})
+
+	t.Run("heartbeats", func(t *testing.T) {
+		m := connection.NewSessionManager()
+		str := &bufferStream{}
+		s := m.Add("alice", str)
+
+		stop := m.StartHeartbeats(20*time.Millisecond, 3, []byte("ping"))
+		defer stop()
+
+		// pinged while silent, then closed after missing the heartbeats
+		assert.Eventually(t, func() bool {
+			str.mx.Lock()
+			defer str.mx.Unlock()
+			return bytes.Contains(str.buf.Bytes(), []byte("ping"))
+		}, time.Second, 5*time.Millisecond)
+		select {
+		case <-s.Done():
+		case <-time.After(time.Second):
+			t.Error("silent session not reaped")
+		}
+		assert.Equal(t, 0, m.Count("alice"))
+	})
+
+	t.Run("close_all", func(t *testing.T) {
+		m := connection.NewSessionManager()
+		s := m.Add("alice", &bufferStream{})
+		m.Add("bob", &bufferStream{})
+
+		m.CloseAll()
+		assert.Equal(t, 0, m.Count("alice"))
+		assert.Equal(t, 0, m.Count("bob"))
+		select {
+		case <-s.Done():
+		default:
+			t.Error("session not closed")
+		}
+	})
+}
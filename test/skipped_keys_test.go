@@ -0,0 +1,129 @@
+package test
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	cli_proto "github.com/as283-ua/yappa/api/gen/client"
+	serv_proto "github.com/as283-ua/yappa/api/gen/server"
+	"github.com/as283-ua/yappa/internal/client/save"
+	"github.com/as283-ua/yappa/internal/client/service"
+	"github.com/stretchr/testify/assert"
+)
+
+// Hash chain chat with a fixed starting key, both ends of it look the same
+func skippedKeysChat() *cli_proto.Chat {
+	return &cli_proto.Chat{
+		Key:  bytes.Repeat([]byte{5}, 32),
+		Peer: &cli_proto.PeerData{Username: "bob", InboxId: bytes.Repeat([]byte{1}, 32)},
+	}
+}
+
+// Message the peer of skippedKeysChat sent with the given serial, its text being the serial
+func hashChainMessage(t *testing.T, serial uint64) *serv_proto.ServerMessage_Send {
+	sender := skippedKeysChat()
+	for range serial {
+		sender.Key = service.Ratchet(sender.Key)
+	}
+	sender.CurrentSerial = serial
+	msg, _, err := service.EncryptMessageForPeer(sender, fmt.Sprint(serial))
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	return &serv_proto.ServerMessage_Send{Send: &serv_proto.ReceiveMsg{Serial: serial, InboxId: msg.InboxId, EncData: msg.Message}}
+}
+
+func receiveHashChain(chat *cli_proto.Chat, msg *serv_proto.ServerMessage_Send) (*service.PeerEvent, error) {
+	peerEvent, err := service.DecryptPeerMessage(chat, msg)
+	if err != nil {
+		return nil, err
+	}
+	return peerEvent, service.AcceptPeerEvent(chat, peerEvent)
+}
+
+func TestSkippedKeys(t *testing.T) {
+	tests := []struct {
+		name  string
+		order []uint64
+		// serials expected to be rejected, at their position in order
+		rejected map[int]bool
+		// skipped keys left once everything was delivered
+		skipped int
+	}{
+		{name: "in_order", order: []uint64{0, 1, 2, 3}},
+		{name: "late", order: []uint64{0, 3, 1, 2}},
+		{name: "reversed", order: []uint64{3, 2, 1, 0}},
+		{name: "gap_left", order: []uint64{0, 3}, skipped: 2},
+		{name: "duplicate", order: []uint64{0, 1, 1}, rejected: map[int]bool{2: true}},
+		{name: "late_duplicate", order: []uint64{3, 1, 1, 3}, rejected: map[int]bool{2: true, 3: true}, skipped: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chat := skippedKeysChat()
+			for i, serial := range tt.order {
+				peerEvent, err := receiveHashChain(chat, hashChainMessage(t, serial))
+				if tt.rejected[i] {
+					assert.Error(t, err, "serial %v at %v", serial, i)
+					continue
+				}
+				if assert.NoError(t, err, "serial %v at %v", serial, i) {
+					assert.Equal(t, fmt.Sprint(serial), peerEvent.Event.GetMessage().Msg)
+				}
+			}
+			assert.Len(t, chat.SkippedKeys, tt.skipped)
+			for i := 1; i < len(chat.Events); i++ {
+				assert.Less(t, chat.Events[i-1].Serial, chat.Events[i].Serial, "history kept in serial order")
+			}
+		})
+	}
+
+	t.Run("max_ratchet_cycle", func(t *testing.T) {
+		chat := skippedKeysChat()
+		_, err := receiveHashChain(chat, hashChainMessage(t, save.MAX_RATCHET_CYCLE+1))
+		assert.Error(t, err)
+		assert.Empty(t, chat.SkippedKeys)
+		assert.Zero(t, chat.CurrentSerial)
+
+		_, err = receiveHashChain(chat, hashChainMessage(t, save.MAX_RATCHET_CYCLE))
+		assert.NoError(t, err)
+		assert.Len(t, chat.SkippedKeys, save.MAX_RATCHET_CYCLE)
+	})
+
+	t.Run("eviction", func(t *testing.T) {
+		chat := skippedKeysChat()
+		// every jump stays within a cycle, together they skip more keys than are kept
+		var last uint64
+		for len(chat.SkippedKeys) < save.MAX_SKIPPED_KEYS {
+			last += save.MAX_RATCHET_CYCLE
+			_, err := receiveHashChain(chat, hashChainMessage(t, last))
+			if !assert.NoError(t, err) {
+				return
+			}
+		}
+		assert.Len(t, chat.SkippedKeys, save.MAX_SKIPPED_KEYS)
+
+		// the oldest keys went first
+		_, err := receiveHashChain(chat, hashChainMessage(t, 0))
+		assert.Error(t, err)
+		_, err = receiveHashChain(chat, hashChainMessage(t, last-1))
+		assert.NoError(t, err)
+	})
+
+	t.Run("skip_keys", func(t *testing.T) {
+		chat := skippedKeysChat()
+		skipped := make([]*cli_proto.SkippedKey, 0, save.MAX_SKIPPED_KEYS+10)
+		for serial := range uint64(save.MAX_SKIPPED_KEYS + 10) {
+			skipped = append(skipped, &cli_proto.SkippedKey{Serial: serial, Key: []byte{byte(serial)}})
+		}
+		save.SkipKeys(chat, skipped)
+		assert.Len(t, chat.SkippedKeys, save.MAX_SKIPPED_KEYS)
+		_, ok := save.SkippedKey(chat, 9)
+		assert.False(t, ok)
+		key, ok := save.SkippedKey(chat, 10)
+		if assert.True(t, ok) {
+			assert.Equal(t, []byte{10}, key)
+		}
+	})
+}